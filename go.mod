@@ -3,6 +3,7 @@ module github.com/qiujian16/kcp-ocm
 go 1.16
 
 require (
+	github.com/evanphx/json-patch v4.11.0+incompatible
 	github.com/openshift/build-machinery-go v0.0.0-20210712174854-1bb7fd1518d3
 	github.com/openshift/library-go v0.0.0-20210804150119-965974e0af3f
 	github.com/spf13/cobra v1.2.1
@@ -13,4 +14,5 @@ require (
 	k8s.io/component-base v0.22.0
 	k8s.io/klog/v2 v2.9.0
 	open-cluster-management.io/api v0.0.0-20210804091127-340467ff6239
+	sigs.k8s.io/yaml v1.2.0
 )
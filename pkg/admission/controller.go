@@ -0,0 +1,71 @@
+package admission
+
+import (
+	"context"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+type creatorWebhookController struct {
+	kubeClient       kubernetes.Interface
+	crdLister        cache.GenericLister
+	webhook          *CreatorWebhook
+	workingNamespace string
+}
+
+// NewCreatorWebhookController registers the creator webhook in the logical cluster, for the resources
+// of its CRDs too since their instances are delivered.
+func NewCreatorWebhookController(
+	namespace string,
+	kubeClient kubernetes.Interface,
+	crdInformer informers.GenericInformer,
+	webhook *CreatorWebhook,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &creatorWebhookController{
+		kubeClient:       kubeClient,
+		crdLister:        crdInformer.Lister(),
+		webhook:          webhook,
+		workingNamespace: namespace,
+	}
+
+	return factory.New().
+		WithInformers(crdInformer.Informer()).
+		WithSync(fairQueue.WrapSync(namespace, "creator-webhook-controller", c.sync)).
+		ToController("creator-webhook-controller", recorder)
+}
+
+func (c *creatorWebhookController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("creator-webhook-controller %s sync", c.workingNamespace)
+
+	crds, err := c.crdLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	customResources := []schema.GroupResource{}
+	for _, obj := range crds {
+		crd, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+		if len(group) == 0 || len(plural) == 0 {
+			continue
+		}
+		customResources = append(customResources, schema.GroupResource{Group: group, Resource: plural})
+	}
+
+	return c.webhook.Register(ctx, c.kubeClient, customResources)
+}
@@ -0,0 +1,296 @@
+package admission
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	creatorWebhookConfigurationName = "kcp-ocm-creator"
+	creatorWebhookName              = "creator.kcp.open-cluster-management.io"
+)
+
+// propagatedResources are the resources kcp-ocm delivers to the managed clusters besides the custom
+// resources, their creators are recorded by the webhook.
+var propagatedResources = map[string][]string{
+	"":                          {"namespaces", "persistentvolumeclaims", "secrets", "serviceaccounts"},
+	"apiextensions.k8s.io":      {"customresourcedefinitions"},
+	"apps":                      {"deployments"},
+	"autoscaling":               {"horizontalpodautoscalers"},
+	"policy":                    {"poddisruptionbudgets"},
+	"rbac.authorization.k8s.io": {"rolebindings", "roles"},
+}
+
+// CreatorWebhook is the mutating admission webhook of the logical clusters recording the user creating
+// a kcp object on the creator annotation. The annotation is set from the user info of the request and
+// signed, and the requests setting or changing it otherwise are rejected, so the creator can be trusted.
+type CreatorWebhook struct {
+	url      string
+	certDir  string
+	port     int
+	caBundle []byte
+	key      []byte
+}
+
+// NewCreatorWebhook returns the webhook reached by kcp at the url. The cert dir holds the serving
+// certificate and key as tls.crt and tls.key, the CA bundle verifying them as ca.crt and the key
+// signing the creators as creator.key.
+func NewCreatorWebhook(url, certDir string, port int) (*CreatorWebhook, error) {
+	if len(url) == 0 || len(certDir) == 0 {
+		return nil, fmt.Errorf("the creator webhook requires an url and a cert dir")
+	}
+
+	caBundle, err := ioutil.ReadFile(filepath.Join(certDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ioutil.ReadFile(filepath.Join(certDir, "creator.key"))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("the creator key in %s is empty", certDir)
+	}
+
+	return &CreatorWebhook{url: url, certDir: certDir, port: port, caBundle: caBundle, key: key}, nil
+}
+
+// Key returns the key the creators are signed with
+func (w *CreatorWebhook) Key() []byte {
+	return w.key
+}
+
+// Start serves the webhook until the context is done
+func (w *CreatorWebhook) Start(ctx context.Context) error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(w.certDir, "tls.crt"), filepath.Join(w.certDir, "tls.key"))
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", w.port),
+		Handler:   w,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+
+	go func() {
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("creator webhook stopped: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+// Register applies the configuration of the webhook to a logical cluster, for the propagated resources
+// and the custom resources. The objects are admitted when the webhook cannot be reached, without the
+// signed creator their creators are not authorized.
+func (w *CreatorWebhook) Register(ctx context.Context, kubeClient kubernetes.Interface, customResources []schema.GroupResource) error {
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	required := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: creatorWebhookConfigurationName,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name: creatorWebhookName,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					URL:      &w.url,
+					CABundle: w.caBundle,
+				},
+				Rules:                   creatorRules(customResources),
+				FailurePolicy:           &failurePolicy,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+		},
+	}
+
+	client := kubeClient.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	existing, err := client.Get(ctx, required.Name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = client.Create(ctx, required, metav1.CreateOptions{})
+		return err
+	case err != nil:
+		return err
+	}
+
+	if equality.Semantic.DeepDerivative(required.Webhooks, existing.Webhooks) {
+		return nil
+	}
+
+	existing = existing.DeepCopy()
+	existing.Webhooks = required.Webhooks
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// creatorRules returns a rule for each group of the propagated resources and the custom resources. The
+// custom resources of kcp and open-cluster-management, kcp-ocm included, are never delivered.
+func creatorRules(customResources []schema.GroupResource) []admissionregistrationv1.RuleWithOperations {
+	resources := map[string]sets.String{}
+	for group, names := range propagatedResources {
+		resources[group] = sets.NewString(names...)
+	}
+	for _, resource := range customResources {
+		if strings.HasSuffix(resource.Group, ".kcp.dev") || strings.HasSuffix(resource.Group, "open-cluster-management.io") {
+			continue
+		}
+		if _, ok := resources[resource.Group]; !ok {
+			resources[resource.Group] = sets.NewString()
+		}
+		resources[resource.Group].Insert(resource.Resource)
+	}
+
+	groups := []string{}
+	for group := range resources {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	rules := []admissionregistrationv1.RuleWithOperations{}
+	for _, group := range groups {
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{group},
+				APIVersions: []string{"*"},
+				Resources:   resources[group].List(),
+			},
+		})
+	}
+	return rules
+}
+
+func (w *CreatorWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	review := &admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(req.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(rw, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = admit(w.key, review.Request)
+	review.Response.UID = review.Request.UID
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(review); err != nil {
+		klog.Errorf("failed to write the admission review: %v", err)
+	}
+}
+
+// admit stamps the signed creator on the created objects and rejects the requests setting the creator
+// annotations to other values than kcp-ocm would.
+func admit(key []byte, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	annotations, err := annotationsOf(request.Object.Raw)
+	if err != nil {
+		return deny(http.StatusBadRequest, err.Error())
+	}
+
+	switch request.Operation {
+	case admissionv1.Create:
+		creator, err := json.Marshal(authenticationv1.UserInfo{
+			Username: request.UserInfo.Username,
+			Groups:   request.UserInfo.Groups,
+		})
+		if err != nil {
+			return deny(http.StatusInternalServerError, err.Error())
+		}
+		required := map[string]string{
+			hub.CreatorAnnotation:          string(creator),
+			hub.CreatorSignatureAnnotation: hub.CreatorSignature(key, string(creator), request.Namespace, request.Name),
+		}
+		for name, value := range required {
+			if current, set := annotations[name]; set && current != value {
+				return deny(http.StatusForbidden, fmt.Sprintf("annotation %s is set by kcp-ocm", name))
+			}
+		}
+		return stamp(annotations, required)
+	case admissionv1.Update:
+		oldAnnotations, err := annotationsOf(request.OldObject.Raw)
+		if err != nil {
+			return deny(http.StatusBadRequest, err.Error())
+		}
+		for _, name := range []string{hub.CreatorAnnotation, hub.CreatorSignatureAnnotation} {
+			current, set := annotations[name]
+			old, wasSet := oldAnnotations[name]
+			if set != wasSet || current != old {
+				return deny(http.StatusForbidden, fmt.Sprintf("annotation %s cannot be changed", name))
+			}
+		}
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+// stamp returns the response patching the annotations on the object
+func stamp(annotations, values map[string]string) *admissionv1.AdmissionResponse {
+	var patch []map[string]interface{}
+	if annotations == nil {
+		patch = append(patch, map[string]interface{}{
+			"op": "add", "path": "/metadata/annotations", "value": values,
+		})
+	} else {
+		names := []string{}
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			patch = append(patch, map[string]interface{}{
+				"op": "add", "path": "/metadata/annotations/" + strings.ReplaceAll(name, "/", "~1"), "value": values[name],
+			})
+		}
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return deny(http.StatusInternalServerError, err.Error())
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{Allowed: true, Patch: data, PatchType: &patchType}
+}
+
+func deny(code int32, message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result:  &metav1.Status{Status: metav1.StatusFailure, Code: code, Message: message},
+	}
+}
+
+func annotationsOf(raw []byte) (map[string]string, error) {
+	obj := &metav1.PartialObjectMetadata{}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return nil, err
+	}
+	return obj.Annotations, nil
+}
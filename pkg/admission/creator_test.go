@@ -0,0 +1,213 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	admissionregistrationv1client "k8s.io/client-go/kubernetes/typed/admissionregistration/v1"
+)
+
+var testKey = []byte("key")
+
+// fakeKubeClient serves the mutating webhook configuration of the logical cluster and records the writes
+type fakeKubeClient struct {
+	kubernetes.Interface
+	admissionregistrationv1client.AdmissionregistrationV1Interface
+	admissionregistrationv1client.MutatingWebhookConfigurationInterface
+	existing *admissionregistrationv1.MutatingWebhookConfiguration
+	actions  []string
+}
+
+func (c *fakeKubeClient) AdmissionregistrationV1() admissionregistrationv1client.AdmissionregistrationV1Interface {
+	return c
+}
+
+func (c *fakeKubeClient) MutatingWebhookConfigurations() admissionregistrationv1client.MutatingWebhookConfigurationInterface {
+	return c
+}
+
+func (c *fakeKubeClient) Get(_ context.Context, name string, _ metav1.GetOptions) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	if c.existing == nil {
+		return nil, errors.NewNotFound(admissionregistrationv1.Resource("mutatingwebhookconfigurations"), name)
+	}
+	return c.existing, nil
+}
+
+func (c *fakeKubeClient) Create(_ context.Context, config *admissionregistrationv1.MutatingWebhookConfiguration, _ metav1.CreateOptions) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	c.actions = append(c.actions, "create")
+	c.existing = config
+	return config, nil
+}
+
+func (c *fakeKubeClient) Update(_ context.Context, config *admissionregistrationv1.MutatingWebhookConfiguration, _ metav1.UpdateOptions) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	c.actions = append(c.actions, "update")
+	c.existing = config
+	return config, nil
+}
+
+func newRequest(t *testing.T, operation admissionv1.Operation, annotations, oldAnnotations map[string]string) *admissionv1.AdmissionRequest {
+	raw := func(annotations map[string]string) []byte {
+		data, err := json.Marshal(&metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	request := &admissionv1.AdmissionRequest{
+		Operation: operation,
+		Namespace: "default",
+		Name:      "web",
+		UserInfo:  authenticationv1.UserInfo{Username: "alice", Groups: []string{"dev"}},
+		Object:    runtime.RawExtension{Raw: raw(annotations)},
+	}
+	if operation == admissionv1.Update {
+		request.OldObject = runtime.RawExtension{Raw: raw(oldAnnotations)}
+	}
+	return request
+}
+
+func TestAdmit(t *testing.T) {
+	creator := `{"username":"alice","groups":["dev"]}`
+	signature := hub.CreatorSignature(testKey, creator, "default", "web")
+	stamped := map[string]string{hub.CreatorAnnotation: creator, hub.CreatorSignatureAnnotation: signature}
+
+	cases := []struct {
+		name            string
+		request         *admissionv1.AdmissionRequest
+		expectedAllowed bool
+		expectedPatch   []map[string]interface{}
+	}{
+		{
+			name:            "stamp the created object",
+			request:         newRequest(t, admissionv1.Create, nil, nil),
+			expectedAllowed: true,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{
+					hub.CreatorAnnotation: creator, hub.CreatorSignatureAnnotation: signature,
+				}},
+			},
+		},
+		{
+			name:            "stamp the created object with annotations",
+			request:         newRequest(t, admissionv1.Create, map[string]string{"app": "web"}, nil),
+			expectedAllowed: true,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/metadata/annotations/kcp.open-cluster-management.io~1creator", "value": creator},
+				{"op": "add", "path": "/metadata/annotations/kcp.open-cluster-management.io~1creator-signature", "value": signature},
+			},
+		},
+		{
+			name:            "forged creator",
+			request:         newRequest(t, admissionv1.Create, map[string]string{hub.CreatorAnnotation: `{"username":"admin"}`}, nil),
+			expectedAllowed: false,
+		},
+		{
+			name: "forged signature",
+			request: newRequest(t, admissionv1.Create, map[string]string{
+				hub.CreatorAnnotation: creator, hub.CreatorSignatureAnnotation: "forged",
+			}, nil),
+			expectedAllowed: false,
+		},
+		{
+			name:            "unchanged creator",
+			request:         newRequest(t, admissionv1.Update, stamped, stamped),
+			expectedAllowed: true,
+		},
+		{
+			name:            "removed signature",
+			request:         newRequest(t, admissionv1.Update, map[string]string{hub.CreatorAnnotation: creator}, stamped),
+			expectedAllowed: false,
+		},
+		{
+			name:            "creator added on update",
+			request:         newRequest(t, admissionv1.Update, stamped, nil),
+			expectedAllowed: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response := admit(testKey, c.request)
+			if response.Allowed != c.expectedAllowed {
+				t.Fatalf("expected allowed %v, got %v", c.expectedAllowed, response.Allowed)
+			}
+			if c.expectedPatch == nil {
+				if response.Patch != nil {
+					t.Errorf("expected no patch, got %s", response.Patch)
+				}
+				return
+			}
+
+			patch := []map[string]interface{}{}
+			if err := json.Unmarshal(response.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(patch, c.expectedPatch) {
+				t.Errorf("expected patch %v, got %v", c.expectedPatch, patch)
+			}
+		})
+	}
+}
+
+func TestCreatorRules(t *testing.T) {
+	rules := creatorRules([]schema.GroupResource{
+		{Group: "example.com", Resource: "widgets"},
+		{Group: "example.com", Resource: "gadgets"},
+		{Group: "kcp.open-cluster-management.io", Resource: "clusteroverrides"},
+		{Group: "tenancy.kcp.dev", Resource: "workspaces"},
+	})
+
+	resources := map[string][]string{}
+	for _, rule := range rules {
+		if len(rule.APIGroups) != 1 {
+			t.Fatalf("expected a rule per group, got %v", rule.APIGroups)
+		}
+		resources[rule.APIGroups[0]] = rule.Resources
+	}
+
+	expected := map[string][]string{"example.com": {"gadgets", "widgets"}}
+	for group, names := range propagatedResources {
+		expected[group] = names
+	}
+	if !reflect.DeepEqual(resources, expected) {
+		t.Errorf("expected resources %v, got %v", expected, resources)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	webhook := &CreatorWebhook{url: "https://kcp-ocm:8443", caBundle: []byte("ca")}
+	client := &fakeKubeClient{}
+	widgets := []schema.GroupResource{{Group: "example.com", Resource: "widgets"}}
+
+	for _, step := range []struct {
+		customResources []schema.GroupResource
+		expectedActions []string
+	}{
+		{customResources: nil, expectedActions: []string{"create"}},
+		{customResources: nil, expectedActions: []string{"create"}},
+		{customResources: widgets, expectedActions: []string{"create", "update"}},
+	} {
+		if err := webhook.Register(context.Background(), client, step.customResources); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(client.actions, step.expectedActions) {
+			t.Errorf("expected actions %v, got %v", step.expectedActions, client.actions)
+		}
+	}
+
+	if policy := client.existing.Webhooks[0].FailurePolicy; policy == nil || *policy != admissionregistrationv1.Ignore {
+		t.Errorf("expected the webhook to be ignored when unreachable, got %v", policy)
+	}
+}
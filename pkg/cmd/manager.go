@@ -11,12 +11,16 @@ import (
 // NewWorkloadAgent generates a command to start workload agent
 func NewManager() *cobra.Command {
 	o := controllers.NewOCMManagerOptions()
-	cmd := controllercmd.
-		NewControllerCommandConfig("work-agent", version.Get(), o.RunManager).
-		NewCommand()
+	cmdConfig := controllercmd.NewControllerCommandConfig("work-agent", version.Get(), o.RunManager)
+	cmd := cmdConfig.NewCommand()
 	cmd.Use = "agent"
 	cmd.Short = "Start the Cluster Registration Agent"
 
+	// The sharded replicas are all active, there is no leader
+	cmd.PreRun = func(cmd *cobra.Command, args []string) {
+		cmdConfig.DisableLeaderElection = o.ShardedReplicas
+	}
+
 	o.AddFlags(cmd)
 	return cmd
 }
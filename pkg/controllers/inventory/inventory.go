@@ -0,0 +1,225 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+const (
+	inventoryLabel = "kcp.open-cluster-management.io/inventory"
+	hubLabel       = "kcp.open-cluster-management.io/hub"
+)
+
+// InventoryGVR is the resource of the managed cluster inventory in the logical cluster
+var InventoryGVR = schema.GroupVersionResource{
+	Group:    "kcp.open-cluster-management.io",
+	Version:  "v1alpha1",
+	Resource: "managedclusterinventories",
+}
+
+type inventoryController struct {
+	kcpClient        dynamic.Interface
+	inventoryLister  cache.GenericLister
+	hubs             []*hub.Scope
+	workingNamespace string
+}
+
+// NewInventoryController mirrors the managed clusters reachable through the ManagedClusterSetBindings
+// of the working namespace into the logical cluster as ManagedClusterInventory objects.
+func NewInventoryController(
+	namespace string,
+	kcpClient dynamic.Interface,
+	inventoryInformer informers.GenericInformer,
+	hubs []*hub.Scope,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &inventoryController{
+		kcpClient:        kcpClient,
+		inventoryLister:  inventoryInformer.Lister(),
+		hubs:             hubs,
+		workingNamespace: namespace,
+	}
+
+	f := factory.New().
+		WithInformers(inventoryInformer.Informer())
+
+	for _, scope := range hubs {
+		f = f.WithFilteredEventsInformers(func(obj interface{}) bool {
+			accessor, _ := meta.Accessor(obj)
+			return accessor.GetNamespace() == namespace
+		}, scope.ManagedClusterSetBindings()).
+			WithInformers(scope.ManagedClusters())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "inventory-controller", c.sync)).ToController("inventory-controller", recorder)
+}
+
+func (c *inventoryController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("inventory-controller %s sync", c.workingNamespace)
+
+	desired := map[string]*unstructured.Unstructured{}
+	for _, scope := range c.hubs {
+		inventories, err := c.hubInventories(scope)
+		if err != nil {
+			return err
+		}
+		for _, inventory := range inventories {
+			desired[inventory.GetName()] = inventory
+		}
+	}
+
+	existing, err := c.inventoryLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	client := c.kcpClient.Resource(InventoryGVR)
+	for _, obj := range existing {
+		current, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+
+		required, ok := desired[current.GetName()]
+		if !ok {
+			err := client.Delete(ctx, current.GetName(), metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		delete(desired, current.GetName())
+
+		if equality.Semantic.DeepEqual(current.Object["spec"], required.Object["spec"]) &&
+			equality.Semantic.DeepEqual(current.GetLabels(), required.GetLabels()) {
+			continue
+		}
+
+		// Revert any change on the inventory, it is read only for users
+		updated := current.DeepCopy()
+		updated.Object["spec"] = required.Object["spec"]
+		updated.SetLabels(required.GetLabels())
+		if _, err := client.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, required := range desired {
+		if _, err := client.Create(ctx, required, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// hubInventories builds the inventories of the clusters in the cluster sets bound to the working namespace on the hub
+func (c *inventoryController) hubInventories(scope *hub.Scope) ([]*unstructured.Unstructured, error) {
+	clusters, err := scope.BoundClusters()
+	if err != nil {
+		return nil, err
+	}
+
+	inventories := []*unstructured.Unstructured{}
+	for _, cluster := range clusters {
+		inventories = append(inventories, buildInventory(scope.Hub.Name, cluster))
+	}
+	return inventories, nil
+}
+
+// InventoryName returns the name of the inventory of a managed cluster, clusters on
+// additional hubs are prefixed with the hub name since cluster names are only unique in a hub.
+func InventoryName(hubName, clusterName string) string {
+	if hubName == hub.DefaultHubName {
+		return clusterName
+	}
+	return fmt.Sprintf("%s.%s", hubName, clusterName)
+}
+
+func buildInventory(hubName string, cluster *clusterapiv1.ManagedCluster) *unstructured.Unstructured {
+	inventoryLabels := map[string]string{}
+	for k, v := range cluster.Labels {
+		inventoryLabels[k] = v
+	}
+	inventoryLabels[inventoryLabel] = "true"
+	inventoryLabels[hubLabel] = hubName
+
+	claims := []interface{}{}
+	for _, claim := range cluster.Status.ClusterClaims {
+		claims = append(claims, map[string]interface{}{
+			"name":  claim.Name,
+			"value": claim.Value,
+		})
+	}
+	sort.Slice(claims, func(i, j int) bool {
+		return claims[i].(map[string]interface{})["name"].(string) < claims[j].(map[string]interface{})["name"].(string)
+	})
+
+	conditions := []interface{}{}
+	for _, condition := range cluster.Status.Conditions {
+		conditions = append(conditions, map[string]interface{}{
+			"type":               condition.Type,
+			"status":             string(condition.Status),
+			"reason":             condition.Reason,
+			"message":            condition.Message,
+			"lastTransitionTime": condition.LastTransitionTime.UTC().Format(time.RFC3339),
+		})
+	}
+
+	available := string(metav1.ConditionUnknown)
+	if condition := meta.FindStatusCondition(cluster.Status.Conditions, clusterapiv1.ManagedClusterConditionAvailable); condition != nil {
+		available = string(condition.Status)
+	}
+
+	inventory := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": InventoryGVR.GroupVersion().String(),
+			"kind":       "ManagedClusterInventory",
+			"spec": map[string]interface{}{
+				"hub":               hubName,
+				"clusterName":       cluster.Name,
+				"clusterSets":       []interface{}{cluster.Labels[hub.ClusterSetLabel]},
+				"available":         available,
+				"kubernetesVersion": cluster.Status.Version.Kubernetes,
+				"clusterClaims":     claims,
+				"capacity":          resourceList(cluster.Status.Capacity),
+				"allocatable":       resourceList(cluster.Status.Allocatable),
+				"conditions":        conditions,
+			},
+		},
+	}
+	inventory.SetName(InventoryName(hubName, cluster.Name))
+	inventory.SetLabels(inventoryLabels)
+
+	return inventory
+}
+
+func resourceList(resources clusterapiv1.ResourceList) map[string]interface{} {
+	list := map[string]interface{}{}
+	for name, quantity := range resources {
+		list[string(name)] = quantity.String()
+	}
+	return list
+}
@@ -0,0 +1,202 @@
+package inventory
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+)
+
+// fakeDynamicClient records the writes of the controller on a resource
+type fakeDynamicClient struct {
+	dynamic.Interface
+	resource *fakeResource
+}
+
+func (c *fakeDynamicClient) Resource(schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return c.resource
+}
+
+type fakeResource struct {
+	dynamic.NamespaceableResourceInterface
+	actions []string
+}
+
+func (r *fakeResource) Create(_ context.Context, obj *unstructured.Unstructured, _ metav1.CreateOptions, _ ...string) (*unstructured.Unstructured, error) {
+	r.actions = append(r.actions, "create "+obj.GetName())
+	return obj, nil
+}
+
+func (r *fakeResource) Update(_ context.Context, obj *unstructured.Unstructured, _ metav1.UpdateOptions, _ ...string) (*unstructured.Unstructured, error) {
+	r.actions = append(r.actions, "update "+obj.GetName())
+	return obj, nil
+}
+
+func (r *fakeResource) Delete(_ context.Context, name string, _ metav1.DeleteOptions, _ ...string) error {
+	r.actions = append(r.actions, "delete "+name)
+	return nil
+}
+
+func newScope(t *testing.T, hubName string, clusterSets []string, clusters ...*clusterapiv1.ManagedCluster) *hub.Scope {
+	informers := clusterinformers.NewSharedInformerFactory(nil, 0)
+	for _, clusterSet := range clusterSets {
+		binding := &clusterapiv1alpha1.ManagedClusterSetBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ws", Name: clusterSet},
+			Spec:       clusterapiv1alpha1.ManagedClusterSetBindingSpec{ClusterSet: clusterSet},
+		}
+		if err := informers.Cluster().V1alpha1().ManagedClusterSetBindings().Informer().GetIndexer().Add(binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cluster := range clusters {
+		if err := informers.Cluster().V1().ManagedClusters().Informer().GetIndexer().Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &hub.Scope{Hub: &hub.Hub{Name: hubName, ClusterInformers: informers}, WorkingNamespace: "ws"}
+}
+
+func newCluster(name, clusterSet string) *clusterapiv1.ManagedCluster {
+	return &clusterapiv1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{hub.ClusterSetLabel: clusterSet}},
+	}
+}
+
+func TestSync(t *testing.T) {
+	changed := buildInventory(hub.DefaultHubName, newCluster("cluster2", "set1"))
+	changed.Object["spec"].(map[string]interface{})["available"] = "True"
+
+	cases := []struct {
+		name            string
+		scopes          []*hub.Scope
+		existing        []*unstructured.Unstructured
+		expectedActions []string
+	}{
+		{
+			name: "create the inventories of the bound clusters",
+			scopes: []*hub.Scope{
+				newScope(t, hub.DefaultHubName, []string{"set1"}, newCluster("cluster1", "set1"), newCluster("cluster2", "set2")),
+				newScope(t, "hub2", []string{"set2"}, newCluster("cluster1", "set2")),
+			},
+			expectedActions: []string{"create cluster1", "create hub2.cluster1"},
+		},
+		{
+			name:   "keep the inventories in sync",
+			scopes: []*hub.Scope{newScope(t, hub.DefaultHubName, []string{"set1"}, newCluster("cluster1", "set1"))},
+			existing: []*unstructured.Unstructured{
+				buildInventory(hub.DefaultHubName, newCluster("cluster1", "set1")),
+			},
+			expectedActions: []string{},
+		},
+		{
+			name:   "revert changed inventories",
+			scopes: []*hub.Scope{newScope(t, hub.DefaultHubName, []string{"set1"}, newCluster("cluster2", "set1"))},
+			existing: []*unstructured.Unstructured{
+				changed,
+			},
+			expectedActions: []string{"update cluster2"},
+		},
+		{
+			name:   "delete the inventories of clusters no longer bound",
+			scopes: []*hub.Scope{newScope(t, hub.DefaultHubName, []string{}, newCluster("cluster1", "set1"))},
+			existing: []*unstructured.Unstructured{
+				buildInventory(hub.DefaultHubName, newCluster("cluster1", "set1")),
+			},
+			expectedActions: []string{"delete cluster1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, inventory := range c.existing {
+				if err := indexer.Add(inventory); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resource := &fakeResource{}
+			controller := &inventoryController{
+				kcpClient:        &fakeDynamicClient{resource: resource},
+				inventoryLister:  cache.NewGenericLister(indexer, InventoryGVR.GroupResource()),
+				hubs:             c.scopes,
+				workingNamespace: "ws",
+			}
+
+			syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+			if err := controller.sync(context.Background(), syncCtx); err != nil {
+				t.Fatal(err)
+			}
+
+			actions := append([]string{}, resource.actions...)
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, c.expectedActions) {
+				t.Errorf("expected actions %v, got %v", c.expectedActions, actions)
+			}
+		})
+	}
+}
+
+func TestBuildInventory(t *testing.T) {
+	cluster := newCluster("cluster1", "set1")
+	cluster.Labels["env"] = "prod"
+	cluster.Status.ClusterClaims = []clusterapiv1.ManagedClusterClaim{
+		{Name: "region.open-cluster-management.io", Value: "us-east"},
+		{Name: "id.k8s.io", Value: "abc"},
+	}
+	cluster.Status.Conditions = []metav1.Condition{
+		{Type: clusterapiv1.ManagedClusterConditionAvailable, Status: metav1.ConditionTrue, Reason: "Available"},
+	}
+	cluster.Status.Version.Kubernetes = "v1.22.0"
+
+	cases := []struct {
+		name         string
+		hubName      string
+		expectedName string
+	}{
+		{name: "default hub", hubName: hub.DefaultHubName, expectedName: "cluster1"},
+		{name: "additional hub", hubName: "hub2", expectedName: "hub2.cluster1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			inventory := buildInventory(c.hubName, cluster)
+			if inventory.GetName() != c.expectedName {
+				t.Errorf("expected name %s, got %s", c.expectedName, inventory.GetName())
+			}
+
+			expectedLabels := map[string]string{
+				hub.ClusterSetLabel: "set1", "env": "prod", inventoryLabel: "true", hubLabel: c.hubName,
+			}
+			if !reflect.DeepEqual(inventory.GetLabels(), expectedLabels) {
+				t.Errorf("expected labels %v, got %v", expectedLabels, inventory.GetLabels())
+			}
+
+			spec := inventory.Object["spec"].(map[string]interface{})
+			if spec["hub"] != c.hubName || spec["clusterName"] != "cluster1" || spec["available"] != "True" ||
+				spec["kubernetesVersion"] != "v1.22.0" {
+				t.Errorf("unexpected spec %v", spec)
+			}
+			claims := spec["clusterClaims"].([]interface{})
+			if len(claims) != 2 || claims[0].(map[string]interface{})["name"] != "id.k8s.io" {
+				t.Errorf("expected the claims sorted by name, got %v", claims)
+			}
+		})
+	}
+
+	if labels := cluster.Labels; len(labels) != 2 {
+		t.Errorf("expected the labels of the cluster to be left unchanged, got %v", labels)
+	}
+}
@@ -0,0 +1,368 @@
+package logicalcluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/controllers/negotiation"
+	"github.com/qiujian16/kcp-ocm/pkg/controllers/splitter"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/manifests"
+	"github.com/qiujian16/kcp-ocm/pkg/membership"
+	"github.com/qiujian16/kcp-ocm/pkg/shard"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// legacyNamespaceWorkName is the work of the namespace propagator created before the works recorded
+	// their source
+	legacyNamespaceWorkName = "namespace-syncer"
+
+	// legacyWorksOwnerKey is hashed on the replicas to elect the one collecting the legacy works, which
+	// record no logical cluster to shard them by
+	legacyWorksOwnerKey = "kcp-ocm-legacy-works"
+
+	// probesOwnerKey is hashed on the replicas to elect the one collecting the probes shared by the
+	// logical clusters
+	probesOwnerKey = "kcp-ocm-api-probes"
+)
+
+var (
+	deploymentsGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	namespacesGVR  = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+)
+
+// GarbageCollector deletes the ManifestWorks and Placements of kcp-ocm left behind by kcp objects or
+// logical clusters that are gone, for instance when they are deleted while kcp-ocm is down. It runs
+// on startup and then periodically. In the dry run mode the orphans are only reported.
+type GarbageCollector struct {
+	hubs       *hub.Registry
+	shards     *shard.Registry
+	membership *membership.Membership
+	dryRun     bool
+
+	// unsourced holds the works without a source seen by the last run. Their controllers record the
+	// source when they apply them, so a work still without a source on the next run is orphaned.
+	lock      sync.Mutex
+	unsourced sets.String
+}
+
+func NewGarbageCollector(
+	hubs *hub.Registry,
+	shards *shard.Registry,
+	replicas *membership.Membership,
+	dryRun bool,
+	interval time.Duration,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &GarbageCollector{
+		hubs:       hubs,
+		shards:     shards,
+		membership: replicas,
+		dryRun:     dryRun,
+		unsourced:  sets.NewString(),
+	}
+
+	f := factory.New()
+	for _, h := range hubs.List() {
+		f = f.WithBareInformers(
+			h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Informer(),
+			h.ClusterInformers.Cluster().V1alpha1().Placements().Informer(),
+			h.WorkInformers.Work().V1().ManifestWorks().Informer(),
+			h.KubeInformers.Core().V1().Namespaces().Informer())
+	}
+
+	return f.ResyncEvery(interval).WithSync(c.sync).ToController("garbage-collector", recorder)
+}
+
+// logicalClusters caches the kcp clients of the logical clusters and whether the logical clusters
+// exist for a run
+type logicalClusters struct {
+	clients map[string]dynamic.Interface
+	exist   map[string]bool
+}
+
+func (c *GarbageCollector) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("garbage-collector sync")
+
+	clients := &logicalClusters{clients: map[string]dynamic.Interface{}, exist: map[string]bool{}}
+
+	errs := []error{}
+	unsourced := sets.NewString()
+	for _, h := range c.hubs.List() {
+		if err := c.collectWorks(ctx, syncCtx.Recorder(), h, clients, unsourced); err != nil {
+			errs = append(errs, err)
+		}
+		if err := c.collectPlacements(ctx, syncCtx.Recorder(), h, clients); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	c.lock.Lock()
+	c.unsourced = unsourced
+	c.lock.Unlock()
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// collectWorks deletes the orphaned works on the hub, and adds the keys of the works without a source
+// to unsourced.
+func (c *GarbageCollector) collectWorks(
+	ctx context.Context, recorder events.Recorder, h *hub.Hub, clients *logicalClusters, unsourced sets.String) error {
+	works, err := h.WorkInformers.Work().V1().ManifestWorks().Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var bound sets.String
+	errs := []error{}
+	for _, work := range works {
+		key := fmt.Sprintf("%s/%s/%s", h.Name, work.Namespace, work.Name)
+
+		reason := ""
+		source, ok := helpers.SourceOf(work)
+		switch {
+		case ok:
+			if reason, err = c.orphaned(ctx, h, source, clients); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		case legacyWork(work.Labels, work.Name):
+			// The legacy works record no logical cluster, a single replica collects them and only while
+			// all the kcp shards are healthy, since the mappers held back do not record their sources.
+			if !c.membership.Owns(legacyWorksOwnerKey) || !c.shardsHealthy() {
+				continue
+			}
+
+			c.lock.Lock()
+			seen := c.unsourced.Has(key)
+			c.lock.Unlock()
+			if !seen {
+				unsourced.Insert(key)
+				continue
+			}
+			reason = "it has no source and is not applied by any logical cluster"
+		case negotiation.SharedProbe(work):
+			// The negotiators stop with the last logical cluster bound to the cluster, so they leave the probe behind
+			if !c.membership.Owns(probesOwnerKey) {
+				continue
+			}
+			if bound == nil {
+				if bound, err = h.BoundClusterNames(); err != nil {
+					return err
+				}
+			}
+			if !bound.Has(work.Namespace) {
+				reason = fmt.Sprintf("cluster %s is not bound to any logical cluster", work.Namespace)
+			}
+		}
+		if len(reason) == 0 {
+			continue
+		}
+
+		if err := c.collect(recorder, "ManifestWork", key, reason, func() error {
+			return h.WorkClient.WorkV1().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// collectPlacements deletes the orphaned placements on the hub, including the placements of existing
+// sources that are no longer used under their name.
+func (c *GarbageCollector) collectPlacements(
+	ctx context.Context, recorder events.Recorder, h *hub.Hub, clients *logicalClusters) error {
+	requirement, err := labels.NewRequirement(helpers.SourceLogicalClusterLabel, selection.Exists, []string{})
+	if err != nil {
+		return err
+	}
+	placements, err := h.ClusterInformers.Cluster().V1alpha1().Placements().Lister().List(labels.NewSelector().Add(*requirement))
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, placement := range placements {
+		source, _ := helpers.SourceOf(placement)
+		key := fmt.Sprintf("%s/%s/%s", h.Name, placement.Namespace, placement.Name)
+
+		reason, err := c.orphaned(ctx, h, source, clients)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		names := placementNames(source)
+		if len(reason) == 0 && c.membership.Owns(source.LogicalCluster) && names.Len() > 0 && !names.Has(placement.Name) {
+			reason = fmt.Sprintf("it is no longer the placement of %s", source)
+		}
+		if len(reason) == 0 {
+			continue
+		}
+
+		if err := c.collect(recorder, "Placement", key, reason, func() error {
+			return h.ClusterClient.ClusterV1alpha1().Placements(placement.Namespace).Delete(ctx, placement.Name, metav1.DeleteOptions{})
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// orphaned returns why the object of the source is orphaned on the hub, or an empty reason if the
+// source still exists or belongs to a logical cluster handled by another replica. Sources that cannot
+// be checked are never reported as orphaned.
+func (c *GarbageCollector) orphaned(
+	ctx context.Context, h *hub.Hub, source helpers.Source, clients *logicalClusters) (string, error) {
+	if !c.membership.Owns(source.LogicalCluster) {
+		return "", nil
+	}
+
+	bindings, err := h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Lister().
+		ManagedClusterSetBindings(source.LogicalCluster).List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	if len(bindings) == 0 {
+		return fmt.Sprintf("logical cluster %s is not bound to hub %s", source.LogicalCluster, h.Name), nil
+	}
+
+	// The works of a whole logical cluster are cleaned by its controllers
+	if len(source.Namespace) == 0 && len(source.Name) == 0 {
+		return "", nil
+	}
+
+	client, err := c.kcpClient(source.LogicalCluster, clients)
+	if err != nil {
+		return "", err
+	}
+
+	// Every object looks deleted in a logical cluster that is unreachable or not on the expected shard
+	exists, err := c.logicalClusterExists(ctx, source.LogicalCluster, client, clients)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	if len(source.Name) == 0 {
+		_, err = client.Resource(namespacesGVR).Get(ctx, source.Namespace, metav1.GetOptions{})
+	} else {
+		_, err = client.Resource(source.Resource).Namespace(source.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+	}
+	switch {
+	case errors.IsNotFound(err):
+		return fmt.Sprintf("source %s is deleted", source), nil
+	case err != nil:
+		return "", err
+	}
+	return "", nil
+}
+
+// kcpClient returns the client of the logical cluster on the kcp shard it lives on
+func (c *GarbageCollector) kcpClient(logicalCluster string, clients *logicalClusters) (dynamic.Interface, error) {
+	if client, ok := clients.clients[logicalCluster]; ok {
+		return client, nil
+	}
+
+	kcpShard, err := shardOf(c.shards, logicalCluster, c.hubs.List())
+	if err != nil {
+		return nil, err
+	}
+	if healthy, err := kcpShard.Healthy(); !healthy {
+		return nil, fmt.Errorf("kcp shard of logical cluster %s is unhealthy: %v", logicalCluster, err)
+	}
+	client, err := dynamic.NewForConfig(kcpShard.LogicalClusterConfig(logicalCluster))
+	if err != nil {
+		return nil, err
+	}
+	clients.clients[logicalCluster] = client
+	return client, nil
+}
+
+// logicalClusterExists returns whether the logical cluster is served by the client, from the CRD
+// kcp-ocm installs into each logical cluster it maps.
+func (c *GarbageCollector) logicalClusterExists(
+	ctx context.Context, logicalCluster string, client dynamic.Interface, clients *logicalClusters) (bool, error) {
+	if exists, ok := clients.exist[logicalCluster]; ok {
+		return exists, nil
+	}
+
+	crd, err := manifests.CRD(manifests.ManagedClusterInventoryCRD)
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Resource(manifests.CustomResourceDefinitionGVR).Get(ctx, crd.GetName(), metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		klog.V(4).Infof("garbage-collector skips logical cluster %s, it is not found on its kcp shard", logicalCluster)
+		clients.exist[logicalCluster] = false
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	clients.exist[logicalCluster] = true
+	return true, nil
+}
+
+// shardsHealthy returns whether all the kcp shards are healthy
+func (c *GarbageCollector) shardsHealthy() bool {
+	for _, name := range c.shards.Names() {
+		kcpShard, err := c.shards.Get(name)
+		if err != nil {
+			return false
+		}
+		if healthy, _ := kcpShard.Healthy(); !healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// collect deletes an orphan, or only reports it in the dry run mode
+func (c *GarbageCollector) collect(recorder events.Recorder, kind, key, reason string, deleteFunc func() error) error {
+	if c.dryRun {
+		klog.Infof("garbage-collector would delete %s %s: %s", kind, key, reason)
+		recorder.Eventf("OrphanFound", "%s %s is orphaned: %s", kind, key, reason)
+		return nil
+	}
+
+	if err := deleteFunc(); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	klog.Infof("garbage-collector deleted %s %s: %s", kind, key, reason)
+	recorder.Eventf("OrphanDeleted", "%s %s is deleted: %s", kind, key, reason)
+	return nil
+}
+
+// legacyWork returns whether a work without a source was created by kcp-ocm
+func legacyWork(workLabels map[string]string, name string) bool {
+	if _, ok := workLabels[hub.SplitWorkLabel]; ok {
+		return true
+	}
+	return name == legacyNamespaceWorkName
+}
+
+// placementNames returns the names of the placements kcp-ocm creates for the source, or an empty set
+// if the names are not known
+func placementNames(source helpers.Source) sets.String {
+	switch {
+	case source.Resource == deploymentsGVR && len(source.Name) > 0:
+		return sets.NewString(splitter.PlacementNames(source.Namespace, source.Name)...)
+	case len(source.Resource.Resource) == 0 && len(source.Name) == 0:
+		return sets.NewString(defaultPlacementName)
+	default:
+		return sets.NewString()
+	}
+}
@@ -0,0 +1,286 @@
+package logicalcluster
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/shard"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterv1alpha1client "open-cluster-management.io/api/client/cluster/clientset/versioned/typed/cluster/v1alpha1"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// fakeHubClient records the works and placements deleted on the hub, it has no List so the garbage
+// collector reads the hub from the informers only
+type fakeHubClient struct {
+	deleted []string
+}
+
+type fakeWorkClient struct {
+	workclient.Interface
+	workv1client.WorkV1Interface
+	client *fakeHubClient
+}
+
+func (c *fakeWorkClient) WorkV1() workv1client.WorkV1Interface {
+	return c
+}
+
+func (c *fakeWorkClient) ManifestWorks(namespace string) workv1client.ManifestWorkInterface {
+	return &fakeHubWorks{client: c.client, namespace: namespace}
+}
+
+type fakeClusterClient struct {
+	clusterclient.Interface
+	clusterv1alpha1client.ClusterV1alpha1Interface
+	client *fakeHubClient
+}
+
+func (c *fakeClusterClient) ClusterV1alpha1() clusterv1alpha1client.ClusterV1alpha1Interface {
+	return c
+}
+
+func (c *fakeClusterClient) Placements(namespace string) clusterv1alpha1client.PlacementInterface {
+	return &fakeHubPlacements{client: c.client, namespace: namespace}
+}
+
+type fakeHubWorks struct {
+	workv1client.ManifestWorkInterface
+	client    *fakeHubClient
+	namespace string
+}
+
+func (w *fakeHubWorks) Delete(_ context.Context, name string, _ metav1.DeleteOptions) error {
+	w.client.deleted = append(w.client.deleted, fmt.Sprintf("work %s/%s", w.namespace, name))
+	return nil
+}
+
+type fakeHubPlacements struct {
+	clusterv1alpha1client.PlacementInterface
+	client    *fakeHubClient
+	namespace string
+}
+
+func (p *fakeHubPlacements) Delete(_ context.Context, name string, _ metav1.DeleteOptions) error {
+	p.client.deleted = append(p.client.deleted, fmt.Sprintf("placement %s/%s", p.namespace, name))
+	return nil
+}
+
+// fakeKCPClient serves the objects of a logical cluster that exist, by <resource>/<namespace>/<name>
+type fakeKCPClient struct {
+	dynamic.Interface
+	dynamic.NamespaceableResourceInterface
+	existing  sets.String
+	resource  string
+	namespace string
+}
+
+func (c *fakeKCPClient) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &fakeKCPClient{existing: c.existing, resource: gvr.Resource}
+}
+
+func (c *fakeKCPClient) Namespace(namespace string) dynamic.ResourceInterface {
+	return &fakeKCPClient{existing: c.existing, resource: c.resource, namespace: namespace}
+}
+
+func (c *fakeKCPClient) Get(_ context.Context, name string, _ metav1.GetOptions, _ ...string) (*unstructured.Unstructured, error) {
+	if !c.existing.Has(fmt.Sprintf("%s/%s/%s", c.resource, c.namespace, name)) {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: c.resource}, name)
+	}
+	return &unstructured.Unstructured{}, nil
+}
+
+// newCollectedHub returns the hub where the logical clusters ws1 and ws3 are bound to cluster1 and the
+// other logical clusters to no cluster, with the works and placements in its informers.
+func newCollectedHub(t *testing.T, client *fakeHubClient, works []*workapiv1.ManifestWork, placements []*clusterapiv1alpha1.Placement) *hub.Hub {
+	h := &hub.Hub{
+		Name:             "hub",
+		WorkClient:       &fakeWorkClient{client: client},
+		ClusterClient:    &fakeClusterClient{client: client},
+		ClusterInformers: clusterinformers.NewSharedInformerFactory(nil, 0),
+		WorkInformers:    workinformers.NewSharedInformerFactory(nil, 0),
+	}
+
+	for _, namespace := range []string{"ws1", "ws3"} {
+		binding := &clusterapiv1alpha1.ManagedClusterSetBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "set1"},
+			Spec:       clusterapiv1alpha1.ManagedClusterSetBindingSpec{ClusterSet: "set1"},
+		}
+		if err := h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Informer().GetIndexer().Add(binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, clusterSet := range map[string]string{"cluster1": "set1", "cluster2": "set2"} {
+		cluster := &clusterapiv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Labels: map[string]string{hub.ClusterSetLabel: clusterSet},
+		}}
+		if err := h.ClusterInformers.Cluster().V1().ManagedClusters().Informer().GetIndexer().Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, work := range works {
+		if err := h.WorkInformers.Work().V1().ManifestWorks().Informer().GetIndexer().Add(work); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, placement := range placements {
+		if err := h.ClusterInformers.Cluster().V1alpha1().Placements().Informer().GetIndexer().Add(placement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func newSourcedWork(clusterName, name string, source helpers.Source) *workapiv1.ManifestWork {
+	work := &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Namespace: clusterName, Name: name}}
+	helpers.SetSource(work, source)
+	return work
+}
+
+func newProbe(clusterName string) *workapiv1.ManifestWork {
+	return &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{
+		Namespace: clusterName, Name: "kcp-api-probe", Labels: map[string]string{"kcp.open-cluster-management.io/api-probe": "true"},
+	}}
+}
+
+// newLogicalClusters returns the clients of the logical clusters ws1, where the deployment default/web
+// exists, and ws3, which is not found on its kcp shard
+func newLogicalClusters() *logicalClusters {
+	return &logicalClusters{
+		clients: map[string]dynamic.Interface{
+			"ws1": &fakeKCPClient{existing: sets.NewString("deployments/default/web")},
+			"ws3": &fakeKCPClient{existing: sets.NewString()},
+		},
+		exist: map[string]bool{"ws1": true, "ws3": false},
+	}
+}
+
+func TestCollectWorks(t *testing.T) {
+	web := helpers.Source{LogicalCluster: "ws1", Resource: deploymentsGVR, Namespace: "default", Name: "web"}
+	api := helpers.Source{LogicalCluster: "ws1", Resource: deploymentsGVR, Namespace: "default", Name: "api"}
+	works := []*workapiv1.ManifestWork{
+		newSourcedWork("cluster1", "web", web),
+		newSourcedWork("cluster1", "api", api),
+		newSourcedWork("cluster1", "namespace-syncer-ws1", helpers.Source{LogicalCluster: "ws1"}),
+		newSourcedWork("cluster1", "namespace-syncer-ws2", helpers.Source{LogicalCluster: "ws2"}),
+		newSourcedWork("cluster1", "api-ws3", helpers.Source{LogicalCluster: "ws3", Resource: deploymentsGVR, Namespace: "default", Name: "api"}),
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "cluster1", Name: legacyNamespaceWorkName}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "cluster1", Name: "other"}},
+		newProbe("cluster1"),
+		newProbe("cluster2"),
+	}
+
+	cases := []struct {
+		name            string
+		dryRun          bool
+		runs            int
+		expectedDeleted []string
+		expectedEvents  []string
+	}{
+		{
+			name: "collect the orphaned works",
+			runs: 1,
+			expectedDeleted: []string{
+				"work cluster1/api", "work cluster1/namespace-syncer-ws2", "work cluster2/kcp-api-probe",
+			},
+			expectedEvents: []string{"OrphanDeleted", "OrphanDeleted", "OrphanDeleted"},
+		},
+		{
+			name: "collect the legacy works on the next run",
+			runs: 2,
+			expectedDeleted: []string{
+				"work cluster1/api", "work cluster1/api", "work cluster1/namespace-syncer",
+				"work cluster1/namespace-syncer-ws2", "work cluster1/namespace-syncer-ws2",
+				"work cluster2/kcp-api-probe", "work cluster2/kcp-api-probe",
+			},
+			expectedEvents: []string{"OrphanDeleted", "OrphanDeleted", "OrphanDeleted", "OrphanDeleted", "OrphanDeleted", "OrphanDeleted", "OrphanDeleted"},
+		},
+		{
+			name:            "only report the orphaned works in the dry run",
+			dryRun:          true,
+			runs:            1,
+			expectedDeleted: []string{},
+			expectedEvents:  []string{"OrphanFound", "OrphanFound", "OrphanFound"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeHubClient{deleted: []string{}}
+			h := newCollectedHub(t, client, works, nil)
+			collector := &GarbageCollector{shards: &shard.Registry{}, dryRun: c.dryRun, unsourced: sets.NewString()}
+			recorder := events.NewInMemoryRecorder("test")
+
+			for i := 0; i < c.runs; i++ {
+				unsourced := sets.NewString()
+				if err := collector.collectWorks(context.Background(), recorder, h, newLogicalClusters(), unsourced); err != nil {
+					t.Fatal(err)
+				}
+				collector.unsourced = unsourced
+			}
+
+			sort.Strings(client.deleted)
+			if !reflect.DeepEqual(client.deleted, c.expectedDeleted) {
+				t.Errorf("expected deleted %v, got %v", c.expectedDeleted, client.deleted)
+			}
+			reasons := []string{}
+			for _, event := range recorder.Events() {
+				reasons = append(reasons, event.Reason)
+			}
+			if !reflect.DeepEqual(reasons, c.expectedEvents) {
+				t.Errorf("expected events %v, got %v", c.expectedEvents, reasons)
+			}
+		})
+	}
+}
+
+func TestCollectPlacements(t *testing.T) {
+	newPlacement := func(namespace, name string, source helpers.Source) *clusterapiv1alpha1.Placement {
+		placement := &clusterapiv1alpha1.Placement{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		helpers.SetSource(placement, source)
+		return placement
+	}
+	web := helpers.Source{LogicalCluster: "ws1", Resource: deploymentsGVR, Namespace: "default", Name: "web"}
+	placements := []*clusterapiv1alpha1.Placement{
+		newPlacement("ws1", defaultPlacementName, helpers.Source{LogicalCluster: "ws1"}),
+		newPlacement("ws1", "renamed", helpers.Source{LogicalCluster: "ws1"}),
+		newPlacement("ws1", "web", web),
+		newPlacement("ws1", "api", helpers.Source{LogicalCluster: "ws1", Resource: deploymentsGVR, Namespace: "default", Name: "api"}),
+		newPlacement("ws2", defaultPlacementName, helpers.Source{LogicalCluster: "ws2"}),
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ws1", Name: "unsourced"}},
+	}
+	for _, name := range placementNames(web).List() {
+		placements = append(placements, newPlacement("ws1", name, web))
+	}
+
+	client := &fakeHubClient{deleted: []string{}}
+	h := newCollectedHub(t, client, nil, placements)
+	collector := &GarbageCollector{shards: &shard.Registry{}, unsourced: sets.NewString()}
+	if err := collector.collectPlacements(context.Background(), events.NewInMemoryRecorder("test"), h, newLogicalClusters()); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(client.deleted)
+	expected := []string{"placement ws1/api", "placement ws1/renamed", "placement ws1/web", "placement ws2/default"}
+	if !reflect.DeepEqual(client.deleted, expected) {
+		t.Errorf("expected deleted %v, got %v", expected, client.deleted)
+	}
+}
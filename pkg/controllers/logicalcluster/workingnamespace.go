@@ -3,26 +3,35 @@ package logicalcluster
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/openshift/library-go/pkg/controller/factory"
 	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/admission"
+	"github.com/qiujian16/kcp-ocm/pkg/controllers/inventory"
+	"github.com/qiujian16/kcp-ocm/pkg/controllers/negotiation"
 	"github.com/qiujian16/kcp-ocm/pkg/controllers/propagator"
 	"github.com/qiujian16/kcp-ocm/pkg/controllers/splitter"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/manifests"
+	"github.com/qiujian16/kcp-ocm/pkg/membership"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	"github.com/qiujian16/kcp-ocm/pkg/secret"
+	"github.com/qiujian16/kcp-ocm/pkg/shard"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
-	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
-	clusterinformerv1alpha1 "open-cluster-management.io/api/client/cluster/informers/externalversions/cluster/v1alpha1"
-	clusterlisterv1alpha1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1alpha1"
-	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
-	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	"k8s.io/klog/v2"
 	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
 )
 
@@ -30,152 +39,479 @@ const defaultPlacementName = "default"
 
 type mapperConfiguration struct {
 	workingNamespace string
+	shard            *shard.Shard
+	hubs             sets.String
 	cancel           context.CancelFunc
 }
 
 // WorkingNamespaceMapper is to map a logical cluster to a working namespace
 type WorkingNamespaceMapper struct {
-	logicalClusterMapper    map[string]*mapperConfiguration
-	clusterSetBindingLister clusterlisterv1alpha1.ManagedClusterSetBindingLister
-	clusterClient           clusterclient.Interface
-	manifestWorkClient      workclient.Interface
-	kcpBaseConfig           *rest.Config
-	recorder                events.Recorder
+	lock                 sync.Mutex
+	logicalClusterMapper map[string]*mapperConfiguration
+	hubs                 *hub.Registry
+	shards               *shard.Registry
+	workers              int
+	apiProbeImage        string
+	deletePolicy         string
+	creatorWebhook       *admission.CreatorWebhook
+	sealer               *secret.Sealer
+	membership           *membership.Membership
+	fairQueue            *helpers.FairShareQueue
+	recorder             events.Recorder
 }
 
 func NewWorkingNamespaceMapper(
-	clusterClient clusterclient.Interface,
-	manifestWorkClient workclient.Interface,
-	kcpBaseConfig *rest.Config,
-	clusterBindingInformer clusterinformerv1alpha1.ManagedClusterSetBindingInformer,
+	hubs *hub.Registry,
+	shards *shard.Registry,
+	workers int,
+	apiProbeImage string,
+	deletePolicy string,
+	creatorWebhook *admission.CreatorWebhook,
+	sealer *secret.Sealer,
+	replicas *membership.Membership,
+	fairQueue *helpers.FairShareQueue,
 	recorder events.Recorder,
 ) factory.Controller {
 	c := &WorkingNamespaceMapper{
-		logicalClusterMapper:    map[string]*mapperConfiguration{},
-		clusterSetBindingLister: clusterBindingInformer.Lister(),
-		clusterClient:           clusterClient,
-		manifestWorkClient:      manifestWorkClient,
-		kcpBaseConfig:           kcpBaseConfig,
-		recorder:                recorder,
+		logicalClusterMapper: map[string]*mapperConfiguration{},
+		hubs:                 hubs,
+		shards:               shards,
+		workers:              workers,
+		apiProbeImage:        apiProbeImage,
+		deletePolicy:         deletePolicy,
+		creatorWebhook:       creatorWebhook,
+		sealer:               sealer,
+		membership:           replicas,
+		fairQueue:            fairQueue,
+		recorder:             recorder,
 	}
 
-	return factory.New().
-		WithInformersQueueKeyFunc(func(obj runtime.Object) string {
+	syncCtx := factory.NewSyncContext("ManifestWorkAgent", recorder)
+	f := factory.New().WithSyncContext(syncCtx)
+
+	// The working namespaces are rebalanced when replicas join or leave
+	if replicas != nil {
+		replicas.AddHandler(func() {
+			for _, namespace := range c.workingNamespaces() {
+				syncCtx.Queue().Add(namespace)
+			}
+		})
+	}
+
+	// The mappers held back while their kcp shard is unhealthy are started when it recovers
+	shards.AddHandler(func() {
+		for _, namespace := range c.workingNamespaces() {
+			syncCtx.Queue().Add(namespace)
+		}
+	})
+
+	// The working namespace of a logical cluster has the same name on each hub
+	for _, h := range hubs.List() {
+		f = f.WithInformersQueueKeyFunc(func(obj runtime.Object) string {
 			accessor, _ := meta.Accessor(obj)
 			return accessor.GetNamespace()
-		}, clusterBindingInformer.Informer()).
-		WithSync(c.sync).ToController("ManifestWorkAgent", recorder)
+		}, h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Informer()).
+			WithFilteredEventsInformersQueueKeyFunc(func(obj runtime.Object) string {
+				accessor, _ := meta.Accessor(obj)
+				return accessor.GetName()
+			}, func(obj interface{}) bool {
+				accessor, _ := meta.Accessor(obj)
+				_, ok := accessor.GetAnnotations()[shard.ShardAnnotation]
+				return ok
+			}, h.KubeInformers.Core().V1().Namespaces().Informer()).
+			WithBareInformers(h.ClusterInformers.Cluster().V1alpha1().Placements().Informer())
+	}
+
+	return f.WithSync(c.sync).ToController("ManifestWorkAgent", recorder)
 }
 
 func (w *WorkingNamespaceMapper) sync(ctx context.Context, syncCtx factory.SyncContext) error {
 	namespace := syncCtx.QueueKey()
 
-	bindings, err := w.clusterSetBindingLister.ManagedClusterSetBindings(namespace).List(labels.Everything())
+	// keys are unique in the queue, the lock only guards the map against other workers
+	w.lock.Lock()
+	config, ok := w.logicalClusterMapper[namespace]
+	w.lock.Unlock()
 
-	if err != nil {
-		return err
+	// The logical cluster is handled by another replica
+	if !w.membership.Owns(namespace) {
+		if ok {
+			klog.Infof("stop mapper of logical cluster %s handled by another replica", namespace)
+			w.stopMapper(namespace, config)
+		}
+		return nil
 	}
 
-	config, ok := w.logicalClusterMapper[namespace]
+	boundHubs := []*hub.Hub{}
+	for _, h := range w.hubs.List() {
+		bindings, err := h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Lister().
+			ManagedClusterSetBindings(namespace).List(labels.Everything())
+		if err != nil {
+			return err
+		}
 
-	// There is no binddings in it,  we remove the syncer
-	if len(bindings) == 0 {
-		err = w.clusterClient.ClusterV1alpha1().Placements(namespace).Delete(ctx, defaultPlacementName, metav1.DeleteOptions{})
-		if err != nil && !errors.IsNotFound(err) {
+		if len(bindings) > 0 {
+			boundHubs = append(boundHubs, h)
+			continue
+		}
+
+		// There is no binddings on this hub, we remove the default placement if kcp-ocm created it
+		if err := deleteDefaultPlacement(ctx, h, namespace); err != nil {
 			return err
 		}
+	}
 
+	// There is no binddings in any hub, we remove the syncer
+	if len(boundHubs) == 0 {
 		if !ok {
 			return nil
 		}
 
-		config.cancel()
-		delete(w.logicalClusterMapper, namespace)
+		w.stopMapper(namespace, config)
 		return nil
 	}
 
-	if ok {
+	kcpShard, err := shardOf(w.shards, namespace, boundHubs)
+	if err != nil {
+		return err
+	}
+
+	hubNames := sets.NewString()
+	for _, h := range boundHubs {
+		hubNames.Insert(h.Name)
+	}
+
+	if ok && config.shard == kcpShard && config.hubs.Equal(hubNames) {
 		return nil
 	}
 
-	// Create a default placement
-	_, err = w.clusterClient.ClusterV1alpha1().Placements(namespace).Get(ctx, defaultPlacementName, metav1.GetOptions{})
-	switch {
-	case errors.IsNotFound(err):
-		defaultPlacement := &clusterapiv1alpha1.Placement{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      defaultPlacementName,
-				Namespace: namespace,
-			},
-			Spec: clusterapiv1alpha1.PlacementSpec{},
-		}
+	// The running mappers keep running while their kcp shard is unhealthy, which is reported by the shard
+	// health metrics, but no mapper is started or restarted until the shard recovers.
+	if healthy, err := kcpShard.Healthy(); !healthy {
+		syncCtx.Recorder().Warningf("ShardUnhealthy", "Mapper of logical cluster %s is not started while kcp shard %s is unhealthy: %v",
+			namespace, kcpShard.Name, err)
+		return nil
+	}
 
-		_, err = w.clusterClient.ClusterV1alpha1().Placements(namespace).Create(ctx, defaultPlacement, metav1.CreateOptions{})
-		if err != nil {
+	// The logical cluster is moved to another shard or bound to different hubs, restart the mapper
+	if ok {
+		klog.Infof("restart mapper of logical cluster %s on kcp shard %s and hubs %v", namespace, kcpShard.Name, hubNames.List())
+		w.stopMapper(namespace, config)
+	}
+
+	// Create a default placement on each bound hub
+	for _, h := range boundHubs {
+		if err := ensureDefaultPlacement(ctx, h, namespace); err != nil {
 			return err
 		}
-	case err != nil:
-		return err
 	}
 
-	cancel, err := w.startMapper(ctx, namespace)
+	cancel, err := w.startMapper(ctx, namespace, kcpShard, boundHubs)
 	if err != nil {
 		return err
 	}
 
 	// Add the working space to the mapper
+	w.lock.Lock()
 	w.logicalClusterMapper[namespace] = &mapperConfiguration{
 		workingNamespace: namespace,
+		shard:            kcpShard,
+		hubs:             hubNames,
 		cancel:           cancel,
 	}
+	w.lock.Unlock()
+	kcpShard.AddLogicalCluster()
 
 	return nil
 }
 
-func (w *WorkingNamespaceMapper) startMapper(ctx context.Context, namespace string) (context.CancelFunc, error) {
-	currentCtx, stopFunc := context.WithCancel(ctx)
+// workingNamespaces returns the working namespaces bound on any hub and the ones with a running mapper
+func (w *WorkingNamespaceMapper) workingNamespaces() []string {
+	namespaces := sets.NewString()
+	for _, h := range w.hubs.List() {
+		bindings, err := h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Lister().List(labels.Everything())
+		if err != nil {
+			klog.Errorf("failed to list ManagedClusterSetBindings of hub %s: %v", h.Name, err)
+			continue
+		}
+		for _, binding := range bindings {
+			namespaces.Insert(binding.Namespace)
+		}
+	}
 
-	clusterInformerFactory := clusterinformers.NewSharedInformerFactoryWithOptions(
-		w.clusterClient, 5*time.Minute, clusterinformers.WithNamespace(namespace))
+	w.lock.Lock()
+	for namespace := range w.logicalClusterMapper {
+		namespaces.Insert(namespace)
+	}
+	w.lock.Unlock()
+	return namespaces.List()
+}
 
-	workInformerFactory := workinformers.NewSharedInformerFactory(w.manifestWorkClient, 5*time.Minute)
+func ensureDefaultPlacement(ctx context.Context, h *hub.Hub, namespace string) error {
+	defaultPlacement := &clusterapiv1alpha1.Placement{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultPlacementName,
+			Namespace: namespace,
+		},
+		Spec: clusterapiv1alpha1.PlacementSpec{},
+	}
+	helpers.SetSource(defaultPlacement, helpers.Source{LogicalCluster: namespace})
 
-	restConfig := rest.CopyConfig(w.kcpBaseConfig)
-	restConfig.Host = fmt.Sprintf("%s/clusters/%s", restConfig.Host, namespace)
+	existing, err := h.ClusterClient.ClusterV1alpha1().Placements(namespace).Get(ctx, defaultPlacementName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = h.ClusterClient.ClusterV1alpha1().Placements(namespace).Create(ctx, defaultPlacement, metav1.CreateOptions{})
+		return err
+	case err != nil:
+		return err
+	}
 
-	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if !helpers.MergeSource(existing, defaultPlacement) {
+		return nil
+	}
+	_, err = h.ClusterClient.ClusterV1alpha1().Placements(namespace).Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
 
+// deleteDefaultPlacement deletes the default placement of the working namespace on the hub, the
+// placements without the source recorded by kcp-ocm are not ours and are kept.
+func deleteDefaultPlacement(ctx context.Context, h *hub.Hub, namespace string) error {
+	placement, err := h.ClusterInformers.Cluster().V1alpha1().Placements().Lister().Placements(namespace).Get(defaultPlacementName)
+	switch {
+	case errors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if _, ok := helpers.SourceOf(placement); !ok {
+		return nil
+	}
+
+	err = h.ClusterClient.ClusterV1alpha1().Placements(namespace).Delete(ctx, defaultPlacementName, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// shardOf returns the kcp shard declared on the working namespace, the first bound hub
+// declaring the shard wins.
+func shardOf(shards *shard.Registry, namespace string, boundHubs []*hub.Hub) (*shard.Shard, error) {
+	shardName := ""
+	for _, h := range boundHubs {
+		ns, err := h.KubeInformers.Core().V1().Namespaces().Lister().Get(namespace)
+		switch {
+		case errors.IsNotFound(err):
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		if name, ok := ns.Annotations[shard.ShardAnnotation]; ok {
+			shardName = name
+			break
+		}
+	}
+
+	kcpShard, err := shards.Get(shardName)
 	if err != nil {
-		return stopFunc, err
+		return nil, fmt.Errorf("failed to find kcp shard of logical cluster %s: %v", namespace, err)
+	}
+	return kcpShard, nil
+}
+
+func (w *WorkingNamespaceMapper) stopMapper(namespace string, config *mapperConfiguration) {
+	config.cancel()
+	config.shard.RemoveLogicalCluster()
+	w.lock.Lock()
+	delete(w.logicalClusterMapper, namespace)
+	w.lock.Unlock()
+	w.fairQueue.Forget(namespace)
+}
+
+func (w *WorkingNamespaceMapper) startMapper(
+	ctx context.Context, namespace string, kcpShard *shard.Shard, boundHubs []*hub.Hub) (context.CancelFunc, error) {
+	currentCtx, stopFunc := context.WithCancel(ctx)
+
+	scopes := []*hub.Scope{}
+	for _, h := range boundHubs {
+		scope := h.NewScope(namespace)
+		scope.DeletePolicy = w.deletePolicy
+		scope.AuthorizeCreators = w.creatorWebhook != nil
+		if w.creatorWebhook != nil {
+			scope.CreatorKey = w.creatorWebhook.Key()
+		}
+		scopes = append(scopes, scope)
+	}
+
+	kcpRestConfig := kcpShard.LogicalClusterConfig(namespace)
+	kubeClient, err := kubernetes.NewForConfig(kcpRestConfig)
+
+	if err != nil {
+		stopFunc()
+		return nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(kcpRestConfig)
+	if err != nil {
+		stopFunc()
+		return nil, err
+	}
+
+	// Install the APIs published by kcp-ocm into the logical cluster
+	if err := manifests.ApplyCRDs(ctx, dynamicClient, manifests.ManagedClusterInventoryCRD, manifests.ClusterOverrideCRD, manifests.DeliveryPolicyCRD); err != nil {
+		stopFunc()
+		return nil, err
 	}
 
 	kubeInformer := informers.NewSharedInformerFactory(kubeClient, 5*time.Minute)
+	dynamicInformer := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 5*time.Minute)
+	overrider := override.NewOverrider(dynamicInformer.ForResource(override.ClusterOverrideGVR))
+	validator := policy.NewValidator(dynamicInformer.ForResource(policy.DeliveryPolicyGVR), dynamicClient)
 
 	splitterController := splitter.NewDeploymentSplitter(
-		w.clusterClient,
-		w.manifestWorkClient.WorkV1(),
 		namespace,
+		kubeClient,
 		kubeInformer.Apps().V1().Deployments(),
-		clusterInformerFactory.Cluster().V1alpha1().Placements(),
-		clusterInformerFactory.Cluster().V1alpha1().PlacementDecisions(),
-		workInformerFactory.Work().V1().ManifestWorks(),
+		kubeInformer.Autoscaling().V2beta2().HorizontalPodAutoscalers(),
+		// The status reporter is delivered with the API probe
+		len(w.apiProbeImage) > 0,
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
 		w.recorder)
 
+	hpaSplitter := splitter.NewHPASplitter(
+		namespace,
+		kubeInformer.Autoscaling().V2beta2().HorizontalPodAutoscalers(),
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
+		w.recorder,
+	)
+
+	pdbSplitter := splitter.NewPDBSplitter(
+		namespace,
+		kubeInformer.Policy().V1().PodDisruptionBudgets(),
+		kubeInformer.Apps().V1().Deployments(),
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
+		w.recorder,
+	)
+
+	pvcSplitter := splitter.NewPVCSplitter(
+		namespace,
+		kubeInformer.Core().V1().PersistentVolumeClaims(),
+		kubeInformer.Apps().V1().Deployments(),
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
+		w.recorder,
+	)
+
 	nsPropagator := propagator.NewNamespacePropagator(
-		w.manifestWorkClient.WorkV1(),
 		namespace,
 		kubeInformer.Core().V1().Namespaces(),
-		workInformerFactory.Work().V1().ManifestWorks(),
-		clusterInformerFactory.Cluster().V1alpha1().Placements(),
-		clusterInformerFactory.Cluster().V1alpha1().PlacementDecisions(),
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
+		w.recorder,
+	)
+
+	rbacPropagator := propagator.NewRBACPropagator(
+		namespace,
+		kubeInformer.Rbac().V1().Roles(),
+		kubeInformer.Rbac().V1().RoleBindings(),
+		kubeInformer.Core().V1().ServiceAccounts(),
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
 		w.recorder,
 	)
 
-	go workInformerFactory.Start(currentCtx.Done())
-	go clusterInformerFactory.Start(currentCtx.Done())
+	inventoryController := inventory.NewInventoryController(
+		namespace,
+		dynamicClient,
+		dynamicInformer.ForResource(inventory.InventoryGVR),
+		scopes,
+		w.fairQueue,
+		w.recorder,
+	)
+
+	crdPropagator := propagator.NewCRDPropagator(
+		namespace,
+		dynamicClient,
+		dynamicInformer,
+		scopes,
+		overrider,
+		validator,
+		w.fairQueue,
+		w.recorder,
+	)
+
+	// Secrets are delivered only when they are sealed
+	if w.sealer != nil {
+		secretPropagator := propagator.NewSecretPropagator(
+			namespace,
+			kubeInformer.Core().V1().Secrets(),
+			scopes,
+			w.sealer,
+			overrider,
+			validator,
+			w.fairQueue,
+			w.recorder,
+		)
+		go secretPropagator.Run(currentCtx, w.workers)
+	}
+
+	// The creators are only trusted when signed by the webhook recording them
+	if w.creatorWebhook != nil {
+		creatorWebhookController := admission.NewCreatorWebhookController(
+			namespace,
+			kubeClient,
+			dynamicInformer.ForResource(manifests.CustomResourceDefinitionGVR),
+			w.creatorWebhook,
+			w.fairQueue,
+			w.recorder,
+		)
+		go creatorWebhookController.Run(currentCtx, 1)
+	}
+
+	// The API negotiation runs only when the image of the probe is set
+	if len(w.apiProbeImage) > 0 {
+		apiNegotiator := negotiation.NewAPINegotiator(
+			namespace,
+			dynamicClient,
+			dynamicInformer.ForResource(manifests.CustomResourceDefinitionGVR),
+			scopes,
+			w.apiProbeImage,
+			w.fairQueue,
+			w.recorder,
+		)
+		go apiNegotiator.Run(currentCtx, 1)
+	}
+
+	for _, scope := range scopes {
+		scope.Start(currentCtx.Done())
+	}
 	go kubeInformer.Start(currentCtx.Done())
-	go splitterController.Run(currentCtx, 1)
-	go nsPropagator.Run(currentCtx, 1)
+	go dynamicInformer.Start(currentCtx.Done())
+	go splitterController.Run(currentCtx, w.workers)
+	go hpaSplitter.Run(currentCtx, w.workers)
+	go pdbSplitter.Run(currentCtx, w.workers)
+	go pvcSplitter.Run(currentCtx, w.workers)
+	go nsPropagator.Run(currentCtx, w.workers)
+	go rbacPropagator.Run(currentCtx, w.workers)
+	go inventoryController.Run(currentCtx, 1)
+	go crdPropagator.Run(currentCtx, 1)
 
 	return stopFunc, nil
 }
@@ -2,26 +2,51 @@ package controllers
 
 import (
 	"context"
+	"os"
 	"time"
 
 	"github.com/spf13/cobra"
-	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
+	"github.com/qiujian16/kcp-ocm/pkg/admission"
 	"github.com/qiujian16/kcp-ocm/pkg/controllers/logicalcluster"
-	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
-	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
-	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/membership"
+	"github.com/qiujian16/kcp-ocm/pkg/secret"
+	"github.com/qiujian16/kcp-ocm/pkg/shard"
 )
 
 // OCMManagerOptions defines the flags for ocm manager
 type OCMManagerOptions struct {
-	KCPBaseKubeConfig string
+	KCPBaseKubeConfig     string
+	KCPShardConfig        string
+	HubConfig             string
+	MapperWorkers         int
+	LogicalClusterWorkers int
+	MaxConcurrentSyncs    int
+	APIProbeImage         string
+	DeletePolicy          string
+	AuthorizeCreators     bool
+	CreatorWebhookURL     string
+	CreatorWebhookCertDir string
+	CreatorWebhookPort    int
+	SecretMode            string
+	SecretStore           string
+	ShardedReplicas       bool
+	GCInterval            time.Duration
+	GCDryRun              bool
 }
 
 // NewWorkloadAgentOptions returns the flags with default value set
 func NewOCMManagerOptions() *OCMManagerOptions {
-	return &OCMManagerOptions{}
+	return &OCMManagerOptions{
+		MapperWorkers:         1,
+		LogicalClusterWorkers: 1,
+		SecretStore:           "kcp-ocm",
+		CreatorWebhookPort:    9443,
+		GCInterval:            10 * time.Minute,
+	}
 }
 
 // AddFlags register and binds the default flags
@@ -29,37 +54,124 @@ func (o *OCMManagerOptions) AddFlags(cmd *cobra.Command) {
 	flags := cmd.Flags()
 	// This command only supports reading from config
 	flags.StringVar(&o.KCPBaseKubeConfig, "kcp-kubeconfig", o.KCPBaseKubeConfig, "Location of kubeconfig file to connect to kcp.")
+	flags.StringVar(&o.KCPShardConfig, "kcp-shard-config", o.KCPShardConfig,
+		"Location of the file listing the kcp shards with their kubeconfig, in addition to the default shard from --kcp-kubeconfig.")
+	flags.StringVar(&o.HubConfig, "hub-config", o.HubConfig,
+		"Location of the file listing additional OCM hubs with their kubeconfig, the hub kcp-ocm runs against is always used.")
+	flags.IntVar(&o.MapperWorkers, "mapper-workers", o.MapperWorkers, "Number of workers mapping logical clusters to working namespaces.")
+	flags.IntVar(&o.LogicalClusterWorkers, "logical-cluster-workers", o.LogicalClusterWorkers,
+		"Number of workers of each controller in a logical cluster, also the max number of concurrent syncs of each of these controllers.")
+	flags.IntVar(&o.MaxConcurrentSyncs, "max-concurrent-syncs", o.MaxConcurrentSyncs,
+		"Number of workers running the syncs of all logical clusters, which take turns on the workers, 0 runs the syncs on the workers of each controller with no shared limit.")
+	flags.StringVar(&o.APIProbeImage, "api-probe-image", o.APIProbeImage,
+		"Image with kubectl to probe the APIs served by managed clusters, the API negotiation is disabled if it is empty.")
+	flags.StringVar(&o.DeletePolicy, "delete-policy", o.DeletePolicy,
+		"Default delete policy of the resources propagated to managed clusters, one of Foreground, Orphan or SelectivelyOrphan. "+
+			"SelectivelyOrphan orphans the namespaces, persistent volumes, statefulsets and CRDs only.")
+	flags.BoolVar(&o.AuthorizeCreators, "authorize-creators", o.AuthorizeCreators,
+		"Deliver a kcp object to a managed cluster only if its creator is allowed to create ManifestWorks in the cluster namespace on the hub. "+
+			"The creator is recorded on the "+hub.CreatorAnnotation+" annotation by the creator webhook of kcp-ocm, which is registered in each logical cluster "+
+			"for the delivered resources, signs the creators and rejects the values set by users. The objects are admitted without a creator when "+
+			"the webhook is unreachable, and never delivered. It requires --creator-webhook-url and --creator-webhook-cert-dir.")
+	flags.StringVar(&o.CreatorWebhookURL, "creator-webhook-url", o.CreatorWebhookURL,
+		"URL kcp calls the creator webhook of kcp-ocm at.")
+	flags.StringVar(&o.CreatorWebhookCertDir, "creator-webhook-cert-dir", o.CreatorWebhookCertDir,
+		"Directory with the serving certificate of the creator webhook as tls.crt and tls.key, the CA bundle kcp verifies it with as ca.crt, "+
+			"and the key signing the creators as creator.key, which must be kept when the certificate is rotated.")
+	flags.IntVar(&o.CreatorWebhookPort, "creator-webhook-port", o.CreatorWebhookPort, "Port the creator webhook is served on.")
+	flags.StringVar(&o.SecretMode, "secret-mode", o.SecretMode,
+		"How the Secrets are delivered to managed clusters, the Secrets are not delivered if it is empty. "+
+			"Encrypt delivers them as EncryptedSecrets encrypted with the key in the "+secret.EncryptionKeyAnnotation+" annotation of the managed cluster, "+
+			"kcp-ocm does not ship the agent decrypting them into Secrets on the managed clusters, it must be installed separately. "+
+			"Reference delivers ExternalSecrets resolving them from the secret store on the managed cluster, kcp-ocm does not write the Secrets "+
+			"to the store, which must already hold their data.")
+	flags.StringVar(&o.SecretStore, "secret-store", o.SecretStore,
+		"Name of the ClusterSecretStore the ExternalSecrets refer to when the secret mode is Reference.")
+	flags.BoolVar(&o.ShardedReplicas, "sharded-replicas", o.ShardedReplicas,
+		"Run all the replicas active with the logical clusters sharded across them by consistent hashing, instead of a single leader. "+
+			"The replicas join with a lease on the hub, named after the host name, and the logical clusters are rebalanced when a replica joins or dies.")
+	flags.DurationVar(&o.GCInterval, "gc-interval", o.GCInterval,
+		"Interval of the garbage collection of the ManifestWorks and Placements whose kcp objects or logical clusters are gone, "+
+			"it also runs on startup. 0 disables the garbage collection.")
+	flags.BoolVar(&o.GCDryRun, "gc-dry-run", o.GCDryRun,
+		"Only report the orphaned ManifestWorks and Placements found by the garbage collection, with logs and events, instead of deleting them.")
 }
 
 // RunWorkloadAgent starts the controllers on agent to process work from hub.
 func (o *OCMManagerOptions) RunManager(ctx context.Context, controllerContext *controllercmd.ControllerContext) error {
-	clusterClient, err := clusterclient.NewForConfig(controllerContext.KubeConfig)
-	if err != nil {
+	if err := helpers.ValidateDeletePolicy(o.DeletePolicy); err != nil {
+		return err
+	}
+
+	if err := secret.ValidateMode(o.SecretMode); err != nil {
 		return err
 	}
 
-	workClient, err := workclient.NewForConfig(controllerContext.KubeConfig)
+	// Creators are never authorized from annotations kcp-ocm has not recorded itself
+	var creatorWebhook *admission.CreatorWebhook
+	if o.AuthorizeCreators {
+		var err error
+		if creatorWebhook, err = admission.NewCreatorWebhook(o.CreatorWebhookURL, o.CreatorWebhookCertDir, o.CreatorWebhookPort); err != nil {
+			return err
+		}
+		if err := creatorWebhook.Start(ctx); err != nil {
+			return err
+		}
+	}
+
+	hubs, err := hub.NewRegistry(controllerContext.KubeConfig, o.HubConfig)
 	if err != nil {
 		return err
 	}
 
-	clusterInformerFactory := clusterinformers.NewSharedInformerFactory(clusterClient, 5*time.Minute)
+	var sealer *secret.Sealer
+	if len(o.SecretMode) > 0 {
+		sealer, err = secret.NewSealer(ctx, hubs.Get(hub.DefaultHubName).KubeClient, controllerContext.OperatorNamespace, o.SecretMode, o.SecretStore)
+		if err != nil {
+			return err
+		}
+	}
 
-	kcpRestConfig, err := clientcmd.BuildConfigFromFlags("", o.KCPBaseKubeConfig)
+	kcpShards, err := shard.NewRegistry(o.KCPBaseKubeConfig, o.KCPShardConfig)
 	if err != nil {
 		return err
 	}
 
+	var replicas *membership.Membership
+	if o.ShardedReplicas {
+		identity, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		replicas = membership.NewMembership(hubs.Get(hub.DefaultHubName).KubeClient, controllerContext.OperatorNamespace, identity)
+		if err := replicas.Start(ctx); err != nil {
+			return err
+		}
+	}
+
+	fairQueue := helpers.NewFairShareQueue(o.MaxConcurrentSyncs, o.LogicalClusterWorkers)
 	controller := logicalcluster.NewWorkingNamespaceMapper(
-		clusterClient,
-		workClient,
-		kcpRestConfig,
-		clusterInformerFactory.Cluster().V1alpha1().ManagedClusterSetBindings(),
+		hubs,
+		kcpShards,
+		o.LogicalClusterWorkers,
+		o.APIProbeImage,
+		o.DeletePolicy,
+		creatorWebhook,
+		sealer,
+		replicas,
+		fairQueue,
 		controllerContext.EventRecorder,
 	)
 
-	go clusterInformerFactory.Start(ctx.Done())
-	go controller.Run(ctx, 1)
+	hubs.Start(ctx)
+	kcpShards.Start(ctx, 30*time.Second)
+	go fairQueue.Run(ctx)
+	go controller.Run(ctx, o.MapperWorkers)
+
+	if o.GCInterval > 0 {
+		gc := logicalcluster.NewGarbageCollector(hubs, kcpShards, replicas, o.GCDryRun, o.GCInterval, controllerContext.EventRecorder)
+		go gc.Run(ctx, 1)
+	}
 
 	<-ctx.Done()
 	return nil
@@ -0,0 +1,395 @@
+package negotiation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/manifests"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// probeWorkName is the work of the probe shared by all the logical clusters bound to a cluster, the
+	// probe reports cluster wide facts and installs cluster scoped resources.
+	probeWorkName = "kcp-api-probe"
+	probeLabel    = "kcp.open-cluster-management.io/api-probe"
+
+	// negotiatedLabel is set on the CRDs published by the negotiation, CRDs without it are never changed
+	negotiatedLabel             = "kcp.open-cluster-management.io/negotiated"
+	supportedClustersAnnotation = "kcp.open-cluster-management.io/supported-clusters"
+	unsupportedAnnotation       = "kcp.open-cluster-management.io/unsupported"
+
+	// apiApprovedAnnotation is required on the CRDs of the groups reserved to Kubernetes
+	apiApprovedAnnotation = "api-approved.kubernetes.io"
+	apiApprovedValue      = "unapproved, negotiated from the APIs served by the managed clusters"
+)
+
+// excludedGroups are the APIs served natively by the clusters and the APIs of the cluster
+// infrastructure, which make no sense in a logical cluster
+var excludedGroups = helpers.BuiltInGroups.Union(sets.NewString("apiregistration.k8s.io", "metrics.k8s.io"))
+
+type apiNegotiator struct {
+	kcpClient        dynamic.Interface
+	crdLister        cache.GenericLister
+	hubs             []*hub.Scope
+	workingNamespace string
+	probeImage       string
+}
+
+// NewAPINegotiator delivers an API probe to the clusters bound to the working namespace, and publishes
+// the API resources served by all of them as CRDs into the logical cluster.
+//
+// The probe reports the served resources and the top level fields of their spec as ClusterClaims, the
+// published CRDs only keep the spec fields of the same type on all the clusters.
+func NewAPINegotiator(
+	namespace string,
+	kcpClient dynamic.Interface,
+	crdInformer informers.GenericInformer,
+	hubs []*hub.Scope,
+	probeImage string,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &apiNegotiator{
+		kcpClient:        kcpClient,
+		crdLister:        crdInformer.Lister(),
+		hubs:             hubs,
+		workingNamespace: namespace,
+		probeImage:       probeImage,
+	}
+
+	f := factory.New().
+		WithFilteredEventsInformers(func(obj interface{}) bool {
+			accessor, _ := meta.Accessor(obj)
+			_, ok := accessor.GetLabels()[negotiatedLabel]
+			return ok
+		}, crdInformer.Informer())
+
+	for _, scope := range hubs {
+		f = f.WithFilteredEventsInformers(func(obj interface{}) bool {
+			accessor, _ := meta.Accessor(obj)
+			return accessor.GetNamespace() == namespace
+		}, scope.ManagedClusterSetBindings()).
+			WithFilteredEventsInformers(func(obj interface{}) bool {
+				accessor, _ := meta.Accessor(obj)
+				_, ok := accessor.GetLabels()[probeLabel]
+				return ok
+			}, scope.ManifestWorks().Informer()).
+			WithInformers(scope.ManagedClusters())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "api-negotiator", c.sync)).ToController("api-negotiator", recorder)
+}
+
+func (c *apiNegotiator) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("api-negotiator %s sync", c.workingNamespace)
+
+	probe, err := c.probeWork()
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	var common map[apiResource]sets.String
+	var schemas map[string]specFields
+	reported := sets.NewString()
+	for _, scope := range c.hubs {
+		clusters, err := scope.BoundClusters()
+		if err != nil {
+			return err
+		}
+
+		for _, cluster := range clusters {
+			work := probe.DeepCopy()
+			work.Namespace = cluster.Name
+			if err := helpers.ApplyWork(ctx, scope.WorkClient(), work); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			// Clusters are negotiated only after the probe reports their APIs
+			served := servedAPIs(cluster)
+			if len(served) == 0 {
+				continue
+			}
+			reported.Insert(hub.ClusterKey(scope.Hub.Name, cluster.Name))
+
+			clusterSchemas := probedSchemas(cluster)
+			if common == nil {
+				common = served
+				schemas = clusterSchemas
+				continue
+			}
+			common = intersect(common, served)
+			schemas = intersectSchemas(schemas, clusterSchemas)
+		}
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	if err := c.cleanProbes(ctx); err != nil {
+		return err
+	}
+
+	if reported.Len() == 0 {
+		return nil
+	}
+
+	return c.publish(ctx, syncCtx.Recorder(), common, schemas, reported)
+}
+
+// cleanProbes deletes the probes on the clusters that are no longer bound to any logical cluster
+func (c *apiNegotiator) cleanProbes(ctx context.Context) error {
+	errs := []error{}
+	for _, scope := range c.hubs {
+		works, err := scope.ManifestWorks().Lister().List(labels.SelectorFromSet(labels.Set{probeLabel: "true"}))
+		if err != nil {
+			return err
+		}
+		if len(works) == 0 {
+			continue
+		}
+
+		bound, err := scope.Hub.BoundClusterNames()
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if !SharedProbe(work) || bound.Has(work.Namespace) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// SharedProbe returns whether the work is the probe shared by the logical clusters bound to the cluster
+func SharedProbe(work *workapiv1.ManifestWork) bool {
+	return work.Name == probeWorkName && work.Labels[probeLabel] == "true"
+}
+
+func (c *apiNegotiator) probeWork() (*workapiv1.ManifestWork, error) {
+	objs, err := manifests.APIProbeManifests(c.probeImage)
+	if err != nil {
+		return nil, err
+	}
+
+	work := &workapiv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: probeWorkName,
+			Labels: map[string]string{
+				probeLabel: "true",
+			},
+		},
+	}
+	for _, obj := range objs {
+		work.Spec.Workload.Manifests = append(work.Spec.Workload.Manifests, workapiv1.Manifest{
+			RawExtension: runtime.RawExtension{Object: obj},
+		})
+	}
+	return work, nil
+}
+
+// publish creates or updates the negotiated CRDs, CRDs no longer supported by all clusters are
+// only marked since deleting a CRD deletes all its instances.
+func (c *apiNegotiator) publish(
+	ctx context.Context, recorder events.Recorder, common map[apiResource]sets.String, schemas map[string]specFields, reported sets.String) error {
+	client := c.kcpClient.Resource(manifests.CustomResourceDefinitionGVR)
+	supported := strings.Join(reported.List(), ",")
+
+	errs := []error{}
+	desired := sets.NewString()
+	for api, versions := range common {
+		required := buildCRD(api, versions, schemas, supported)
+		desired.Insert(required.GetName())
+
+		obj, err := c.crdLister.Get(required.GetName())
+		switch {
+		case errors.IsNotFound(err):
+			if _, err := client.Create(ctx, required, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+				errs = append(errs, err)
+			}
+			continue
+		case err != nil:
+			errs = append(errs, err)
+			continue
+		}
+
+		existing, ok := obj.(*unstructured.Unstructured)
+		if !ok || existing.GetLabels()[negotiatedLabel] != "true" {
+			continue
+		}
+
+		annotations := existing.GetAnnotations()
+		if helpers.FieldsEqual(existing.Object["spec"], required.Object["spec"]) &&
+			annotations[supportedClustersAnnotation] == supported && annotations[unsupportedAnnotation] != "true" &&
+			annotations[apiApprovedAnnotation] == required.GetAnnotations()[apiApprovedAnnotation] {
+			continue
+		}
+
+		updated := existing.DeepCopy()
+		updated.Object["spec"] = required.Object["spec"]
+		annotations = updated.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for key, value := range required.GetAnnotations() {
+			annotations[key] = value
+		}
+		delete(annotations, unsupportedAnnotation)
+		updated.SetAnnotations(annotations)
+		if _, err := client.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	objs, err := c.crdLister.List(negotiatedSelector())
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		existing, ok := obj.(*unstructured.Unstructured)
+		if !ok || desired.Has(existing.GetName()) || existing.GetAnnotations()[unsupportedAnnotation] == "true" {
+			continue
+		}
+
+		recorder.Warningf("APIUnsupported", "API %s is no longer served by all the clusters %s", existing.GetName(), supported)
+		updated := existing.DeepCopy()
+		annotations := updated.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[unsupportedAnnotation] = "true"
+		updated.SetAnnotations(annotations)
+		if _, err := client.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func negotiatedSelector() labels.Selector {
+	return labels.SelectorFromSet(labels.Set{negotiatedLabel: "true"})
+}
+
+// servedAPIs returns the versions of the resources served by the cluster that can be published
+func servedAPIs(cluster *clusterapiv1.ManagedCluster) map[apiResource]sets.String {
+	served := map[apiResource]sets.String{}
+	for _, api := range probedAPIs(cluster) {
+		if excludedGroups.Has(api.group) || strings.HasSuffix(api.group, "open-cluster-management.io") {
+			continue
+		}
+
+		if _, ok := served[api.apiResource]; !ok {
+			served[api.apiResource] = sets.NewString()
+		}
+		served[api.apiResource].Insert(api.version)
+	}
+	return served
+}
+
+// intersect keeps the resources with the same kind and scope on both sides, and the versions served by both
+func intersect(left, right map[apiResource]sets.String) map[apiResource]sets.String {
+	common := map[apiResource]sets.String{}
+	for api, versions := range left {
+		otherVersions, ok := right[api]
+		if !ok {
+			continue
+		}
+		if shared := versions.Intersection(otherVersions); shared.Len() > 0 {
+			common[api] = shared
+		}
+	}
+	return common
+}
+
+// buildCRD returns the CRD of the resource, the versions without a schema known on all the clusters
+// preserve unknown fields.
+func buildCRD(api apiResource, versions sets.String, schemas map[string]specFields, supported string) *unstructured.Unstructured {
+	sorted := versions.List()
+	sort.Slice(sorted, func(i, j int) bool {
+		return version.CompareKubeAwareVersionStrings(sorted[i], sorted[j]) > 0
+	})
+
+	crdVersions := []interface{}{}
+	for i, v := range sorted {
+		schema := map[string]interface{}{
+			"type":                                 "object",
+			"x-kubernetes-preserve-unknown-fields": true,
+		}
+		if fields, ok := schemas[schemaKey(api.group, v, api.resource)]; ok {
+			schema = specSchema(fields)
+		}
+
+		crdVersions = append(crdVersions, map[string]interface{}{
+			"name":    v,
+			"served":  true,
+			"storage": i == 0,
+			"schema": map[string]interface{}{
+				"openAPIV3Schema": schema,
+			},
+		})
+	}
+
+	crd := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": manifests.CustomResourceDefinitionGVR.GroupVersion().String(),
+			"kind":       "CustomResourceDefinition",
+			"spec": map[string]interface{}{
+				"group": api.group,
+				"names": map[string]interface{}{
+					"kind":     api.kind,
+					"listKind": api.kind + "List",
+					"plural":   api.resource,
+					"singular": strings.ToLower(api.kind),
+				},
+				"scope":    api.scope,
+				"versions": crdVersions,
+			},
+		},
+	}
+	crd.SetName(fmt.Sprintf("%s.%s", api.resource, api.group))
+	crd.SetLabels(map[string]string{negotiatedLabel: "true"})
+	annotations := map[string]string{supportedClustersAnnotation: supported}
+	if protectedGroup(api.group) {
+		annotations[apiApprovedAnnotation] = apiApprovedValue
+	}
+	crd.SetAnnotations(annotations)
+	return crd
+}
+
+// protectedGroup returns whether the group is reserved to Kubernetes, the apiserver only accepts
+// CRDs in these groups with the api-approved annotation.
+func protectedGroup(group string) bool {
+	return group == "k8s.io" || group == "kubernetes.io" ||
+		strings.HasSuffix(group, ".k8s.io") || strings.HasSuffix(group, ".kubernetes.io")
+}
@@ -0,0 +1,187 @@
+package negotiation
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// fakeWorkClient records the deleted works
+type fakeWorkClient struct {
+	workclient.Interface
+	workv1client.WorkV1Interface
+	deleted []string
+}
+
+func (c *fakeWorkClient) WorkV1() workv1client.WorkV1Interface {
+	return c
+}
+
+func (c *fakeWorkClient) ManifestWorks(namespace string) workv1client.ManifestWorkInterface {
+	return &fakeManifestWorks{client: c, namespace: namespace}
+}
+
+type fakeManifestWorks struct {
+	workv1client.ManifestWorkInterface
+	client    *fakeWorkClient
+	namespace string
+}
+
+func (w *fakeManifestWorks) Delete(_ context.Context, name string, _ metav1.DeleteOptions) error {
+	w.client.deleted = append(w.client.deleted, w.namespace+"/"+name)
+	return nil
+}
+
+func TestCleanProbes(t *testing.T) {
+	informers := clusterinformers.NewSharedInformerFactory(nil, 0)
+	// cluster1 is bound to the working namespace, cluster2 to another one and cluster3 to none
+	for _, binding := range []*clusterapiv1alpha1.ManagedClusterSetBinding{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ws1", Name: "set1"}, Spec: clusterapiv1alpha1.ManagedClusterSetBindingSpec{ClusterSet: "set1"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ws2", Name: "set2"}, Spec: clusterapiv1alpha1.ManagedClusterSetBindingSpec{ClusterSet: "set2"}},
+	} {
+		if err := informers.Cluster().V1alpha1().ManagedClusterSetBindings().Informer().GetIndexer().Add(binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, clusterSet := range map[string]string{"cluster1": "set1", "cluster2": "set2", "cluster3": "set3"} {
+		cluster := &clusterapiv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Labels: map[string]string{hub.ClusterSetLabel: clusterSet},
+		}}
+		if err := informers.Cluster().V1().ManagedClusters().Informer().GetIndexer().Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	workClient := &fakeWorkClient{}
+	scope := (&hub.Hub{Name: "hub", ClusterInformers: informers, WorkClient: workClient}).NewScope("ws1")
+	c := &apiNegotiator{hubs: []*hub.Scope{scope}, workingNamespace: "ws1"}
+	for _, cluster := range []string{"cluster1", "cluster2", "cluster3"} {
+		probe, err := c.probeWork()
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe.Namespace = cluster
+		if err := scope.ManifestWorks().Informer().GetIndexer().Add(probe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "cluster3", Name: "other", Labels: map[string]string{probeLabel: "true"},
+	}}
+	if err := scope.ManifestWorks().Informer().GetIndexer().Add(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.cleanProbes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(workClient.deleted)
+	if expected := []string{"cluster3/" + probeWorkName}; !reflect.DeepEqual(workClient.deleted, expected) {
+		t.Errorf("expected deleted works %v, got %v", expected, workClient.deleted)
+	}
+}
+
+func TestServedAPIs(t *testing.T) {
+	cluster := newProbedCluster(chunkedClaims(t, apiClaimSuffix, 1000,
+		"core/v1/configmaps/ConfigMap/Namespaced",
+		"metrics.k8s.io/v1beta1/pods/PodMetrics/Namespaced",
+		"work.open-cluster-management.io/v1/appliedmanifestworks/AppliedManifestWork/Cluster",
+		"example.com/v1/widgets/Widget/Namespaced",
+		"example.com/v1beta1/widgets/Widget/Namespaced",
+	)...)
+
+	expected := map[apiResource]sets.String{
+		{group: "example.com", resource: "widgets", kind: "Widget", scope: "Namespaced"}: sets.NewString("v1", "v1beta1"),
+	}
+	if served := servedAPIs(cluster); !reflect.DeepEqual(served, expected) {
+		t.Errorf("expected %v, got %v", expected, served)
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	widget := apiResource{group: "example.com", resource: "widgets", kind: "Widget", scope: "Namespaced"}
+	clusterWidget := apiResource{group: "example.com", resource: "widgets", kind: "Widget", scope: "Cluster"}
+	gadget := apiResource{group: "example.com", resource: "gadgets", kind: "Gadget", scope: "Namespaced"}
+
+	left := map[apiResource]sets.String{
+		widget: sets.NewString("v1", "v1beta1"),
+		gadget: sets.NewString("v1"),
+	}
+	right := map[apiResource]sets.String{
+		widget:        sets.NewString("v1beta1", "v2"),
+		clusterWidget: sets.NewString("v1"),
+		gadget:        sets.NewString("v2"),
+	}
+
+	expected := map[apiResource]sets.String{widget: sets.NewString("v1beta1")}
+	if common := intersect(left, right); !reflect.DeepEqual(common, expected) {
+		t.Errorf("expected %v, got %v", expected, common)
+	}
+}
+
+func TestBuildCRD(t *testing.T) {
+	cases := []struct {
+		name             string
+		api              apiResource
+		versions         sets.String
+		schemas          map[string]specFields
+		expectedStorage  string
+		expectedApproved bool
+	}{
+		{
+			name:            "newest version is stored",
+			api:             apiResource{group: "example.com", resource: "widgets", kind: "Widget", scope: "Namespaced"},
+			versions:        sets.NewString("v1beta1", "v1", "v1alpha1"),
+			schemas:         map[string]specFields{"example.com/v1/widgets": {"size": "integer"}},
+			expectedStorage: "v1",
+		},
+		{
+			name:             "protected group",
+			api:              apiResource{group: "networking.k8s.io", resource: "gateways", kind: "Gateway", scope: "Namespaced"},
+			versions:         sets.NewString("v1alpha2"),
+			expectedStorage:  "v1alpha2",
+			expectedApproved: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			crd := buildCRD(c.api, c.versions, c.schemas, "hub/cluster1")
+			if crd.GetName() != c.api.resource+"."+c.api.group {
+				t.Errorf("unexpected name %s", crd.GetName())
+			}
+			if _, approved := crd.GetAnnotations()[apiApprovedAnnotation]; approved != c.expectedApproved {
+				t.Errorf("expected approved %v, got %v", c.expectedApproved, approved)
+			}
+
+			versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+			if len(versions) != c.versions.Len() {
+				t.Fatalf("expected %d versions, got %d", c.versions.Len(), len(versions))
+			}
+			for _, v := range versions {
+				version := v.(map[string]interface{})
+				if storage := version["storage"].(bool); storage != (version["name"] == c.expectedStorage) {
+					t.Errorf("unexpected storage %v of version %v", storage, version["name"])
+				}
+
+				_, preserved, _ := unstructured.NestedBool(version, "schema", "openAPIV3Schema", "x-kubernetes-preserve-unknown-fields")
+				_, known := c.schemas[schemaKey(c.api.group, version["name"].(string), c.api.resource)]
+				if preserved == known {
+					t.Errorf("expected version %v to preserve unknown fields only without a known schema", version["name"])
+				}
+			}
+		})
+	}
+}
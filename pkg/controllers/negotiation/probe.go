@@ -0,0 +1,180 @@
+package negotiation
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+const (
+	apiClaimSuffix    = ".apis.kcp.open-cluster-management.io"
+	schemaClaimSuffix = ".schemas.kcp.open-cluster-management.io"
+)
+
+// apiResource is a resource served by a managed cluster regardless of the version
+type apiResource struct {
+	group    string
+	resource string
+	kind     string
+	scope    string
+}
+
+// probedAPI is a version of a resource reported by the probe
+type probedAPI struct {
+	apiResource
+	version string
+}
+
+// specFields are the top level fields of the spec of a version of a resource with their types as
+// reported by kubectl explain, such as string, Object, []Object or map[string]string.
+type specFields map[string]string
+
+// probedAPIs decodes the API claims reported by the probe on the cluster. It returns nil if the claims
+// are missing or incomplete. The probe reports the core group as "core", it is the empty group here as
+// in discovery.
+func probedAPIs(cluster *clusterapiv1.ManagedCluster) []probedAPI {
+	lines, ok := helpers.ChunkedClaimLines(cluster, apiClaimSuffix)
+	if !ok {
+		return nil
+	}
+
+	apis := []probedAPI{}
+	for _, line := range lines {
+		// <group>/<version>/<resource>/<kind>/<scope>
+		parts := strings.Split(line, "/")
+		if len(parts) != 5 {
+			continue
+		}
+		apis = append(apis, probedAPI{
+			apiResource: apiResource{group: probedGroup(parts[0]), resource: parts[2], kind: parts[3], scope: parts[4]},
+			version:     parts[1],
+		})
+	}
+	return apis
+}
+
+// ServedResources returns the resources served by the cluster as <resource>.<group>, or false if the
+// probe has not reported all the APIs of the cluster.
+func ServedResources(cluster *clusterapiv1.ManagedCluster) (sets.String, bool) {
+	apis := probedAPIs(cluster)
+	if len(apis) == 0 {
+		return nil, false
+	}
+
+	resources := sets.NewString()
+	for _, api := range apis {
+		resources.Insert(fmt.Sprintf("%s.%s", api.resource, api.group))
+	}
+	return resources, true
+}
+
+// probedSchemas decodes the schema claims of the cluster by <group>/<version>/<resource>. It returns
+// nil if the claims are missing or incomplete.
+func probedSchemas(cluster *clusterapiv1.ManagedCluster) map[string]specFields {
+	lines, ok := helpers.ChunkedClaimLines(cluster, schemaClaimSuffix)
+	if !ok {
+		return nil
+	}
+
+	schemas := map[string]specFields{}
+	for _, line := range lines {
+		// <group>/<version>/<resource> <field>:<type>...
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+		gvr := strings.Split(parts[0], "/")
+		if len(gvr) != 3 {
+			continue
+		}
+
+		fields := specFields{}
+		for _, field := range parts[1:] {
+			nameType := strings.SplitN(field, ":", 2)
+			if len(nameType) == 2 {
+				fields[nameType[0]] = nameType[1]
+			}
+		}
+		schemas[schemaKey(probedGroup(gvr[0]), gvr[1], gvr[2])] = fields
+	}
+	return schemas
+}
+
+// intersectSchemas keeps the fields with the same type on both sides. The resources missing on a side
+// are dropped, since their fields are not known on all the clusters.
+func intersectSchemas(left, right map[string]specFields) map[string]specFields {
+	common := map[string]specFields{}
+	for key, fields := range left {
+		otherFields, ok := right[key]
+		if !ok {
+			continue
+		}
+
+		shared := specFields{}
+		for name, fieldType := range fields {
+			if otherFields[name] == fieldType {
+				shared[name] = fieldType
+			}
+		}
+		common[key] = shared
+	}
+	return common
+}
+
+// specSchema returns the OpenAPI schema of the resource with only the fields of the spec known on all
+// the clusters, the status is kept as reported by the clusters.
+func specSchema(fields specFields) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for name, fieldType := range fields {
+		properties[name] = fieldSchema(fieldType)
+	}
+
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"spec": map[string]interface{}{
+				"type":       "object",
+				"properties": properties,
+			},
+			"status": map[string]interface{}{
+				"type":                                 "object",
+				"x-kubernetes-preserve-unknown-fields": true,
+			},
+		},
+	}
+}
+
+// fieldSchema returns the schema of a field from its kubectl explain type, the fields of nested
+// objects and the fields of unknown types are preserved.
+func fieldSchema(fieldType string) map[string]interface{} {
+	switch {
+	case strings.HasPrefix(fieldType, "[]"):
+		return map[string]interface{}{
+			"type":  "array",
+			"items": fieldSchema(strings.TrimPrefix(fieldType, "[]")),
+		}
+	case fieldType == "Object" || strings.HasPrefix(fieldType, "map["):
+		return map[string]interface{}{
+			"type":                                 "object",
+			"x-kubernetes-preserve-unknown-fields": true,
+		}
+	case fieldType == "string" || fieldType == "integer" || fieldType == "number" || fieldType == "boolean":
+		return map[string]interface{}{"type": fieldType}
+	default:
+		return map[string]interface{}{"x-kubernetes-preserve-unknown-fields": true}
+	}
+}
+
+func schemaKey(group, version, resource string) string {
+	return fmt.Sprintf("%s/%s/%s", group, version, resource)
+}
+
+func probedGroup(group string) string {
+	if group == "core" {
+		return ""
+	}
+	return group
+}
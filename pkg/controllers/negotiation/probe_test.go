@@ -0,0 +1,120 @@
+package negotiation
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// chunkedClaims encodes the lines as the probe publishes them, in claims of at most size characters
+func chunkedClaims(t *testing.T, suffix string, size int, lines ...string) []clusterapiv1.ManagedClusterClaim {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	claims := []clusterapiv1.ManagedClusterClaim{}
+	for i := 0; len(encoded) > 0; i++ {
+		n := size
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		claims = append(claims, clusterapiv1.ManagedClusterClaim{Name: fmt.Sprintf("%d%s", i, suffix), Value: encoded[:n]})
+		encoded = encoded[n:]
+	}
+	return claims
+}
+
+func newProbedCluster(claims ...clusterapiv1.ManagedClusterClaim) *clusterapiv1.ManagedCluster {
+	cluster := &clusterapiv1.ManagedCluster{}
+	cluster.Name = "cluster1"
+	cluster.Status.ClusterClaims = claims
+	return cluster
+}
+
+func TestServedResources(t *testing.T) {
+	apis := chunkedClaims(t, apiClaimSuffix, 20,
+		"core/v1/configmaps/ConfigMap/Namespaced",
+		"apps/v1/deployments/Deployment/Namespaced",
+		"example.com/v1/widgets/Widget/Cluster",
+		"invalid",
+	)
+	if len(apis) < 3 {
+		t.Fatalf("expected the APIs in several claims, got %d", len(apis))
+	}
+
+	cases := []struct {
+		name       string
+		claims     []clusterapiv1.ManagedClusterClaim
+		expected   []string
+		expectedOK bool
+	}{
+		{
+			name:       "no claims",
+			expectedOK: false,
+		},
+		{
+			name:       "all claims",
+			claims:     apis,
+			expected:   []string{"configmaps.", "deployments.apps", "widgets.example.com"},
+			expectedOK: true,
+		},
+		{
+			name:       "missing claim",
+			claims:     append(append([]clusterapiv1.ManagedClusterClaim{}, apis[:1]...), apis[2:]...),
+			expectedOK: false,
+		},
+		{
+			name:       "last claim missing",
+			claims:     apis[:len(apis)-1],
+			expectedOK: false,
+		},
+		{
+			name:       "other claims",
+			claims:     append([]clusterapiv1.ManagedClusterClaim{{Name: "id.k8s.io", Value: "cluster1"}}, apis...),
+			expected:   []string{"configmaps.", "deployments.apps", "widgets.example.com"},
+			expectedOK: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			served, ok := ServedResources(newProbedCluster(c.claims...))
+			if ok != c.expectedOK {
+				t.Fatalf("expected ok %v, got %v", c.expectedOK, ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(served.List(), c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, served.List())
+			}
+		})
+	}
+}
+
+func TestProbedSchemas(t *testing.T) {
+	cluster := newProbedCluster(chunkedClaims(t, schemaClaimSuffix, 1000,
+		"apps/v1/deployments replicas:integer selector:Object template:Object",
+		"core/v1/services ports:[]Object",
+	)...)
+
+	expected := map[string]specFields{
+		"apps/v1/deployments": {"replicas": "integer", "selector": "Object", "template": "Object"},
+		"/v1/services":        {"ports": "[]Object"},
+	}
+	if schemas := probedSchemas(cluster); !reflect.DeepEqual(schemas, expected) {
+		t.Errorf("expected %v, got %v", expected, schemas)
+	}
+}
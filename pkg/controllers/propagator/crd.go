@@ -0,0 +1,665 @@
+package propagator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/controllers/negotiation"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/manifests"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	crdWorkName = "crd-syncer"
+	crWorkName  = "cr-syncer"
+
+	// crdSyncerLabel is set on the crd and cr works with the working namespace as the value
+	crdSyncerLabel        = "kcp.open-cluster-management.io/crd-syncer"
+	crdHashAnnotation     = "kcp.open-cluster-management.io/crd-hash"
+	crdConflictAnnotation = "kcp.open-cluster-management.io/crd-conflicts"
+	propagateAnnotation   = "kcp.open-cluster-management.io/propagate"
+
+	// negotiatedLabel is set on the CRDs negotiated from the APIs served by the managed clusters
+	negotiatedLabel = "kcp.open-cluster-management.io/negotiated"
+)
+
+type crdPropagator struct {
+	kcpClient        dynamic.Interface
+	crdLister        cache.GenericLister
+	hubs             []*hub.Scope
+	overrider        *override.Overrider
+	validator        *policy.Validator
+	workingNamespace string
+	syncCtx          factory.SyncContext
+
+	lock    sync.Mutex
+	watched map[schema.GroupVersionResource]*instanceWatch
+}
+
+// instanceWatch is the informer of the instances of a CRD, it is stopped when the CRD is deleted or
+// its storage version changes.
+type instanceWatch struct {
+	informer informers.GenericInformer
+	stop     context.CancelFunc
+}
+
+// NewCRDPropagator delivers the CRDs created in the logical cluster to the clusters decided by the
+// default placement, and the instances of those CRDs once the CRDs are applied on the clusters.
+func NewCRDPropagator(
+	namespace string,
+	kcpClient dynamic.Interface,
+	kcpInformers dynamicinformer.DynamicSharedInformerFactory,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	syncCtx := factory.NewSyncContext("crd-propagator", recorder)
+	c := &crdPropagator{
+		kcpClient:        kcpClient,
+		crdLister:        kcpInformers.ForResource(manifests.CustomResourceDefinitionGVR).Lister(),
+		hubs:             hubs,
+		overrider:        overrider,
+		validator:        validator,
+		workingNamespace: namespace,
+		syncCtx:          syncCtx,
+		watched:          map[schema.GroupVersionResource]*instanceWatch{},
+	}
+
+	f := factory.New().
+		WithSyncContext(syncCtx).
+		WithInformers(kcpInformers.ForResource(manifests.CustomResourceDefinitionGVR).Informer(), overrider.Informer(), validator.Informer())
+
+	for _, scope := range hubs {
+		placementLister := scope.Placements().Lister()
+		f = f.WithFilteredEventsInformers(func(obj interface{}) bool {
+			return decisionFilter(placementLister, obj)
+		}, scope.PlacementDecisions().Informer()).
+			WithFilteredEventsInformers(func(obj interface{}) bool {
+				accessor, _ := meta.Accessor(obj)
+				_, ok := accessor.GetLabels()[crdSyncerLabel]
+				return ok
+			}, scope.ManifestWorks().Informer()).
+			WithInformers(scope.ManagedClusters())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "crd-propagator", c.sync)).ToController("crd-propagator", recorder)
+}
+
+func (c *crdPropagator) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("crd-propagator %s sync", c.workingNamespace)
+
+	objs, err := c.crdLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	crds := []*unstructured.Unstructured{}
+	for _, obj := range objs {
+		crd, ok := obj.(*unstructured.Unstructured)
+		if !ok || !propagatable(crd) {
+			continue
+		}
+		crds = append(crds, crd)
+	}
+	sort.Slice(crds, func(i, j int) bool {
+		return crds[i].GetName() < crds[j].GetName()
+	})
+
+	// Instances are listed only when the informer of the CRD is synced
+	instances := map[string][]*unstructured.Unstructured{}
+	hashes := map[string]string{}
+	watched := map[schema.GroupVersionResource]bool{}
+	unsynced := false
+	for _, crd := range crds {
+		hashes[crd.GetName()] = crdHash(crd)
+
+		gvr, ok := storageResource(crd)
+		if !ok {
+			continue
+		}
+		watched[gvr] = true
+
+		crs, synced, err := c.instances(ctx, gvr)
+		if err != nil {
+			return err
+		}
+		if !synced {
+			unsynced = true
+			continue
+		}
+		instances[crd.GetName()] = crs
+	}
+	c.stopWatches(watched)
+
+	// The works are not built until the instances of all the CRDs are known, a work missing the
+	// instances of a CRD would delete them from the clusters.
+	if unsynced {
+		syncCtx.Queue().AddAfter(factory.DefaultQueueKey, 5*time.Second)
+		return nil
+	}
+
+	decisions, err := hub.DecisionsOf(c.hubs, defaultPlacement)
+	if err != nil {
+		return err
+	}
+
+	// The works on the drained clusters are not desired and are cleaned
+	decisions, _, draining, err := drainDecisions(decisions)
+	if err != nil {
+		return err
+	}
+	if draining {
+		syncCtx.Queue().AddAfter(factory.DefaultQueueKey, drainInterval)
+	}
+
+	errs := []error{}
+	desiredWorks := sets.NewString()
+	conflicts := map[string]sets.String{}
+	violations := policy.NewViolations()
+	for _, dec := range decisions {
+		conflicting, err := c.conflicts(dec, hashes)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for name := range conflicting {
+			if _, ok := conflicts[name]; !ok {
+				conflicts[name] = sets.NewString()
+			}
+			conflicts[name].Insert(dec.Key())
+		}
+
+		crdWork := c.newWork(crdWorkName, dec.ClusterName)
+		authorizedCRDs := sets.NewString()
+		authorizeErrs := []error{}
+		for _, crd := range crds {
+			if conflicting.Has(crd.GetName()) {
+				continue
+			}
+			allowed, err := dec.Scope.Authorize(ctx, crd, dec.ClusterName)
+			if err != nil {
+				authorizeErrs = append(authorizeErrs, err)
+				continue
+			}
+			if !allowed {
+				syncCtx.Recorder().Warningf("Unauthorized", "The creator of CRD %s is not allowed to deliver it to cluster %s",
+					crd.GetName(), dec.Key())
+				continue
+			}
+			authorizedCRDs.Insert(crd.GetName())
+			crdWork.Spec.Workload.Manifests = append(crdWork.Spec.Workload.Manifests, workapiv1.Manifest{
+				RawExtension: runtime.RawExtension{Object: cleanCRD(crd, hashes[crd.GetName()])},
+			})
+		}
+
+		// The work is not applied with a part of the CRDs, which would delete the others
+		if len(authorizeErrs) > 0 {
+			errs = append(errs, authorizeErrs...)
+			continue
+		}
+
+		if len(crdWork.Spec.Workload.Manifests) == 0 {
+			continue
+		}
+
+		if err := helpers.SetDeleteOption(crdWork, dec.Scope.DeletePolicy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		chunks, err := helpers.ApplyChunkedWork(ctx, dec.Scope.WorkClient(), dec.Scope.ManifestWorks().Lister(), crdWork)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, chunk := range chunks {
+			desiredWorks.Insert(workKey(dec.Scope, dec.ClusterName, chunk))
+		}
+
+		// The instances follow the CRD once the work agent reports the CRD is applied on the cluster
+		appliedCRDWorks, err := helpers.ChunkedWorks(dec.Scope.ManifestWorks().Lister(), dec.ClusterName, crdWork.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for name := range failedCRDs(appliedCRDWorks, authorizedCRDs) {
+			if _, ok := conflicts[name]; !ok {
+				conflicts[name] = sets.NewString()
+			}
+			conflicts[name].Insert(dec.Key())
+		}
+
+		crWork := c.newWork(crWorkName, dec.ClusterName)
+		deployedCRs, err := helpers.ChunkedWorks(dec.Scope.ManifestWorks().Lister(), dec.ClusterName, crWork.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		instanceErrs := []error{}
+		for _, crd := range crds {
+			if !authorizedCRDs.Has(crd.GetName()) {
+				continue
+			}
+			condition := helpers.FindChunkedManifestCondition(appliedCRDWorks, manifests.CustomResourceDefinitionGVR.Group, "CustomResourceDefinition", "", crd.GetName())
+			applied := helpers.IsManifestConditionTrue(condition, workapiv1.ManifestApplied)
+			gvr, _ := storageResource(crd)
+			for _, cr := range instances[crd.GetName()] {
+				// While the CRD is not applied the instances already delivered are kept as they are
+				if !applied {
+					if manifest, ok := helpers.DeployedManifest(deployedCRs, cr); ok {
+						crWork.Spec.Workload.Manifests = append(crWork.Spec.Workload.Manifests, manifest)
+					}
+					continue
+				}
+
+				allowed, err := dec.Scope.Authorize(ctx, cr, dec.ClusterName)
+				if err != nil {
+					instanceErrs = append(instanceErrs, err)
+					continue
+				}
+				if !allowed {
+					syncCtx.Recorder().Warningf("Unauthorized", "The creator of %s %s/%s is not allowed to deliver it to cluster %s",
+						cr.GetKind(), cr.GetNamespace(), cr.GetName(), dec.Key())
+					continue
+				}
+
+				overridden, err := c.overrider.Apply(dec, cleanInstance(cr))
+				if err != nil {
+					instanceErrs = append(instanceErrs, err)
+					continue
+				}
+
+				manifest, ok, err := compliantManifest(c.validator, violations, gvr, cr, dec, overridden, deployedCRs)
+				if err != nil {
+					instanceErrs = append(instanceErrs, err)
+					continue
+				}
+				if ok {
+					crWork.Spec.Workload.Manifests = append(crWork.Spec.Workload.Manifests, manifest)
+				}
+			}
+		}
+
+		// The work is not applied with a part of the instances, which would delete the others
+		if len(instanceErrs) > 0 {
+			errs = append(errs, instanceErrs...)
+			continue
+		}
+
+		if len(crWork.Spec.Workload.Manifests) == 0 {
+			continue
+		}
+
+		if err := helpers.SetDeleteOption(crWork, dec.Scope.DeletePolicy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		chunks, err = helpers.ApplyChunkedWork(ctx, dec.Scope.WorkClient(), dec.Scope.ManifestWorks().Lister(), crWork)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, chunk := range chunks {
+			desiredWorks.Insert(workKey(dec.Scope, dec.ClusterName, chunk))
+		}
+	}
+
+	if err := c.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	if err := c.recordConflicts(ctx, syncCtx.Recorder(), crds, conflicts); err != nil {
+		return err
+	}
+
+	return c.cleanWorks(ctx, desiredWorks)
+}
+
+func (c *crdPropagator) newWork(prefix, clusterName string) *workapiv1.ManifestWork {
+	work := &workapiv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%s", prefix, c.workingNamespace),
+			Namespace: clusterName,
+			Labels: map[string]string{
+				crdSyncerLabel: c.workingNamespace,
+			},
+		},
+		Spec: workapiv1.ManifestWorkSpec{
+			Workload: workapiv1.ManifestsTemplate{
+				Manifests: []workapiv1.Manifest{},
+			},
+		},
+	}
+	helpers.SetSource(work, helpers.Source{LogicalCluster: c.workingNamespace})
+	return work
+}
+
+// instances starts to watch the resource of a CRD if it is not watched yet and returns its
+// instances when the informer is synced.
+func (c *crdPropagator) instances(ctx context.Context, gvr schema.GroupVersionResource) ([]*unstructured.Unstructured, bool, error) {
+	c.lock.Lock()
+	watch, ok := c.watched[gvr]
+	if !ok {
+		informer := dynamicinformer.NewFilteredDynamicInformer(
+			c.kcpClient, gvr, metav1.NamespaceAll, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, nil)
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { c.syncCtx.Queue().Add(factory.DefaultQueueKey) },
+			UpdateFunc: func(interface{}, interface{}) { c.syncCtx.Queue().Add(factory.DefaultQueueKey) },
+			DeleteFunc: func(interface{}) { c.syncCtx.Queue().Add(factory.DefaultQueueKey) },
+		})
+
+		watchCtx, stop := context.WithCancel(ctx)
+		go informer.Informer().Run(watchCtx.Done())
+		watch = &instanceWatch{informer: informer, stop: stop}
+		c.watched[gvr] = watch
+	}
+	c.lock.Unlock()
+
+	informer := watch.informer
+	if !informer.Informer().HasSynced() {
+		return nil, false, nil
+	}
+
+	objs, err := informer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, false, err
+	}
+
+	crs := []*unstructured.Unstructured{}
+	for _, obj := range objs {
+		if cr, ok := obj.(*unstructured.Unstructured); ok {
+			crs = append(crs, cr)
+		}
+	}
+	sort.Slice(crs, func(i, j int) bool {
+		if crs[i].GetNamespace() != crs[j].GetNamespace() {
+			return crs[i].GetNamespace() < crs[j].GetNamespace()
+		}
+		return crs[i].GetName() < crs[j].GetName()
+	})
+	return crs, true, nil
+}
+
+// stopWatches stops the informers of the resources that are no longer the storage resource of a CRD
+func (c *crdPropagator) stopWatches(watched map[schema.GroupVersionResource]bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for gvr, watch := range c.watched {
+		if watched[gvr] {
+			continue
+		}
+		watch.stop()
+		delete(c.watched, gvr)
+	}
+}
+
+// conflicts returns the CRDs that cannot be delivered to the cluster, because the cluster already
+// gets a different version of the CRD from an older work of another logical cluster, or already
+// serves the resource of the CRD without any crd work, for instance from a CRD installed by its admin.
+func (c *crdPropagator) conflicts(dec hub.Decision, hashes map[string]string) (sets.String, error) {
+	conflicting := sets.NewString()
+
+	requirement, err := labels.NewRequirement(crdSyncerLabel, selection.Exists, []string{})
+	if err != nil {
+		return conflicting, err
+	}
+
+	works, err := dec.Scope.ManifestWorks().Lister().ManifestWorks(dec.ClusterName).List(labels.NewSelector().Add(*requirement))
+	if err != nil {
+		return conflicting, err
+	}
+
+	var own *workapiv1.ManifestWork
+	delivered := sets.NewString()
+	for _, work := range works {
+		if !strings.HasPrefix(work.Name, crdWorkName) {
+			continue
+		}
+		for _, manifest := range work.Spec.Workload.Manifests {
+			obj := &unstructured.Unstructured{}
+			if err := obj.UnmarshalJSON(manifest.Raw); err == nil && obj.GetKind() == "CustomResourceDefinition" {
+				delivered.Insert(obj.GetName())
+			}
+		}
+
+		if work.Labels[crdSyncerLabel] == c.workingNamespace && work.Name == c.newWork(crdWorkName, dec.ClusterName).Name {
+			own = work
+		}
+	}
+
+	for _, work := range works {
+		if work.Labels[crdSyncerLabel] == c.workingNamespace || !strings.HasPrefix(work.Name, crdWorkName) {
+			continue
+		}
+
+		// The first logical cluster delivering the CRD owns it on the cluster
+		if own != nil && own.CreationTimestamp.Before(&work.CreationTimestamp) {
+			continue
+		}
+
+		for _, manifest := range work.Spec.Workload.Manifests {
+			obj := &unstructured.Unstructured{}
+			if err := obj.UnmarshalJSON(manifest.Raw); err != nil {
+				continue
+			}
+			hash, ok := hashes[obj.GetName()]
+			if !ok || obj.GetKind() != "CustomResourceDefinition" {
+				continue
+			}
+			if obj.GetAnnotations()[crdHashAnnotation] != hash {
+				conflicting.Insert(obj.GetName())
+			}
+		}
+	}
+
+	// The name of a CRD is the <resource>.<group> it serves
+	cluster, err := dec.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(dec.ClusterName)
+	switch {
+	case errors.IsNotFound(err):
+		return conflicting, nil
+	case err != nil:
+		return conflicting, err
+	}
+	if served, ok := negotiation.ServedResources(cluster); ok {
+		for name := range hashes {
+			if served.Has(name) && !delivered.Has(name) {
+				conflicting.Insert(name)
+			}
+		}
+	}
+
+	return conflicting, nil
+}
+
+// failedCRDs returns the delivered CRDs the work agent fails to apply, for instance when the cluster has
+// an incompatible version of the CRD. They are only reported as conflicts, dropping them from the work
+// would delete the CRDs and their instances from the cluster.
+func failedCRDs(works []*workapiv1.ManifestWork, names sets.String) sets.String {
+	failed := sets.NewString()
+	for name := range names {
+		condition := helpers.FindChunkedManifestCondition(works, manifests.CustomResourceDefinitionGVR.Group, "CustomResourceDefinition", "", name)
+		if condition != nil && meta.IsStatusConditionFalse(condition.Conditions, string(workapiv1.ManifestApplied)) {
+			failed.Insert(name)
+		}
+	}
+	return failed
+}
+
+// recordConflicts annotates the CRDs in the logical cluster with the clusters they conflict on
+func (c *crdPropagator) recordConflicts(
+	ctx context.Context, recorder events.Recorder, crds []*unstructured.Unstructured, conflicts map[string]sets.String) error {
+	errs := []error{}
+	for _, crd := range crds {
+		clusters := ""
+		if conflict, ok := conflicts[crd.GetName()]; ok {
+			clusters = strings.Join(conflict.List(), ",")
+		}
+
+		if crd.GetAnnotations()[crdConflictAnnotation] == clusters {
+			continue
+		}
+
+		if len(clusters) > 0 {
+			recorder.Warningf("CRDConflict", "CRD %s conflicts with the version on clusters %s", crd.GetName(), clusters)
+		}
+
+		var patch []byte
+		if len(clusters) == 0 {
+			patch = []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, crdConflictAnnotation))
+		} else {
+			patch = []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, crdConflictAnnotation, clusters))
+		}
+
+		_, err := c.kcpClient.Resource(manifests.CustomResourceDefinitionGVR).Patch(
+			ctx, crd.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// cleanWorks removes the crd and cr works of the logical cluster that are no longer desired
+func (c *crdPropagator) cleanWorks(ctx context.Context, desiredWorks sets.String) error {
+	requirement, err := labels.NewRequirement(crdSyncerLabel, selection.Equals, []string{c.workingNamespace})
+	if err != nil {
+		return err
+	}
+	labelSelector := labels.NewSelector().Add(*requirement)
+
+	errs := []error{}
+	for _, scope := range c.hubs {
+		works, err := scope.ManifestWorks().Lister().List(labelSelector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if desiredWorks.Has(workKey(scope, work.Namespace, work.Name)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func workKey(scope *hub.Scope, clusterName, workName string) string {
+	return fmt.Sprintf("%s/%s", hub.ClusterKey(scope.Hub.Name, clusterName), workName)
+}
+
+// propagatable returns whether the CRD is defined by users of the logical cluster
+func propagatable(crd *unstructured.Unstructured) bool {
+	if crd.GetDeletionTimestamp() != nil || crd.GetAnnotations()[propagateAnnotation] == "false" {
+		return false
+	}
+
+	// Negotiated CRDs describe APIs the clusters already serve
+	if _, ok := crd.GetLabels()[negotiatedLabel]; ok {
+		return false
+	}
+
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	if helpers.BuiltInGroups.Has(group) || strings.HasSuffix(group, ".kcp.dev") || strings.HasSuffix(group, "open-cluster-management.io") {
+		return false
+	}
+
+	return true
+}
+
+// storageResource returns the resource of the storage version of the CRD
+func storageResource(crd *unstructured.Unstructured) (schema.GroupVersionResource, bool) {
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if storage, _ := version["storage"].(bool); !storage {
+			continue
+		}
+		name, _ := version["name"].(string)
+		return schema.GroupVersionResource{Group: group, Version: name, Resource: plural}, true
+	}
+
+	return schema.GroupVersionResource{}, false
+}
+
+func crdHash(crd *unstructured.Unstructured) string {
+	data, _ := json.Marshal(crd.Object["spec"])
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16]
+}
+
+// cleanCRD keeps the spec of the CRD and records its hash, so other logical clusters can detect conflicts
+func cleanCRD(crd *unstructured.Unstructured, hash string) *unstructured.Unstructured {
+	cleaned := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": crd.GetAPIVersion(),
+			"kind":       crd.GetKind(),
+			"spec":       crd.Object["spec"],
+		},
+	}
+	cleaned.SetName(crd.GetName())
+	cleaned.SetLabels(crd.GetLabels())
+	annotations := deletePolicyAnnotation(crd.GetAnnotations())
+	annotations[crdHashAnnotation] = hash
+	cleaned.SetAnnotations(annotations)
+	return cleaned
+}
+
+// cleanInstance drops the status and the server populated metadata of the custom resource
+func cleanInstance(cr *unstructured.Unstructured) *unstructured.Unstructured {
+	cleaned := cr.DeepCopy()
+	unstructured.RemoveNestedField(cleaned.Object, "status")
+	unstructured.RemoveNestedField(cleaned.Object, "metadata")
+	cleaned.SetName(cr.GetName())
+	cleaned.SetNamespace(cr.GetNamespace())
+	cleaned.SetLabels(cr.GetLabels())
+	cleaned.SetAnnotations(cr.GetAnnotations())
+	return cleaned
+}
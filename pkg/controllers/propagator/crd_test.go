@@ -0,0 +1,295 @@
+package propagator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/manifests"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+var widgetGVR = schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+
+// fakeWorkClient serves the works of the hub from a map, and records the writes and the written works
+type fakeWorkClient struct {
+	workclient.Interface
+	works   map[string]*workapiv1.ManifestWork
+	actions []string
+}
+
+func (c *fakeWorkClient) WorkV1() workv1client.WorkV1Interface {
+	return &fakeWorkV1{client: c}
+}
+
+type fakeWorkV1 struct {
+	workv1client.WorkV1Interface
+	client *fakeWorkClient
+}
+
+func (c *fakeWorkV1) ManifestWorks(namespace string) workv1client.ManifestWorkInterface {
+	return &fakeManifestWorks{client: c.client, namespace: namespace}
+}
+
+type fakeManifestWorks struct {
+	workv1client.ManifestWorkInterface
+	client    *fakeWorkClient
+	namespace string
+}
+
+func (w *fakeManifestWorks) Get(_ context.Context, name string, _ metav1.GetOptions) (*workapiv1.ManifestWork, error) {
+	work, ok := w.client.works[w.namespace+"/"+name]
+	if !ok {
+		return nil, errors.NewNotFound(workapiv1.Resource("manifestworks"), name)
+	}
+	return work.DeepCopy(), nil
+}
+
+func (w *fakeManifestWorks) List(_ context.Context, opts metav1.ListOptions) (*workapiv1.ManifestWorkList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &workapiv1.ManifestWorkList{}
+	for _, work := range w.client.works {
+		if work.Namespace == w.namespace && selector.Matches(labels.Set(work.Labels)) {
+			list.Items = append(list.Items, *work.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (w *fakeManifestWorks) Create(_ context.Context, work *workapiv1.ManifestWork, _ metav1.CreateOptions) (*workapiv1.ManifestWork, error) {
+	w.client.actions = append(w.client.actions, fmt.Sprintf("create %s/%s", w.namespace, work.Name))
+	w.client.works[w.namespace+"/"+work.Name] = work
+	return work, nil
+}
+
+func (w *fakeManifestWorks) Update(_ context.Context, work *workapiv1.ManifestWork, _ metav1.UpdateOptions) (*workapiv1.ManifestWork, error) {
+	w.client.actions = append(w.client.actions, fmt.Sprintf("update %s/%s", w.namespace, work.Name))
+	w.client.works[w.namespace+"/"+work.Name] = work
+	return work, nil
+}
+
+func (w *fakeManifestWorks) Delete(_ context.Context, name string, _ metav1.DeleteOptions) error {
+	w.client.actions = append(w.client.actions, fmt.Sprintf("delete %s/%s", w.namespace, name))
+	return nil
+}
+
+// fakeKCPClient records the patches of the CRDs in the logical cluster
+type fakeKCPClient struct {
+	dynamic.Interface
+	resource *fakeKCPResource
+}
+
+func (c *fakeKCPClient) Resource(schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return c.resource
+}
+
+type fakeKCPResource struct {
+	dynamic.NamespaceableResourceInterface
+	actions []string
+}
+
+func (r *fakeKCPResource) Patch(_ context.Context, name string, _ types.PatchType, _ []byte, _ metav1.PatchOptions, _ ...string) (*unstructured.Unstructured, error) {
+	r.actions = append(r.actions, "patch "+name)
+	return nil, nil
+}
+
+// syncedInformer is an instance informer reporting it is synced without running
+type syncedInformer struct {
+	cache.SharedIndexInformer
+}
+
+func (i syncedInformer) HasSynced() bool {
+	return true
+}
+
+type instanceInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func (i instanceInformer) Informer() cache.SharedIndexInformer {
+	return i.informer
+}
+
+func (i instanceInformer) Lister() cache.GenericLister {
+	return cache.NewGenericLister(i.informer.GetIndexer(), widgetGVR.GroupResource())
+}
+
+func newCRD() *unstructured.Unstructured {
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"spec": map[string]interface{}{
+			"group": "example.com",
+			"names": map[string]interface{}{"plural": "widgets", "kind": "Widget"},
+			"versions": []interface{}{
+				map[string]interface{}{"name": "v1", "storage": true, "served": true},
+			},
+		},
+	}}
+	crd.SetName("widgets.example.com")
+	return crd
+}
+
+func newWidget(size int64) *unstructured.Unstructured {
+	widget := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"spec":       map[string]interface{}{"size": size},
+	}}
+	widget.SetNamespace("default")
+	widget.SetName("widget1")
+	return widget
+}
+
+// deployedWork returns the work as the hub serves it once applied, with the applied condition of the
+// manifests reported by the work agent.
+func deployedWork(t *testing.T, work *workapiv1.ManifestWork, applied metav1.ConditionStatus, objs ...*unstructured.Unstructured) *workapiv1.ManifestWork {
+	for _, obj := range objs {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		work.Spec.Workload.Manifests = append(work.Spec.Workload.Manifests, workapiv1.Manifest{RawExtension: runtime.RawExtension{Raw: data}})
+	}
+	if err := helpers.SetDeleteOption(work, ""); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := helpers.ChunkWork(work, helpers.MaxManifestsSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployed := chunks[0]
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		deployed.Status.ResourceStatus.Manifests = append(deployed.Status.ResourceStatus.Manifests, workapiv1.ManifestCondition{
+			ResourceMeta: workapiv1.ManifestResourceMeta{Group: gvk.Group, Kind: gvk.Kind, Namespace: obj.GetNamespace(), Name: obj.GetName()},
+			Conditions:   []metav1.Condition{{Type: string(workapiv1.ManifestApplied), Status: applied}},
+		})
+	}
+	return deployed
+}
+
+func TestCRDSync(t *testing.T) {
+	crd := newCRD()
+
+	cases := []struct {
+		name            string
+		synced          bool
+		crdApplied      metav1.ConditionStatus
+		expectedActions []string
+		expectedPatches []string
+	}{
+		{
+			name:            "instances not synced",
+			synced:          false,
+			crdApplied:      metav1.ConditionTrue,
+			expectedActions: []string{},
+			expectedPatches: []string{},
+		},
+		{
+			name:            "instances follow the applied CRD",
+			synced:          true,
+			crdApplied:      metav1.ConditionTrue,
+			expectedActions: []string{"update cluster1/cr-syncer-ws"},
+			expectedPatches: []string{},
+		},
+		{
+			name:            "CRD failing to apply",
+			synced:          true,
+			crdApplied:      metav1.ConditionFalse,
+			expectedActions: []string{},
+			expectedPatches: []string{"patch widgets.example.com"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			crdIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if err := crdIndexer.Add(crd); err != nil {
+				t.Fatal(err)
+			}
+
+			workClient := &fakeWorkClient{works: map[string]*workapiv1.ManifestWork{}}
+			scope := (&hub.Hub{
+				Name: "hub", ClusterInformers: clusterinformers.NewSharedInformerFactory(nil, 0), WorkClient: workClient,
+			}).NewScope("ws")
+			decision := &clusterapiv1alpha1.PlacementDecision{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ws", Name: "default-1", Labels: map[string]string{"cluster.open-cluster-management.io/placement": defaultPlacement},
+				},
+				Status: clusterapiv1alpha1.PlacementDecisionStatus{Decisions: []clusterapiv1alpha1.ClusterDecision{{ClusterName: "cluster1"}}},
+			}
+			if err := scope.PlacementDecisions().Informer().GetIndexer().Add(decision); err != nil {
+				t.Fatal(err)
+			}
+
+			resource := &fakeKCPResource{}
+			controller := &crdPropagator{
+				kcpClient:        &fakeKCPClient{resource: resource},
+				crdLister:        cache.NewGenericLister(crdIndexer, manifests.CustomResourceDefinitionGVR.GroupResource()),
+				hubs:             []*hub.Scope{scope},
+				workingNamespace: "ws",
+				watched:          map[schema.GroupVersionResource]*instanceWatch{},
+			}
+
+			// the instance was delivered before it changed in the logical cluster
+			crdWork := deployedWork(t, controller.newWork(crdWorkName, "cluster1"), c.crdApplied, cleanCRD(crd, crdHash(crd)))
+			crWork := deployedWork(t, controller.newWork(crWorkName, "cluster1"), metav1.ConditionTrue, cleanInstance(newWidget(1)))
+			for _, work := range []*workapiv1.ManifestWork{crdWork, crWork} {
+				workClient.works[work.Namespace+"/"+work.Name] = work
+				if err := scope.ManifestWorks().Informer().GetIndexer().Add(work); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			informer := dynamicinformer.NewFilteredDynamicInformer(nil, widgetGVR, metav1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+			if err := informer.GetIndexer().Add(newWidget(2)); err != nil {
+				t.Fatal(err)
+			}
+			if c.synced {
+				informer = syncedInformer{SharedIndexInformer: informer}
+			}
+			controller.watched[widgetGVR] = &instanceWatch{informer: instanceInformer{informer: informer}, stop: func() {}}
+
+			syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+			if err := controller.sync(context.Background(), syncCtx); err != nil {
+				t.Fatal(err)
+			}
+
+			actions := append([]string{}, workClient.actions...)
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, c.expectedActions) {
+				t.Errorf("expected actions %v, got %v", c.expectedActions, actions)
+			}
+			patches := append([]string{}, resource.actions...)
+			if !reflect.DeepEqual(patches, c.expectedPatches) {
+				t.Errorf("expected patches %v, got %v", c.expectedPatches, patches)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package propagator
+
+import (
+	"time"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+)
+
+// drainInterval is the interval to check whether the split workloads are moved off a draining cluster
+const drainInterval = 30 * time.Second
+
+// drainDecisions separates the decisions on the drained clusters. The resources stay on a draining
+// cluster until the split workloads are moved off it, the returned bool tells whether a cluster is
+// still draining.
+func drainDecisions(decisions []hub.Decision) ([]hub.Decision, []hub.Decision, bool, error) {
+	active, draining := hub.SplitDraining(decisions)
+
+	drained := []hub.Decision{}
+	waiting := false
+	for _, decision := range draining {
+		ok, err := decision.Scope.Drained(decision.ClusterName)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !ok {
+			active = append(active, decision)
+			waiting = true
+			continue
+		}
+		drained = append(drained, decision)
+	}
+	return active, drained, waiting, nil
+}
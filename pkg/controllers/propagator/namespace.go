@@ -2,67 +2,82 @@ package propagator
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/openshift/library-go/pkg/controller/factory"
 	"github.com/openshift/library-go/pkg/operator/events"
 	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/runtime"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	coreinformer "k8s.io/client-go/informers/core/v1"
 	corelister "k8s.io/client-go/listers/core/v1"
 	"k8s.io/klog/v2"
-	clusterinformerv1alpha1 "open-cluster-management.io/api/client/cluster/informers/externalversions/cluster/v1alpha1"
 	clusterlisterv1alpha1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1alpha1"
-	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
-	workinformer "open-cluster-management.io/api/client/work/informers/externalversions/work/v1"
-	worklister "open-cluster-management.io/api/client/work/listers/work/v1"
 	workapiv1 "open-cluster-management.io/api/work/v1"
 )
 
 const (
-	defaultPlacement = "default"
-	workName         = "namespace-syncer"
-	placementLabel   = "cluster.open-cluster-management.io/placement"
+	defaultPlacement  = "default"
+	namespaceWorkName = "namespace-syncer"
+	placementLabel    = "cluster.open-cluster-management.io/placement"
+
+	// namespaceSyncerLabel is set on the namespace works with the working namespace as the value
+	namespaceSyncerLabel = "kcp.open-cluster-management.io/namespace-syncer"
 )
 
 type namespacePropagator struct {
-	decisionLister     clusterlisterv1alpha1.PlacementDecisionLister
-	workLister         worklister.ManifestWorkLister
-	manifestWorkClient workv1client.WorkV1Interface
 	kcpNamespaceLister corelister.NamespaceLister
-	placementLister    clusterlisterv1alpha1.PlacementLister
+	hubs               []*hub.Scope
+	overrider          *override.Overrider
+	validator          *policy.Validator
 	workingNamespace   string
 }
 
 func NewNamespacePropagator(
-	manifestWorkClient workv1client.WorkV1Interface,
 	namespace string,
 	kcpNamespaceInformer coreinformer.NamespaceInformer,
-	workInformer workinformer.ManifestWorkInformer,
-	placementInformer clusterinformerv1alpha1.PlacementInformer,
-	placementDecisionInformer clusterinformerv1alpha1.PlacementDecisionInformer,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
 	recorder events.Recorder,
 ) factory.Controller {
 	c := &namespacePropagator{
 		workingNamespace:   namespace,
-		workLister:         workInformer.Lister(),
 		kcpNamespaceLister: kcpNamespaceInformer.Lister(),
-		decisionLister:     placementDecisionInformer.Lister(),
-		placementLister:    placementInformer.Lister(),
-		manifestWorkClient: manifestWorkClient,
+		hubs:               hubs,
+		overrider:          overrider,
+		validator:          validator,
+	}
+
+	f := factory.New().
+		WithInformers(kcpNamespaceInformer.Informer(), overrider.Informer(), validator.Informer())
+
+	for _, scope := range hubs {
+		placementLister := scope.Placements().Lister()
+		f = f.WithFilteredEventsInformers(func(obj interface{}) bool {
+			return decisionFilter(placementLister, obj)
+		}, scope.PlacementDecisions().Informer()).
+			WithFilteredEventsInformers(func(obj interface{}) bool {
+				accessor, _ := meta.Accessor(obj)
+				return accessor.GetLabels()[namespaceSyncerLabel] == namespace
+			}, scope.ManifestWorks().Informer()).
+			WithInformers(scope.ManagedClusters())
 	}
-	return factory.New().
-		WithInformers(kcpNamespaceInformer.Informer()).
-		WithFilteredEventsInformers(
-			c.decisionFilter, placementDecisionInformer.Informer()).
-		WithSync(c.sync).ToController("namespace-propagator", recorder)
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "namespace-propagator", c.sync)).ToController("namespace-propagator", recorder)
 }
 
 func (d *namespacePropagator) sync(ctx context.Context, syncCtx factory.SyncContext) error {
-	klog.Infof("namespace-propagator %s sync %s", d.workingNamespace)
+	klog.V(4).Infof("namespace-propagator %s sync", d.workingNamespace)
 
 	namespaces, err := d.kcpNamespaceLister.List(labels.Everything())
 	if err != nil {
@@ -71,7 +86,10 @@ func (d *namespacePropagator) sync(ctx context.Context, syncCtx factory.SyncCont
 
 	manifestWork := &workapiv1.ManifestWork{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: workName,
+			Name: fmt.Sprintf("%s-%s", namespaceWorkName, d.workingNamespace),
+			Labels: map[string]string{
+				namespaceSyncerLabel: d.workingNamespace,
+			},
 		},
 		Spec: workapiv1.ManifestWorkSpec{
 			Workload: workapiv1.ManifestsTemplate{
@@ -80,45 +98,143 @@ func (d *namespacePropagator) sync(ctx context.Context, syncCtx factory.SyncCont
 		},
 	}
 
+	toDeploy := []*corev1.Namespace{}
 	for _, namespace := range namespaces {
-		toDeploy := &corev1.Namespace{
+		toDeploy = append(toDeploy, &corev1.Namespace{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: namespace.Name,
+				Name:        namespace.Name,
+				Annotations: deletePolicyAnnotation(namespace.Annotations),
 			},
 			TypeMeta: metav1.TypeMeta{
 				APIVersion: corev1.SchemeGroupVersion.String(),
 				Kind:       "Namespace",
 			},
-		}
-		manifestWork.Spec.Workload.Manifests = append(manifestWork.Spec.Workload.Manifests, workapiv1.Manifest{
-			RawExtension: runtime.RawExtension{Object: toDeploy},
 		})
 	}
 
-	decisions, err := helpers.GetDecisionsByPlacement(d.decisionLister, defaultPlacement, d.workingNamespace)
+	decisions, err := hub.DecisionsOf(d.hubs, defaultPlacement)
+	if err != nil {
+		return err
+	}
+
+	// The works on the drained clusters are not desired and are cleaned
+	decisions, _, draining, err := drainDecisions(decisions)
 	if err != nil {
 		return err
 	}
+	if draining {
+		syncCtx.Queue().AddAfter(syncCtx.QueueKey(), drainInterval)
+	}
 
 	errs := []error{}
+	desiredWorks := sets.NewString()
+	violations := policy.NewViolations()
 	for _, dec := range decisions {
 		manifestWorkCopy := manifestWork.DeepCopy()
 		manifestWorkCopy.Namespace = dec.ClusterName
-		err := helpers.ApplyWork(ctx, d.manifestWorkClient, manifestWorkCopy)
+		helpers.SetSource(manifestWorkCopy, helpers.Source{
+			LogicalCluster: d.workingNamespace,
+			Resource:       corev1.SchemeGroupVersion.WithResource("namespaces"),
+		})
+
+		deployed, err := helpers.ChunkedWorks(dec.Scope.ManifestWorks().Lister(), dec.ClusterName, manifestWorkCopy.Name)
 		if err != nil {
 			errs = append(errs, err)
+			continue
+		}
+
+		// The work is not applied with a part of the namespaces, which would delete the others
+		complete := true
+		for i, namespace := range toDeploy {
+			allowed, err := dec.Scope.Authorize(ctx, namespaces[i], dec.ClusterName)
+			if err != nil {
+				errs = append(errs, err)
+				complete = false
+				break
+			}
+			if !allowed {
+				syncCtx.Recorder().Warningf("Unauthorized", "The creator of namespace %s is not allowed to deliver it to cluster %s",
+					namespace.Name, dec.Key())
+				continue
+			}
+
+			overridden, err := d.overrider.Apply(dec, namespace)
+			if err != nil {
+				errs = append(errs, err)
+				complete = false
+				break
+			}
+
+			manifest, ok, err := compliantManifest(
+				d.validator, violations, corev1.SchemeGroupVersion.WithResource("namespaces"), namespaces[i], dec, overridden, deployed)
+			if err != nil {
+				errs = append(errs, err)
+				complete = false
+				break
+			}
+			if ok {
+				manifestWorkCopy.Spec.Workload.Manifests = append(manifestWorkCopy.Spec.Workload.Manifests, manifest)
+			}
+		}
+		if !complete {
+			continue
+		}
+
+		if err := helpers.SetDeleteOption(manifestWorkCopy, dec.Scope.DeletePolicy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		// The namespaces are split across several works when they exceed the size of a work
+		chunks, err := helpers.ApplyChunkedWork(ctx, dec.Scope.WorkClient(), dec.Scope.ManifestWorks().Lister(), manifestWorkCopy)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, chunk := range chunks {
+			desiredWorks.Insert(workKey(dec.Scope, dec.ClusterName, chunk))
 		}
 	}
 
+	if err := d.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
 	if len(errs) > 0 {
 		return utilerrors.NewAggregate(errs)
 	}
 
-	return nil
+	return d.cleanWorks(ctx, desiredWorks)
 }
 
-func (d *namespacePropagator) decisionFilter(object interface{}) bool {
-	placement := helpers.GetPlacementByDecision(d.placementLister, object)
+// cleanWorks removes the namespace works of the logical cluster that are no longer desired
+func (d *namespacePropagator) cleanWorks(ctx context.Context, desiredWorks sets.String) error {
+	selector := labels.SelectorFromSet(labels.Set{namespaceSyncerLabel: d.workingNamespace})
+
+	errs := []error{}
+	for _, scope := range d.hubs {
+		works, err := scope.ManifestWorks().Lister().List(selector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if desiredWorks.Has(workKey(scope, work.Namespace, work.Name)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func decisionFilter(placementLister clusterlisterv1alpha1.PlacementLister, object interface{}) bool {
+	placement := helpers.GetPlacementByDecision(placementLister, object)
 	if placement == nil {
 		return false
 	}
@@ -129,3 +245,12 @@ func (d *namespacePropagator) decisionFilter(object interface{}) bool {
 
 	return false
 }
+
+// deletePolicyAnnotation keeps the delete policy of a kcp resource on the manifest delivering it
+func deletePolicyAnnotation(annotations map[string]string) map[string]string {
+	kept := map[string]string{}
+	if policy, ok := annotations[helpers.DeletePolicyAnnotation]; ok {
+		kept[helpers.DeletePolicyAnnotation] = policy
+	}
+	return kept
+}
@@ -0,0 +1,30 @@
+package propagator
+
+import (
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// compliantManifest returns the manifest delivering the object of the kcp resource to the cluster. It is
+// the object when it complies with the policies, or the version of the object already delivered by the
+// works otherwise. It returns false when the object violates the policies and was never delivered.
+func compliantManifest(
+	validator *policy.Validator, violations *policy.Violations, gvr schema.GroupVersionResource, source metav1.Object,
+	dec hub.Decision, obj runtime.Object, deployed []*workapiv1.ManifestWork) (workapiv1.Manifest, bool, error) {
+	violated, err := validator.Validate(dec, obj)
+	if err != nil {
+		return workapiv1.Manifest{}, false, err
+	}
+	violations.Add(gvr, source, dec, violated)
+
+	if len(violated) == 0 {
+		return workapiv1.Manifest{RawExtension: runtime.RawExtension{Object: obj}}, true, nil
+	}
+	manifest, ok := helpers.DeployedManifest(deployed, obj)
+	return manifest, ok, nil
+}
@@ -0,0 +1,303 @@
+package propagator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	coreinformer "k8s.io/client-go/informers/core/v1"
+	rbacinformer "k8s.io/client-go/informers/rbac/v1"
+	corelister "k8s.io/client-go/listers/core/v1"
+	rbaclister "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/klog/v2"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	rbacWorkName = "rbac-syncer"
+
+	// rbacSyncerLabel is set on the rbac works with the working namespace as the value
+	rbacSyncerLabel = "kcp.open-cluster-management.io/rbac-syncer"
+
+	// defaultServiceAccount is created in every namespace by the clusters themselves
+	defaultServiceAccount = "default"
+)
+
+type rbacPropagator struct {
+	kcpRoleLister           rbaclister.RoleLister
+	kcpRoleBindingLister    rbaclister.RoleBindingLister
+	kcpServiceAccountLister corelister.ServiceAccountLister
+	hubs                    []*hub.Scope
+	overrider               *override.Overrider
+	validator               *policy.Validator
+	workingNamespace        string
+}
+
+// NewRBACPropagator delivers the Roles, RoleBindings and ServiceAccounts of the logical cluster to
+// the clusters decided by the default placement.
+func NewRBACPropagator(
+	namespace string,
+	kcpRoleInformer rbacinformer.RoleInformer,
+	kcpRoleBindingInformer rbacinformer.RoleBindingInformer,
+	kcpServiceAccountInformer coreinformer.ServiceAccountInformer,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &rbacPropagator{
+		kcpRoleLister:           kcpRoleInformer.Lister(),
+		kcpRoleBindingLister:    kcpRoleBindingInformer.Lister(),
+		kcpServiceAccountLister: kcpServiceAccountInformer.Lister(),
+		hubs:                    hubs,
+		overrider:               overrider,
+		validator:               validator,
+		workingNamespace:        namespace,
+	}
+
+	f := factory.New().
+		WithInformers(kcpRoleInformer.Informer(), kcpRoleBindingInformer.Informer(),
+			kcpServiceAccountInformer.Informer(), overrider.Informer(), validator.Informer())
+
+	for _, scope := range hubs {
+		placementLister := scope.Placements().Lister()
+		f = f.WithFilteredEventsInformers(func(obj interface{}) bool {
+			return decisionFilter(placementLister, obj)
+		}, scope.PlacementDecisions().Informer()).
+			WithFilteredEventsInformers(func(obj interface{}) bool {
+				accessor, _ := meta.Accessor(obj)
+				return accessor.GetLabels()[rbacSyncerLabel] == namespace
+			}, scope.ManifestWorks().Informer()).
+			WithInformers(scope.ManagedClusters())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "rbac-propagator", c.sync)).ToController("rbac-propagator", recorder)
+}
+
+func (c *rbacPropagator) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("rbac-propagator %s sync", c.workingNamespace)
+
+	objs, err := c.rbacObjects()
+	if err != nil {
+		return err
+	}
+
+	decisions, err := hub.DecisionsOf(c.hubs, defaultPlacement)
+	if err != nil {
+		return err
+	}
+
+	// The works on the drained clusters are not desired and are cleaned
+	decisions, _, draining, err := drainDecisions(decisions)
+	if err != nil {
+		return err
+	}
+	if draining {
+		syncCtx.Queue().AddAfter(factory.DefaultQueueKey, drainInterval)
+	}
+
+	errs := []error{}
+	desiredWorks := sets.NewString()
+	violations := policy.NewViolations()
+	for _, dec := range decisions {
+		work := &workapiv1.ManifestWork{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%s", rbacWorkName, c.workingNamespace),
+				Namespace: dec.ClusterName,
+				Labels: map[string]string{
+					rbacSyncerLabel: c.workingNamespace,
+				},
+			},
+		}
+
+		helpers.SetSource(work, helpers.Source{LogicalCluster: c.workingNamespace})
+
+		deployed, err := helpers.ChunkedWorks(dec.Scope.ManifestWorks().Lister(), dec.ClusterName, work.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		// The work is not applied with a part of the objects, which would delete the others
+		workErrs := []error{}
+		for _, obj := range objs {
+			accessor, _ := meta.Accessor(obj)
+			allowed, err := dec.Scope.Authorize(ctx, accessor, dec.ClusterName)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+			if !allowed {
+				syncCtx.Recorder().Warningf("Unauthorized", "The creator of %s %s/%s is not allowed to deliver it to cluster %s",
+					obj.GetObjectKind().GroupVersionKind().Kind, accessor.GetNamespace(), accessor.GetName(), dec.Key())
+				continue
+			}
+
+			overridden, err := c.overrider.Apply(dec, obj)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+
+			gvr, _ := meta.UnsafeGuessKindToResource(obj.GetObjectKind().GroupVersionKind())
+			manifest, ok, err := compliantManifest(c.validator, violations, gvr, accessor, dec, overridden, deployed)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+			if ok {
+				work.Spec.Workload.Manifests = append(work.Spec.Workload.Manifests, manifest)
+			}
+		}
+		if len(workErrs) > 0 {
+			errs = append(errs, workErrs...)
+			continue
+		}
+
+		if len(work.Spec.Workload.Manifests) == 0 {
+			continue
+		}
+
+		if err := helpers.SetDeleteOption(work, dec.Scope.DeletePolicy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		chunks, err := helpers.ApplyChunkedWork(ctx, dec.Scope.WorkClient(), dec.Scope.ManifestWorks().Lister(), work)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, chunk := range chunks {
+			desiredWorks.Insert(workKey(dec.Scope, dec.ClusterName, chunk))
+		}
+	}
+
+	if err := c.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	return c.cleanWorks(ctx, desiredWorks)
+}
+
+// rbacObjects returns the service accounts, roles and role bindings to deliver, in this order so the
+// subjects and roles are applied before the bindings referring to them.
+func (c *rbacPropagator) rbacObjects() ([]runtime.Object, error) {
+	serviceAccounts, err := c.kcpServiceAccountLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	roles, err := c.kcpRoleLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	roleBindings, err := c.kcpRoleBindingLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(serviceAccounts, func(i, j int) bool {
+		return namespacedName(&serviceAccounts[i].ObjectMeta) < namespacedName(&serviceAccounts[j].ObjectMeta)
+	})
+	sort.Slice(roles, func(i, j int) bool {
+		return namespacedName(&roles[i].ObjectMeta) < namespacedName(&roles[j].ObjectMeta)
+	})
+	sort.Slice(roleBindings, func(i, j int) bool {
+		return namespacedName(&roleBindings[i].ObjectMeta) < namespacedName(&roleBindings[j].ObjectMeta)
+	})
+
+	objs := []runtime.Object{}
+	for _, sa := range serviceAccounts {
+		if sa.Name == defaultServiceAccount || sa.DeletionTimestamp != nil {
+			continue
+		}
+		objs = append(objs, &corev1.ServiceAccount{
+			TypeMeta:                     metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ServiceAccount"},
+			ObjectMeta:                   cleanMeta(&sa.ObjectMeta),
+			ImagePullSecrets:             sa.ImagePullSecrets,
+			AutomountServiceAccountToken: sa.AutomountServiceAccountToken,
+		})
+	}
+	for _, role := range roles {
+		if role.DeletionTimestamp != nil {
+			continue
+		}
+		objs = append(objs, &rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+			ObjectMeta: cleanMeta(&role.ObjectMeta),
+			Rules:      role.Rules,
+		})
+	}
+	for _, binding := range roleBindings {
+		if binding.DeletionTimestamp != nil {
+			continue
+		}
+		objs = append(objs, &rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+			ObjectMeta: cleanMeta(&binding.ObjectMeta),
+			Subjects:   binding.Subjects,
+			RoleRef:    binding.RoleRef,
+		})
+	}
+	return objs, nil
+}
+
+// cleanWorks removes the rbac works of the logical cluster that are no longer desired
+func (c *rbacPropagator) cleanWorks(ctx context.Context, desiredWorks sets.String) error {
+	selector := labels.SelectorFromSet(labels.Set{rbacSyncerLabel: c.workingNamespace})
+
+	errs := []error{}
+	for _, scope := range c.hubs {
+		works, err := scope.ManifestWorks().Lister().List(selector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if desiredWorks.Has(workKey(scope, work.Namespace, work.Name)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// cleanMeta keeps the identity, labels and annotations of a kcp object
+func cleanMeta(objectMeta *metav1.ObjectMeta) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        objectMeta.Name,
+		Namespace:   objectMeta.Namespace,
+		Labels:      objectMeta.Labels,
+		Annotations: objectMeta.Annotations,
+	}
+}
+
+func namespacedName(objectMeta *metav1.ObjectMeta) string {
+	return fmt.Sprintf("%s/%s", objectMeta.Namespace, objectMeta.Name)
+}
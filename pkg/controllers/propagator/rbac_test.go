@@ -0,0 +1,158 @@
+package propagator
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/informers"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// newDecidedScope returns the scope of the working namespace whose default placement decides cluster1,
+// with the works in its cache and served by the work client.
+func newDecidedScope(t *testing.T, workClient *fakeWorkClient, works ...*workapiv1.ManifestWork) *hub.Scope {
+	scope := (&hub.Hub{
+		Name: "hub", ClusterInformers: clusterinformers.NewSharedInformerFactory(nil, 0), WorkClient: workClient,
+	}).NewScope("ws")
+	decision := &clusterapiv1alpha1.PlacementDecision{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ws", Name: "default-1", Labels: map[string]string{placementLabel: defaultPlacement},
+		},
+		Status: clusterapiv1alpha1.PlacementDecisionStatus{Decisions: []clusterapiv1alpha1.ClusterDecision{{ClusterName: "cluster1"}}},
+	}
+	if err := scope.PlacementDecisions().Informer().GetIndexer().Add(decision); err != nil {
+		t.Fatal(err)
+	}
+	for _, work := range works {
+		workClient.works[work.Namespace+"/"+work.Name] = work
+		if err := scope.ManifestWorks().Informer().GetIndexer().Add(work); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scope
+}
+
+// manifestKinds returns the kind/namespace/name of the manifests of the work
+func manifestKinds(t *testing.T, work *workapiv1.ManifestWork) []string {
+	kinds := []string{}
+	for _, manifest := range work.Spec.Workload.Manifests {
+		data := manifest.Raw
+		if manifest.Object != nil {
+			var err error
+			if data, err = json.Marshal(manifest.Object); err != nil {
+				t.Fatal(err)
+			}
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, obj.GetKind()+" "+namespacedName(&metav1.ObjectMeta{Namespace: obj.GetNamespace(), Name: obj.GetName()}))
+	}
+	return kinds
+}
+
+func TestRBACSync(t *testing.T) {
+	creator := map[string]string{hub.CreatorAnnotation: `{"username":"alice"}`}
+	existing := &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "cluster1", Name: "rbac-syncer-ws",
+		Labels: map[string]string{rbacSyncerLabel: "ws", helpers.ChunkLabel: "rbac-syncer-ws"},
+	}}
+
+	cases := []struct {
+		name              string
+		authorizeCreators bool
+		existing          []*workapiv1.ManifestWork
+		expectedActions   []string
+		expectedKinds     []string
+		expectedEvents    []string
+	}{
+		{
+			name:            "deliver the bindings after their subjects and roles",
+			expectedActions: []string{"create cluster1/rbac-syncer-ws"},
+			expectedKinds:   []string{"ServiceAccount default/deployer", "Role default/deployer", "RoleBinding default/deployer"},
+			expectedEvents:  []string{},
+		},
+		{
+			name:              "creators not allowed",
+			authorizeCreators: true,
+			existing:          []*workapiv1.ManifestWork{existing},
+			expectedActions:   []string{"delete cluster1/rbac-syncer-ws"},
+			expectedEvents:    []string{"Unauthorized", "Unauthorized", "Unauthorized"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			kubeInformers := informers.NewSharedInformerFactory(nil, 0)
+			for _, obj := range []interface{}{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "default"}},
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployer", Annotations: creator}},
+			} {
+				if err := kubeInformers.Core().V1().ServiceAccounts().Informer().GetIndexer().Add(obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+			role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployer", Annotations: creator}}
+			if err := kubeInformers.Rbac().V1().Roles().Informer().GetIndexer().Add(role); err != nil {
+				t.Fatal(err)
+			}
+			binding := &rbacv1.RoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployer", Annotations: creator},
+				Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "deployer"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "deployer"},
+			}
+			if err := kubeInformers.Rbac().V1().RoleBindings().Informer().GetIndexer().Add(binding); err != nil {
+				t.Fatal(err)
+			}
+
+			workClient := &fakeWorkClient{works: map[string]*workapiv1.ManifestWork{}}
+			scope := newDecidedScope(t, workClient, c.existing...)
+			// the creators are not signed, they are never allowed
+			scope.AuthorizeCreators = c.authorizeCreators
+			controller := &rbacPropagator{
+				kcpRoleLister:           kubeInformers.Rbac().V1().Roles().Lister(),
+				kcpRoleBindingLister:    kubeInformers.Rbac().V1().RoleBindings().Lister(),
+				kcpServiceAccountLister: kubeInformers.Core().V1().ServiceAccounts().Lister(),
+				hubs:                    []*hub.Scope{scope},
+				workingNamespace:        "ws",
+			}
+
+			recorder := events.NewInMemoryRecorder("test")
+			if err := controller.sync(context.Background(), factory.NewSyncContext("test", recorder)); err != nil {
+				t.Fatal(err)
+			}
+
+			actions := append([]string{}, workClient.actions...)
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, c.expectedActions) {
+				t.Errorf("expected actions %v, got %v", c.expectedActions, actions)
+			}
+			if c.expectedKinds != nil {
+				if kinds := manifestKinds(t, workClient.works["cluster1/rbac-syncer-ws"]); !reflect.DeepEqual(kinds, c.expectedKinds) {
+					t.Errorf("expected manifests %v, got %v", c.expectedKinds, kinds)
+				}
+			}
+			reasons := []string{}
+			for _, event := range recorder.Events() {
+				reasons = append(reasons, event.Reason)
+			}
+			if !reflect.DeepEqual(reasons, c.expectedEvents) {
+				t.Errorf("expected events %v, got %v", c.expectedEvents, reasons)
+			}
+		})
+	}
+}
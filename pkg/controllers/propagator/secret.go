@@ -0,0 +1,265 @@
+package propagator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	"github.com/qiujian16/kcp-ocm/pkg/secret"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	coreinformer "k8s.io/client-go/informers/core/v1"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	secretWorkName = "secret-syncer"
+
+	// secretSyncerLabel is set on the secret works with the working namespace as the value
+	secretSyncerLabel = "kcp.open-cluster-management.io/secret-syncer"
+)
+
+type secretPropagator struct {
+	kcpSecretLister  corelister.SecretLister
+	hubs             []*hub.Scope
+	sealer           *secret.Sealer
+	overrider        *override.Overrider
+	validator        *policy.Validator
+	workingNamespace string
+}
+
+// NewSecretPropagator delivers the Secrets of the logical cluster to the clusters decided by the default
+// placement. The Secrets are sealed so the works on the hub never carry their data in clear.
+func NewSecretPropagator(
+	namespace string,
+	kcpSecretInformer coreinformer.SecretInformer,
+	hubs []*hub.Scope,
+	sealer *secret.Sealer,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &secretPropagator{
+		kcpSecretLister:  kcpSecretInformer.Lister(),
+		hubs:             hubs,
+		sealer:           sealer,
+		overrider:        overrider,
+		validator:        validator,
+		workingNamespace: namespace,
+	}
+
+	f := factory.New().
+		WithInformers(kcpSecretInformer.Informer(), overrider.Informer(), validator.Informer())
+
+	for _, scope := range hubs {
+		placementLister := scope.Placements().Lister()
+		f = f.WithFilteredEventsInformers(func(obj interface{}) bool {
+			return decisionFilter(placementLister, obj)
+		}, scope.PlacementDecisions().Informer()).
+			WithFilteredEventsInformers(func(obj interface{}) bool {
+				accessor, _ := meta.Accessor(obj)
+				return accessor.GetLabels()[secretSyncerLabel] == namespace
+			}, scope.ManifestWorks().Informer()).
+			WithInformers(scope.ManagedClusters())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "secret-propagator", c.sync)).ToController("secret-propagator", recorder)
+}
+
+func (c *secretPropagator) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	klog.V(4).Infof("secret-propagator %s sync", c.workingNamespace)
+
+	secrets, err := c.secrets()
+	if err != nil {
+		return err
+	}
+
+	prerequisites, err := c.sealer.Prerequisites()
+	if err != nil {
+		return err
+	}
+
+	decisions, err := hub.DecisionsOf(c.hubs, defaultPlacement)
+	if err != nil {
+		return err
+	}
+
+	// The works on the drained clusters are not desired and are cleaned
+	decisions, _, draining, err := drainDecisions(decisions)
+	if err != nil {
+		return err
+	}
+	if draining {
+		syncCtx.Queue().AddAfter(factory.DefaultQueueKey, drainInterval)
+	}
+
+	errs := []error{}
+	desiredWorks := sets.NewString()
+	violations := policy.NewViolations()
+	for _, dec := range decisions {
+		work := &workapiv1.ManifestWork{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%s", secretWorkName, c.workingNamespace),
+				Namespace: dec.ClusterName,
+				Labels: map[string]string{
+					secretSyncerLabel: c.workingNamespace,
+				},
+			},
+		}
+
+		helpers.SetSource(work, helpers.Source{LogicalCluster: c.workingNamespace, Resource: corev1.SchemeGroupVersion.WithResource("secrets")})
+
+		deployed, err := helpers.ChunkedWorks(dec.Scope.ManifestWorks().Lister(), dec.ClusterName, work.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		// The work is not applied with a part of the secrets, which would delete the others
+		workErrs := []error{}
+		for _, s := range secrets {
+			allowed, err := dec.Scope.Authorize(ctx, s, dec.ClusterName)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+			if !allowed {
+				syncCtx.Recorder().Warningf("Unauthorized", "The creator of Secret %s/%s is not allowed to deliver it to cluster %s",
+					s.Namespace, s.Name, dec.Key())
+				continue
+			}
+
+			overridden, err := c.overrider.Apply(dec, s)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+
+			sealed, ok, err := c.sealer.Seal(dec, overridden, deployed)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+			if !ok {
+				syncCtx.Recorder().Warningf("NoEncryptionKey", "Secret %s/%s is not delivered to cluster %s without the %s annotation",
+					s.Namespace, s.Name, dec.Key(), secret.EncryptionKeyAnnotation)
+				continue
+			}
+
+			manifest, ok, err := compliantManifest(c.validator, violations, corev1.SchemeGroupVersion.WithResource("secrets"), s, dec, sealed, deployed)
+			if err != nil {
+				workErrs = append(workErrs, err)
+				continue
+			}
+			if ok {
+				work.Spec.Workload.Manifests = append(work.Spec.Workload.Manifests, manifest)
+			}
+		}
+		if len(workErrs) > 0 {
+			errs = append(errs, workErrs...)
+			continue
+		}
+
+		if len(work.Spec.Workload.Manifests) == 0 {
+			continue
+		}
+
+		manifests := []workapiv1.Manifest{}
+		for _, obj := range prerequisites {
+			manifests = append(manifests, workapiv1.Manifest{RawExtension: runtime.RawExtension{Object: obj}})
+		}
+		work.Spec.Workload.Manifests = append(manifests, work.Spec.Workload.Manifests...)
+
+		if err := helpers.SetDeleteOption(work, dec.Scope.DeletePolicy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		chunks, err := helpers.ApplyChunkedWork(ctx, dec.Scope.WorkClient(), dec.Scope.ManifestWorks().Lister(), work)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, chunk := range chunks {
+			desiredWorks.Insert(workKey(dec.Scope, dec.ClusterName, chunk))
+		}
+	}
+
+	if err := c.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	return c.cleanWorks(ctx, desiredWorks)
+}
+
+// secrets returns the Secrets to deliver, the service account tokens are issued by the clusters themselves
+func (c *secretPropagator) secrets() ([]*corev1.Secret, error) {
+	secrets, err := c.kcpSecretLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(secrets, func(i, j int) bool {
+		return namespacedName(&secrets[i].ObjectMeta) < namespacedName(&secrets[j].ObjectMeta)
+	})
+
+	desired := []*corev1.Secret{}
+	for _, s := range secrets {
+		if s.Type == corev1.SecretTypeServiceAccountToken || s.DeletionTimestamp != nil {
+			continue
+		}
+		desired = append(desired, &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+			ObjectMeta: cleanMeta(&s.ObjectMeta),
+			Type:       s.Type,
+			Data:       s.Data,
+			StringData: s.StringData,
+		})
+	}
+	return desired, nil
+}
+
+// cleanWorks removes the secret works of the logical cluster that are no longer desired
+func (c *secretPropagator) cleanWorks(ctx context.Context, desiredWorks sets.String) error {
+	selector := labels.SelectorFromSet(labels.Set{secretSyncerLabel: c.workingNamespace})
+
+	errs := []error{}
+	for _, scope := range c.hubs {
+		works, err := scope.ManifestWorks().Lister().List(selector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if desiredWorks.Has(workKey(scope, work.Namespace, work.Name)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
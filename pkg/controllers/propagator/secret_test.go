@@ -0,0 +1,129 @@
+package propagator
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/secret"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// fakeDigestKeyClient serves the digest key of the sealer from the hub
+type fakeDigestKeyClient struct {
+	kubernetes.Interface
+	corev1client.CoreV1Interface
+	corev1client.SecretInterface
+}
+
+func (c *fakeDigestKeyClient) CoreV1() corev1client.CoreV1Interface {
+	return c
+}
+
+func (c *fakeDigestKeyClient) Secrets(string) corev1client.SecretInterface {
+	return c
+}
+
+func (c *fakeDigestKeyClient) Get(_ context.Context, name string, _ metav1.GetOptions) (*corev1.Secret, error) {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Data:       map[string][]byte{"key": []byte("0123456789abcdef0123456789abcdef")},
+	}, nil
+}
+
+func TestSecretSync(t *testing.T) {
+	existing := &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "cluster1", Name: "secret-syncer-ws",
+		Labels: map[string]string{secretSyncerLabel: "ws", helpers.ChunkLabel: "secret-syncer-ws"},
+	}}
+
+	cases := []struct {
+		name            string
+		mode            string
+		existing        []*workapiv1.ManifestWork
+		expectedActions []string
+		expectedKinds   []string
+		expectedEvents  []string
+	}{
+		{
+			name:            "deliver the secrets referenced from the store",
+			mode:            secret.ModeReference,
+			expectedActions: []string{"create cluster1/secret-syncer-ws"},
+			expectedKinds:   []string{"ExternalSecret default/db"},
+			expectedEvents:  []string{},
+		},
+		{
+			name:            "cluster without encryption key",
+			mode:            secret.ModeEncrypt,
+			existing:        []*workapiv1.ManifestWork{existing},
+			expectedActions: []string{"delete cluster1/secret-syncer-ws"},
+			expectedEvents:  []string{"NoEncryptionKey"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			kubeInformers := informers.NewSharedInformerFactory(nil, 0)
+			for _, s := range []*corev1.Secret{
+				{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}, Data: map[string][]byte{"password": []byte("secret")}},
+				{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "token"}, Type: corev1.SecretTypeServiceAccountToken},
+			} {
+				if err := kubeInformers.Core().V1().Secrets().Informer().GetIndexer().Add(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sealer, err := secret.NewSealer(context.Background(), &fakeDigestKeyClient{}, "kcp-ocm", c.mode, "vault")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			workClient := &fakeWorkClient{works: map[string]*workapiv1.ManifestWork{}}
+			scope := newDecidedScope(t, workClient, c.existing...)
+			cluster := &clusterapiv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster1"}}
+			if err := scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Informer().GetIndexer().Add(cluster); err != nil {
+				t.Fatal(err)
+			}
+			controller := &secretPropagator{
+				kcpSecretLister:  kubeInformers.Core().V1().Secrets().Lister(),
+				hubs:             []*hub.Scope{scope},
+				sealer:           sealer,
+				workingNamespace: "ws",
+			}
+
+			recorder := events.NewInMemoryRecorder("test")
+			if err := controller.sync(context.Background(), factory.NewSyncContext("test", recorder)); err != nil {
+				t.Fatal(err)
+			}
+
+			actions := append([]string{}, workClient.actions...)
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, c.expectedActions) {
+				t.Errorf("expected actions %v, got %v", c.expectedActions, actions)
+			}
+			if c.expectedKinds != nil {
+				if kinds := manifestKinds(t, workClient.works["cluster1/secret-syncer-ws"]); !reflect.DeepEqual(kinds, c.expectedKinds) {
+					t.Errorf("expected manifests %v, got %v", c.expectedKinds, kinds)
+				}
+			}
+			reasons := []string{}
+			for _, event := range recorder.Events() {
+				reasons = append(reasons, event.Reason)
+			}
+			if !reflect.DeepEqual(reasons, c.expectedEvents) {
+				t.Errorf("expected events %v, got %v", c.expectedEvents, reasons)
+			}
+		})
+	}
+}
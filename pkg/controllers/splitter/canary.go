@@ -0,0 +1,188 @@
+package splitter
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+)
+
+const (
+	// canaryClusterSetsAnnotation on the kcp deployment is the comma separated ManagedClusterSets the
+	// template changes are tried on before they are promoted to the other clusters.
+	canaryClusterSetsAnnotation = "kcp.open-cluster-management.io/canary-clustersets"
+	// canaryPercentAnnotation is the percentage of the replicas deployed on the canary clusters, defaults to 10.
+	// With 0 the canary clusters run no replica and the template is promoted at once.
+	canaryPercentAnnotation = "kcp.open-cluster-management.io/canary-replicas-percent"
+	defaultCanaryPercent    = 10
+
+	canaryLabel = "kcp.open-cluster-management.io/canary"
+)
+
+// ensureCanaryPlacement applies the canary placement of the deployment on each hub and returns the
+// clusters it decides, the canary placement is deleted when the deployment has no canary.
+func (d *DeploymentSplitter) ensureCanaryPlacement(ctx context.Context, deployment *appsv1.Deployment) ([]hub.Decision, error) {
+	placementName := canaryPlacementName(deployment.Namespace, deployment.Name)
+
+	clusterSets := canaryClusterSets(deployment)
+	if len(clusterSets) == 0 {
+		for _, scope := range d.hubs {
+			if err := scope.DeletePlacement(ctx, placementName); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	for _, scope := range d.hubs {
+		placement := &clusterapiv1alpha1.Placement{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: placementName,
+			},
+			Spec: clusterapiv1alpha1.PlacementSpec{
+				ClusterSets: clusterSets,
+			},
+		}
+		helpers.SetSource(placement, d.sourceOf(deployment))
+		if err := scope.ApplyPlacement(ctx, placement); err != nil {
+			return nil, err
+		}
+	}
+
+	return hub.DecisionsOf(d.hubs, placementName)
+}
+
+func canaryClusterSets(deployment *appsv1.Deployment) []string {
+	clusterSets := sets.NewString()
+	for _, clusterSet := range strings.Split(deployment.Annotations[canaryClusterSetsAnnotation], ",") {
+		if clusterSet = strings.TrimSpace(clusterSet); len(clusterSet) > 0 {
+			clusterSets.Insert(clusterSet)
+		}
+	}
+	return clusterSets.List()
+}
+
+// canaryReplicas returns the share of the replicas deployed on the canary clusters, the canary
+// gets at least one replica unless the percentage is 0.
+func canaryReplicas(deployment *appsv1.Deployment, total int32, canaryClusters int) int32 {
+	if canaryClusters == 0 || total == 0 {
+		return 0
+	}
+
+	percent := defaultCanaryPercent
+	if value, err := strconv.Atoi(deployment.Annotations[canaryPercentAnnotation]); err == nil && value >= 0 && value <= 100 {
+		percent = value
+	}
+	if percent == 0 {
+		return 0
+	}
+
+	replicas := (int64(total)*int64(percent) + 99) / 100
+	if replicas < 1 {
+		replicas = 1
+	}
+	return int32(replicas)
+}
+
+// excludeDecisions returns the decisions not in the excluded decisions
+func excludeDecisions(decisions, excluded []hub.Decision) []hub.Decision {
+	excludedKeys := sets.NewString()
+	for _, decision := range excluded {
+		excludedKeys.Insert(decision.Key())
+	}
+
+	filtered := []hub.Decision{}
+	for _, decision := range decisions {
+		if !excludedKeys.Has(decision.Key()) {
+			filtered = append(filtered, decision)
+		}
+	}
+	return filtered
+}
+
+// canary deploys the template on the canary clusters and holds it back on the other clusters until the
+// canary clusters report the deployment of the template rolled out, with all its replicas updated and
+// available, or until they apply it when they do not report the status of the deployments. It returns
+// whether the template is promoted and whether the canary is in progress.
+func canary(
+	recorder events.Recorder, deployment *appsv1.Deployment, canaryTargets, targets []*rolloutTarget) (bool, bool, error) {
+	if len(canaryTargets) == 0 {
+		return true, false, nil
+	}
+
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		return false, false, err
+	}
+	for _, target := range append(canaryTargets, targets...) {
+		target.work.Annotations[templateHashAnnotation] = hash
+	}
+
+	progressing := false
+	for _, target := range canaryTargets {
+		existing, err := target.decision.Scope.ManifestWorks().Lister().ManifestWorks(target.decision.ClusterName).Get(target.work.Name)
+		switch {
+		case errors.IsNotFound(err):
+			progressing = true
+			continue
+		case err != nil:
+			return false, false, err
+		}
+
+		_, existingHash, err := workTemplate(existing)
+		if err != nil {
+			return false, false, err
+		}
+		if existingHash != hash {
+			progressing = true
+			if !target.reportStatus {
+				recorder.Warningf("CanaryStatusUnavailable",
+					"Canary of deployment %s/%s is promoted once cluster %s applies the template, the clusters do not report the status of the deployments without the API probe",
+					deployment.Namespace, deployment.Name, target.decision.Key())
+			}
+			continue
+		}
+
+		switch workRolloutState(target, existing) {
+		case rolloutProgressing:
+			progressing = true
+		case rolloutFailed:
+			recorder.Warningf("CanaryFailed", "Canary of deployment %s/%s failed on cluster %s, the template is not promoted",
+				deployment.Namespace, deployment.Name, target.decision.Key())
+			return false, false, holdBackTargets(targets)
+		}
+	}
+
+	if !progressing {
+		return true, false, nil
+	}
+	return false, true, holdBackTargets(targets)
+}
+
+// holdBackTargets keeps the existing template on the clusters already deployed
+func holdBackTargets(targets []*rolloutTarget) error {
+	for _, target := range targets {
+		existing, err := target.decision.Scope.ManifestWorks().Lister().ManifestWorks(target.decision.ClusterName).Get(target.work.Name)
+		switch {
+		case errors.IsNotFound(err):
+			continue
+		case err != nil:
+			return err
+		}
+
+		template, hash, err := workTemplate(existing)
+		if err != nil {
+			return err
+		}
+		holdBack(target, template, hash)
+	}
+	return nil
+}
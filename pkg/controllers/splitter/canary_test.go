@@ -0,0 +1,110 @@
+package splitter
+
+import (
+	"testing"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func TestCanary(t *testing.T) {
+	previous := newDeployment("web:v1")
+	deployment := newDeployment("web:v2")
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name               string
+		reportStatus       bool
+		canaryTemplate     bool
+		canaryAvailable    metav1.ConditionStatus
+		statusLines        []string
+		expectedPromoted   bool
+		expectedInProgress bool
+		expectedWarning    string
+	}{
+		{
+			name:               "canary not deployed yet",
+			canaryAvailable:    metav1.ConditionTrue,
+			expectedInProgress: true,
+			expectedWarning:    "CanaryStatusUnavailable",
+		},
+		{
+			name:               "canary not applied without the status reporter",
+			canaryTemplate:     true,
+			canaryAvailable:    metav1.ConditionFalse,
+			expectedInProgress: true,
+		},
+		{
+			name:             "canary applied without the status reporter",
+			canaryTemplate:   true,
+			canaryAvailable:  metav1.ConditionTrue,
+			expectedPromoted: true,
+		},
+		{
+			name:               "canary applied but not reported",
+			reportStatus:       true,
+			canaryTemplate:     true,
+			canaryAvailable:    metav1.ConditionTrue,
+			expectedInProgress: true,
+		},
+		{
+			name:             "canary reported available",
+			reportStatus:     true,
+			canaryTemplate:   true,
+			canaryAvailable:  metav1.ConditionTrue,
+			statusLines:      []string{"default/web " + hash + " 2 2 1 1 1 NewReplicaSetAvailable"},
+			expectedPromoted: true,
+		},
+		{
+			name:            "canary reported failed",
+			reportStatus:    true,
+			canaryTemplate:  true,
+			canaryAvailable: metav1.ConditionTrue,
+			statusLines:     []string{"default/web " + hash + " 2 2 1 0 0 " + progressDeadlineExceeded},
+			expectedWarning: "CanaryFailed",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			canaryCluster := newCluster("canary1", nil, nil)
+			if len(c.statusLines) > 0 {
+				canaryCluster.Status.ClusterClaims = statusClaims(t, c.statusLines...)
+			}
+			canaryDeployment := previous
+			if c.canaryTemplate {
+				canaryDeployment = deployment
+			}
+			scope := newWorkScope(t, []*clusterapiv1.ManagedCluster{canaryCluster, newCluster("cluster1", nil, nil)},
+				newSplitWork(t, "canary1", canaryDeployment, metav1.ConditionTrue, c.canaryAvailable),
+				newSplitWork(t, "cluster1", previous, metav1.ConditionTrue, metav1.ConditionTrue))
+			canaryTargets := []*rolloutTarget{newTarget(scope, "canary1", deployment, c.reportStatus)}
+			targets := []*rolloutTarget{newTarget(scope, "cluster1", deployment, c.reportStatus)}
+
+			recorder := events.NewInMemoryRecorder("test")
+			promoted, inProgress, err := canary(recorder, deployment, canaryTargets, targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if promoted != c.expectedPromoted || inProgress != c.expectedInProgress {
+				t.Errorf("expected promoted %v and in progress %v, got %v and %v",
+					c.expectedPromoted, c.expectedInProgress, promoted, inProgress)
+			}
+			if targets[0].heldBack == promoted {
+				t.Errorf("expected the template held back on the other clusters until it is promoted")
+			}
+
+			warnings := []string{}
+			for _, event := range recorder.Events() {
+				warnings = append(warnings, event.Reason)
+			}
+			if (len(c.expectedWarning) > 0) != (len(warnings) > 0) || (len(warnings) > 0 && warnings[0] != c.expectedWarning) {
+				t.Errorf("expected warning %q, got %v", c.expectedWarning, warnings)
+			}
+		})
+	}
+}
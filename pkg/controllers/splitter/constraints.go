@@ -0,0 +1,175 @@
+package splitter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// minReplicasAnnotation on the kcp deployment is the min replicas of a cluster the deployment is
+	// split to, defaults to 1. The replicas decide the max number of clusters to deploy.
+	minReplicasAnnotation = "kcp.open-cluster-management.io/min-replicas-per-cluster"
+	// maxReplicasAnnotation on the kcp deployment is the max replicas of a cluster
+	maxReplicasAnnotation = "kcp.open-cluster-management.io/max-replicas-per-cluster"
+	// minClustersAnnotation on the kcp deployment is the min number of clusters to spread the replicas on
+	minClustersAnnotation = "kcp.open-cluster-management.io/min-clusters"
+
+	// clusterMaxReplicasAnnotation on a managed cluster is the max replicas of any split deployment on the cluster
+	clusterMaxReplicasAnnotation = "kcp.open-cluster-management.io/max-replicas"
+
+	// unsatisfiableAnnotation is set on the kcp deployment with the constraints the split does not satisfy
+	unsatisfiableAnnotation = "kcp.open-cluster-management.io/split-unsatisfiable"
+)
+
+// splitConstraints bounds the replicas of the clusters a deployment is split to, a max of 0 is unbounded
+type splitConstraints struct {
+	minReplicas int32
+	maxReplicas int32
+	minClusters int
+}
+
+func constraintsOf(deployment *appsv1.Deployment) splitConstraints {
+	constraints := splitConstraints{minReplicas: 1}
+	if value, err := strconv.Atoi(deployment.Annotations[minReplicasAnnotation]); err == nil && value > 0 {
+		constraints.minReplicas = int32(value)
+	}
+	if value, err := strconv.Atoi(deployment.Annotations[maxReplicasAnnotation]); err == nil && value > 0 {
+		constraints.maxReplicas = int32(value)
+	}
+	if value, err := strconv.Atoi(deployment.Annotations[minClustersAnnotation]); err == nil && value > 0 {
+		constraints.minClusters = value
+	}
+	return constraints
+}
+
+// maxReplicasOf returns the max replicas of the decided cluster, 0 is unbounded
+func (c splitConstraints) maxReplicasOf(decision hub.Decision) int32 {
+	max := c.maxReplicas
+
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil {
+		return max
+	}
+	if value, err := strconv.Atoi(cluster.Annotations[clusterMaxReplicasAnnotation]); err == nil && value > 0 {
+		if max == 0 || int32(value) < max {
+			max = int32(value)
+		}
+	}
+	return max
+}
+
+// splitReplicas divides the replicas on the decided clusters within the constraints. The clusters
+// are chosen in the order of their keys, and the replicas are spread evenly on top of the min replicas.
+// When the constraints cannot be satisfied, the replicas are split as close as possible and the
+// reasons are returned.
+func splitReplicas(totalReplica int32, decisions []hub.Decision, constraints splitConstraints) ([]replicaAllocation, []string) {
+	sorted := make([]hub.Decision, len(decisions))
+	copy(sorted, decisions)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key() < sorted[j].Key()
+	})
+
+	// Clusters that cannot run the min replicas are not eligible
+	eligible := []hub.Decision{}
+	maxReplicas := []int32{}
+	for _, decision := range sorted {
+		max := constraints.maxReplicasOf(decision)
+		if max != 0 && max < constraints.minReplicas {
+			continue
+		}
+		eligible = append(eligible, decision)
+		maxReplicas = append(maxReplicas, max)
+	}
+
+	numberToDeploy := len(eligible)
+	if limit := int(totalReplica / constraints.minReplicas); limit < numberToDeploy {
+		numberToDeploy = limit
+	}
+
+	reasons := []string{}
+	if numberToDeploy < constraints.minClusters {
+		reasons = append(reasons, fmt.Sprintf("%d clusters are required but the replicas can be split to %d clusters",
+			constraints.minClusters, numberToDeploy))
+	}
+
+	parts := make([]int32, numberToDeploy)
+	remaining := totalReplica
+	for i := range parts {
+		parts[i] = constraints.minReplicas
+		remaining -= constraints.minReplicas
+	}
+
+	// Spread the rest evenly on the clusters below their max replicas
+	remaining = fill(parts, maxReplicas, remaining)
+
+	if remaining > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d replicas exceed the max replicas of the clusters", remaining))
+	}
+
+	allocations := []replicaAllocation{}
+	for i, replicas := range parts {
+		allocations = append(allocations, replicaAllocation{decision: eligible[i], replicas: replicas})
+	}
+	return allocations, reasons
+}
+
+// fill spreads the replicas evenly on the parts below their max, a max of 0 is unbounded. It returns
+// the replicas exceeding the max of all the parts.
+func fill(parts, max []int32, replicas int32) int32 {
+	for replicas > 0 {
+		open := []int{}
+		for i := range parts {
+			if max[i] == 0 || parts[i] < max[i] {
+				open = append(open, i)
+			}
+		}
+		if len(open) == 0 {
+			break
+		}
+
+		for k, share := range divide(replicas, len(open)) {
+			i := open[k]
+			if max[i] != 0 && parts[i]+share > max[i] {
+				share = max[i] - parts[i]
+			}
+			parts[i] += share
+			replicas -= share
+		}
+	}
+	return replicas
+}
+
+// recordUnsatisfiable annotates the kcp deployment with the constraints the split does not satisfy
+func (d *DeploymentSplitter) recordUnsatisfiable(
+	ctx context.Context, recorder events.Recorder, deployment *appsv1.Deployment, reasons []string) error {
+	message := strings.Join(reasons, "; ")
+	if deployment.Annotations[unsatisfiableAnnotation] == message {
+		return nil
+	}
+
+	var patch []byte
+	if len(message) == 0 {
+		patch = []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, unsatisfiableAnnotation))
+	} else {
+		recorder.Warningf("SplitUnsatisfiable", "Deployment %s/%s cannot be split within its constraints: %s",
+			deployment.Namespace, deployment.Name, message)
+		patch = []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, unsatisfiableAnnotation, message))
+	}
+
+	_, err := d.kcpKubeClient.AppsV1().Deployments(deployment.Namespace).Patch(
+		ctx, deployment.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package splitter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// newTestScope returns a scope of a hub whose cluster lister holds the clusters, the informers are
+// never started.
+func newTestScope(t *testing.T, clusters ...*clusterapiv1.ManagedCluster) *hub.Scope {
+	informers := clusterinformers.NewSharedInformerFactory(nil, 0)
+	indexer := informers.Cluster().V1().ManagedClusters().Informer().GetIndexer()
+	for _, cluster := range clusters {
+		if err := indexer.Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &hub.Scope{Hub: &hub.Hub{Name: "hub", ClusterInformers: informers}, WorkingNamespace: "ws"}
+}
+
+func newCluster(name string, labels, annotations map[string]string, claims ...clusterapiv1.ManagedClusterClaim) *clusterapiv1.ManagedCluster {
+	return &clusterapiv1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, Annotations: annotations},
+		Status:     clusterapiv1.ManagedClusterStatus{ClusterClaims: claims},
+	}
+}
+
+func maxReplicas(value string) map[string]string {
+	return map[string]string{clusterMaxReplicasAnnotation: value}
+}
+
+func decisionsOf(scope *hub.Scope, names ...string) []hub.Decision {
+	decisions := []hub.Decision{}
+	for _, name := range names {
+		decisions = append(decisions, hub.Decision{Scope: scope, ClusterName: name})
+	}
+	return decisions
+}
+
+func allocated(allocations []replicaAllocation) []string {
+	result := []string{}
+	for _, allocation := range allocations {
+		result = append(result, fmt.Sprintf("%s=%d", allocation.decision.Key(), allocation.replicas))
+	}
+	return result
+}
+
+func TestSplitReplicas(t *testing.T) {
+	cases := []struct {
+		name                string
+		clusters            []*clusterapiv1.ManagedCluster
+		decided             []string
+		replicas            int32
+		constraints         splitConstraints
+		expectedAllocations []string
+		expectedReasons     []string
+	}{
+		{
+			name:                "spread evenly in the order of the cluster keys",
+			decided:             []string{"c3", "c1", "c2"},
+			replicas:            5,
+			constraints:         splitConstraints{minReplicas: 1},
+			expectedAllocations: []string{"hub/c1=2", "hub/c2=2", "hub/c3=1"},
+			expectedReasons:     []string{},
+		},
+		{
+			name:                "min replicas limit the number of clusters",
+			decided:             []string{"c1", "c2", "c3"},
+			replicas:            3,
+			constraints:         splitConstraints{minReplicas: 2},
+			expectedAllocations: []string{"hub/c1=3"},
+			expectedReasons:     []string{},
+		},
+		{
+			name:                "no replicas",
+			decided:             []string{"c1", "c2"},
+			replicas:            0,
+			constraints:         splitConstraints{minReplicas: 1},
+			expectedAllocations: []string{},
+			expectedReasons:     []string{},
+		},
+		{
+			name:                "min clusters unsatisfiable",
+			decided:             []string{"c1", "c2", "c3"},
+			replicas:            4,
+			constraints:         splitConstraints{minReplicas: 2, minClusters: 3},
+			expectedAllocations: []string{"hub/c1=2", "hub/c2=2"},
+			expectedReasons:     []string{"3 clusters are required but the replicas can be split to 2 clusters"},
+		},
+		{
+			name:                "max replicas of a cluster",
+			clusters:            []*clusterapiv1.ManagedCluster{newCluster("c1", nil, maxReplicas("1"))},
+			decided:             []string{"c1", "c2"},
+			replicas:            5,
+			constraints:         splitConstraints{minReplicas: 1},
+			expectedAllocations: []string{"hub/c1=1", "hub/c2=4"},
+			expectedReasons:     []string{},
+		},
+		{
+			name:                "cluster max replicas lower than the deployment max",
+			clusters:            []*clusterapiv1.ManagedCluster{newCluster("c1", nil, maxReplicas("2"))},
+			decided:             []string{"c1", "c2"},
+			replicas:            6,
+			constraints:         splitConstraints{minReplicas: 1, maxReplicas: 3},
+			expectedAllocations: []string{"hub/c1=2", "hub/c2=3"},
+			expectedReasons:     []string{"1 replicas exceed the max replicas of the clusters"},
+		},
+		{
+			name:                "cluster below the min replicas is not eligible",
+			clusters:            []*clusterapiv1.ManagedCluster{newCluster("c1", nil, maxReplicas("1"))},
+			decided:             []string{"c1", "c2"},
+			replicas:            4,
+			constraints:         splitConstraints{minReplicas: 2},
+			expectedAllocations: []string{"hub/c2=4"},
+			expectedReasons:     []string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scope := newTestScope(t, c.clusters...)
+			allocations, reasons := splitReplicas(c.replicas, decisionsOf(scope, c.decided...), c.constraints)
+			if actual := allocated(allocations); !reflect.DeepEqual(actual, c.expectedAllocations) {
+				t.Errorf("expected allocations %v, got %v", c.expectedAllocations, actual)
+			}
+			if !reflect.DeepEqual(reasons, c.expectedReasons) {
+				t.Errorf("expected reasons %v, got %v", c.expectedReasons, reasons)
+			}
+		})
+	}
+}
+
+func TestFill(t *testing.T) {
+	cases := []struct {
+		name              string
+		parts             []int32
+		max               []int32
+		replicas          int32
+		expectedParts     []int32
+		expectedRemaining int32
+	}{
+		{
+			name:          "unbounded",
+			parts:         []int32{0, 0, 0},
+			max:           []int32{0, 0, 0},
+			replicas:      7,
+			expectedParts: []int32{3, 2, 2},
+		},
+		{
+			name:          "on top of the existing parts",
+			parts:         []int32{1, 1},
+			max:           []int32{0, 0},
+			replicas:      3,
+			expectedParts: []int32{3, 2},
+		},
+		{
+			name:          "full parts pass the replicas on",
+			parts:         []int32{0, 0},
+			max:           []int32{1, 0},
+			replicas:      5,
+			expectedParts: []int32{1, 4},
+		},
+		{
+			name:              "all parts full",
+			parts:             []int32{1, 1},
+			max:               []int32{1, 1},
+			replicas:          3,
+			expectedParts:     []int32{1, 1},
+			expectedRemaining: 3,
+		},
+		{
+			name:              "no parts",
+			parts:             []int32{},
+			max:               []int32{},
+			replicas:          2,
+			expectedParts:     []int32{},
+			expectedRemaining: 2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			remaining := fill(c.parts, c.max, c.replicas)
+			if !reflect.DeepEqual(c.parts, c.expectedParts) {
+				t.Errorf("expected parts %v, got %v", c.expectedParts, c.parts)
+			}
+			if remaining != c.expectedRemaining {
+				t.Errorf("expected %d remaining replicas, got %d", c.expectedRemaining, remaining)
+			}
+		})
+	}
+}
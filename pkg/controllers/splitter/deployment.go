@@ -2,88 +2,137 @@ package splitter
 
 import (
 	"context"
-	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/openshift/library-go/pkg/controller/factory"
 	"github.com/openshift/library-go/pkg/operator/events"
 	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/selection"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
 	appsinformer "k8s.io/client-go/informers/apps/v1"
+	autoscalinginformer "k8s.io/client-go/informers/autoscaling/v2beta2"
+	"k8s.io/client-go/kubernetes"
 	appslister "k8s.io/client-go/listers/apps/v1"
+	autoscalinglister "k8s.io/client-go/listers/autoscaling/v2beta2"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
-	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
-	clusterinformerv1alpha1 "open-cluster-management.io/api/client/cluster/informers/externalversions/cluster/v1alpha1"
 	clusterlisterv1alpha1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1alpha1"
-	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
-	workinformer "open-cluster-management.io/api/client/work/informers/externalversions/work/v1"
-	worklister "open-cluster-management.io/api/client/work/listers/work/v1"
 	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
 	workapiv1 "open-cluster-management.io/api/work/v1"
 )
 
 const (
-	splitLabel     = "kcp.open-cluster-management.io/splitter"
+	splitLabel     = hub.SplitWorkLabel
 	placementLabel = "cluster.open-cluster-management.io/placement"
+
+	// replicasAnnotation records on the work the replicas allocated to the cluster
+	replicasAnnotation = "kcp.open-cluster-management.io/replicas"
 )
 
+// replicaAllocation is the replicas of a split deployment on a decided cluster
+type replicaAllocation struct {
+	decision hub.Decision
+	replicas int32
+}
+
 type DeploymentSplitter struct {
-	clusterClient       clusterclient.Interface
-	manifestWorkClient  workv1client.WorkV1Interface
+	kcpKubeClient       kubernetes.Interface
 	kcpDeploymentLister appslister.DeploymentLister
-	placementLister     clusterlisterv1alpha1.PlacementLister
-	decisionLister      clusterlisterv1alpha1.PlacementDecisionLister
-	workLister          worklister.ManifestWorkLister
+	kcpHPALister        autoscalinglister.HorizontalPodAutoscalerLister
+	hubs                []*hub.Scope
+	overrider           *override.Overrider
+	validator           *policy.Validator
 	workingNamespace    string
+	// reportStatus is set when the clusters run the status reporter of the API probe
+	reportStatus bool
 }
 
 func NewDeploymentSplitter(
-	clusterClient clusterclient.Interface,
-	manifestWorkClient workv1client.WorkV1Interface,
 	namespace string,
+	kcpKubeClient kubernetes.Interface,
 	kcpDeploymentInformer appsinformer.DeploymentInformer,
-	placementInformer clusterinformerv1alpha1.PlacementInformer,
-	placementDecisionInformer clusterinformerv1alpha1.PlacementDecisionInformer,
-	workInformer workinformer.ManifestWorkInformer,
+	kcpHPAInformer autoscalinginformer.HorizontalPodAutoscalerInformer,
+	reportStatus bool,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
 	recorder events.Recorder,
 ) factory.Controller {
 	controller := &DeploymentSplitter{
-		clusterClient:       clusterClient,
-		manifestWorkClient:  manifestWorkClient,
+		overrider:           overrider,
+		validator:           validator,
 		workingNamespace:    namespace,
+		kcpKubeClient:       kcpKubeClient,
 		kcpDeploymentLister: kcpDeploymentInformer.Lister(),
-		placementLister:     placementInformer.Lister(),
-		decisionLister:      placementDecisionInformer.Lister(),
-		workLister:          workInformer.Lister(),
+		kcpHPALister:        kcpHPAInformer.Lister(),
+		reportStatus:        reportStatus,
+		hubs:                hubs,
 	}
 
-	return factory.New().
+	syncCtx := factory.NewSyncContext("Deployment-Splitter", recorder)
+
+	// The replicas are left to the HPAs scaling the deployments
+	kcpHPAInformer.Informer().AddEventHandler(enqueueScaledDeployments(syncCtx))
+
+	f := factory.New().
+		WithSyncContext(syncCtx).
 		WithInformersQueueKeyFunc(func(obj runtime.Object) string {
 			key, _ := cache.MetaNamespaceKeyFunc(obj)
 			return key
 		}, kcpDeploymentInformer.Informer()).
-		WithFilteredEventsInformersQueueKeyFunc(func(obj runtime.Object) string {
+		WithBareInformers(kcpHPAInformer.Informer())
+
+	helpers.RequeueOnChange(syncCtx, overrider.Informer(), controller.deploymentKeys)
+	helpers.RequeueOnChange(syncCtx, validator.Informer(), controller.deploymentKeys)
+
+	for _, scope := range hubs {
+		watchClusters(syncCtx, scope, controller.deploymentKeys)
+
+		placementLister := scope.Placements().Lister()
+		f = f.WithFilteredEventsInformersQueueKeyFunc(func(obj runtime.Object) string {
 			accessor, _ := meta.Accessor(obj)
-			key, _ := splitDeploymentKey(accessor.GetName())
+			key, _ := deploymentKeyOf(accessor, namespace)
 			return key
 		}, func(obj interface{}) bool {
 			accessor, _ := meta.Accessor(obj)
-			_, valid := splitDeploymentKey(accessor.GetName())
+			_, valid := deploymentKeyOf(accessor, namespace)
 			return valid
-		}, workInformer.Informer(), placementInformer.Informer()).
-		WithFilteredEventsInformersQueueKeyFunc(
-			controller.decisionQueueKey,
-			controller.decisionFilter, placementDecisionInformer.Informer()).
-		WithSync(controller.sync).ToController("Deployment-Splitter", recorder)
+		}, scope.ManifestWorks().Informer(), scope.Placements().Informer()).
+			WithFilteredEventsInformersQueueKeyFunc(
+				func(obj runtime.Object) string {
+					return decisionQueueKey(placementLister, namespace, obj)
+				},
+				func(obj interface{}) bool {
+					return decisionFilter(placementLister, namespace, obj)
+				}, scope.PlacementDecisions().Informer())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "Deployment-Splitter", controller.sync)).ToController("Deployment-Splitter", recorder)
+}
+
+func (d *DeploymentSplitter) deploymentKeys() []string {
+	keys := []string{}
+	deployments, err := d.kcpDeploymentLister.List(labels.Everything())
+	if err != nil {
+		return keys
+	}
+	for _, deployment := range deployments {
+		if key, err := cache.MetaNamespaceKeyFunc(deployment); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
 
 func (d *DeploymentSplitter) sync(ctx context.Context, syncCtx factory.SyncContext) error {
@@ -102,80 +151,120 @@ func (d *DeploymentSplitter) sync(ctx context.Context, syncCtx factory.SyncConte
 		return err
 	}
 
-	placementName := fmt.Sprintf("deployment-%s-%s", namespace, name)
-
-	placement, err := d.placementLister.Placements(d.workingNamespace).Get(placementName)
+	placementName := deploymentPlacementName(namespace, name)
 
-	switch {
-	case errors.IsNotFound(err):
-		placement = &clusterapiv1alpha1.Placement{
+	// The placement is evaluated on each hub the logical cluster is bound to
+	for _, scope := range d.hubs {
+		placement := &clusterapiv1alpha1.Placement{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      placementName,
-				Namespace: d.workingNamespace,
+				Name: placementName,
 			},
 			Spec: clusterapiv1alpha1.PlacementSpec{},
 		}
+		helpers.SetSource(placement, d.sourceOf(deployment))
+		if err := scope.EnsurePlacement(ctx, placement); err != nil {
+			return err
+		}
+	}
 
-		_, err = d.clusterClient.ClusterV1alpha1().Placements(d.workingNamespace).Create(ctx, placement, metav1.CreateOptions{})
+	canaryDecisions, err := d.ensureCanaryPlacement(ctx, deployment)
+	if err != nil {
 		return err
-	case err != nil:
+	}
+
+	decisions, err := hub.DecisionsOf(d.hubs, placementName)
+	if err != nil {
 		return err
 	}
 
-	decisions, err := helpers.GetDecisionsByPlacement(d.decisionLister, placement.Name, d.workingNamespace)
+	// The canary clusters only run the canary share of the replicas
+	decisions = excludeDecisions(decisions, canaryDecisions)
+
+	// The replicas are moved off the clusters marked to be drained
+	decisions, draining := hub.SplitDraining(decisions)
+	canaryDecisions, canaryDraining := hub.SplitDraining(canaryDecisions)
+
+	// The replicas only go to the clusters the creator of the deployment is allowed to deliver to
+	decisions, denied, err := hub.AuthorizedDecisions(ctx, deployment, decisions)
+	if err != nil {
+		return err
+	}
+	canaryDecisions, canaryDenied, err := hub.AuthorizedDecisions(ctx, deployment, canaryDecisions)
 	if err != nil {
 		return err
 	}
+	if denied = append(denied, canaryDenied...); len(denied) > 0 {
+		syncCtx.Recorder().Warningf("Unauthorized", "The creator of deployment %s/%s is not allowed to deliver it to clusters %s",
+			namespace, name, strings.Join(denied, ","))
+	}
 
-	err = d.generateDeploymentSplitter(ctx, deployment, decisions)
+	err = d.generateDeploymentSplitter(ctx, syncCtx, deployment, decisions, canaryDecisions, append(draining, canaryDraining...))
 
 	return err
 }
 
 func (d *DeploymentSplitter) generateDeploymentSplitter(
-	ctx context.Context, deployment *appsv1.Deployment, decisions []clusterapiv1alpha1.ClusterDecision) error {
+	ctx context.Context, syncCtx factory.SyncContext, deployment *appsv1.Deployment, decisions, canaryDecisions, draining []hub.Decision) error {
 
 	if deployment.Spec.Replicas == nil {
 		return nil
 	}
 
-	numberToDeploy := int(*deployment.Spec.Replicas)
+	canaryTotal := canaryReplicas(deployment, *deployment.Spec.Replicas, len(canaryDecisions))
+	allocations, reasons := splitReplicasByTopology(
+		*deployment.Spec.Replicas-canaryTotal, decisions, constraintsOf(deployment), topologyKeyOf(deployment))
+	canaryAllocations, _ := splitReplicas(canaryTotal, canaryDecisions, splitConstraints{minReplicas: 1})
 
-	if len(decisions) < numberToDeploy {
-		numberToDeploy = len(decisions)
+	if err := d.recordUnsatisfiable(ctx, syncCtx.Recorder(), deployment, reasons); err != nil {
+		return err
 	}
 
-	if numberToDeploy == 0 {
+	if len(allocations)+len(canaryAllocations) == 0 {
+		if len(draining) > 0 {
+			syncCtx.Recorder().Warningf("DrainBlocked", "Deployment %s/%s has no cluster to move the replicas of the draining clusters to",
+				deployment.Namespace, deployment.Name)
+		}
 		return nil
 	}
 
-	totalReplica := *deployment.Spec.Replicas
+	workName := deploymentWorkName(d.workingNamespace, deployment.Namespace, deployment.Name)
 
-	workName := fmt.Sprintf("deployment-%s-%s", deployment.Namespace, deployment.Name)
+	// The HPA delivered with the deployment scales the replicas on each cluster, the replicas of the split
+	// are only recorded to divide the min and max replicas of the HPA.
+	hpa, err := hpaOf(d.kcpHPALister, deployment.Namespace, deployment.Name)
+	if err != nil {
+		return err
+	}
+	scaled := hpa != nil && hpa.Annotations[hpaModeAnnotation] != hpaModeGlobal
 
 	errorArray := []error{}
 
 	deployedClusters := sets.NewString()
 
-	for numberToDeploy > 0 {
-		cluster := decisions[numberToDeploy-1].ClusterName
+	targets := []*rolloutTarget{}
+	canaryTargets := []*rolloutTarget{}
+	for i, allocation := range append(allocations, canaryAllocations...) {
+		decision := allocation.decision
+		replica := allocation.replicas
 
 		// Record the  desired cluster to deploy
-		deployedClusters.Insert(cluster)
+		deployedClusters.Insert(decision.Key())
 
-		// Calculate the current replica for this cluster
-		replica := totalReplica / int32(numberToDeploy)
-
-		numberToDeploy = numberToDeploy - 1
-		totalReplica = totalReplica - replica
-
-		// Build the deployment with the resplica
+		// Build the deployment with the resplica, the cluster reports its status for the rollouts
+		labels := map[string]string{reportStatusLabel: "true"}
+		for key, value := range deployment.Labels {
+			labels[key] = value
+		}
+		annotations := map[string]string{}
+		for key, value := range deployment.Annotations {
+			annotations[key] = value
+		}
 		toBeDeployed := &appsv1.Deployment{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:        deployment.Name,
 				Namespace:   deployment.Namespace,
-				Labels:      deployment.Labels,
-				Annotations: deployment.Annotations,
+				Labels:      labels,
+				Annotations: annotations,
 			},
 			TypeMeta: metav1.TypeMeta{
 				APIVersion: appsv1.SchemeGroupVersion.String(),
@@ -185,69 +274,200 @@ func (d *DeploymentSplitter) generateDeploymentSplitter(
 		}
 
 		toBeDeployed.Spec.Replicas = &replica
+		if scaled {
+			toBeDeployed.Spec.Replicas = nil
+		}
 
 		work := &workapiv1.ManifestWork{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      workName,
-				Namespace: cluster,
+				Namespace: decision.ClusterName,
 				Labels: map[string]string{
 					splitLabel: workName,
 				},
-			},
-			Spec: workapiv1.ManifestWorkSpec{
-				Workload: workapiv1.ManifestsTemplate{
-					Manifests: []workapiv1.Manifest{
-						{
-							RawExtension: runtime.RawExtension{Object: toBeDeployed},
-						},
-					},
+				Annotations: map[string]string{
+					replicasAnnotation: strconv.Itoa(int(replica)),
 				},
 			},
 		}
 
-		if err := helpers.ApplyWork(ctx, d.manifestWorkClient, work); err != nil {
+		helpers.SetSource(work, d.sourceOf(deployment))
+
+		target := &rolloutTarget{decision: decision, deployment: toBeDeployed, work: work, reportStatus: d.reportStatus}
+		if i >= len(allocations) {
+			work.Labels[canaryLabel] = "true"
+			canaryTargets = append(canaryTargets, target)
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	// The template change is held back on the clusters out of the canary until it is promoted,
+	// and then on the clusters out of the current wave of a progressive rollout
+	promoted, inProgress, err := canary(syncCtx.Recorder(), deployment, canaryTargets, targets)
+	if err != nil {
+		return err
+	}
+
+	if promoted {
+		inProgress, err = rollout(syncCtx.Recorder(), deployment, targets)
+		if err != nil {
+			return err
+		}
+	}
+
+	violations := policy.NewViolations()
+	for _, target := range append(targets, canaryTargets...) {
+		// The reported status is matched to the template of the work by its hash
+		target.deployment.Annotations[templateHashAnnotation] = target.work.Annotations[templateHashAnnotation]
+
+		var manifest runtime.Object = target.deployment
+		if !target.heldBack {
+			manifest, err = d.overrider.Apply(target.decision, target.deployment)
+			if err != nil {
+				errorArray = append(errorArray, err)
+				continue
+			}
+
+			// The cluster keeps the deployment already delivered when the deployment violates the policies
+			violated, err := d.validator.Validate(target.decision, manifest)
+			if err != nil {
+				errorArray = append(errorArray, err)
+				continue
+			}
+			violations.Add(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment, target.decision, violated)
+			if len(violated) > 0 {
+				continue
+			}
+		}
+
+		target.work.Spec.Workload.Manifests = []workapiv1.Manifest{
+			{
+				RawExtension: runtime.RawExtension{Object: manifest},
+			},
+		}
+
+		if err := helpers.SetDeleteOption(target.work, target.decision.Scope.DeletePolicy); err != nil {
+			errorArray = append(errorArray, err)
+			continue
+		}
+
+		if err := helpers.ApplyWork(ctx, target.decision.Scope.WorkClient(), target.work); err != nil {
 			errorArray = append(errorArray, err)
 			continue
 		}
 	}
 
+	if err := d.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errorArray = append(errorArray, err)
+	}
+
 	if len(errorArray) != 0 {
 		return utilerrors.NewAggregate(errorArray)
 	}
 
+	// The works on the draining clusters are kept until the replicas are available on the other clusters
+	if len(draining) > 0 {
+		moved, err := drained(append(targets, canaryTargets...))
+		if err != nil {
+			return err
+		}
+		if !moved {
+			for _, decision := range draining {
+				deployedClusters.Insert(decision.Key())
+			}
+			inProgress = true
+		}
+
+		deployed, err := deployedOn(draining, workName)
+		if err != nil {
+			return err
+		}
+		if moved && deployed && !d.reportStatus {
+			syncCtx.Recorder().Warningf("DrainStatusUnavailable",
+				"Deployment %s/%s is moved off the draining clusters once the other clusters apply it, the clusters do not report the status of the deployments without the API probe",
+				deployment.Namespace, deployment.Name)
+		}
+	}
+
+	if inProgress {
+		syncCtx.Queue().AddAfter(syncCtx.QueueKey(), rolloutInterval)
+	}
+
 	if err := d.cleanWork(ctx, workName, deployedClusters); err != nil {
 		return err
 	}
 
-	return nil
+	return d.cleanLegacyNames(ctx, deployment)
 }
 
-func (d *DeploymentSplitter) cleanWork(ctx context.Context, workName string, deployedCluster sets.String) error {
-	requirement, err := labels.NewRequirement(splitLabel, selection.Equals, []string{workName})
-
+// cleanLegacyNames deletes the works and placements of the deployment under the legacy names once the
+// works under the new name are applied.
+func (d *DeploymentSplitter) cleanLegacyNames(ctx context.Context, deployment *appsv1.Deployment) error {
+	err := cleanLegacyWorks(ctx, d.hubs, splitLabel, legacyWorkNames(deploymentPrefix, deployment.Namespace, deployment.Name),
+		deployment.Namespace, deployment.Name)
 	if err != nil {
 		return err
 	}
 
-	labelSelector := labels.NewSelector().Add(*requirement)
-
-	works, err := d.workLister.List(labelSelector)
+	legacyNames := []string{
+		legacySplitName(deploymentPrefix, deployment.Namespace, deployment.Name),
+		legacySplitName(canaryDeploymentPrefix, deployment.Namespace, deployment.Name),
+	}
+	for _, scope := range d.hubs {
+		for _, name := range legacyNames {
+			placement, err := scope.Placements().Lister().Placements(scope.WorkingNamespace).Get(name)
+			switch {
+			case errors.IsNotFound(err):
+				continue
+			case err != nil:
+				return err
+			}
+
+			// The legacy name may be the new name of a deployment of another namespace
+			if source, ok := helpers.SourceOf(placement); ok && source.Namespace != deployment.Namespace {
+				continue
+			}
+			if err := scope.DeletePlacement(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	if err != nil {
-		return err
+// divide divides the total into n parts, the front parts get the remainder
+func divide(total int32, n int) []int32 {
+	parts := make([]int32, n)
+	for i := n; i > 0; i-- {
+		parts[i-1] = total / int32(i)
+		total = total - parts[i-1]
 	}
+	return parts
+}
+
+func (d *DeploymentSplitter) cleanWork(ctx context.Context, workName string, deployedCluster sets.String) error {
+	labelSelector := splitWorkSelector(splitLabel, workName, d.workingNamespace)
 
 	errorArray := []error{}
 
-	for _, work := range works {
-		if deployedCluster.Has(work.Namespace) {
-			continue
+	for _, scope := range d.hubs {
+		works, err := scope.ManifestWorks().Lister().List(labelSelector)
+
+		if err != nil {
+			return err
 		}
 
-		err := d.manifestWorkClient.ManifestWorks(work.Namespace).Delete(ctx, workName, metav1.DeleteOptions{})
+		for _, work := range works {
+			if deployedCluster.Has(hub.ClusterKey(scope.Hub.Name, work.Namespace)) {
+				continue
+			}
 
-		if err != nil {
-			errorArray = append(errorArray, err)
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, workName, metav1.DeleteOptions{})
+
+			if err != nil {
+				errorArray = append(errorArray, err)
+			}
 		}
 	}
 
@@ -258,38 +478,34 @@ func (d *DeploymentSplitter) cleanWork(ctx context.Context, workName string, dep
 	return nil
 }
 
-func (d *DeploymentSplitter) decisionFilter(object interface{}) bool {
-	placement := helpers.GetPlacementByDecision(d.placementLister, object)
+func decisionFilter(placementLister clusterlisterv1alpha1.PlacementLister, workingNamespace string, object interface{}) bool {
+	placement := helpers.GetPlacementByDecision(placementLister, object)
 
 	if placement == nil {
 		return false
 	}
 
-	_, valid := splitDeploymentKey(placement.Name)
+	_, valid := deploymentKeyOf(placement, workingNamespace)
 	return valid
 }
 
-func (d *DeploymentSplitter) decisionQueueKey(object runtime.Object) string {
-	placement := helpers.GetPlacementByDecision(d.placementLister, object)
+func decisionQueueKey(placementLister clusterlisterv1alpha1.PlacementLister, workingNamespace string, object runtime.Object) string {
+	placement := helpers.GetPlacementByDecision(placementLister, object)
 
 	if placement == nil {
 		return ""
 	}
 
-	key, _ := splitDeploymentKey(placement.Name)
+	key, _ := deploymentKeyOf(placement, workingNamespace)
 	return key
 }
 
-func splitDeploymentKey(key string) (string, bool) {
-	if !strings.HasPrefix("deployment-", key) {
-		return "", false
-	}
-
-	keyArray := strings.SplitN(strings.TrimPrefix("deployment-", key), "-", 2)
-
-	if len(keyArray) < 2 {
-		return "", false
+// sourceOf returns the source of the works and placements of the deployment
+func (d *DeploymentSplitter) sourceOf(deployment *appsv1.Deployment) helpers.Source {
+	return helpers.Source{
+		LogicalCluster: d.workingNamespace,
+		Resource:       appsv1.SchemeGroupVersion.WithResource("deployments"),
+		Namespace:      deployment.Namespace,
+		Name:           deployment.Name,
 	}
-
-	return fmt.Sprintf("%s/%s", keyArray[0], keyArray[1]), true
 }
@@ -0,0 +1,77 @@
+package splitter
+
+import (
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// watchClusters requeues the deployments when a managed cluster is marked to be drained or unmarked,
+// or its max replicas, topology or storage classes change.
+func watchClusters(syncCtx factory.SyncContext, scope *hub.Scope, keysFunc func() []string) {
+	scope.ManagedClusters().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCluster, ok := oldObj.(*clusterapiv1.ManagedCluster)
+			if !ok {
+				return
+			}
+			newCluster, ok := newObj.(*clusterapiv1.ManagedCluster)
+			if !ok {
+				return
+			}
+			if oldCluster.Labels[hub.DrainLabel] == newCluster.Labels[hub.DrainLabel] &&
+				oldCluster.Annotations[clusterMaxReplicasAnnotation] == newCluster.Annotations[clusterMaxReplicasAnnotation] &&
+				topologyOfCluster(oldCluster, corev1.LabelTopologyRegion) == topologyOfCluster(newCluster, corev1.LabelTopologyRegion) &&
+				topologyOfCluster(oldCluster, corev1.LabelTopologyZone) == topologyOfCluster(newCluster, corev1.LabelTopologyZone) &&
+				oldCluster.Annotations[clusterStorageClassesAnnotation] == newCluster.Annotations[clusterStorageClassesAnnotation] {
+				return
+			}
+
+			// Any deployment may be split to the cluster once it is back in service
+			for _, key := range keysFunc() {
+				syncCtx.Queue().Add(key)
+			}
+		},
+	})
+}
+
+// drained returns whether the replicas moved off the draining clusters are available on the
+// clusters they are moved to, or only applied when the clusters do not report the status of the
+// deployments, see workRolloutState.
+func drained(targets []*rolloutTarget) (bool, error) {
+	for _, target := range targets {
+		existing, err := target.decision.Scope.ManifestWorks().Lister().ManifestWorks(target.decision.ClusterName).Get(target.work.Name)
+		switch {
+		case errors.IsNotFound(err):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+
+		if existing.Annotations[replicasAnnotation] != target.work.Annotations[replicasAnnotation] {
+			return false, nil
+		}
+		if workRolloutState(target, existing) != rolloutAvailable {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deployedOn returns whether the work is still on any of the draining clusters
+func deployedOn(draining []hub.Decision, workName string) (bool, error) {
+	for _, decision := range draining {
+		_, err := decision.Scope.ManifestWorks().Lister().ManifestWorks(decision.ClusterName).Get(workName)
+		switch {
+		case errors.IsNotFound(err):
+			continue
+		case err != nil:
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
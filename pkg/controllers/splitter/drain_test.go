@@ -0,0 +1,110 @@
+package splitter
+
+import (
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+func TestDrained(t *testing.T) {
+	deployment := newDeployment("web:v1")
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		reportStatus bool
+		available    metav1.ConditionStatus
+		statusLines  []string
+		replicas     string
+		expected     bool
+	}{
+		{
+			name:      "moved replicas applied without the status reporter",
+			available: metav1.ConditionTrue,
+			replicas:  "3",
+			expected:  true,
+		},
+		{
+			name:      "moved replicas not applied without the status reporter",
+			available: metav1.ConditionFalse,
+			replicas:  "3",
+			expected:  false,
+		},
+		{
+			name:      "replicas not moved yet",
+			available: metav1.ConditionTrue,
+			replicas:  "2",
+			expected:  false,
+		},
+		{
+			name:         "moved replicas not reported",
+			reportStatus: true,
+			available:    metav1.ConditionTrue,
+			replicas:     "3",
+			expected:     false,
+		},
+		{
+			name:         "moved replicas reported available",
+			reportStatus: true,
+			available:    metav1.ConditionTrue,
+			statusLines:  []string{"default/web " + hash + " 1 1 3 3 3 NewReplicaSetAvailable"},
+			replicas:     "3",
+			expected:     true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cluster := newCluster("cluster1", nil, nil)
+			if len(c.statusLines) > 0 {
+				cluster.Status.ClusterClaims = statusClaims(t, c.statusLines...)
+			}
+			work := newSplitWork(t, "cluster1", deployment, metav1.ConditionTrue, c.available)
+			work.Annotations[replicasAnnotation] = c.replicas
+			scope := newWorkScope(t, []*clusterapiv1.ManagedCluster{cluster}, work)
+
+			target := newTarget(scope, "cluster1", deployment, c.reportStatus)
+			target.work.Annotations[replicasAnnotation] = "3"
+			moved, err := drained([]*rolloutTarget{target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if moved != c.expected {
+				t.Errorf("expected drained %v, got %v", c.expected, moved)
+			}
+		})
+	}
+}
+
+func TestDeployedOn(t *testing.T) {
+	workName := deploymentWorkName("ws", "default", "web")
+	scope := newWorkScope(t, nil, &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Namespace: "cluster1", Name: workName}})
+
+	cases := []struct {
+		name     string
+		draining []hub.Decision
+		expected bool
+	}{
+		{name: "no draining cluster", expected: false},
+		{name: "work on a draining cluster", draining: []hub.Decision{{Scope: scope, ClusterName: "cluster2"}, {Scope: scope, ClusterName: "cluster1"}}, expected: true},
+		{name: "work cleaned from the draining cluster", draining: []hub.Decision{{Scope: scope, ClusterName: "cluster2"}}, expected: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			deployed, err := deployedOn(c.draining, workName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deployed != c.expected {
+				t.Errorf("expected deployed %v, got %v", c.expected, deployed)
+			}
+		})
+	}
+}
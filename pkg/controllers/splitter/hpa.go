@@ -0,0 +1,422 @@
+package splitter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	autoscalinginformer "k8s.io/client-go/informers/autoscaling/v2beta2"
+	autoscalinglister "k8s.io/client-go/listers/autoscaling/v2beta2"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	hpaLabel = "kcp.open-cluster-management.io/hpa"
+
+	// hpaModeAnnotation selects how the HPA of a split deployment scales, the HPA is split
+	// per cluster by default.
+	hpaModeAnnotation = "kcp.open-cluster-management.io/hpa-mode"
+	hpaModeGlobal     = "global"
+)
+
+// clusterReplicas is the replicas allocated to a cluster by the deployment splitter
+type clusterReplicas struct {
+	scope       *hub.Scope
+	clusterName string
+	replicas    int32
+}
+
+type HPASplitter struct {
+	kcpHPALister     autoscalinglister.HorizontalPodAutoscalerLister
+	hubs             []*hub.Scope
+	overrider        *override.Overrider
+	validator        *policy.Validator
+	workingNamespace string
+}
+
+// NewHPASplitter propagates the HPAs of split deployments, with the min and max replicas divided
+// on the clusters the deployment is split to in proportion to their replicas.
+func NewHPASplitter(
+	namespace string,
+	kcpHPAInformer autoscalinginformer.HorizontalPodAutoscalerInformer,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	controller := &HPASplitter{
+		kcpHPALister:     kcpHPAInformer.Lister(),
+		hubs:             hubs,
+		overrider:        overrider,
+		validator:        validator,
+		workingNamespace: namespace,
+	}
+
+	syncCtx := factory.NewSyncContext("HPA-Splitter", recorder)
+	helpers.RequeueOnChange(syncCtx, overrider.Informer(), controller.deploymentKeys)
+	helpers.RequeueOnChange(syncCtx, validator.Informer(), controller.deploymentKeys)
+
+	// The queue key is the key of the scaled deployment
+	kcpHPAInformer.Informer().AddEventHandler(enqueueScaledDeployments(syncCtx))
+	f := factory.New().
+		WithSyncContext(syncCtx).
+		WithBareInformers(kcpHPAInformer.Informer())
+
+	for _, scope := range hubs {
+		f = f.WithFilteredEventsInformersQueueKeyFunc(func(obj runtime.Object) string {
+			accessor, _ := meta.Accessor(obj)
+			key, _ := deploymentKeyOf(accessor, namespace)
+			return key
+		}, func(obj interface{}) bool {
+			accessor, _ := meta.Accessor(obj)
+			if _, ok := accessor.GetLabels()[splitLabel]; !ok {
+				return false
+			}
+			_, valid := deploymentKeyOf(accessor, namespace)
+			return valid
+		}, scope.ManifestWorks().Informer())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "HPA-Splitter", controller.sync)).ToController("HPA-Splitter", recorder)
+}
+
+func (h *HPASplitter) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	key := syncCtx.QueueKey()
+	klog.V(4).Infof("HPA-Splitter %s sync %s", h.workingNamespace, key)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	workName := splitWorkName(hpaPrefix, h.workingNamespace, namespace, name)
+
+	hpa, err := hpaOf(h.kcpHPALister, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	if hpa == nil {
+		return h.removeWorks(ctx, namespace, name)
+	}
+
+	// The work API does not report the utilisation of the clusters, so the replicas cannot be scaled
+	// globally. The mode is rejected and the works already delivered are kept as they are.
+	if hpa.Annotations[hpaModeAnnotation] == hpaModeGlobal {
+		syncCtx.Recorder().Warningf("HPAModeUnsupported",
+			"HPA %s/%s requests global mode, which requires utilisation feedback from the clusters that is not available", namespace, hpa.Name)
+		return nil
+	}
+
+	allocations, err := currentAllocations(h.hubs, deploymentWorkName(h.workingNamespace, namespace, name))
+	if err != nil {
+		return err
+	}
+
+	minReplicas := int32(1)
+	if hpa.Spec.MinReplicas != nil {
+		minReplicas = *hpa.Spec.MinReplicas
+	}
+	replicas := []int32{}
+	for _, allocation := range allocations {
+		replicas = append(replicas, allocation.replicas)
+	}
+	mins := weigh(minReplicas, replicas)
+	maxs := weigh(hpa.Spec.MaxReplicas, replicas)
+
+	errs := []error{}
+	deployedClusters := sets.NewString()
+	violations := policy.NewViolations()
+	for i, allocation := range allocations {
+		allowed, err := authorized(ctx, syncCtx.Recorder(), hpa, "HPA", allocation)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !allowed {
+			continue
+		}
+		deployedClusters.Insert(hub.ClusterKey(allocation.scope.Hub.Name, allocation.clusterName))
+
+		// A HPA scales at least one replica
+		clusterMin := mins[i]
+		if clusterMin < 1 {
+			clusterMin = 1
+		}
+		clusterMax := maxs[i]
+		if clusterMax < clusterMin {
+			clusterMax = clusterMin
+		}
+
+		toBeDeployed := &autoscalingv2beta2.HorizontalPodAutoscaler{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: autoscalingv2beta2.SchemeGroupVersion.String(),
+				Kind:       "HorizontalPodAutoscaler",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        hpa.Name,
+				Namespace:   hpa.Namespace,
+				Labels:      hpa.Labels,
+				Annotations: hpa.Annotations,
+			},
+			Spec: *hpa.Spec.DeepCopy(),
+		}
+		toBeDeployed.Spec.MinReplicas = &clusterMin
+		toBeDeployed.Spec.MaxReplicas = clusterMax
+
+		decision := hub.Decision{Scope: allocation.scope, ClusterName: allocation.clusterName}
+		manifest, err := h.overrider.Apply(decision, toBeDeployed)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		// The cluster keeps the HPA already delivered when the HPA violates the policies
+		violated, err := h.validator.Validate(decision, manifest)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		violations.Add(autoscalingv2beta2.SchemeGroupVersion.WithResource("horizontalpodautoscalers"), hpa, decision, violated)
+		if len(violated) > 0 {
+			continue
+		}
+
+		work := &workapiv1.ManifestWork{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      workName,
+				Namespace: allocation.clusterName,
+				Labels: map[string]string{
+					hpaLabel: workName,
+				},
+			},
+			Spec: workapiv1.ManifestWorkSpec{
+				Workload: workapiv1.ManifestsTemplate{
+					Manifests: []workapiv1.Manifest{
+						{
+							RawExtension: runtime.RawExtension{Object: manifest},
+						},
+					},
+				},
+			},
+		}
+		helpers.SetSource(work, helpers.Source{
+			LogicalCluster: h.workingNamespace,
+			Resource:       autoscalingv2beta2.SchemeGroupVersion.WithResource("horizontalpodautoscalers"),
+			Namespace:      hpa.Namespace,
+			Name:           hpa.Name,
+		})
+
+		if err := helpers.SetDeleteOption(work, allocation.scope.DeletePolicy); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := helpers.ApplyWork(ctx, allocation.scope.WorkClient(), work); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := h.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	if err := cleanLegacyWorks(ctx, h.hubs, hpaLabel, legacyWorkNames(hpaPrefix, namespace, name), namespace, hpa.Name); err != nil {
+		return err
+	}
+
+	return h.cleanWork(ctx, workName, deployedClusters)
+}
+
+func (h *HPASplitter) deploymentKeys() []string {
+	keys := []string{}
+	hpas, err := h.kcpHPALister.List(labels.Everything())
+	if err != nil {
+		return keys
+	}
+	for _, hpa := range hpas {
+		if scalesDeployment(hpa) {
+			keys = append(keys, fmt.Sprintf("%s/%s", hpa.Namespace, hpa.Spec.ScaleTargetRef.Name))
+		}
+	}
+	return keys
+}
+
+// hpaOf returns the HPA scaling the deployment, or nil if there is none
+func hpaOf(lister autoscalinglister.HorizontalPodAutoscalerLister, namespace, deploymentName string) (*autoscalingv2beta2.HorizontalPodAutoscaler, error) {
+	hpas, err := lister.HorizontalPodAutoscalers(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hpas, func(i, j int) bool {
+		return hpas[i].Name < hpas[j].Name
+	})
+
+	for _, hpa := range hpas {
+		if scalesDeployment(hpa) && hpa.Spec.ScaleTargetRef.Name == deploymentName && hpa.DeletionTimestamp == nil {
+			return hpa, nil
+		}
+	}
+	return nil, nil
+}
+
+// removeWorks deletes the works of the HPA of the deployment, including the works under the legacy name
+func (h *HPASplitter) removeWorks(ctx context.Context, namespace, name string) error {
+	if err := cleanLegacyWorks(ctx, h.hubs, hpaLabel, legacyWorkNames(hpaPrefix, namespace, name), namespace, ""); err != nil {
+		return err
+	}
+	return h.cleanWork(ctx, splitWorkName(hpaPrefix, h.workingNamespace, namespace, name), sets.NewString())
+}
+
+func (h *HPASplitter) cleanWork(ctx context.Context, workName string, deployedClusters sets.String) error {
+	labelSelector := splitWorkSelector(hpaLabel, workName, h.workingNamespace)
+
+	errs := []error{}
+	for _, scope := range h.hubs {
+		works, err := scope.ManifestWorks().Lister().List(labelSelector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if deployedClusters.Has(hub.ClusterKey(scope.Hub.Name, work.Namespace)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, workName, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func scalesDeployment(hpa *autoscalingv2beta2.HorizontalPodAutoscaler) bool {
+	return hpa.Spec.ScaleTargetRef.Kind == "Deployment"
+}
+
+// enqueueScaledDeployments queues the keys of the deployments scaled by the HPAs, the previous target
+// is queued too when the target of a HPA changes.
+func enqueueScaledDeployments(syncCtx factory.SyncContext) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		hpa, ok := obj.(*autoscalingv2beta2.HorizontalPodAutoscaler)
+		if !ok || !scalesDeployment(hpa) {
+			return
+		}
+		syncCtx.Queue().Add(fmt.Sprintf("%s/%s", hpa.Namespace, hpa.Spec.ScaleTargetRef.Name))
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueue(oldObj)
+			enqueue(newObj)
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+// weigh divides the total on the clusters in proportion to their replicas, the largest remainders
+// get the rest. The total is divided evenly when no cluster has replicas.
+func weigh(total int32, replicas []int32) []int32 {
+	sum := int64(0)
+	for _, r := range replicas {
+		sum += int64(r)
+	}
+	if sum == 0 {
+		return divide(total, len(replicas))
+	}
+
+	parts := make([]int32, len(replicas))
+	remainders := make([]int64, len(replicas))
+	remaining := total
+	for i, r := range replicas {
+		parts[i] = int32(int64(total) * int64(r) / sum)
+		remainders[i] = int64(total) * int64(r) % sum
+		remaining -= parts[i]
+	}
+
+	order := make([]int, len(replicas))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for i := 0; remaining > 0; i++ {
+		parts[order[i%len(order)]]++
+		remaining--
+	}
+	return parts
+}
+
+// currentAllocations returns the replicas recorded on the works of the split deployment,
+// sorted by the cluster key so every caller divides in the same order.
+func currentAllocations(hubs []*hub.Scope, deploymentWorkName string) ([]clusterReplicas, error) {
+	allocations := []clusterReplicas{}
+	for _, scope := range hubs {
+		works, err := scope.ManifestWorks().Lister().List(splitWorkSelector(splitLabel, deploymentWorkName, scope.WorkingNamespace))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, work := range works {
+			replicas, err := strconv.Atoi(work.Annotations[replicasAnnotation])
+			if err != nil || replicas <= 0 || work.DeletionTimestamp != nil {
+				continue
+			}
+			allocations = append(allocations, clusterReplicas{
+				scope:       scope,
+				clusterName: work.Namespace,
+				replicas:    int32(replicas),
+			})
+		}
+	}
+
+	sort.Slice(allocations, func(i, j int) bool {
+		return hub.ClusterKey(allocations[i].scope.Hub.Name, allocations[i].clusterName) <
+			hub.ClusterKey(allocations[j].scope.Hub.Name, allocations[j].clusterName)
+	})
+	return allocations, nil
+}
+
+// authorized returns whether the creator of the object is allowed to deliver it to the cluster of the
+// allocation, and records a warning when it is not.
+func authorized(ctx context.Context, recorder events.Recorder, obj metav1.Object, kind string, allocation clusterReplicas) (bool, error) {
+	allowed, err := allocation.scope.Authorize(ctx, obj, allocation.clusterName)
+	if err != nil || allowed {
+		return allowed, err
+	}
+
+	recorder.Warningf("Unauthorized", "The creator of %s %s/%s is not allowed to deliver it to cluster %s",
+		kind, obj.GetNamespace(), obj.GetName(), hub.ClusterKey(allocation.scope.Hub.Name, allocation.clusterName))
+	return false, nil
+}
@@ -0,0 +1,132 @@
+package splitter
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	deploymentPrefix       = "deployment"
+	canaryDeploymentPrefix = "canary-deployment"
+	hpaPrefix              = "hpa"
+	pdbPrefix              = "pdb"
+	pvcPrefix              = "pvc"
+
+	// nameHashLength is the length of the hash of the object key appended to the truncated names
+	nameHashLength = 10
+)
+
+// splitName returns the name of the works and placements of a kcp object split to the clusters. The
+// namespace and the name are joined with a dot, which namespaces never contain, so two objects never
+// share a name. The names are also label values, the names longer than a label value are truncated
+// and end with a hash of the object key instead.
+func splitName(prefix, namespace, name string) string {
+	splitName := fmt.Sprintf("%s-%s.%s", prefix, namespace, name)
+	if len(splitName) <= validation.LabelValueMaxLength {
+		return splitName
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(namespace+"/"+name)))[:nameHashLength]
+	truncated := strings.TrimRight(splitName[:validation.LabelValueMaxLength-nameHashLength-1], "-.")
+	return fmt.Sprintf("%s-%s", truncated, hash)
+}
+
+// splitWorkName returns the name of the works of a kcp object split to the clusters. The logical clusters
+// share the namespaces of the clusters on the hub, so the working namespace is joined to the namespace
+// of the object with a dot too.
+func splitWorkName(prefix, workingNamespace, namespace, name string) string {
+	return splitName(prefix, workingNamespace+"."+namespace, name)
+}
+
+// legacySplitName returns the name used before the names were encoded by splitName, it is ambiguous
+// when the namespace contains dashes and is only used to clean the works and placements it named.
+func legacySplitName(prefix, namespace, name string) string {
+	return fmt.Sprintf("%s-%s-%s", prefix, namespace, name)
+}
+
+// legacyWorkNames returns the names of the works of a kcp object before they were named by splitWorkName,
+// the works named without the working namespace collide across the logical clusters.
+func legacyWorkNames(prefix, namespace, name string) []string {
+	return []string{legacySplitName(prefix, namespace, name), splitName(prefix, namespace, name)}
+}
+
+func deploymentWorkName(workingNamespace, namespace, name string) string {
+	return splitWorkName(deploymentPrefix, workingNamespace, namespace, name)
+}
+
+func deploymentPlacementName(namespace, name string) string {
+	return splitName(deploymentPrefix, namespace, name)
+}
+
+func canaryPlacementName(namespace, name string) string {
+	return splitName(canaryDeploymentPrefix, namespace, name)
+}
+
+// PlacementNames returns the names of the placements the splitter creates for a deployment
+func PlacementNames(namespace, name string) []string {
+	return []string{deploymentPlacementName(namespace, name), canaryPlacementName(namespace, name)}
+}
+
+// deploymentKeyOf returns the key of the kcp deployment a work or placement of the logical cluster is
+// created for, from the source recorded on it.
+func deploymentKeyOf(obj metav1.Object, workingNamespace string) (string, bool) {
+	source, ok := helpers.SourceOf(obj)
+	if !ok || source.LogicalCluster != workingNamespace || len(source.Name) == 0 {
+		return "", false
+	}
+	if source.Resource != appsv1.SchemeGroupVersion.WithResource("deployments") {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s", source.Namespace, source.Name), true
+}
+
+// splitWorkSelector selects the works labelled with the name of the split that the logical cluster created
+func splitWorkSelector(label, workName, workingNamespace string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{label: workName, helpers.SourceLogicalClusterLabel: workingNamespace})
+}
+
+// cleanLegacyWorks deletes the works labelled with the legacy names that are recorded for the object of
+// the namespace in the logical cluster, and the works named with a legacy name that were created before
+// the works recorded their source. The legacy name of an object may equal the new name of another object,
+// whose works always have a source and are kept. An empty name matches the objects of the namespace.
+func cleanLegacyWorks(ctx context.Context, hubs []*hub.Scope, label string, legacyNames []string, namespace, name string) error {
+	errs := []error{}
+	for _, legacyName := range legacyNames {
+		selector := labels.SelectorFromSet(labels.Set{label: legacyName})
+		for _, scope := range hubs {
+			works, err := scope.ManifestWorks().Lister().List(selector)
+			if err != nil {
+				return err
+			}
+
+			for _, work := range works {
+				source, ok := helpers.SourceOf(work)
+				switch {
+				case ok && source.LogicalCluster == scope.WorkingNamespace && source.Namespace == namespace &&
+					(len(name) == 0 || source.Name == name):
+				case !ok && work.Name == legacyName:
+				default:
+					continue
+				}
+
+				err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+				if err != nil && !errors.IsNotFound(err) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
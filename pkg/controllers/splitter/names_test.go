@@ -0,0 +1,205 @@
+package splitter
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// fakeWorkClient records the deleted works
+type fakeWorkClient struct {
+	workclient.Interface
+	workv1client.WorkV1Interface
+	deleted []string
+}
+
+func (c *fakeWorkClient) WorkV1() workv1client.WorkV1Interface {
+	return c
+}
+
+func (c *fakeWorkClient) ManifestWorks(namespace string) workv1client.ManifestWorkInterface {
+	return &fakeManifestWorks{client: c, namespace: namespace}
+}
+
+type fakeManifestWorks struct {
+	workv1client.ManifestWorkInterface
+	client    *fakeWorkClient
+	namespace string
+}
+
+func (w *fakeManifestWorks) Delete(_ context.Context, name string, _ metav1.DeleteOptions) error {
+	w.client.deleted = append(w.client.deleted, w.namespace+"/"+name)
+	return nil
+}
+
+// newDeploymentWork returns a work of the split deployment default/web recorded for the logical cluster
+func newDeploymentWork(clusterName, name, logicalCluster string) *workapiv1.ManifestWork {
+	work := &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{
+		Namespace: clusterName, Name: name, Labels: map[string]string{splitLabel: name},
+	}}
+	if len(logicalCluster) > 0 {
+		helpers.SetSource(work, helpers.Source{
+			LogicalCluster: logicalCluster,
+			Resource:       appsv1.SchemeGroupVersion.WithResource("deployments"),
+			Namespace:      "default",
+			Name:           "web",
+		})
+	}
+	return work
+}
+
+func TestSplitName(t *testing.T) {
+	long := strings.Repeat("n", 40)
+
+	cases := []struct {
+		name      string
+		prefix    string
+		namespace string
+		objName   string
+		expected  string
+		// expectedPrefix is checked instead of expected for the truncated names
+		expectedPrefix string
+	}{
+		{
+			name:      "short name",
+			prefix:    deploymentPrefix,
+			namespace: "default",
+			objName:   "web",
+			expected:  "deployment-default.web",
+		},
+		{
+			name:      "dashes in the namespace",
+			prefix:    deploymentPrefix,
+			namespace: "a-b",
+			objName:   "c",
+			expected:  "deployment-a-b.c",
+		},
+		{
+			name:      "dashes in the name",
+			prefix:    deploymentPrefix,
+			namespace: "a",
+			objName:   "b-c",
+			expected:  "deployment-a.b-c",
+		},
+		{
+			name:           "long name",
+			prefix:         canaryDeploymentPrefix,
+			namespace:      "default",
+			objName:        long,
+			expectedPrefix: "canary-deployment-default." + long[:63-nameHashLength-len("canary-deployment-default.")-1] + "-",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := splitName(c.prefix, c.namespace, c.objName)
+			if errs := validation.IsValidLabelValue(actual); len(errs) > 0 {
+				t.Errorf("%q is not a label value: %v", actual, errs)
+			}
+			if len(c.expectedPrefix) == 0 {
+				if actual != c.expected {
+					t.Errorf("expected %q, got %q", c.expected, actual)
+				}
+				return
+			}
+			if len(actual) != validation.LabelValueMaxLength || !strings.HasPrefix(actual, c.expectedPrefix) {
+				t.Errorf("expected a truncated name starting with %q, got %q", c.expectedPrefix, actual)
+			}
+		})
+	}
+}
+
+func TestSplitNameUnique(t *testing.T) {
+	long := strings.Repeat("n", 60)
+	names := [][]string{
+		{"a-b", "c"},
+		{"a", "b-c"},
+		{"default", long + "1"},
+		{"default", long + "2"},
+		{"default" + long, "x"},
+	}
+
+	seen := map[string][]string{}
+	for _, key := range names {
+		name := splitName(deploymentPrefix, key[0], key[1])
+		if other, ok := seen[name]; ok {
+			t.Errorf("%v and %v are both split to %q", other, key, name)
+		}
+		seen[name] = key
+	}
+}
+
+func TestSplitWorkNameUnique(t *testing.T) {
+	names := [][]string{
+		{"ws1", "default", "web"},
+		{"ws2", "default", "web"},
+		{"ws1-default", "x", "web"},
+		{"ws1", "default-x", "web"},
+	}
+
+	seen := map[string][]string{}
+	for _, key := range names {
+		name := splitWorkName(deploymentPrefix, key[0], key[1], key[2])
+		if other, ok := seen[name]; ok {
+			t.Errorf("%v and %v are both split to %q", other, key, name)
+		}
+		seen[name] = key
+	}
+	if name := splitWorkName(deploymentPrefix, "ws1", "default", "web"); name != "deployment-ws1.default.web" {
+		t.Errorf("unexpected work name %q", name)
+	}
+}
+
+func TestCleanWork(t *testing.T) {
+	workName := deploymentWorkName("ws", "default", "web")
+	workClient := &fakeWorkClient{}
+	scope := newWorkScope(t, nil,
+		newDeploymentWork("cluster1", workName, "ws"),
+		newDeploymentWork("cluster2", workName, "ws"),
+		// the label of another logical cluster never selects the works of the logical cluster
+		newDeploymentWork("cluster3", workName, "ws2"),
+	)
+	scope.Hub.WorkClient = workClient
+
+	d := &DeploymentSplitter{hubs: []*hub.Scope{scope}, workingNamespace: "ws"}
+	if err := d.cleanWork(context.Background(), workName, sets.NewString(hub.ClusterKey("hub", "cluster1"))); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"cluster2/" + workName}; !reflect.DeepEqual(workClient.deleted, expected) {
+		t.Errorf("expected deleted works %v, got %v", expected, workClient.deleted)
+	}
+}
+
+func TestCleanLegacyWorks(t *testing.T) {
+	unscoped := splitName(deploymentPrefix, "default", "web")
+	workClient := &fakeWorkClient{}
+	scope := newWorkScope(t, nil,
+		newDeploymentWork("cluster1", legacySplitName(deploymentPrefix, "default", "web"), ""),
+		newDeploymentWork("cluster1", unscoped, "ws"),
+		newDeploymentWork("cluster2", unscoped, "ws2"),
+		newDeploymentWork("cluster1", deploymentWorkName("ws", "default", "web"), "ws"),
+	)
+	scope.Hub.WorkClient = workClient
+
+	err := cleanLegacyWorks(context.Background(), []*hub.Scope{scope}, splitLabel, legacyWorkNames(deploymentPrefix, "default", "web"), "default", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(workClient.deleted)
+	expected := []string{"cluster1/" + legacySplitName(deploymentPrefix, "default", "web"), "cluster1/" + unscoped}
+	if !reflect.DeepEqual(workClient.deleted, expected) {
+		t.Errorf("expected deleted works %v, got %v", expected, workClient.deleted)
+	}
+}
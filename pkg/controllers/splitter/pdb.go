@@ -0,0 +1,374 @@
+package splitter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	appsinformer "k8s.io/client-go/informers/apps/v1"
+	policyinformer "k8s.io/client-go/informers/policy/v1"
+	appslister "k8s.io/client-go/listers/apps/v1"
+	policylister "k8s.io/client-go/listers/policy/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// pdbLabel is set on the works of the PDBs with the working namespace they belong to
+	pdbLabel          = "kcp.open-cluster-management.io/pdb"
+	pdbNamespaceLabel = "kcp.open-cluster-management.io/pdb-namespace"
+)
+
+type PDBSplitter struct {
+	kcpPDBLister        policylister.PodDisruptionBudgetLister
+	kcpDeploymentLister appslister.DeploymentLister
+	hubs                []*hub.Scope
+	overrider           *override.Overrider
+	validator           *policy.Validator
+	workingNamespace    string
+}
+
+// NewPDBSplitter propagates the PDBs of split deployments, with minAvailable or maxUnavailable
+// divided in proportion to the replicas allocated to each cluster.
+func NewPDBSplitter(
+	namespace string,
+	kcpPDBInformer policyinformer.PodDisruptionBudgetInformer,
+	kcpDeploymentInformer appsinformer.DeploymentInformer,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	controller := &PDBSplitter{
+		kcpPDBLister:        kcpPDBInformer.Lister(),
+		kcpDeploymentLister: kcpDeploymentInformer.Lister(),
+		hubs:                hubs,
+		overrider:           overrider,
+		validator:           validator,
+		workingNamespace:    namespace,
+	}
+
+	// A PDB may select several deployments and the allocation of a deployment may affect several
+	// PDBs, so all the PDBs of a namespace are synced together and the queue key is the namespace.
+	syncCtx := factory.NewSyncContext("PDB-Splitter", recorder)
+	helpers.RequeueOnChange(syncCtx, overrider.Informer(), controller.namespaces)
+	helpers.RequeueOnChange(syncCtx, validator.Informer(), controller.namespaces)
+
+	f := factory.New().
+		WithSyncContext(syncCtx).
+		WithInformersQueueKeyFunc(func(obj runtime.Object) string {
+			accessor, _ := meta.Accessor(obj)
+			return accessor.GetNamespace()
+		}, kcpPDBInformer.Informer(), kcpDeploymentInformer.Informer())
+
+	for _, scope := range hubs {
+		f = f.WithFilteredEventsInformersQueueKeyFunc(func(obj runtime.Object) string {
+			accessor, _ := meta.Accessor(obj)
+			if ns, ok := accessor.GetLabels()[pdbNamespaceLabel]; ok {
+				return ns
+			}
+			key, _ := deploymentKeyOf(accessor, namespace)
+			ns, _, _ := cache.SplitMetaNamespaceKey(key)
+			return ns
+		}, func(obj interface{}) bool {
+			accessor, _ := meta.Accessor(obj)
+			if accessor.GetLabels()[pdbLabel] == namespace {
+				return true
+			}
+			if _, ok := accessor.GetLabels()[splitLabel]; !ok {
+				return false
+			}
+			_, valid := deploymentKeyOf(accessor, namespace)
+			return valid
+		}, scope.ManifestWorks().Informer())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "PDB-Splitter", controller.sync)).ToController("PDB-Splitter", recorder)
+}
+
+func (p *PDBSplitter) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	namespace := syncCtx.QueueKey()
+	klog.V(4).Infof("PDB-Splitter %s sync %s", p.workingNamespace, namespace)
+
+	pdbs, err := p.kcpPDBLister.PodDisruptionBudgets(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	deployments, err := p.kcpDeploymentLister.Deployments(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Name < deployments[j].Name
+	})
+
+	errs := []error{}
+	deployed := sets.NewString()
+	violations := policy.NewViolations()
+	for _, pdb := range pdbs {
+		if pdb.DeletionTimestamp != nil {
+			continue
+		}
+
+		deployment, err := selectedDeployment(pdb, deployments)
+		if err != nil {
+			syncCtx.Recorder().Warningf("InvalidPDBSelector", "PDB %s/%s has an invalid selector: %v", namespace, pdb.Name, err)
+			continue
+		}
+		if deployment == nil {
+			continue
+		}
+
+		allocations, err := currentAllocations(p.hubs, deploymentWorkName(p.workingNamespace, namespace, deployment.Name))
+		if err != nil {
+			return err
+		}
+
+		workName := splitWorkName(pdbPrefix, p.workingNamespace, namespace, pdb.Name)
+		for i, spec := range splitPDBSpec(pdb.Spec, allocations) {
+			allocation := allocations[i]
+			allowed, err := authorized(ctx, syncCtx.Recorder(), pdb, "PDB", allocation)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !allowed {
+				continue
+			}
+			deployed.Insert(workKey(allocation.scope.Hub.Name, allocation.clusterName, workName))
+
+			toBeDeployed := &policyv1.PodDisruptionBudget{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: policyv1.SchemeGroupVersion.String(),
+					Kind:       "PodDisruptionBudget",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        pdb.Name,
+					Namespace:   pdb.Namespace,
+					Labels:      pdb.Labels,
+					Annotations: pdb.Annotations,
+				},
+				Spec: spec,
+			}
+
+			decision := hub.Decision{Scope: allocation.scope, ClusterName: allocation.clusterName}
+			manifest, err := p.overrider.Apply(decision, toBeDeployed)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			// The cluster keeps the PDB already delivered when the PDB violates the policies
+			violated, err := p.validator.Validate(decision, manifest)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			violations.Add(policyv1.SchemeGroupVersion.WithResource("poddisruptionbudgets"), pdb, decision, violated)
+			if len(violated) > 0 {
+				continue
+			}
+
+			work := &workapiv1.ManifestWork{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      workName,
+					Namespace: allocation.clusterName,
+					Labels: map[string]string{
+						pdbLabel:          p.workingNamespace,
+						pdbNamespaceLabel: namespace,
+					},
+				},
+				Spec: workapiv1.ManifestWorkSpec{
+					Workload: workapiv1.ManifestsTemplate{
+						Manifests: []workapiv1.Manifest{
+							{
+								RawExtension: runtime.RawExtension{Object: manifest},
+							},
+						},
+					},
+				},
+			}
+			helpers.SetSource(work, helpers.Source{
+				LogicalCluster: p.workingNamespace,
+				Resource:       policyv1.SchemeGroupVersion.WithResource("poddisruptionbudgets"),
+				Namespace:      pdb.Namespace,
+				Name:           pdb.Name,
+			})
+
+			if err := helpers.SetDeleteOption(work, allocation.scope.DeletePolicy); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if err := helpers.ApplyWork(ctx, allocation.scope.WorkClient(), work); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if err := p.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	return p.cleanWorks(ctx, namespace, deployed)
+}
+
+// namespaces returns the namespaces with PDBs
+func (p *PDBSplitter) namespaces() []string {
+	pdbs, err := p.kcpPDBLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+
+	namespaces := sets.NewString()
+	for _, pdb := range pdbs {
+		namespaces.Insert(pdb.Namespace)
+	}
+	return namespaces.List()
+}
+
+// cleanWorks deletes the PDB works of the namespace that are not deployed
+func (p *PDBSplitter) cleanWorks(ctx context.Context, namespace string, deployed sets.String) error {
+	selector := labels.SelectorFromSet(labels.Set{
+		pdbLabel:          p.workingNamespace,
+		pdbNamespaceLabel: namespace,
+	})
+
+	errs := []error{}
+	for _, scope := range p.hubs {
+		works, err := scope.ManifestWorks().Lister().List(selector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if deployed.Has(workKey(scope.Hub.Name, work.Namespace, work.Name)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func workKey(hubName, clusterName, workName string) string {
+	return fmt.Sprintf("%s/%s", hub.ClusterKey(hubName, clusterName), workName)
+}
+
+// selectedDeployment returns the first deployment whose pods are selected by the PDB
+func selectedDeployment(pdb *policyv1.PodDisruptionBudget, deployments []*appsv1.Deployment) (*appsv1.Deployment, error) {
+	if pdb.Spec.Selector == nil {
+		return nil, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if selector.Empty() {
+		return nil, nil
+	}
+
+	for _, deployment := range deployments {
+		if selector.Matches(labels.Set(deployment.Spec.Template.Labels)) {
+			return deployment, nil
+		}
+	}
+	return nil, nil
+}
+
+// splitPDBSpec returns the PDB spec of each allocation. Percentages apply to the replicas on each
+// cluster as they are, absolute numbers are apportioned in proportion to the replicas.
+func splitPDBSpec(spec policyv1.PodDisruptionBudgetSpec, allocations []clusterReplicas) []policyv1.PodDisruptionBudgetSpec {
+	replicas := make([]int32, len(allocations))
+	for i, allocation := range allocations {
+		replicas[i] = allocation.replicas
+	}
+
+	var minAvailable, maxUnavailable []int32
+	if spec.MinAvailable != nil && spec.MinAvailable.Type == intstr.Int {
+		minAvailable = apportion(spec.MinAvailable.IntVal, replicas)
+	}
+	if spec.MaxUnavailable != nil && spec.MaxUnavailable.Type == intstr.Int {
+		maxUnavailable = apportion(spec.MaxUnavailable.IntVal, replicas)
+	}
+
+	specs := []policyv1.PodDisruptionBudgetSpec{}
+	for i := range allocations {
+		clusterSpec := *spec.DeepCopy()
+		if minAvailable != nil {
+			value := intstr.FromInt(int(minAvailable[i]))
+			clusterSpec.MinAvailable = &value
+		}
+		if maxUnavailable != nil {
+			value := intstr.FromInt(int(maxUnavailable[i]))
+			clusterSpec.MaxUnavailable = &value
+		}
+		specs = append(specs, clusterSpec)
+	}
+	return specs
+}
+
+// apportion divides the total in proportion to the replicas, a part never exceeds the replicas
+// and the remainder goes to the front parts that still have room.
+func apportion(total int32, replicas []int32) []int32 {
+	sum := int32(0)
+	for _, r := range replicas {
+		sum += r
+	}
+
+	parts := make([]int32, len(replicas))
+	if sum == 0 {
+		return parts
+	}
+	if total > sum {
+		total = sum
+	}
+
+	remaining := total
+	for i, r := range replicas {
+		parts[i] = int32(int64(total) * int64(r) / int64(sum))
+		remaining -= parts[i]
+	}
+
+	for remaining > 0 {
+		for i := range parts {
+			if remaining == 0 {
+				break
+			}
+			if parts[i] < replicas[i] {
+				parts[i]++
+				remaining--
+			}
+		}
+	}
+	return parts
+}
@@ -0,0 +1,60 @@
+package splitter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApportion(t *testing.T) {
+	cases := []struct {
+		name     string
+		total    int32
+		replicas []int32
+		expected []int32
+	}{
+		{
+			name:     "proportional",
+			total:    3,
+			replicas: []int32{2, 2, 2},
+			expected: []int32{1, 1, 1},
+		},
+		{
+			name:     "remainder to the front parts",
+			total:    4,
+			replicas: []int32{2, 2, 2},
+			expected: []int32{2, 1, 1},
+		},
+		{
+			name:     "remainder skips the full parts",
+			total:    1,
+			replicas: []int32{3, 1},
+			expected: []int32{1, 0},
+		},
+		{
+			name:     "never more than the replicas",
+			total:    10,
+			replicas: []int32{1, 2},
+			expected: []int32{1, 2},
+		},
+		{
+			name:     "no replicas",
+			total:    2,
+			replicas: []int32{0, 0},
+			expected: []int32{0, 0},
+		},
+		{
+			name:     "no parts",
+			total:    2,
+			replicas: []int32{},
+			expected: []int32{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := apportion(c.total, c.replicas); !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package splitter
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"github.com/qiujian16/kcp-ocm/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	appsinformer "k8s.io/client-go/informers/apps/v1"
+	coreinformer "k8s.io/client-go/informers/core/v1"
+	appslister "k8s.io/client-go/listers/apps/v1"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// pvcLabel is set on the works of the PVCs with the working namespace they belong to
+	pvcLabel          = "kcp.open-cluster-management.io/pvc"
+	pvcNamespaceLabel = "kcp.open-cluster-management.io/pvc-namespace"
+
+	// clusterStorageClassesAnnotation on a ManagedCluster maps the storage classes of the claims in kcp
+	// to the storage classes of the cluster, as a list of <kcp class>=<cluster class> separated by commas.
+	clusterStorageClassesAnnotation = "kcp.open-cluster-management.io/storage-classes"
+)
+
+type PVCSplitter struct {
+	kcpPVCLister        corelister.PersistentVolumeClaimLister
+	kcpDeploymentLister appslister.DeploymentLister
+	hubs                []*hub.Scope
+	overrider           *override.Overrider
+	validator           *policy.Validator
+	workingNamespace    string
+}
+
+// NewPVCSplitter propagates the PVCs mounted by split deployments to the clusters the deployments
+// are split to, with a claim on each cluster sized by the share of replicas of the cluster.
+func NewPVCSplitter(
+	namespace string,
+	kcpPVCInformer coreinformer.PersistentVolumeClaimInformer,
+	kcpDeploymentInformer appsinformer.DeploymentInformer,
+	hubs []*hub.Scope,
+	overrider *override.Overrider,
+	validator *policy.Validator,
+	fairQueue *helpers.FairShareQueue,
+	recorder events.Recorder,
+) factory.Controller {
+	controller := &PVCSplitter{
+		kcpPVCLister:        kcpPVCInformer.Lister(),
+		kcpDeploymentLister: kcpDeploymentInformer.Lister(),
+		hubs:                hubs,
+		overrider:           overrider,
+		validator:           validator,
+		workingNamespace:    namespace,
+	}
+
+	// As the PDBs, all the PVCs of a namespace are synced together and the queue key is the namespace
+	syncCtx := factory.NewSyncContext("PVC-Splitter", recorder)
+	helpers.RequeueOnChange(syncCtx, overrider.Informer(), controller.namespaces)
+	helpers.RequeueOnChange(syncCtx, validator.Informer(), controller.namespaces)
+
+	f := factory.New().
+		WithSyncContext(syncCtx).
+		WithInformersQueueKeyFunc(func(obj runtime.Object) string {
+			accessor, _ := meta.Accessor(obj)
+			return accessor.GetNamespace()
+		}, kcpPVCInformer.Informer(), kcpDeploymentInformer.Informer())
+
+	for _, scope := range hubs {
+		watchClusters(syncCtx, scope, controller.namespaces)
+		f = f.WithFilteredEventsInformersQueueKeyFunc(func(obj runtime.Object) string {
+			accessor, _ := meta.Accessor(obj)
+			if ns, ok := accessor.GetLabels()[pvcNamespaceLabel]; ok {
+				return ns
+			}
+			key, _ := deploymentKeyOf(accessor, namespace)
+			ns, _, _ := cache.SplitMetaNamespaceKey(key)
+			return ns
+		}, func(obj interface{}) bool {
+			accessor, _ := meta.Accessor(obj)
+			if accessor.GetLabels()[pvcLabel] == namespace {
+				return true
+			}
+			if _, ok := accessor.GetLabels()[splitLabel]; !ok {
+				return false
+			}
+			_, valid := deploymentKeyOf(accessor, namespace)
+			return valid
+		}, scope.ManifestWorks().Informer())
+	}
+
+	return f.WithSync(fairQueue.WrapSync(namespace, "PVC-Splitter", controller.sync)).ToController("PVC-Splitter", recorder)
+}
+
+func (p *PVCSplitter) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	namespace := syncCtx.QueueKey()
+	klog.V(4).Infof("PVC-Splitter %s sync %s", p.workingNamespace, namespace)
+
+	pvcs, err := p.kcpPVCLister.PersistentVolumeClaims(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	deployments, err := p.kcpDeploymentLister.Deployments(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Name < deployments[j].Name
+	})
+
+	errs := []error{}
+	deployed := sets.NewString()
+	violations := policy.NewViolations()
+	for _, pvc := range pvcs {
+		if pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		deployment := mountingDeployment(pvc, deployments)
+		if deployment == nil {
+			continue
+		}
+
+		allocations, err := currentAllocations(p.hubs, deploymentWorkName(p.workingNamespace, namespace, deployment.Name))
+		if err != nil {
+			return err
+		}
+
+		if readWriteOnce(pvc) && len(allocations) > 1 {
+			syncCtx.Recorder().Warningf("ReadWriteOnceClaimSplit",
+				"Deployment %s/%s mounts the ReadWriteOnce claim %s and is split to %d clusters, each cluster gets its own empty claim",
+				namespace, deployment.Name, pvc.Name, len(allocations))
+		}
+
+		total := int32(0)
+		for _, allocation := range allocations {
+			total += allocation.replicas
+		}
+
+		workName := splitWorkName(pvcPrefix, p.workingNamespace, namespace, pvc.Name)
+		for _, allocation := range allocations {
+			allowed, err := authorized(ctx, syncCtx.Recorder(), pvc, "PVC", allocation)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !allowed {
+				continue
+			}
+			deployed.Insert(workKey(allocation.scope.Hub.Name, allocation.clusterName, workName))
+			decision := hub.Decision{Scope: allocation.scope, ClusterName: allocation.clusterName}
+
+			toBeDeployed, err := clusterClaim(pvc, decision, workName, allocation.replicas, total)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			manifest, err := p.overrider.Apply(decision, toBeDeployed)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			// The cluster keeps the claim already delivered when the claim violates the policies
+			violated, err := p.validator.Validate(decision, manifest)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			violations.Add(corev1.SchemeGroupVersion.WithResource("persistentvolumeclaims"), pvc, decision, violated)
+			if len(violated) > 0 {
+				continue
+			}
+
+			work := &workapiv1.ManifestWork{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      workName,
+					Namespace: allocation.clusterName,
+					Labels: map[string]string{
+						pvcLabel:          p.workingNamespace,
+						pvcNamespaceLabel: namespace,
+					},
+				},
+				Spec: workapiv1.ManifestWorkSpec{
+					Workload: workapiv1.ManifestsTemplate{
+						Manifests: []workapiv1.Manifest{
+							{
+								RawExtension: runtime.RawExtension{Object: manifest},
+							},
+						},
+					},
+				},
+			}
+			helpers.SetSource(work, helpers.Source{
+				LogicalCluster: p.workingNamespace,
+				Resource:       corev1.SchemeGroupVersion.WithResource("persistentvolumeclaims"),
+				Namespace:      pvc.Namespace,
+				Name:           pvc.Name,
+			})
+
+			if err := helpers.SetDeleteOption(work, allocation.scope.DeletePolicy); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if err := helpers.ApplyWork(ctx, allocation.scope.WorkClient(), work); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if err := p.validator.Record(ctx, syncCtx.Recorder(), violations); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	return p.cleanWorks(ctx, namespace, deployed)
+}
+
+// namespaces returns the namespaces with PVCs
+func (p *PVCSplitter) namespaces() []string {
+	pvcs, err := p.kcpPVCLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+
+	namespaces := sets.NewString()
+	for _, pvc := range pvcs {
+		namespaces.Insert(pvc.Namespace)
+	}
+	return namespaces.List()
+}
+
+// cleanWorks deletes the PVC works of the namespace that are not deployed
+func (p *PVCSplitter) cleanWorks(ctx context.Context, namespace string, deployed sets.String) error {
+	selector := labels.SelectorFromSet(labels.Set{
+		pvcLabel:          p.workingNamespace,
+		pvcNamespaceLabel: namespace,
+	})
+
+	errs := []error{}
+	for _, scope := range p.hubs {
+		works, err := scope.ManifestWorks().Lister().List(selector)
+		if err != nil {
+			return err
+		}
+
+		for _, work := range works {
+			if deployed.Has(workKey(scope.Hub.Name, work.Namespace, work.Name)) {
+				continue
+			}
+
+			err := scope.WorkClient().ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// mountingDeployment returns the first deployment whose pods mount the claim
+func mountingDeployment(pvc *corev1.PersistentVolumeClaim, deployments []*appsv1.Deployment) *appsv1.Deployment {
+	for _, deployment := range deployments {
+		for _, volume := range deployment.Spec.Template.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc.Name {
+				return deployment
+			}
+		}
+	}
+	return nil
+}
+
+func readWriteOnce(pvc *corev1.PersistentVolumeClaim) bool {
+	for _, mode := range pvc.Spec.AccessModes {
+		if mode == corev1.ReadWriteOnce || mode == corev1.ReadWriteOncePod {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterClaim returns the claim of the cluster. The requested storage is the share of the replicas of
+// the cluster, and it never shrinks below the storage already requested on the cluster since claims
+// cannot be shrunk. The storage class is mapped to the storage class of the cluster.
+func clusterClaim(pvc *corev1.PersistentVolumeClaim, decision hub.Decision, workName string, replicas, total int32) (*corev1.PersistentVolumeClaim, error) {
+	claim := &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "PersistentVolumeClaim",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvc.Name,
+			Namespace:   pvc.Namespace,
+			Labels:      pvc.Labels,
+			Annotations: pvc.Annotations,
+		},
+		Spec: *pvc.Spec.DeepCopy(),
+	}
+	// The volume bound in kcp does not exist on the cluster
+	claim.Spec.VolumeName = ""
+
+	if request, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok && total > 0 {
+		share := (request.Value()*int64(replicas) + int64(total) - 1) / int64(total)
+		size := resource.NewQuantity(share, request.Format)
+
+		// The claim may still be delivered by the work under a legacy name
+		existing, err := deployedClaim(decision, pvc, append([]string{workName}, legacyWorkNames(pvcPrefix, pvc.Namespace, pvc.Name)...)...)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			if deployedSize, ok := existing.Spec.Resources.Requests[corev1.ResourceStorage]; ok && deployedSize.Cmp(*size) > 0 {
+				size = &deployedSize
+			}
+		}
+		claim.Spec.Resources.Requests[corev1.ResourceStorage] = *size
+	}
+
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if cluster != nil && pvc.Spec.StorageClassName != nil {
+		if class, ok := storageClasses(cluster.Annotations[clusterStorageClassesAnnotation])[*pvc.Spec.StorageClassName]; ok {
+			claim.Spec.StorageClassName = &class
+		}
+	}
+
+	return claim, nil
+}
+
+// deployedClaim returns the claim of the PVC in the first of the works of the logical cluster found on the
+// cluster, or nil if there is none
+func deployedClaim(decision hub.Decision, pvc *corev1.PersistentVolumeClaim, workNames ...string) (*corev1.PersistentVolumeClaim, error) {
+	for _, workName := range workNames {
+		work, err := decision.Scope.ManifestWorks().Lister().ManifestWorks(decision.ClusterName).Get(workName)
+		switch {
+		case errors.IsNotFound(err):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		if len(work.Spec.Workload.Manifests) == 0 {
+			continue
+		}
+		if source, ok := helpers.SourceOf(work); ok && source.LogicalCluster != decision.Scope.WorkingNamespace {
+			continue
+		}
+
+		claim := &corev1.PersistentVolumeClaim{}
+		if err := json.Unmarshal(work.Spec.Workload.Manifests[0].Raw, claim); err != nil {
+			return nil, err
+		}
+		if claim.Namespace == pvc.Namespace && claim.Name == pvc.Name {
+			return claim, nil
+		}
+	}
+	return nil, nil
+}
+
+// storageClasses parses the storage class mapping of a cluster, invalid entries are ignored
+func storageClasses(mapping string) map[string]string {
+	classes := map[string]string{}
+	for _, entry := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			continue
+		}
+		classes[parts[0]] = parts[1]
+	}
+	return classes
+}
@@ -0,0 +1,255 @@
+package splitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// rolloutStrategyAnnotation on the kcp deployment rolls template changes out to the clusters
+	// in waves, the template is changed on all the clusters at once by default.
+	rolloutStrategyAnnotation = "kcp.open-cluster-management.io/rollout-strategy"
+	rolloutProgressive        = "Progressive"
+	// rolloutWaveSizeAnnotation is the number of clusters updated at the same time, defaults to 1
+	rolloutWaveSizeAnnotation = "kcp.open-cluster-management.io/rollout-wave-size"
+	// rolloutRollbackAnnotation set to true rolls the failed clusters back to their previous template
+	rolloutRollbackAnnotation = "kcp.open-cluster-management.io/rollout-rollback"
+
+	templateHashAnnotation     = "kcp.open-cluster-management.io/template-hash"
+	previousTemplateAnnotation = "kcp.open-cluster-management.io/previous-template"
+	failedHashAnnotation       = "kcp.open-cluster-management.io/failed-template-hash"
+
+	// rolloutInterval is the interval to check the progress of a rollout
+	rolloutInterval = 10 * time.Second
+)
+
+type rolloutState int
+
+const (
+	rolloutProgressing rolloutState = iota
+	rolloutAvailable
+	rolloutFailed
+)
+
+// rolloutTarget is the deployment and its work to apply on a decided cluster
+type rolloutTarget struct {
+	decision   hub.Decision
+	deployment *appsv1.Deployment
+	work       *workapiv1.ManifestWork
+	// heldBack is set when the deployment keeps the template deployed by the work, which is
+	// already overridden for the cluster
+	heldBack bool
+	// reportStatus is set when the status reporter of the probe runs on the cluster
+	reportStatus bool
+}
+
+// rollout holds the template change back on the clusters out of the current wave when the deployment
+// requests a progressive rollout. It returns whether the rollout has clusters left to wait for.
+//
+// A cluster is rolled out once its status reporter reports the deployment of the updated template with
+// all the replicas updated and available. The work API does not report the status of the deployments,
+// so without the status reporter a cluster is rolled out once the work agent applies the template.
+func rollout(recorder events.Recorder, deployment *appsv1.Deployment, targets []*rolloutTarget) (bool, error) {
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		return false, err
+	}
+	for _, target := range targets {
+		target.work.Annotations[templateHashAnnotation] = hash
+	}
+
+	if deployment.Annotations[rolloutStrategyAnnotation] != rolloutProgressive {
+		return false, nil
+	}
+
+	waveSize := 1
+	if size, err := strconv.Atoi(deployment.Annotations[rolloutWaveSizeAnnotation]); err == nil && size > 0 {
+		waveSize = size
+	}
+	rollback := deployment.Annotations[rolloutRollbackAnnotation] == "true"
+
+	failed := false
+	progressing := 0
+	outdated := []*rolloutTarget{}
+	existingTemplates := map[*rolloutTarget]*corev1.PodTemplateSpec{}
+	for _, target := range targets {
+		existing, err := target.decision.Scope.ManifestWorks().Lister().ManifestWorks(target.decision.ClusterName).Get(target.work.Name)
+		switch {
+		case errors.IsNotFound(err):
+			// Clusters newly decided start with the current template
+			continue
+		case err != nil:
+			return false, err
+		}
+
+		existingTemplate, existingHash, err := workTemplate(existing)
+		if err != nil {
+			return false, err
+		}
+		existingTemplates[target] = existingTemplate
+		if previous, ok := existing.Annotations[previousTemplateAnnotation]; ok {
+			target.work.Annotations[previousTemplateAnnotation] = previous
+		}
+
+		switch {
+		case existing.Annotations[failedHashAnnotation] == hash:
+			// The cluster is rolled back, it keeps the previous template until the template changes again
+			failed = true
+			holdBack(target, existingTemplate, existingHash)
+			target.work.Annotations[failedHashAnnotation] = hash
+		case existingHash != hash:
+			outdated = append(outdated, target)
+		default:
+			switch workRolloutState(target, existing) {
+			case rolloutProgressing:
+				progressing++
+			case rolloutFailed:
+				failed = true
+				recorder.Warningf("RolloutFailed", "Rollout of deployment %s/%s failed on cluster %s",
+					deployment.Namespace, deployment.Name, target.decision.Key())
+				if rollback {
+					if err := rollBack(target, hash); err != nil {
+						return false, err
+					}
+				}
+			}
+		}
+	}
+
+	// The rollout pauses on failures until the template changes
+	if failed {
+		for _, target := range outdated {
+			holdBack(target, existingTemplates[target], "")
+		}
+		return false, nil
+	}
+
+	for i, target := range outdated {
+		if i < waveSize-progressing {
+			previous, err := json.Marshal(existingTemplates[target])
+			if err != nil {
+				return false, err
+			}
+			target.work.Annotations[previousTemplateAnnotation] = string(previous)
+			if !target.reportStatus {
+				recorder.Warningf("RolloutStatusUnavailable",
+					"Deployment %s/%s is rolled out to cluster %s once the previous clusters apply the template, the clusters do not report the status of the deployments without the API probe",
+					deployment.Namespace, deployment.Name, target.decision.Key())
+			}
+			continue
+		}
+		holdBack(target, existingTemplates[target], "")
+	}
+
+	return progressing > 0 || len(outdated) > 0, nil
+}
+
+// holdBack keeps the existing template of the cluster
+func holdBack(target *rolloutTarget, template *corev1.PodTemplateSpec, hash string) {
+	target.deployment.Spec.Template = *template
+	target.heldBack = true
+	if len(hash) == 0 {
+		hash, _ = templateHash(template)
+	}
+	target.work.Annotations[templateHashAnnotation] = hash
+}
+
+// rollBack restores the template the cluster had before the failed template
+func rollBack(target *rolloutTarget, failedHash string) error {
+	data, ok := target.work.Annotations[previousTemplateAnnotation]
+	if !ok || len(data) == 0 {
+		return nil
+	}
+
+	previous := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal([]byte(data), previous); err != nil {
+		return err
+	}
+	holdBack(target, previous, "")
+	target.work.Annotations[failedHashAnnotation] = failedHash
+	return nil
+}
+
+// workRolloutState returns the rollout state of the deployment of the existing work on the cluster of
+// the target. The work is rolled out once the cluster reports the deployment of the template of the work
+// observed with all its replicas updated and available, or once the work agent applies the deployment
+// when the cluster does not report the status of the deployments.
+func workRolloutState(target *rolloutTarget, work *workapiv1.ManifestWork) rolloutState {
+	applied := meta.FindStatusCondition(work.Status.Conditions, workapiv1.WorkApplied)
+	if applied == nil || applied.ObservedGeneration != work.Generation {
+		return rolloutProgressing
+	}
+
+	deployment := target.deployment
+	condition := helpers.FindManifestCondition(work, appsv1.GroupName, "Deployment", deployment.Namespace, deployment.Name)
+	if applied.Status == metav1.ConditionFalse || helpers.IsManifestConditionTrue(condition, workapiv1.ManifestDegraded) {
+		return rolloutFailed
+	}
+
+	if !target.reportStatus {
+		if helpers.IsManifestConditionTrue(condition, workapiv1.ManifestAvailable) {
+			return rolloutAvailable
+		}
+		return rolloutProgressing
+	}
+
+	status, ok := reportedStatus(target.decision, deployment.Namespace, deployment.Name)
+	if !ok || status.templateHash != work.Annotations[templateHashAnnotation] {
+		return rolloutProgressing
+	}
+	switch {
+	case status.progressingReason == progressDeadlineExceeded:
+		return rolloutFailed
+	case status.rolledOut():
+		return rolloutAvailable
+	default:
+		return rolloutProgressing
+	}
+}
+
+// workTemplate returns the pod template deployed by the work and the hash of the template it is
+// built from, the deployed template may be overridden for the cluster.
+func workTemplate(work *workapiv1.ManifestWork) (*corev1.PodTemplateSpec, string, error) {
+	if len(work.Spec.Workload.Manifests) == 0 {
+		return nil, "", fmt.Errorf("work %s/%s has no manifest", work.Namespace, work.Name)
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := json.Unmarshal(work.Spec.Workload.Manifests[0].Raw, deployment); err != nil {
+		return nil, "", err
+	}
+
+	if hash, ok := work.Annotations[templateHashAnnotation]; ok {
+		return &deployment.Spec.Template, hash, nil
+	}
+
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		return nil, "", err
+	}
+	return &deployment.Spec.Template, hash, nil
+}
+
+func templateHash(template *corev1.PodTemplateSpec) (string, error) {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(data)
+	return fmt.Sprintf("%x", hasher.Sum32()), nil
+}
@@ -0,0 +1,250 @@
+package splitter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// newWorkScope returns a scope whose cluster and work listers hold the clusters and the works, the
+// informers are never started.
+func newWorkScope(t *testing.T, clusters []*clusterapiv1.ManagedCluster, works ...*workapiv1.ManifestWork) *hub.Scope {
+	scope := (&hub.Hub{Name: "hub", ClusterInformers: clusterinformers.NewSharedInformerFactory(nil, 0)}).NewScope("ws")
+	for _, cluster := range clusters {
+		if err := scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Informer().GetIndexer().Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, work := range works {
+		if err := scope.ManifestWorks().Informer().GetIndexer().Add(work); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scope
+}
+
+// statusClaims encodes the lines of the status reporter as the deployment claims of a cluster
+func statusClaims(t *testing.T, lines ...string) []clusterapiv1.ManagedClusterClaim {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		if _, err := writer.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return []clusterapiv1.ManagedClusterClaim{
+		{Name: "0" + deploymentStatusClaimSuffix, Value: base64.StdEncoding.EncodeToString(buf.Bytes())},
+	}
+}
+
+func newDeployment(image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{}},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: image}}},
+			},
+		},
+	}
+}
+
+// newSplitWork returns the work of the deployment on the cluster as the hub serves it, with the
+// conditions reported by the work agent. An empty applied status means the agent has not applied it yet.
+func newSplitWork(t *testing.T, clusterName string, deployment *appsv1.Deployment, applied, available metav1.ConditionStatus) *workapiv1.ManifestWork {
+	data, err := json.Marshal(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	work := &workapiv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   clusterName,
+			Name:        deploymentWorkName("ws", deployment.Namespace, deployment.Name),
+			Annotations: map[string]string{templateHashAnnotation: hash},
+		},
+		Spec: workapiv1.ManifestWorkSpec{
+			Workload: workapiv1.ManifestsTemplate{Manifests: []workapiv1.Manifest{{RawExtension: runtime.RawExtension{Raw: data}}}},
+		},
+	}
+	if len(applied) == 0 {
+		return work
+	}
+
+	work.Status.Conditions = []metav1.Condition{{Type: workapiv1.WorkApplied, Status: applied}}
+	work.Status.ResourceStatus.Manifests = []workapiv1.ManifestCondition{{
+		ResourceMeta: workapiv1.ManifestResourceMeta{
+			Group: appsv1.GroupName, Kind: "Deployment", Namespace: deployment.Namespace, Name: deployment.Name,
+		},
+		Conditions: []metav1.Condition{
+			{Type: string(workapiv1.ManifestApplied), Status: applied},
+			{Type: string(workapiv1.ManifestAvailable), Status: available},
+		},
+	}}
+	return work
+}
+
+func newTarget(scope *hub.Scope, clusterName string, deployment *appsv1.Deployment, reportStatus bool) *rolloutTarget {
+	return &rolloutTarget{
+		decision:     hub.Decision{Scope: scope, ClusterName: clusterName},
+		deployment:   deployment.DeepCopy(),
+		work:         &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Name: deploymentWorkName("ws", deployment.Namespace, deployment.Name), Annotations: map[string]string{}}},
+		reportStatus: reportStatus,
+	}
+}
+
+func TestWorkRolloutState(t *testing.T) {
+	deployment := newDeployment("web:v1")
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		reportStatus bool
+		applied      metav1.ConditionStatus
+		available    metav1.ConditionStatus
+		statusLines  []string
+		expected     rolloutState
+	}{
+		{
+			name:     "not applied yet",
+			expected: rolloutProgressing,
+		},
+		{
+			name:      "failed to apply",
+			applied:   metav1.ConditionFalse,
+			available: metav1.ConditionFalse,
+			expected:  rolloutFailed,
+		},
+		{
+			name:      "applied without the status reporter",
+			applied:   metav1.ConditionTrue,
+			available: metav1.ConditionTrue,
+			expected:  rolloutAvailable,
+		},
+		{
+			name:      "not available without the status reporter",
+			applied:   metav1.ConditionTrue,
+			available: metav1.ConditionFalse,
+			expected:  rolloutProgressing,
+		},
+		{
+			name:         "status not reported",
+			reportStatus: true,
+			applied:      metav1.ConditionTrue,
+			available:    metav1.ConditionTrue,
+			expected:     rolloutProgressing,
+		},
+		{
+			name:         "replicas reported available",
+			reportStatus: true,
+			applied:      metav1.ConditionTrue,
+			available:    metav1.ConditionTrue,
+			statusLines:  []string{"default/web " + hash + " 2 2 3 3 3 NewReplicaSetAvailable"},
+			expected:     rolloutAvailable,
+		},
+		{
+			name:         "replicas reported updating",
+			reportStatus: true,
+			applied:      metav1.ConditionTrue,
+			available:    metav1.ConditionTrue,
+			statusLines:  []string{"default/web " + hash + " 2 2 3 1 3 ReplicaSetUpdated"},
+			expected:     rolloutProgressing,
+		},
+		{
+			name:         "progress deadline exceeded",
+			reportStatus: true,
+			applied:      metav1.ConditionTrue,
+			available:    metav1.ConditionTrue,
+			statusLines:  []string{"default/web " + hash + " 2 2 3 1 2 " + progressDeadlineExceeded},
+			expected:     rolloutFailed,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cluster := newCluster("cluster1", nil, nil)
+			if len(c.statusLines) > 0 {
+				cluster.Status.ClusterClaims = statusClaims(t, c.statusLines...)
+			}
+			work := newSplitWork(t, "cluster1", deployment, c.applied, c.available)
+			scope := newWorkScope(t, []*clusterapiv1.ManagedCluster{cluster})
+
+			if state := workRolloutState(newTarget(scope, "cluster1", deployment, c.reportStatus), work); state != c.expected {
+				t.Errorf("expected state %v, got %v", c.expected, state)
+			}
+		})
+	}
+}
+
+func TestRolloutWithoutStatusReporter(t *testing.T) {
+	previous := newDeployment("web:v1")
+	deployment := newDeployment("web:v2")
+	deployment.Annotations[rolloutStrategyAnnotation] = rolloutProgressive
+
+	cases := []struct {
+		name             string
+		appliedAvailable metav1.ConditionStatus
+		expectedHeldBack bool
+	}{
+		{name: "first wave not applied yet", appliedAvailable: metav1.ConditionFalse, expectedHeldBack: true},
+		{name: "first wave applied", appliedAvailable: metav1.ConditionTrue, expectedHeldBack: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// cluster1 is in the first wave, cluster2 waits for it
+			scope := newWorkScope(t, []*clusterapiv1.ManagedCluster{newCluster("cluster1", nil, nil), newCluster("cluster2", nil, nil)},
+				newSplitWork(t, "cluster1", deployment, metav1.ConditionTrue, c.appliedAvailable),
+				newSplitWork(t, "cluster2", previous, metav1.ConditionTrue, metav1.ConditionTrue))
+			targets := []*rolloutTarget{
+				newTarget(scope, "cluster1", deployment, false),
+				newTarget(scope, "cluster2", deployment, false),
+			}
+
+			recorder := events.NewInMemoryRecorder("test")
+			inProgress, err := rollout(recorder, deployment, targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !inProgress {
+				t.Errorf("expected the rollout in progress")
+			}
+			if targets[0].heldBack {
+				t.Errorf("expected the first wave to keep the template")
+			}
+			if targets[1].heldBack != c.expectedHeldBack {
+				t.Errorf("expected the second wave held back %v, got %v", c.expectedHeldBack, targets[1].heldBack)
+			}
+
+			warned := false
+			for _, event := range recorder.Events() {
+				warned = warned || event.Reason == "RolloutStatusUnavailable"
+			}
+			if warned == c.expectedHeldBack {
+				t.Errorf("expected a warning only when the second wave starts, got %v", recorder.Events())
+			}
+		})
+	}
+}
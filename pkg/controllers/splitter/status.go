@@ -0,0 +1,76 @@
+package splitter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+)
+
+const (
+	// reportStatusLabel is set on the split deployments whose status the status reporter of the probe
+	// publishes as the deployment claims of the cluster
+	reportStatusLabel           = "kcp.open-cluster-management.io/report-status"
+	deploymentStatusClaimSuffix = ".deployments.kcp.open-cluster-management.io"
+
+	progressDeadlineExceeded = "ProgressDeadlineExceeded"
+)
+
+// deploymentStatus is the rollout status of a deployment reported by a cluster
+type deploymentStatus struct {
+	templateHash       string
+	generation         int64
+	observedGeneration int64
+	replicas           int32
+	updatedReplicas    int32
+	availableReplicas  int32
+	progressingReason  string
+}
+
+// rolledOut returns whether the deployment controller of the cluster observed the deployment and all
+// its replicas are updated and available
+func (s deploymentStatus) rolledOut() bool {
+	return s.observedGeneration >= s.generation &&
+		s.updatedReplicas == s.replicas && s.availableReplicas >= s.replicas
+}
+
+// reportedStatus returns the status of the deployment reported by the cluster of the decision, or false
+// if the cluster has not reported it.
+func reportedStatus(decision hub.Decision, namespace, name string) (deploymentStatus, bool) {
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil {
+		return deploymentStatus{}, false
+	}
+
+	lines, ok := helpers.ChunkedClaimLines(cluster, deploymentStatusClaimSuffix)
+	if !ok {
+		return deploymentStatus{}, false
+	}
+
+	key := namespace + "/" + name
+	for _, line := range lines {
+		// <namespace>/<name> <template-hash> <generation> <observed-generation> <replicas> <updated> <available> <reason>
+		fields := strings.Fields(line)
+		if len(fields) != 8 || fields[0] != key {
+			continue
+		}
+
+		numbers := make([]int64, 5)
+		for i := range numbers {
+			if numbers[i], err = strconv.ParseInt(fields[i+2], 10, 64); err != nil {
+				return deploymentStatus{}, false
+			}
+		}
+		return deploymentStatus{
+			templateHash:       fields[1],
+			generation:         numbers[0],
+			observedGeneration: numbers[1],
+			replicas:           int32(numbers[2]),
+			updatedReplicas:    int32(numbers[3]),
+			availableReplicas:  int32(numbers[4]),
+			progressingReason:  fields[7],
+		}, true
+	}
+	return deploymentStatus{}, false
+}
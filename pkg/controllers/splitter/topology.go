@@ -0,0 +1,135 @@
+package splitter
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// topologyClaims are the ClusterClaims reporting the topology of a cluster when it has no topology label
+var topologyClaims = map[string][]string{
+	corev1.LabelTopologyRegion: {corev1.LabelTopologyRegion, "region.open-cluster-management.io"},
+	corev1.LabelTopologyZone:   {corev1.LabelTopologyZone, "zone.open-cluster-management.io"},
+}
+
+// topologyKeyOf returns the region or zone key the pods of the deployment are spread on. Only the first
+// constraint on a region or zone is honoured, the other keys are about the nodes in a cluster.
+func topologyKeyOf(deployment *appsv1.Deployment) string {
+	for _, constraint := range deployment.Spec.Template.Spec.TopologySpreadConstraints {
+		if _, ok := topologyClaims[constraint.TopologyKey]; ok {
+			return constraint.TopologyKey
+		}
+	}
+	return ""
+}
+
+// topologyOf returns the topology domain of the decided cluster from its labels or ClusterClaims
+func topologyOf(decision hub.Decision, topologyKey string) string {
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil {
+		return ""
+	}
+	return topologyOfCluster(cluster, topologyKey)
+}
+
+func topologyOfCluster(cluster *clusterapiv1.ManagedCluster, topologyKey string) string {
+	if value, ok := cluster.Labels[topologyKey]; ok {
+		return value
+	}
+
+	for _, name := range topologyClaims[topologyKey] {
+		for _, claim := range cluster.Status.ClusterClaims {
+			if claim.Name == name {
+				return claim.Value
+			}
+		}
+	}
+	return ""
+}
+
+// splitReplicasByTopology divides the replicas evenly on the topology domains of the decided clusters
+// first, and then on the clusters in each domain. Clusters without the topology are not split to unless
+// no cluster reports it.
+func splitReplicasByTopology(
+	totalReplica int32, decisions []hub.Decision, constraints splitConstraints, topologyKey string) ([]replicaAllocation, []string) {
+	if len(topologyKey) == 0 {
+		return splitReplicas(totalReplica, decisions, constraints)
+	}
+
+	domains := map[string][]hub.Decision{}
+	for _, decision := range decisions {
+		if domain := topologyOf(decision, topologyKey); len(domain) > 0 {
+			domains[domain] = append(domains[domain], decision)
+		}
+	}
+
+	if len(domains) == 0 {
+		return splitReplicas(totalReplica, decisions, constraints)
+	}
+
+	// A domain can run the replicas its clusters can run
+	names := []string{}
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	eligible := []string{}
+	maxReplicas := []int32{}
+	for _, name := range names {
+		domainMax := int32(0)
+		runnable := false
+		for _, decision := range domains[name] {
+			max := constraints.maxReplicasOf(decision)
+			if max != 0 && max < constraints.minReplicas {
+				continue
+			}
+			runnable = true
+			if max == 0 {
+				domainMax = 0
+				break
+			}
+			domainMax += max
+		}
+		if runnable {
+			eligible = append(eligible, name)
+			maxReplicas = append(maxReplicas, domainMax)
+		}
+	}
+
+	numberOfDomains := len(eligible)
+	if limit := int(totalReplica / constraints.minReplicas); limit < numberOfDomains {
+		numberOfDomains = limit
+	}
+
+	shares := make([]int32, numberOfDomains)
+	remaining := fill(shares, maxReplicas, totalReplica)
+
+	allocations := []replicaAllocation{}
+	domainConstraints := constraints
+	domainConstraints.minClusters = 0
+	for i, share := range shares {
+		// The replicas a domain cannot run are reported with the replicas no domain can run
+		domainAllocations, _ := splitReplicas(share, domains[eligible[i]], domainConstraints)
+		allocations = append(allocations, domainAllocations...)
+		for _, allocation := range domainAllocations {
+			share -= allocation.replicas
+		}
+		remaining += share
+	}
+
+	reasons := []string{}
+	if len(allocations) < constraints.minClusters {
+		reasons = append(reasons, fmt.Sprintf("%d clusters are required but the replicas can be split to %d clusters",
+			constraints.minClusters, len(allocations)))
+	}
+	if remaining > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d replicas exceed the max replicas of the clusters in the %s domains",
+			remaining, topologyKey))
+	}
+	return allocations, reasons
+}
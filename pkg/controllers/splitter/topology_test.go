@@ -0,0 +1,113 @@
+package splitter
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func zone(value string) map[string]string {
+	return map[string]string{corev1.LabelTopologyZone: value}
+}
+
+func TestSplitReplicasByTopology(t *testing.T) {
+	cases := []struct {
+		name                string
+		clusters            []*clusterapiv1.ManagedCluster
+		decided             []string
+		replicas            int32
+		topologyKey         string
+		expectedAllocations []string
+		expectedReasons     []string
+	}{
+		{
+			name: "no topology key",
+			clusters: []*clusterapiv1.ManagedCluster{
+				newCluster("c1", zone("a"), nil), newCluster("c2", zone("a"), nil), newCluster("c3", zone("b"), nil),
+			},
+			decided:             []string{"c1", "c2", "c3"},
+			replicas:            4,
+			expectedAllocations: []string{"hub/c1=2", "hub/c2=1", "hub/c3=1"},
+			expectedReasons:     []string{},
+		},
+		{
+			name: "spread on the domains first",
+			clusters: []*clusterapiv1.ManagedCluster{
+				newCluster("c1", zone("a"), nil), newCluster("c2", zone("a"), nil), newCluster("c3", zone("b"), nil),
+			},
+			decided:             []string{"c1", "c2", "c3"},
+			replicas:            4,
+			topologyKey:         corev1.LabelTopologyZone,
+			expectedAllocations: []string{"hub/c1=1", "hub/c2=1", "hub/c3=2"},
+			expectedReasons:     []string{},
+		},
+		{
+			name: "topology from the cluster claims",
+			clusters: []*clusterapiv1.ManagedCluster{
+				newCluster("c1", nil, nil, clusterapiv1.ManagedClusterClaim{Name: "zone.open-cluster-management.io", Value: "a"}),
+				newCluster("c2", zone("b"), nil),
+			},
+			decided:             []string{"c1", "c2"},
+			replicas:            3,
+			topologyKey:         corev1.LabelTopologyZone,
+			expectedAllocations: []string{"hub/c1=2", "hub/c2=1"},
+			expectedReasons:     []string{},
+		},
+		{
+			name:                "clusters without the topology are skipped",
+			clusters:            []*clusterapiv1.ManagedCluster{newCluster("c1", zone("a"), nil), newCluster("c2", nil, nil)},
+			decided:             []string{"c1", "c2"},
+			replicas:            3,
+			topologyKey:         corev1.LabelTopologyZone,
+			expectedAllocations: []string{"hub/c1=3"},
+			expectedReasons:     []string{},
+		},
+		{
+			name:                "no cluster reports the topology",
+			clusters:            []*clusterapiv1.ManagedCluster{newCluster("c1", nil, nil), newCluster("c2", nil, nil)},
+			decided:             []string{"c1", "c2"},
+			replicas:            3,
+			topologyKey:         corev1.LabelTopologyZone,
+			expectedAllocations: []string{"hub/c1=2", "hub/c2=1"},
+			expectedReasons:     []string{},
+		},
+		{
+			name: "full domains pass the replicas on",
+			clusters: []*clusterapiv1.ManagedCluster{
+				newCluster("c1", zone("a"), maxReplicas("1")), newCluster("c2", zone("b"), nil),
+			},
+			decided:             []string{"c1", "c2"},
+			replicas:            4,
+			topologyKey:         corev1.LabelTopologyZone,
+			expectedAllocations: []string{"hub/c1=1", "hub/c2=3"},
+			expectedReasons:     []string{},
+		},
+		{
+			name: "replicas exceed the domains",
+			clusters: []*clusterapiv1.ManagedCluster{
+				newCluster("c1", zone("a"), maxReplicas("1")), newCluster("c2", zone("b"), maxReplicas("1")),
+			},
+			decided:             []string{"c1", "c2"},
+			replicas:            3,
+			topologyKey:         corev1.LabelTopologyZone,
+			expectedAllocations: []string{"hub/c1=1", "hub/c2=1"},
+			expectedReasons:     []string{"1 replicas exceed the max replicas of the clusters in the topology.kubernetes.io/zone domains"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scope := newTestScope(t, c.clusters...)
+			allocations, reasons := splitReplicasByTopology(
+				c.replicas, decisionsOf(scope, c.decided...), splitConstraints{minReplicas: 1}, c.topologyKey)
+			if actual := allocated(allocations); !reflect.DeepEqual(actual, c.expectedAllocations) {
+				t.Errorf("expected allocations %v, got %v", c.expectedAllocations, actual)
+			}
+			if !reflect.DeepEqual(reasons, c.expectedReasons) {
+				t.Errorf("expected reasons %v, got %v", c.expectedReasons, reasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package helpers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
+	worklister "open-cluster-management.io/api/client/work/listers/work/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// MaxManifestsSize is the max serialized size of the manifests of a work, well below the size
+	// limit of etcd objects since the hub adds the status of each manifest to the work.
+	MaxManifestsSize = 500 * 1024
+
+	// ChunkLabel is set on the chunks of a work with the name of the first chunk, see ChunkLabelValue
+	ChunkLabel           = "kcp.open-cluster-management.io/chunk-of"
+	chunkIndexAnnotation = "kcp.open-cluster-management.io/chunk-index"
+
+	// chunkHashLength is the length of the hash of the work name ending the truncated label values
+	chunkHashLength = 10
+)
+
+// ChunkWork splits the manifests of the work into works whose manifests do not exceed the max size.
+// The first chunk keeps the name of the work and the others are named <name>-chunk-<index>.
+//
+// The manifests stay in the deployed chunks they are in, so a changed manifest does not shift the
+// others across the chunks. The new manifests and the ones no longer fitting their chunk fill the
+// chunks in order. A manifest moved to another chunk is also kept in its deployed chunk until the new
+// chunk reports it applied, the work agent would otherwise delete it from the cluster before applying
+// it again.
+func ChunkWork(work *workapiv1.ManifestWork, maxSize int, deployed []*workapiv1.ManifestWork) ([]*workapiv1.ManifestWork, error) {
+	// the indexes of the deployed chunks of each manifest, a moved manifest is in two chunks
+	deployedIn := map[string][]int{}
+	deployedChunks := map[int]*workapiv1.ManifestWork{}
+	for _, chunk := range deployed {
+		index := chunkIndex(chunk)
+		deployedChunks[index] = chunk
+		for _, manifest := range chunk.Spec.Workload.Manifests {
+			if key, ok := manifestKey(manifest); ok {
+				deployedIn[key] = append(deployedIn[key], index)
+			}
+		}
+	}
+	for key := range deployedIn {
+		sort.Ints(deployedIn[key])
+	}
+
+	assigned := map[int][]chunkedManifest{}
+	sizes := map[int]int{}
+	pending := []chunkedManifest{}
+	for i, manifest := range work.Spec.Workload.Manifests {
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxSize {
+			return nil, fmt.Errorf("manifest %d of work %s/%s exceeds the max size of %d bytes", i, work.Namespace, work.Name, maxSize)
+		}
+
+		m := chunkedManifest{manifest: manifest, index: -1, size: len(data)}
+		m.key, _ = manifestKey(manifest)
+		for _, index := range deployedIn[m.key] {
+			if sizes[index]+m.size <= maxSize {
+				m.index = index
+				break
+			}
+		}
+		if m.index < 0 {
+			pending = append(pending, m)
+			continue
+		}
+		assigned[m.index] = append(assigned[m.index], m)
+		sizes[m.index] += m.size
+	}
+
+	for _, m := range pending {
+		index := 0
+		for sizes[index] > 0 && sizes[index]+m.size > maxSize {
+			index++
+		}
+		assigned[index] = append(assigned[index], m)
+		sizes[index] += m.size
+	}
+
+	indexes := []int{}
+	for index, manifests := range assigned {
+		if index > 0 && len(manifests) > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	// the first chunk keeps the name of the work, it takes the manifests of the last chunk over
+	if len(assigned[0]) == 0 && len(indexes) > 0 {
+		last := indexes[len(indexes)-1]
+		assigned[0], indexes = assigned[last], indexes[:len(indexes)-1]
+		delete(assigned, last)
+	}
+	indexes = append([]int{0}, indexes...)
+
+	chunks := map[int]*workapiv1.ManifestWork{}
+	for _, index := range indexes {
+		chunk := newChunk(work, index)
+		for _, m := range assigned[index] {
+			chunk.Spec.Workload.Manifests = append(chunk.Spec.Workload.Manifests, m.manifest)
+		}
+		chunks[index] = chunk
+	}
+
+	// a moved manifest stays in its deployed chunks until its new chunk has applied it
+	for _, index := range indexes {
+		for _, m := range assigned[index] {
+			if appliedIn(deployedChunks[index], m.key) {
+				continue
+			}
+			for _, previous := range deployedIn[m.key] {
+				if previous == index {
+					continue
+				}
+				if _, ok := chunks[previous]; !ok {
+					chunks[previous] = newChunk(work, previous)
+				}
+				chunks[previous].Spec.Workload.Manifests = append(chunks[previous].Spec.Workload.Manifests, m.manifest)
+			}
+		}
+	}
+
+	indexes = []int{}
+	for index := range chunks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	result := []*workapiv1.ManifestWork{}
+	for _, index := range indexes {
+		result = append(result, chunks[index])
+	}
+
+	// Each chunk only orphans its own manifests
+	if option := work.Spec.DeleteOption; option != nil && option.SelectivelyOrphan != nil {
+		for _, chunk := range result {
+			chunk.Spec.DeleteOption.SelectivelyOrphan.OrphaningRules = orphaningRulesOf(
+				option.SelectivelyOrphan.OrphaningRules, chunk.Spec.Workload.Manifests)
+		}
+	}
+	return result, nil
+}
+
+// chunkedManifest is a manifest of a work with the key of its object, its chunk and its serialized size
+type chunkedManifest struct {
+	manifest workapiv1.Manifest
+	key      string
+	index    int
+	size     int
+}
+
+// manifestKey returns the <group>/<kind>/<namespace>/<name> of the object of the manifest
+func manifestKey(manifest workapiv1.Manifest) (string, bool) {
+	obj, err := manifestObject(manifest)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", obj.GroupVersionKind().Group, obj.GetKind(), obj.GetNamespace(), obj.GetName()), true
+}
+
+// appliedIn returns whether the work agent reports the object of the key applied by the deployed chunk
+func appliedIn(chunk *workapiv1.ManifestWork, key string) bool {
+	if chunk == nil {
+		return false
+	}
+	for _, manifest := range chunk.Spec.Workload.Manifests {
+		if k, ok := manifestKey(manifest); !ok || k != key {
+			continue
+		}
+		obj, _ := manifestObject(manifest)
+		condition := FindManifestCondition(chunk, obj.GroupVersionKind().Group, obj.GetKind(), obj.GetNamespace(), obj.GetName())
+		return IsManifestConditionTrue(condition, workapiv1.ManifestApplied)
+	}
+	return false
+}
+
+func newChunk(work *workapiv1.ManifestWork, index int) *workapiv1.ManifestWork {
+	chunk := &workapiv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ChunkName(work.Name, index),
+			Namespace:   work.Namespace,
+			Labels:      mergeMap(nil, work.Labels),
+			Annotations: mergeMap(nil, work.Annotations),
+		},
+		Spec: *work.Spec.DeepCopy(),
+	}
+	if chunk.Labels == nil {
+		chunk.Labels = map[string]string{}
+	}
+	if chunk.Annotations == nil {
+		chunk.Annotations = map[string]string{}
+	}
+	chunk.Labels[ChunkLabel] = ChunkLabelValue(work.Name)
+	chunk.Annotations[chunkIndexAnnotation] = strconv.Itoa(index)
+	chunk.Spec.Workload.Manifests = []workapiv1.Manifest{}
+	return chunk
+}
+
+// ChunkName returns the name of a chunk of the work
+func ChunkName(workName string, index int) string {
+	if index == 0 {
+		return workName
+	}
+	return fmt.Sprintf("%s-chunk-%d", workName, index)
+}
+
+// ChunkLabelValue returns the value of the chunk label of the chunks of the work. Work names may be
+// longer than a label value, these names are truncated and end with a hash of the full name instead.
+func ChunkLabelValue(workName string) string {
+	if len(workName) <= validation.LabelValueMaxLength {
+		return workName
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(workName)))[:chunkHashLength]
+	truncated := strings.TrimRight(workName[:validation.LabelValueMaxLength-chunkHashLength-1], "-.")
+	return fmt.Sprintf("%s-%s", truncated, hash)
+}
+
+// ApplyChunkedWork applies the work in chunks below the max size and deletes the chunks of the work
+// in the cache that are no longer needed. It returns the names of the applied chunks.
+func ApplyChunkedWork(ctx context.Context, manifestWorkClient workv1client.WorkV1Interface, lister worklister.ManifestWorkLister, work *workapiv1.ManifestWork) ([]string, error) {
+	deployed, err := ChunkedWorks(lister, work.Namespace, work.Name)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := ChunkWork(work, MaxManifestsSize, deployed)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, chunk := range chunks {
+		if err := ApplyWork(ctx, manifestWorkClient, chunk); err != nil {
+			return nil, err
+		}
+		names = append(names, chunk.Name)
+	}
+
+	return names, deleteChunks(ctx, manifestWorkClient, deployed, sets.NewString(names...))
+}
+
+// DeleteChunkedWork deletes all the chunks of the work, the first chunk is deleted last
+func DeleteChunkedWork(ctx context.Context, manifestWorkClient workv1client.WorkV1Interface, lister worklister.ManifestWorkLister, namespace, workName string) error {
+	deployed, err := ChunkedWorks(lister, namespace, workName)
+	if err != nil {
+		return err
+	}
+	if err := deleteChunks(ctx, manifestWorkClient, deployed, sets.NewString(workName)); err != nil {
+		return err
+	}
+
+	err = manifestWorkClient.ManifestWorks(namespace).Delete(ctx, workName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func deleteChunks(ctx context.Context, manifestWorkClient workv1client.WorkV1Interface, deployed []*workapiv1.ManifestWork, kept sets.String) error {
+	for _, work := range deployed {
+		if kept.Has(work.Name) {
+			continue
+		}
+		err := manifestWorkClient.ManifestWorks(work.Namespace).Delete(ctx, work.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChunkedWorks returns the chunks of the work in the cache in their order
+func ChunkedWorks(lister worklister.ManifestWorkLister, namespace, workName string) ([]*workapiv1.ManifestWork, error) {
+	works, err := lister.ManifestWorks(namespace).List(labels.SelectorFromSet(labels.Set{ChunkLabel: ChunkLabelValue(workName)}))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(works, func(i, j int) bool {
+		return chunkIndex(works[i]) < chunkIndex(works[j])
+	})
+	return works, nil
+}
+
+func chunkIndex(work *workapiv1.ManifestWork) int {
+	index, _ := strconv.Atoi(work.Annotations[chunkIndexAnnotation])
+	return index
+}
+
+// FindChunkedManifestCondition returns the condition of the manifest reported in the status of
+// any chunk of a work.
+func FindChunkedManifestCondition(works []*workapiv1.ManifestWork, group, kind, namespace, name string) *workapiv1.ManifestCondition {
+	for _, work := range works {
+		if condition := FindManifestCondition(work, group, kind, namespace, name); condition != nil {
+			return condition
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+func newManifest(t *testing.T, apiVersion, kind, namespace, name string, annotations map[string]string) workapiv1.Manifest {
+	obj := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name},
+	}
+	if len(namespace) > 0 {
+		obj["metadata"].(map[string]interface{})["namespace"] = namespace
+	}
+	if len(annotations) > 0 {
+		values := map[string]interface{}{}
+		for k, v := range annotations {
+			values[k] = v
+		}
+		obj["metadata"].(map[string]interface{})["annotations"] = values
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workapiv1.Manifest{RawExtension: runtime.RawExtension{Raw: data}}
+}
+
+func manifestSize(t *testing.T, manifest workapiv1.Manifest) int {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(data)
+}
+
+func TestChunkWork(t *testing.T) {
+	configMaps := []workapiv1.Manifest{}
+	for i := 0; i < 3; i++ {
+		configMaps = append(configMaps, newManifest(t, "v1", "ConfigMap", "default", fmt.Sprintf("cm%d", i), nil))
+	}
+	size := manifestSize(t, configMaps[0])
+
+	claim := newManifest(t, "v1", "PersistentVolumeClaim", "default", "data", nil)
+	deployment := newManifest(t, "apps/v1", "Deployment", "default", "web", nil)
+	claimRule := workapiv1.OrphaningRule{Resource: "persistentvolumeclaims", Namespace: "default", Name: "data"}
+
+	cases := []struct {
+		name      string
+		workName  string
+		manifests []workapiv1.Manifest
+		option    *workapiv1.DeleteOption
+		maxSize   int
+		// expectedChunks are the number of manifests of each chunk
+		expectedChunks []int
+		expectedRules  [][]workapiv1.OrphaningRule
+		expectedErr    bool
+	}{
+		{
+			name:           "single chunk",
+			workName:       "work",
+			manifests:      configMaps,
+			maxSize:        3 * size,
+			expectedChunks: []int{3},
+		},
+		{
+			name:           "split in order",
+			workName:       "work",
+			manifests:      configMaps,
+			maxSize:        2 * size,
+			expectedChunks: []int{2, 1},
+		},
+		{
+			name:           "a chunk per manifest",
+			workName:       "work",
+			manifests:      configMaps,
+			maxSize:        size,
+			expectedChunks: []int{1, 1, 1},
+		},
+		{
+			name:           "no manifests",
+			workName:       "work",
+			manifests:      []workapiv1.Manifest{},
+			maxSize:        size,
+			expectedChunks: []int{0},
+		},
+		{
+			name:        "manifest exceeding the max size",
+			workName:    "work",
+			manifests:   configMaps,
+			maxSize:     size - 1,
+			expectedErr: true,
+		},
+		{
+			name:      "orphaning rules follow their manifests",
+			workName:  "work",
+			manifests: []workapiv1.Manifest{deployment, claim},
+			option: &workapiv1.DeleteOption{
+				PropagationPolicy: workapiv1.DeletePropagationPolicyTypeSelectivelyOrphan,
+				SelectivelyOrphan: &workapiv1.SelectivelyOrphan{OrphaningRules: []workapiv1.OrphaningRule{claimRule}},
+			},
+			maxSize:        manifestSize(t, claim),
+			expectedChunks: []int{1, 1},
+			expectedRules:  [][]workapiv1.OrphaningRule{{}, {claimRule}},
+		},
+		{
+			name:           "long work name",
+			workName:       strings.Repeat("w", 70),
+			manifests:      configMaps,
+			maxSize:        2 * size,
+			expectedChunks: []int{2, 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			work := &workapiv1.ManifestWork{
+				ObjectMeta: metav1.ObjectMeta{Name: c.workName, Namespace: "cluster1", Labels: map[string]string{"app": "test"}},
+				Spec: workapiv1.ManifestWorkSpec{
+					Workload:     workapiv1.ManifestsTemplate{Manifests: c.manifests},
+					DeleteOption: c.option,
+				},
+			}
+
+			chunks, err := ChunkWork(work, c.maxSize, nil)
+			if c.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := []int{}
+			for i, chunk := range chunks {
+				actual = append(actual, len(chunk.Spec.Workload.Manifests))
+				if chunk.Name != ChunkName(c.workName, i) || chunk.Namespace != work.Namespace {
+					t.Errorf("unexpected chunk %s/%s at %d", chunk.Namespace, chunk.Name, i)
+				}
+				if chunkIndex(chunk) != i {
+					t.Errorf("expected chunk index %d, got %d", i, chunkIndex(chunk))
+				}
+				label := chunk.Labels[ChunkLabel]
+				if label != ChunkLabelValue(c.workName) || len(validation.IsValidLabelValue(label)) > 0 {
+					t.Errorf("unexpected chunk label %q", label)
+				}
+				if chunk.Labels["app"] != "test" {
+					t.Errorf("expected the labels of the work on the chunk, got %v", chunk.Labels)
+				}
+				if c.expectedRules != nil &&
+					!reflect.DeepEqual(chunk.Spec.DeleteOption.SelectivelyOrphan.OrphaningRules, c.expectedRules[i]) {
+					t.Errorf("expected orphaning rules %v in chunk %d, got %v",
+						c.expectedRules[i], i, chunk.Spec.DeleteOption.SelectivelyOrphan.OrphaningRules)
+				}
+			}
+			if !reflect.DeepEqual(actual, c.expectedChunks) {
+				t.Errorf("expected chunks %v, got %v", c.expectedChunks, actual)
+			}
+			if len(work.Spec.Workload.Manifests) != len(c.manifests) {
+				t.Errorf("expected the work to be left unchanged")
+			}
+		})
+	}
+}
+
+// deployedChunk returns the chunk of the work with the config maps as the hub serves it, with the
+// config maps in applied reported by the work agent.
+func deployedChunk(t *testing.T, index int, configMaps []string, applied ...string) *workapiv1.ManifestWork {
+	chunk := newChunk(&workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Name: "work", Namespace: "cluster1"}}, index)
+	for _, name := range configMaps {
+		chunk.Spec.Workload.Manifests = append(chunk.Spec.Workload.Manifests, newManifest(t, "v1", "ConfigMap", "default", name, nil))
+	}
+	for _, name := range applied {
+		chunk.Status.ResourceStatus.Manifests = append(chunk.Status.ResourceStatus.Manifests, workapiv1.ManifestCondition{
+			ResourceMeta: workapiv1.ManifestResourceMeta{Kind: "ConfigMap", Namespace: "default", Name: name},
+			Conditions:   []metav1.Condition{{Type: string(workapiv1.ManifestApplied), Status: metav1.ConditionTrue}},
+		})
+	}
+	return chunk
+}
+
+func TestChunkDeployedWork(t *testing.T) {
+	size := manifestSize(t, newManifest(t, "v1", "ConfigMap", "default", "cm0", nil))
+
+	cases := []struct {
+		name       string
+		configMaps []string
+		deployed   []*workapiv1.ManifestWork
+		// expectedChunks are the names of the config maps of each chunk
+		expectedChunks [][]string
+	}{
+		{
+			name:       "new manifests fill the chunks in order",
+			configMaps: []string{"cm3", "cm0", "cm1", "cm2"},
+			deployed: []*workapiv1.ManifestWork{
+				deployedChunk(t, 0, []string{"cm0", "cm1"}),
+				deployedChunk(t, 1, []string{"cm2"}),
+			},
+			expectedChunks: [][]string{{"cm0", "cm1"}, {"cm2", "cm3"}},
+		},
+		{
+			name:       "removed manifests leave the others in their chunks",
+			configMaps: []string{"cm1", "cm2"},
+			deployed: []*workapiv1.ManifestWork{
+				deployedChunk(t, 0, []string{"cm0", "cm1"}),
+				deployedChunk(t, 1, []string{"cm2"}),
+			},
+			expectedChunks: [][]string{{"cm1"}, {"cm2"}},
+		},
+		{
+			name:       "moved manifests stay in their chunk",
+			configMaps: []string{"cm1"},
+			deployed: []*workapiv1.ManifestWork{
+				deployedChunk(t, 0, []string{"cm0"}, "cm0"),
+				deployedChunk(t, 1, []string{"cm1"}, "cm1"),
+			},
+			expectedChunks: [][]string{{"cm1"}, {"cm1"}},
+		},
+		{
+			name:       "moved manifests stay in their chunk until applied",
+			configMaps: []string{"cm1"},
+			deployed: []*workapiv1.ManifestWork{
+				deployedChunk(t, 0, []string{"cm1"}),
+				deployedChunk(t, 1, []string{"cm1"}, "cm1"),
+			},
+			expectedChunks: [][]string{{"cm1"}, {"cm1"}},
+		},
+		{
+			name:       "moved manifests leave their chunk once applied",
+			configMaps: []string{"cm1"},
+			deployed: []*workapiv1.ManifestWork{
+				deployedChunk(t, 0, []string{"cm1"}, "cm1"),
+				deployedChunk(t, 1, []string{"cm1"}, "cm1"),
+			},
+			expectedChunks: [][]string{{"cm1"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			work := &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Name: "work", Namespace: "cluster1"}}
+			for _, name := range c.configMaps {
+				work.Spec.Workload.Manifests = append(work.Spec.Workload.Manifests, newManifest(t, "v1", "ConfigMap", "default", name, nil))
+			}
+
+			chunks, err := ChunkWork(work, 2*size, c.deployed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := [][]string{}
+			for i, chunk := range chunks {
+				if chunk.Name != ChunkName("work", i) {
+					t.Errorf("unexpected chunk %s at %d", chunk.Name, i)
+				}
+				names := []string{}
+				for _, manifest := range chunk.Spec.Workload.Manifests {
+					obj, err := manifestObject(manifest)
+					if err != nil {
+						t.Fatal(err)
+					}
+					names = append(names, obj.GetName())
+				}
+				actual = append(actual, names)
+			}
+			if !reflect.DeepEqual(actual, c.expectedChunks) {
+				t.Errorf("expected chunks %v, got %v", c.expectedChunks, actual)
+			}
+		})
+	}
+}
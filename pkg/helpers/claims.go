@@ -0,0 +1,68 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// ChunkedClaimLines decodes the lines the probe publishes on the cluster across the claims named
+// <index><suffix>, the lines are gzipped, base64 encoded and cut into the claim values in the order
+// of their index. It returns false if the claims are missing or incomplete, for instance when the
+// cluster drops the claims above its max number of custom claims.
+func ChunkedClaimLines(cluster *clusterapiv1.ManagedCluster, suffix string) ([]string, bool) {
+	chunks := map[int]string{}
+	for _, claim := range cluster.Status.ClusterClaims {
+		if !strings.HasSuffix(claim.Name, suffix) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSuffix(claim.Name, suffix))
+		if err != nil {
+			continue
+		}
+		chunks[index] = claim.Value
+	}
+
+	indexes := []int{}
+	for index := range chunks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	encoded := ""
+	for i, index := range indexes {
+		if i != index {
+			return nil, false
+		}
+		encoded += chunks[index]
+	}
+	if len(encoded) == 0 {
+		return nil, false
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if scanner.Err() != nil {
+		return nil, false
+	}
+	return lines, true
+}
@@ -0,0 +1,149 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// DeletePolicyAnnotation on a propagated object overrides the default delete policy of the object,
+	// it is one of Foreground, Orphan or SelectivelyOrphan.
+	DeletePolicyAnnotation = "kcp.open-cluster-management.io/delete-policy"
+
+	// The SelectivelyOrphan policy orphans the stateful objects only
+	DeletePolicySelectivelyOrphan = string(workapiv1.DeletePropagationPolicyTypeSelectivelyOrphan)
+	DeletePolicyOrphan            = string(workapiv1.DeletePropagationPolicyTypeOrphan)
+	DeletePolicyForeground        = string(workapiv1.DeletePropagationPolicyTypeForeground)
+)
+
+// statefulResources are the resources holding data, they are orphaned by the SelectivelyOrphan policy
+var statefulResources = map[schema.GroupKind]string{
+	{Group: "", Kind: "Namespace"}:                                    "namespaces",
+	{Group: "", Kind: "PersistentVolumeClaim"}:                        "persistentvolumeclaims",
+	{Group: "", Kind: "PersistentVolume"}:                             "persistentvolumes",
+	{Group: "apps", Kind: "StatefulSet"}:                              "statefulsets",
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}: "customresourcedefinitions",
+}
+
+// ValidateDeletePolicy returns an error if the policy is not a delete policy
+func ValidateDeletePolicy(policy string) error {
+	switch policy {
+	case "", DeletePolicyForeground, DeletePolicyOrphan, DeletePolicySelectivelyOrphan:
+		return nil
+	}
+	return fmt.Errorf("unknown delete policy %q", policy)
+}
+
+// DeleteOptionOf returns the delete option of a work with the manifests. The delete policy of a manifest
+// is the one annotated on it, or the default policy. The work is orphaned when all of its manifests are
+// orphaned, otherwise the orphaned manifests and the stateful manifests of the SelectivelyOrphan policy
+// are selected by orphaning rules. It returns nil when nothing is orphaned, which is a foreground delete.
+func DeleteOptionOf(defaultPolicy string, manifests []workapiv1.Manifest) (*workapiv1.DeleteOption, error) {
+	rules := []workapiv1.OrphaningRule{}
+	orphaned := 0
+	for _, manifest := range manifests {
+		obj, err := manifestObject(manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		policy := defaultPolicy
+		if annotated, ok := obj.GetAnnotations()[DeletePolicyAnnotation]; ok {
+			policy = annotated
+		}
+		if err := ValidateDeletePolicy(policy); err != nil {
+			return nil, fmt.Errorf("%s %s/%s: %v", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+		}
+
+		rule, stateful := orphaningRule(obj)
+		switch {
+		case policy == DeletePolicyOrphan:
+			orphaned++
+		case policy == DeletePolicySelectivelyOrphan && stateful:
+		default:
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	switch {
+	case len(rules) == 0:
+		return nil, nil
+	case orphaned == len(manifests):
+		return &workapiv1.DeleteOption{PropagationPolicy: workapiv1.DeletePropagationPolicyTypeOrphan}, nil
+	}
+
+	return &workapiv1.DeleteOption{
+		PropagationPolicy: workapiv1.DeletePropagationPolicyTypeSelectivelyOrphan,
+		SelectivelyOrphan: &workapiv1.SelectivelyOrphan{OrphaningRules: rules},
+	}, nil
+}
+
+// orphaningRule returns the orphaning rule of the object and whether the object is stateful. The
+// resource of the objects that are not stateful is guessed from their kind.
+func orphaningRule(obj *unstructured.Unstructured) (workapiv1.OrphaningRule, bool) {
+	gvk := obj.GroupVersionKind()
+	resource, stateful := statefulResources[gvk.GroupKind()]
+	if !stateful {
+		plural, _ := meta.UnsafeGuessKindToResource(gvk)
+		resource = plural.Resource
+	}
+
+	return workapiv1.OrphaningRule{
+		Group:     gvk.Group,
+		Resource:  resource,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}, stateful
+}
+
+// orphaningRulesOf returns the orphaning rules selecting the manifests
+func orphaningRulesOf(rules []workapiv1.OrphaningRule, manifests []workapiv1.Manifest) []workapiv1.OrphaningRule {
+	selected := []workapiv1.OrphaningRule{}
+	for _, manifest := range manifests {
+		obj, err := manifestObject(manifest)
+		if err != nil {
+			continue
+		}
+		manifestRule, _ := orphaningRule(obj)
+		for _, rule := range rules {
+			if rule == manifestRule {
+				selected = append(selected, rule)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func manifestObject(manifest workapiv1.Manifest) (*unstructured.Unstructured, error) {
+	raw := manifest.Raw
+	if manifest.Object != nil {
+		data, err := json.Marshal(manifest.Object)
+		if err != nil {
+			return nil, err
+		}
+		raw = data
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// SetDeleteOption sets the delete option of the work from the delete policies of its manifests
+func SetDeleteOption(work *workapiv1.ManifestWork, defaultPolicy string) error {
+	option, err := DeleteOptionOf(defaultPolicy, work.Spec.Workload.Manifests)
+	if err != nil {
+		return fmt.Errorf("invalid delete policy in work %s/%s: %v", work.Namespace, work.Name, err)
+	}
+	work.Spec.DeleteOption = option
+	return nil
+}
@@ -0,0 +1,119 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+func TestDeleteOptionOf(t *testing.T) {
+	deployment := newManifest(t, "apps/v1", "Deployment", "default", "web", nil)
+	claim := newManifest(t, "v1", "PersistentVolumeClaim", "default", "data", nil)
+	orphanedService := newManifest(t, "v1", "Service", "default", "web",
+		map[string]string{DeletePolicyAnnotation: DeletePolicyOrphan})
+	foregroundClaim := newManifest(t, "v1", "PersistentVolumeClaim", "default", "cache",
+		map[string]string{DeletePolicyAnnotation: DeletePolicyForeground})
+	invalid := newManifest(t, "v1", "ConfigMap", "default", "config",
+		map[string]string{DeletePolicyAnnotation: "Never"})
+
+	claimRule := workapiv1.OrphaningRule{Resource: "persistentvolumeclaims", Namespace: "default", Name: "data"}
+	serviceRule := workapiv1.OrphaningRule{Resource: "services", Namespace: "default", Name: "web"}
+
+	cases := []struct {
+		name          string
+		defaultPolicy string
+		manifests     []workapiv1.Manifest
+		expected      *workapiv1.DeleteOption
+		expectedErr   bool
+	}{
+		{
+			name:          "foreground",
+			defaultPolicy: DeletePolicyForeground,
+			manifests:     []workapiv1.Manifest{deployment, claim},
+		},
+		{
+			name:      "no default policy",
+			manifests: []workapiv1.Manifest{deployment, claim},
+		},
+		{
+			name:          "orphan",
+			defaultPolicy: DeletePolicyOrphan,
+			manifests:     []workapiv1.Manifest{deployment, claim},
+			expected:      &workapiv1.DeleteOption{PropagationPolicy: workapiv1.DeletePropagationPolicyTypeOrphan},
+		},
+		{
+			name:          "selectively orphan the stateful manifests",
+			defaultPolicy: DeletePolicySelectivelyOrphan,
+			manifests:     []workapiv1.Manifest{deployment, claim},
+			expected: &workapiv1.DeleteOption{
+				PropagationPolicy: workapiv1.DeletePropagationPolicyTypeSelectivelyOrphan,
+				SelectivelyOrphan: &workapiv1.SelectivelyOrphan{OrphaningRules: []workapiv1.OrphaningRule{claimRule}},
+			},
+		},
+		{
+			name:          "selectively orphan without stateful manifests",
+			defaultPolicy: DeletePolicySelectivelyOrphan,
+			manifests:     []workapiv1.Manifest{deployment},
+		},
+		{
+			name:          "annotated orphan",
+			defaultPolicy: DeletePolicyForeground,
+			manifests:     []workapiv1.Manifest{deployment, orphanedService},
+			expected: &workapiv1.DeleteOption{
+				PropagationPolicy: workapiv1.DeletePropagationPolicyTypeSelectivelyOrphan,
+				SelectivelyOrphan: &workapiv1.SelectivelyOrphan{OrphaningRules: []workapiv1.OrphaningRule{serviceRule}},
+			},
+		},
+		{
+			name:          "annotated foreground",
+			defaultPolicy: DeletePolicySelectivelyOrphan,
+			manifests:     []workapiv1.Manifest{foregroundClaim, orphanedService},
+			expected: &workapiv1.DeleteOption{
+				PropagationPolicy: workapiv1.DeletePropagationPolicyTypeSelectivelyOrphan,
+				SelectivelyOrphan: &workapiv1.SelectivelyOrphan{OrphaningRules: []workapiv1.OrphaningRule{serviceRule}},
+			},
+		},
+		{
+			name:          "all manifests annotated orphan",
+			defaultPolicy: DeletePolicyForeground,
+			manifests:     []workapiv1.Manifest{orphanedService},
+			expected:      &workapiv1.DeleteOption{PropagationPolicy: workapiv1.DeletePropagationPolicyTypeOrphan},
+		},
+		{
+			name:          "no manifests",
+			defaultPolicy: DeletePolicyOrphan,
+			manifests:     []workapiv1.Manifest{},
+		},
+		{
+			name:          "invalid annotated policy",
+			defaultPolicy: DeletePolicyForeground,
+			manifests:     []workapiv1.Manifest{deployment, invalid},
+			expectedErr:   true,
+		},
+		{
+			name:          "invalid default policy",
+			defaultPolicy: "Never",
+			manifests:     []workapiv1.Manifest{deployment},
+			expectedErr:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := DeleteOptionOf(c.defaultPolicy, c.manifests)
+			if c.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("expected %+v, got %+v", c.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// FairShareQueue runs the syncs of the controllers of all logical clusters on a shared pool of
+// workers. The keys of each controller of a working namespace are queued on their own sub-queue,
+// and the workers dequeue the working namespaces round-robin, so the queue depth of a noisy logical
+// cluster neither delays the keys of the others nor holds the workers while it waits. Each sub-queue
+// runs at most perQueue syncs at the same time.
+type FairShareQueue struct {
+	capacity int
+	perQueue int
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	tenants  []*tenantQueues
+	next     int
+	shutdown bool
+}
+
+// tenantQueues are the sub-queues of the controllers of a working namespace
+type tenantQueues struct {
+	name   string
+	queues []*subQueue
+	next   int
+}
+
+// subQueue holds the keys of a controller of a working namespace. The keys are deduplicated and a
+// key is never synced twice at the same time, as in the queue of the controller.
+type subQueue struct {
+	name        string
+	queue       workqueue.Interface
+	rateLimiter workqueue.RateLimiter
+	running     int
+
+	// the sync of the controller with the context and the sync context it was last called with
+	sync    factory.SyncFunc
+	ctx     context.Context
+	syncCtx factory.SyncContext
+}
+
+// NewFairShareQueue returns a queue run by capacity workers. A capacity less than 1 means no limit,
+// the syncs then run on the workers of each controller. A perQueue less than 1 means no limit.
+func NewFairShareQueue(capacity, perQueue int) *FairShareQueue {
+	q := &FairShareQueue{
+		capacity: capacity,
+		perQueue: perQueue,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// WrapSync returns a sync func that queues the key on the sub-queue of the controller of the
+// tenant, the given sync runs on the workers of the fair share queue. A nil queue or a queue
+// without capacity returns the sync func unchanged.
+func (q *FairShareQueue) WrapSync(tenant, queue string, syncFn factory.SyncFunc) factory.SyncFunc {
+	if q == nil || q.capacity < 1 {
+		return syncFn
+	}
+
+	return func(ctx context.Context, syncCtx factory.SyncContext) error {
+		q.add(ctx, tenant, queue, syncFn, syncCtx)
+		return nil
+	}
+}
+
+// Run starts the workers and blocks until the context is done
+func (q *FairShareQueue) Run(ctx context.Context) {
+	if q == nil || q.capacity < 1 {
+		return
+	}
+
+	for i := 0; i < q.capacity; i++ {
+		go q.runWorker()
+	}
+
+	<-ctx.Done()
+	q.lock.Lock()
+	q.shutdown = true
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+// Forget drops the sub-queues of a tenant which is no longer served, with their pending keys.
+func (q *FairShareQueue) Forget(tenant string) {
+	if q == nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, t := range q.tenants {
+		if t.name != tenant {
+			continue
+		}
+		for _, sq := range t.queues {
+			sq.queue.ShutDown()
+		}
+		q.tenants = append(q.tenants[:i], q.tenants[i+1:]...)
+		if q.next > i {
+			q.next--
+		}
+		return
+	}
+}
+
+func (q *FairShareQueue) add(ctx context.Context, tenant, queue string, syncFn factory.SyncFunc, syncCtx factory.SyncContext) {
+	// the controller is stopped, its keys are dropped
+	if ctx.Err() != nil {
+		return
+	}
+
+	q.lock.Lock()
+	sq := q.subQueue(tenant, queue)
+	sq.sync, sq.ctx, sq.syncCtx = syncFn, ctx, syncCtx
+	sq.queue.Add(syncCtx.QueueKey())
+	q.lock.Unlock()
+	q.cond.Signal()
+}
+
+func (q *FairShareQueue) subQueue(tenant, queue string) *subQueue {
+	var t *tenantQueues
+	for _, existing := range q.tenants {
+		if existing.name == tenant {
+			t = existing
+			break
+		}
+	}
+	if t == nil {
+		t = &tenantQueues{name: tenant}
+		q.tenants = append(q.tenants, t)
+	}
+
+	for _, sq := range t.queues {
+		if sq.name == queue {
+			return sq
+		}
+	}
+	sq := &subQueue{
+		name:        queue,
+		queue:       workqueue.New(),
+		rateLimiter: workqueue.DefaultControllerRateLimiter(),
+	}
+	t.queues = append(t.queues, sq)
+	return sq
+}
+
+func (q *FairShareQueue) runWorker() {
+	for {
+		task, ok := q.get()
+		if !ok {
+			return
+		}
+		q.process(task)
+	}
+}
+
+// task is a key dequeued from a sub-queue with the sync to run it
+type task struct {
+	tenant  string
+	queue   *subQueue
+	key     string
+	sync    factory.SyncFunc
+	ctx     context.Context
+	syncCtx factory.SyncContext
+}
+
+// get blocks until a key is ready on a sub-queue or the queue is shut down
+func (q *FairShareQueue) get() (task, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if q.shutdown {
+			return task{}, false
+		}
+		if t, sq := q.ready(); sq != nil {
+			item, _ := sq.queue.Get()
+			sq.running++
+			return task{
+				tenant: t.name, queue: sq, key: item.(string), sync: sq.sync, ctx: sq.ctx, syncCtx: sq.syncCtx,
+			}, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// ready returns the next sub-queue with a key to sync, the tenants are served round-robin and so are
+// the sub-queues of a tenant.
+func (q *FairShareQueue) ready() (*tenantQueues, *subQueue) {
+	for i := range q.tenants {
+		t := q.tenants[(q.next+i)%len(q.tenants)]
+		for j := range t.queues {
+			sq := t.queues[(t.next+j)%len(t.queues)]
+			if sq.queue.Len() == 0 || (q.perQueue > 0 && sq.running >= q.perQueue) {
+				continue
+			}
+			q.next = (q.next + i + 1) % len(q.tenants)
+			t.next = (t.next + j + 1) % len(t.queues)
+			return t, sq
+		}
+	}
+	return nil, nil
+}
+
+func (q *FairShareQueue) process(t task) {
+	defer q.done(t)
+	if t.ctx.Err() != nil {
+		return
+	}
+
+	err := t.sync(t.ctx, keySyncContext{SyncContext: t.syncCtx, key: t.key})
+	if err == nil {
+		t.queue.rateLimiter.Forget(t.key)
+		return
+	}
+	if err != factory.SyntheticRequeueError {
+		utilruntime.HandleError(fmt.Errorf("%q controller of %s failed to sync %q, err: %w", t.queue.name, t.tenant, t.key, err))
+	}
+	// the key is requeued by the controller, which queues it here again
+	t.syncCtx.Queue().AddAfter(t.key, t.queue.rateLimiter.When(t.key))
+}
+
+func (q *FairShareQueue) done(t task) {
+	q.lock.Lock()
+	t.queue.queue.Done(t.key)
+	t.queue.running--
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+// keySyncContext is the sync context of the controller with the dequeued key
+type keySyncContext struct {
+	factory.SyncContext
+	key string
+}
+
+func (c keySyncContext) QueueKey() string {
+	return c.key
+}
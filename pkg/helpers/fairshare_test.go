@@ -0,0 +1,172 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+)
+
+// queued is a key queued by a controller of a tenant
+type queued struct {
+	tenant string
+	queue  string
+	key    string
+}
+
+func (k queued) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.tenant, k.queue, k.key)
+}
+
+func TestFairShareQueueOrder(t *testing.T) {
+	cases := []struct {
+		name     string
+		perQueue int
+		queued   []queued
+		// running are dequeued first and are still syncing while the others are dequeued
+		running  int
+		expected []string
+	}{
+		{
+			name:     "tenants take turns",
+			queued:   []queued{{"a", "q", "1"}, {"a", "q", "2"}, {"a", "q", "3"}, {"b", "q", "1"}},
+			expected: []string{"a/q/1", "b/q/1", "a/q/2", "a/q/3"},
+		},
+		{
+			name: "queues of a tenant take turns",
+			queued: []queued{
+				{"a", "q1", "1"}, {"a", "q1", "2"}, {"a", "q2", "1"}, {"b", "q1", "1"}, {"b", "q1", "2"},
+			},
+			expected: []string{"a/q1/1", "b/q1/1", "a/q2/1", "b/q1/2", "a/q1/2"},
+		},
+		{
+			name:     "keys are deduplicated",
+			queued:   []queued{{"a", "q", "1"}, {"a", "q", "1"}, {"b", "q", "1"}},
+			expected: []string{"a/q/1", "b/q/1"},
+		},
+		{
+			name:     "queues at their limit are skipped",
+			perQueue: 1,
+			queued:   []queued{{"a", "q1", "1"}, {"a", "q1", "2"}, {"a", "q2", "1"}, {"b", "q1", "1"}},
+			running:  1,
+			expected: []string{"a/q1/1", "b/q1/1", "a/q2/1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := NewFairShareQueue(1, c.perQueue)
+			syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+			for _, k := range c.queued {
+				q.add(context.Background(), k.tenant, k.queue, nil, keySyncContext{SyncContext: syncCtx, key: k.key})
+			}
+
+			actual := []string{}
+			for i := 0; i < len(c.expected); i++ {
+				task, ok := q.get()
+				if !ok {
+					t.Fatal("expected a key")
+				}
+				actual = append(actual, queued{task.tenant, task.queue.name, task.key}.String())
+				if i >= c.running {
+					q.done(task)
+				}
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, actual)
+			}
+
+			q.lock.Lock()
+			_, sq := q.ready()
+			q.lock.Unlock()
+			if sq != nil {
+				t.Errorf("expected no key left to sync")
+			}
+		})
+	}
+}
+
+func TestFairShareQueueRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := NewFairShareQueue(2, 1)
+	go q.Run(ctx)
+
+	synced := make(chan string, 10)
+	failed := false
+	syncFn := func(ctx context.Context, syncCtx factory.SyncContext) error {
+		if syncCtx.QueueKey() == "fail" && !failed {
+			failed = true
+			return fmt.Errorf("failed")
+		}
+		synced <- syncCtx.QueueKey()
+		return nil
+	}
+
+	// the controller queue runs the wrapped sync, which hands the keys to the fair share queue
+	syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+	wrapped := q.WrapSync("a", "q", syncFn)
+	go func() {
+		for {
+			key, quit := syncCtx.Queue().Get()
+			if quit {
+				return
+			}
+			_ = wrapped(ctx, keySyncContext{SyncContext: syncCtx, key: key.(string)})
+			syncCtx.Queue().Done(key)
+		}
+	}()
+	defer syncCtx.Queue().ShutDown()
+
+	syncCtx.Queue().Add("fail")
+	syncCtx.Queue().Add("ok")
+
+	received := map[string]bool{}
+	for len(received) < 2 {
+		select {
+		case key := <-synced:
+			received[key] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the keys to be synced, got %v", received)
+		}
+	}
+}
+
+func TestFairShareQueueStoppedController(t *testing.T) {
+	q := NewFairShareQueue(1, 0)
+	syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.add(stopped, "a", "q", nil, keySyncContext{SyncContext: syncCtx, key: "1"})
+	q.add(context.Background(), "b", "q", nil, keySyncContext{SyncContext: syncCtx, key: "1"})
+	q.Forget("b")
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, sq := q.ready(); sq != nil {
+		t.Errorf("expected the keys of stopped controllers and forgotten tenants to be dropped")
+	}
+}
+
+func TestFairShareQueueWithoutCapacity(t *testing.T) {
+	called := false
+	syncFn := func(ctx context.Context, syncCtx factory.SyncContext) error {
+		called = true
+		return nil
+	}
+
+	var nilQueue *FairShareQueue
+	for _, q := range []*FairShareQueue{nilQueue, NewFairShareQueue(0, 1)} {
+		called = false
+		syncCtx := factory.NewSyncContext("test", events.NewInMemoryRecorder("test"))
+		if err := q.WrapSync("a", "q", syncFn)(context.Background(), syncCtx); err != nil || !called {
+			t.Errorf("expected the sync to run on the controller worker")
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package helpers
+
+import "k8s.io/apimachinery/pkg/util/sets"
+
+// BuiltInGroups are the API groups served natively by managed clusters, kcp exposes some of them as
+// CRDs. The core group is the empty group.
+var BuiltInGroups = sets.NewString(
+	"", "apps", "batch", "autoscaling", "policy", "extensions",
+	"admissionregistration.k8s.io", "apiextensions.k8s.io", "authentication.k8s.io", "authorization.k8s.io",
+	"certificates.k8s.io", "coordination.k8s.io", "discovery.k8s.io", "events.k8s.io",
+	"flowcontrol.apiserver.k8s.io", "networking.k8s.io", "node.k8s.io", "rbac.authorization.k8s.io",
+	"scheduling.k8s.io", "storage.k8s.io",
+)
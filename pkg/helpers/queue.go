@@ -0,0 +1,22 @@
+package helpers
+
+import (
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"k8s.io/client-go/tools/cache"
+)
+
+// RequeueOnChange adds the keys returned by keysFunc to the queue on the events of the informer,
+// for the informers whose objects affect the objects of many queue keys.
+func RequeueOnChange(syncCtx factory.SyncContext, informer cache.SharedIndexInformer, keysFunc func() []string) {
+	requeue := func() {
+		for _, key := range keysFunc() {
+			syncCtx.Queue().Add(key)
+		}
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { requeue() },
+		UpdateFunc: func(interface{}, interface{}) { requeue() },
+		DeleteFunc: func(interface{}) { requeue() },
+	})
+}
@@ -0,0 +1,112 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// SourceLogicalClusterLabel is set on the works and placements created by kcp-ocm with the working
+	// namespace of the logical cluster they belong to.
+	SourceLogicalClusterLabel = "kcp.open-cluster-management.io/source-logical-cluster"
+	// SourceResourceAnnotation is the resource of the kcp object a work or placement is created for, as
+	// <resource>.<version>.<group>
+	SourceResourceAnnotation = "kcp.open-cluster-management.io/source-resource"
+	// SourceNamespaceAnnotation is the namespace of the kcp object
+	SourceNamespaceAnnotation = "kcp.open-cluster-management.io/source-namespace"
+	// SourceNameAnnotation is the name of the kcp object
+	SourceNameAnnotation = "kcp.open-cluster-management.io/source-name"
+)
+
+// Source is the kcp object a work or placement is created for. Works aggregating the objects of a
+// namespace have no name, and works aggregating the objects of the logical cluster have neither a
+// namespace nor a name.
+type Source struct {
+	LogicalCluster string
+	Resource       schema.GroupVersionResource
+	Namespace      string
+	Name           string
+}
+
+// SetSource records the source on the labels and annotations of the object
+func SetSource(obj metav1.Object, source Source) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[SourceLogicalClusterLabel] = source.LogicalCluster
+	obj.SetLabels(labels)
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if len(source.Resource.Resource) > 0 {
+		annotations[SourceResourceAnnotation] = strings.TrimSuffix(
+			fmt.Sprintf("%s.%s.%s", source.Resource.Resource, source.Resource.Version, source.Resource.Group), ".")
+	}
+	if len(source.Namespace) > 0 {
+		annotations[SourceNamespaceAnnotation] = source.Namespace
+	}
+	if len(source.Name) > 0 {
+		annotations[SourceNameAnnotation] = source.Name
+	}
+	obj.SetAnnotations(annotations)
+}
+
+// SourceOf returns the source recorded on the object, or false if the object has no source
+func SourceOf(obj metav1.Object) (Source, bool) {
+	logicalCluster, ok := obj.GetLabels()[SourceLogicalClusterLabel]
+	if !ok {
+		return Source{}, false
+	}
+
+	source := Source{
+		LogicalCluster: logicalCluster,
+		Namespace:      obj.GetAnnotations()[SourceNamespaceAnnotation],
+		Name:           obj.GetAnnotations()[SourceNameAnnotation],
+	}
+	if resource, ok := obj.GetAnnotations()[SourceResourceAnnotation]; ok {
+		parts := strings.SplitN(resource, ".", 3)
+		if len(parts) < 2 {
+			return Source{}, false
+		}
+		source.Resource = schema.GroupVersionResource{Resource: parts[0], Version: parts[1]}
+		if len(parts) == 3 {
+			source.Resource.Group = parts[2]
+		}
+	}
+	return source, true
+}
+
+// MergeSource copies the source of the required object to the existing object, and returns whether the
+// existing object is changed.
+func MergeSource(existing, required metav1.Object) bool {
+	source, ok := SourceOf(required)
+	if !ok {
+		return false
+	}
+	if current, ok := SourceOf(existing); ok && current == source {
+		return false
+	}
+	SetSource(existing, source)
+	return true
+}
+
+// String returns the logical cluster qualified reference of the source
+func (s Source) String() string {
+	ref := s.LogicalCluster
+	if len(s.Resource.Resource) > 0 {
+		ref = fmt.Sprintf("%s:%s", ref, s.Resource.GroupResource().String())
+	}
+	if len(s.Namespace) > 0 {
+		ref = fmt.Sprintf("%s/%s", ref, s.Namespace)
+	}
+	if len(s.Name) > 0 {
+		ref = fmt.Sprintf("%s/%s", ref, s.Name)
+	}
+	return ref
+}
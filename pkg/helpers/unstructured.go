@@ -0,0 +1,25 @@
+package helpers
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// FieldsEqual returns whether each top level field of required equals the same field of existing,
+// fields only in existing are ignored since they are usually defaulted by the server.
+func FieldsEqual(existing, required interface{}) bool {
+	existingFields, ok := existing.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	requiredFields, ok := required.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	for key, value := range requiredFields {
+		if !equality.Semantic.DeepEqual(existingFields[key], value) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,12 +2,14 @@ package helpers
 
 import (
 	"context"
+	"encoding/json"
 
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/selection"
 	clusterlisterv1alpha1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1alpha1"
 	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
@@ -28,29 +30,95 @@ func ApplyWork(ctx context.Context, manifestWorkClient workv1client.WorkV1Interf
 		return err
 	}
 
-	if manifestsEqual(work.Spec.Workload.Manifests, existing.Spec.Workload.Manifests) {
+	if manifestsEqual(work.Spec.Workload.Manifests, existing.Spec.Workload.Manifests) &&
+		equality.Semantic.DeepEqual(work.Spec.DeleteOption, existing.Spec.DeleteOption) &&
+		mapContains(existing.Labels, work.Labels) && mapContains(existing.Annotations, work.Annotations) {
 		return nil
 	}
 
 	existing.Spec.Workload.Manifests = work.Spec.Workload.Manifests
+	existing.Spec.DeleteOption = work.Spec.DeleteOption
+	existing.Labels = mergeMap(existing.Labels, work.Labels)
+	existing.Annotations = mergeMap(existing.Annotations, work.Annotations)
 	_, err = manifestWorkClient.ManifestWorks(work.Namespace).Update(ctx, existing, metav1.UpdateOptions{})
 
 	return err
 }
 
+func mapContains(existing, required map[string]string) bool {
+	for k, v := range required {
+		if existingValue, ok := existing[k]; !ok || existingValue != v {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeMap(existing, required map[string]string) map[string]string {
+	if len(required) == 0 {
+		return existing
+	}
+	merged := map[string]string{}
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range required {
+		merged[k] = v
+	}
+	return merged
+}
+
 func manifestsEqual(new, old []workapiv1.Manifest) bool {
 	if len(new) != len(old) {
 		return false
 	}
 
 	for i := range new {
-		if !equality.Semantic.DeepEqual(new[i].Raw, old[i].Raw) {
+		if !equality.Semantic.DeepEqual(manifestContent(new[i]), manifestContent(old[i])) {
 			return false
 		}
 	}
 	return true
 }
 
+// manifestContent decodes the manifest, manifests built by the controllers carry the object
+// while the manifests read from the hub carry the raw json.
+func manifestContent(manifest workapiv1.Manifest) interface{} {
+	raw := manifest.Raw
+	if manifest.Object != nil {
+		data, err := json.Marshal(manifest.Object)
+		if err != nil {
+			return nil
+		}
+		raw = data
+	}
+
+	var content interface{}
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return nil
+	}
+	return dropNulls(content)
+}
+
+// dropNulls removes the null fields the hub may drop when it stores the manifests
+func dropNulls(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for k, v := range typed {
+			if v == nil {
+				delete(typed, k)
+				continue
+			}
+			typed[k] = dropNulls(v)
+		}
+	case []interface{}:
+		for i := range typed {
+			typed[i] = dropNulls(typed[i])
+		}
+	}
+	return value
+}
+
 func GetDecisionsByPlacement(decisionLister clusterlisterv1alpha1.PlacementDecisionLister, placementName, namespace string) ([]clusterapiv1alpha1.ClusterDecision, error) {
 	decisions := []clusterapiv1alpha1.ClusterDecision{}
 	requirement, err := labels.NewRequirement(placementLabel, selection.Equals, []string{placementName})
@@ -92,3 +160,47 @@ func GetPlacementByDecision(placementLister clusterlisterv1alpha1.PlacementListe
 
 	return placement
 }
+
+// FindManifestCondition returns the condition of the manifest with the kind, namespace and name
+// reported in the status of the work, or nil if the work agent has not reported it yet.
+func FindManifestCondition(work *workapiv1.ManifestWork, group, kind, namespace, name string) *workapiv1.ManifestCondition {
+	for i := range work.Status.ResourceStatus.Manifests {
+		resourceMeta := work.Status.ResourceStatus.Manifests[i].ResourceMeta
+		if resourceMeta.Group == group && resourceMeta.Kind == kind &&
+			resourceMeta.Namespace == namespace && resourceMeta.Name == name {
+			return &work.Status.ResourceStatus.Manifests[i]
+		}
+	}
+	return nil
+}
+
+// IsManifestConditionTrue returns whether the manifest reports the condition type as true
+func IsManifestConditionTrue(condition *workapiv1.ManifestCondition, conditionType workapiv1.ManifestConditionType) bool {
+	if condition == nil {
+		return false
+	}
+	return meta.IsStatusConditionTrue(condition.Conditions, string(conditionType))
+}
+
+// DeployedManifest returns the manifest of the object in the works, the object is identified by its
+// kind, namespace and name.
+func DeployedManifest(works []*workapiv1.ManifestWork, obj runtime.Object) (workapiv1.Manifest, bool) {
+	target, err := manifestObject(workapiv1.Manifest{RawExtension: runtime.RawExtension{Object: obj}})
+	if err != nil {
+		return workapiv1.Manifest{}, false
+	}
+
+	for _, work := range works {
+		for _, manifest := range work.Spec.Workload.Manifests {
+			deployed, err := manifestObject(manifest)
+			if err != nil {
+				continue
+			}
+			if deployed.GroupVersionKind().GroupKind() == target.GroupVersionKind().GroupKind() &&
+				deployed.GetNamespace() == target.GetNamespace() && deployed.GetName() == target.GetName() {
+				return manifest, true
+			}
+		}
+	}
+	return workapiv1.Manifest{}, false
+}
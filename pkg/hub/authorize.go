@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// CreatorAnnotation records the user creating a kcp object as a json user info with the username
+	// and groups. It is set by the creator admission webhook of kcp-ocm, which rejects the values set
+	// by users.
+	CreatorAnnotation = "kcp.open-cluster-management.io/creator"
+
+	// CreatorSignatureAnnotation is the signature of the creator by the creator webhook, see CreatorSignature.
+	// The webhook does not fail the requests when it is unreachable, the creators it has not signed are
+	// never trusted.
+	CreatorSignatureAnnotation = "kcp.open-cluster-management.io/creator-signature"
+
+	// authorizationTTL is how long the result of a SubjectAccessReview is reused
+	authorizationTTL = time.Minute
+)
+
+type authorization struct {
+	allowed bool
+	expiry  time.Time
+}
+
+// authorizations caches the results of the SubjectAccessReviews of a scope
+type authorizations struct {
+	lock    sync.Mutex
+	results map[string]authorization
+}
+
+// Authorize returns whether the creator of the kcp object is allowed to create ManifestWorks in the
+// namespace of the managed cluster on the hub. Objects are always allowed unless the scope authorizes
+// creators, and objects without a creator signed with the creator key are denied when it does.
+func (s *Scope) Authorize(ctx context.Context, obj metav1.Object, clusterName string) (bool, error) {
+	if !s.AuthorizeCreators {
+		return true, nil
+	}
+
+	creator, ok := obj.GetAnnotations()[CreatorAnnotation]
+	if !ok || !validCreatorSignature(s.CreatorKey, obj, creator) {
+		return false, nil
+	}
+	user, err := parseCreator(creator)
+	if err != nil {
+		return false, fmt.Errorf("invalid creator of %s: %v", obj.GetName(), err)
+	}
+
+	key := fmt.Sprintf("%s/%s/%s", user.Username, strings.Join(user.Groups, ","), clusterName)
+	s.authorizations.lock.Lock()
+	result, ok := s.authorizations.results[key]
+	s.authorizations.lock.Unlock()
+	if ok && time.Now().Before(result.expiry) {
+		return result.allowed, nil
+	}
+
+	review, err := s.Hub.KubeClient.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			Groups: user.Groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: clusterName,
+				Verb:      "create",
+				Group:     workapiv1.GroupName,
+				Resource:  "manifestworks",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	s.authorizations.lock.Lock()
+	s.authorizations.results[key] = authorization{allowed: review.Status.Allowed, expiry: time.Now().Add(authorizationTTL)}
+	s.authorizations.lock.Unlock()
+	return review.Status.Allowed, nil
+}
+
+// AuthorizedDecisions returns the decisions on the clusters the creator of the object is allowed to
+// create works for, and the keys of the other clusters.
+func AuthorizedDecisions(ctx context.Context, obj metav1.Object, decisions []Decision) ([]Decision, []string, error) {
+	authorized := []Decision{}
+	denied := []string{}
+	for _, decision := range decisions {
+		allowed, err := decision.Scope.Authorize(ctx, obj, decision.ClusterName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !allowed {
+			denied = append(denied, decision.Key())
+			continue
+		}
+		authorized = append(authorized, decision)
+	}
+	return authorized, denied, nil
+}
+
+func parseCreator(creator string) (authenticationv1.UserInfo, error) {
+	user := authenticationv1.UserInfo{}
+	if err := json.Unmarshal([]byte(creator), &user); err != nil {
+		return user, err
+	}
+	if len(user.Username) == 0 {
+		return user, fmt.Errorf("no username")
+	}
+	return user, nil
+}
+
+// CreatorSignature returns the signature of the creator of the object with the namespace and name. The
+// name of an object created with a generated name is not known yet when its creator is recorded, these
+// creators are signed with an empty name.
+func CreatorSignature(key []byte, creator, namespace, name string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{creator, namespace, name}, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validCreatorSignature(key []byte, obj metav1.Object, creator string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	signature := obj.GetAnnotations()[CreatorSignatureAnnotation]
+	for _, name := range []string{obj.GetName(), ""} {
+		expected := CreatorSignature(key, creator, obj.GetNamespace(), name)
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
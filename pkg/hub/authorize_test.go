@@ -0,0 +1,118 @@
+package hub
+
+import (
+	"context"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+// fakeAuthorizationClient allows the users it lists to create works and counts the reviews
+type fakeAuthorizationClient struct {
+	kubernetes.Interface
+	authorizationv1client.AuthorizationV1Interface
+	authorizationv1client.SubjectAccessReviewInterface
+	allowed map[string]bool
+	reviews int
+}
+
+func (c *fakeAuthorizationClient) AuthorizationV1() authorizationv1client.AuthorizationV1Interface {
+	return c
+}
+
+func (c *fakeAuthorizationClient) SubjectAccessReviews() authorizationv1client.SubjectAccessReviewInterface {
+	return c
+}
+
+func (c *fakeAuthorizationClient) Create(_ context.Context, review *authorizationv1.SubjectAccessReview, _ metav1.CreateOptions) (*authorizationv1.SubjectAccessReview, error) {
+	c.reviews++
+	review.Status.Allowed = c.allowed[review.Spec.User]
+	return review, nil
+}
+
+func TestAuthorize(t *testing.T) {
+	key := []byte("key")
+	alice := `{"username":"alice"}`
+	bob := `{"username":"bob"}`
+
+	cases := []struct {
+		name            string
+		annotations     map[string]string
+		expected        bool
+		expectedReviews int
+	}{
+		{
+			name:     "no creator",
+			expected: false,
+		},
+		{
+			name:        "unsigned creator",
+			annotations: map[string]string{CreatorAnnotation: alice},
+			expected:    false,
+		},
+		{
+			name: "creator signed for another object",
+			annotations: map[string]string{
+				CreatorAnnotation: alice, CreatorSignatureAnnotation: CreatorSignature(key, alice, "default", "other"),
+			},
+			expected: false,
+		},
+		{
+			name: "signature of another creator",
+			annotations: map[string]string{
+				CreatorAnnotation: bob, CreatorSignatureAnnotation: CreatorSignature(key, alice, "default", "web"),
+			},
+			expected: false,
+		},
+		{
+			name: "signed creator allowed",
+			annotations: map[string]string{
+				CreatorAnnotation: alice, CreatorSignatureAnnotation: CreatorSignature(key, alice, "default", "web"),
+			},
+			expected:        true,
+			expectedReviews: 1,
+		},
+		{
+			name: "creator signed with a generated name",
+			annotations: map[string]string{
+				CreatorAnnotation: alice, CreatorSignatureAnnotation: CreatorSignature(key, alice, "default", ""),
+			},
+			expected:        true,
+			expectedReviews: 1,
+		},
+		{
+			name: "signed creator denied",
+			annotations: map[string]string{
+				CreatorAnnotation: bob, CreatorSignatureAnnotation: CreatorSignature(key, bob, "default", "web"),
+			},
+			expected:        false,
+			expectedReviews: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeAuthorizationClient{allowed: map[string]bool{"alice": true}}
+			scope := (&Hub{Name: "hub", KubeClient: client}).NewScope("ws")
+			scope.AuthorizeCreators = true
+			scope.CreatorKey = key
+
+			obj := &metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: c.annotations}
+			for i := 0; i < 2; i++ {
+				allowed, err := scope.Authorize(context.Background(), obj, "cluster1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if allowed != c.expected {
+					t.Errorf("expected allowed %v, got %v", c.expected, allowed)
+				}
+			}
+			if client.reviews != c.expectedReviews {
+				t.Errorf("expected the review to be cached after %d reviews, got %d", c.expectedReviews, client.reviews)
+			}
+		})
+	}
+}
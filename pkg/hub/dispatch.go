@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// dispatcher fans the events of a cluster scoped informer of the hub out to the handlers of the
+// scopes. The shared informers cannot remove their handlers, so the handlers of a scope are kept
+// here and dropped when the scope is stopped.
+type dispatcher struct {
+	informer cache.SharedIndexInformer
+
+	lock     sync.RWMutex
+	handlers map[*Scope][]cache.ResourceEventHandler
+}
+
+func newDispatcher(informer cache.SharedIndexInformer) *dispatcher {
+	d := &dispatcher{
+		informer: informer,
+		handlers: map[*Scope][]cache.ResourceEventHandler{},
+	}
+	informer.AddEventHandler(d)
+	return d
+}
+
+// add registers the handler of the scope, it is notified of the objects already known as the
+// handlers added to the shared informer are.
+func (d *dispatcher) add(scope *Scope, handler cache.ResourceEventHandler) {
+	d.lock.Lock()
+	d.handlers[scope] = append(d.handlers[scope], handler)
+	d.lock.Unlock()
+
+	for _, obj := range d.informer.GetStore().List() {
+		handler.OnAdd(obj)
+	}
+}
+
+// remove drops all the handlers of the scope
+func (d *dispatcher) remove(scope *Scope) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.handlers, scope)
+}
+
+func (d *dispatcher) snapshot() []cache.ResourceEventHandler {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	handlers := []cache.ResourceEventHandler{}
+	for _, scopeHandlers := range d.handlers {
+		handlers = append(handlers, scopeHandlers...)
+	}
+	return handlers
+}
+
+func (d *dispatcher) OnAdd(obj interface{}) {
+	for _, handler := range d.snapshot() {
+		handler.OnAdd(obj)
+	}
+}
+
+func (d *dispatcher) OnUpdate(oldObj, newObj interface{}) {
+	for _, handler := range d.snapshot() {
+		handler.OnUpdate(oldObj, newObj)
+	}
+}
+
+func (d *dispatcher) OnDelete(obj interface{}) {
+	for _, handler := range d.snapshot() {
+		handler.OnDelete(obj)
+	}
+}
+
+// ScopedInformer is a cluster scoped informer of the hub seen from a scope, its event handlers live
+// as long as the scope.
+type ScopedInformer struct {
+	scope      *Scope
+	dispatcher *dispatcher
+}
+
+// AddEventHandler adds a handler removed when the scope is stopped
+func (i *ScopedInformer) AddEventHandler(handler cache.ResourceEventHandler) {
+	i.dispatcher.add(i.scope, handler)
+}
+
+// HasSynced returns whether the shared informer of the hub has synced
+func (i *ScopedInformer) HasSynced() bool {
+	return i.dispatcher.informer.HasSynced()
+}
@@ -0,0 +1,159 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	workclient "open-cluster-management.io/api/client/work/clientset/versioned"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultHubName is the hub that kcp-ocm is started against
+const DefaultHubName = "default"
+
+// Config is the file format of the hub registry
+type Config struct {
+	Hubs []HubConfig `json:"hubs"`
+}
+
+// HubConfig describes how to connect to one OCM hub
+type HubConfig struct {
+	Name       string `json:"name"`
+	KubeConfig string `json:"kubeconfig"`
+}
+
+// Hub holds the clients and the hub wide informers of an OCM hub
+type Hub struct {
+	Name             string
+	KubeClient       kubernetes.Interface
+	ClusterClient    clusterclient.Interface
+	WorkClient       workclient.Interface
+	KubeInformers    informers.SharedInformerFactory
+	ClusterInformers clusterinformers.SharedInformerFactory
+	WorkInformers    workinformers.SharedInformerFactory
+
+	clusters           *dispatcher
+	clusterSetBindings *dispatcher
+}
+
+// Registry holds all OCM hubs driven by the manager
+type Registry struct {
+	hubs map[string]*Hub
+}
+
+// NewRegistry builds the registry from the default hub config and an optional hub config file.
+func NewRegistry(defaultConfig *rest.Config, hubConfigFile string) (*Registry, error) {
+	r := &Registry{hubs: map[string]*Hub{}}
+
+	if err := r.add(DefaultHubName, defaultConfig); err != nil {
+		return nil, err
+	}
+
+	if len(hubConfigFile) == 0 {
+		return r, nil
+	}
+
+	data, err := ioutil.ReadFile(hubConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse hub config %s: %v", hubConfigFile, err)
+	}
+
+	for _, h := range config.Hubs {
+		if len(h.Name) == 0 {
+			return nil, fmt.Errorf("hub with kubeconfig %s has no name", h.KubeConfig)
+		}
+		if _, ok := r.hubs[h.Name]; ok {
+			return nil, fmt.Errorf("hub %q is defined more than once", h.Name)
+		}
+
+		restConfig, err := clientcmd.BuildConfigFromFlags("", h.KubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig of hub %q: %v", h.Name, err)
+		}
+
+		if err := r.add(h.Name, restConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Registry) add(name string, restConfig *rest.Config) error {
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	clusterClient, err := clusterclient.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	workClient, err := workclient.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	h := &Hub{
+		Name:             name,
+		KubeClient:       kubeClient,
+		ClusterClient:    clusterClient,
+		WorkClient:       workClient,
+		KubeInformers:    informers.NewSharedInformerFactory(kubeClient, 5*time.Minute),
+		ClusterInformers: clusterinformers.NewSharedInformerFactory(clusterClient, 5*time.Minute),
+		WorkInformers:    workinformers.NewSharedInformerFactory(workClient, 5*time.Minute),
+	}
+
+	// The cluster scoped informers are shared by the controllers of all logical clusters, they
+	// must be registered before the registry is started.
+	h.clusterSetBindings = newDispatcher(h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Informer())
+	h.clusters = newDispatcher(h.ClusterInformers.Cluster().V1().ManagedClusters().Informer())
+	h.ClusterInformers.Cluster().V1alpha1().Placements().Informer()
+	h.KubeInformers.Core().V1().Namespaces().Informer()
+	h.WorkInformers.Work().V1().ManifestWorks().Informer()
+
+	r.hubs[name] = h
+	return nil
+}
+
+// List returns all hubs sorted by name
+func (r *Registry) List() []*Hub {
+	hubs := []*Hub{}
+	for _, h := range r.hubs {
+		hubs = append(hubs, h)
+	}
+	sort.Slice(hubs, func(i, j int) bool {
+		return hubs[i].Name < hubs[j].Name
+	})
+	return hubs
+}
+
+// Get returns the hub with the name, or nil if it is not registered
+func (r *Registry) Get(name string) *Hub {
+	return r.hubs[name]
+}
+
+// Start starts the hub wide informers of all hubs
+func (r *Registry) Start(ctx context.Context) {
+	for _, h := range r.hubs {
+		go h.KubeInformers.Start(ctx.Done())
+		go h.ClusterInformers.Start(ctx.Done())
+		go h.WorkInformers.Start(ctx.Done())
+	}
+}
@@ -0,0 +1,294 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterinformerv1alpha1 "open-cluster-management.io/api/client/cluster/informers/externalversions/cluster/v1alpha1"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned/typed/work/v1"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	workinformer "open-cluster-management.io/api/client/work/informers/externalversions/work/v1"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	clusterapiv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+)
+
+const (
+	// ClusterSetLabel is set on a managed cluster with the ManagedClusterSet it belongs to
+	ClusterSetLabel = "cluster.open-cluster-management.io/clusterset"
+
+	// DrainLabel set to true on a managed cluster moves the kcp workloads off the cluster, the
+	// workloads are moved back when the label is removed.
+	DrainLabel = "kcp.open-cluster-management.io/drain"
+
+	// SplitWorkLabel is set on the works of the split workloads
+	SplitWorkLabel = "kcp.open-cluster-management.io/splitter"
+)
+
+// Scope is the working namespace of a logical cluster on one hub, with the informers
+// of the placements in the working namespace and the manifestworks in cluster namespaces.
+type Scope struct {
+	Hub              *Hub
+	WorkingNamespace string
+	// DeletePolicy is the default delete policy of the works delivering the resources of the logical cluster
+	DeletePolicy string
+	// AuthorizeCreators requires the creators of the kcp objects to be allowed to create the works on the hub
+	AuthorizeCreators bool
+	// CreatorKey is the key the creator webhook signs the creators with
+	CreatorKey []byte
+
+	authorizations   *authorizations
+	clusterInformers clusterinformers.SharedInformerFactory
+	workInformers    workinformers.SharedInformerFactory
+}
+
+// Decision is a managed cluster decided by a placement on a hub
+type Decision struct {
+	Scope       *Scope
+	ClusterName string
+}
+
+// Key returns the hub qualified name of the cluster, cluster names are only unique in a hub.
+func (d Decision) Key() string {
+	return ClusterKey(d.Scope.Hub.Name, d.ClusterName)
+}
+
+// ClusterKey returns the hub qualified name of a cluster
+func ClusterKey(hubName, clusterName string) string {
+	return fmt.Sprintf("%s/%s", hubName, clusterName)
+}
+
+// NewScope returns the scope of the working namespace on the hub
+func (h *Hub) NewScope(workingNamespace string) *Scope {
+	return &Scope{
+		Hub:              h,
+		WorkingNamespace: workingNamespace,
+		authorizations:   &authorizations{results: map[string]authorization{}},
+		clusterInformers: clusterinformers.NewSharedInformerFactoryWithOptions(
+			h.ClusterClient, 5*time.Minute, clusterinformers.WithNamespace(workingNamespace)),
+		workInformers: workinformers.NewSharedInformerFactory(h.WorkClient, 5*time.Minute),
+	}
+}
+
+// Start starts the informers of the scope, the handlers added to the informers shared with the
+// other scopes are removed when the scope is stopped.
+func (s *Scope) Start(stopCh <-chan struct{}) {
+	go s.clusterInformers.Start(stopCh)
+	go s.workInformers.Start(stopCh)
+	go func() {
+		<-stopCh
+		s.Hub.clusters.remove(s)
+		s.Hub.clusterSetBindings.remove(s)
+	}()
+}
+
+// ManagedClusters returns the managed cluster informer of the hub for the controllers of the scope
+func (s *Scope) ManagedClusters() *ScopedInformer {
+	return &ScopedInformer{scope: s, dispatcher: s.Hub.clusters}
+}
+
+// ManagedClusterSetBindings returns the binding informer of the hub for the controllers of the scope
+func (s *Scope) ManagedClusterSetBindings() *ScopedInformer {
+	return &ScopedInformer{scope: s, dispatcher: s.Hub.clusterSetBindings}
+}
+
+func (s *Scope) Placements() clusterinformerv1alpha1.PlacementInformer {
+	return s.clusterInformers.Cluster().V1alpha1().Placements()
+}
+
+func (s *Scope) PlacementDecisions() clusterinformerv1alpha1.PlacementDecisionInformer {
+	return s.clusterInformers.Cluster().V1alpha1().PlacementDecisions()
+}
+
+func (s *Scope) ManifestWorks() workinformer.ManifestWorkInformer {
+	return s.workInformers.Work().V1().ManifestWorks()
+}
+
+func (s *Scope) WorkClient() workv1client.WorkV1Interface {
+	return s.Hub.WorkClient.WorkV1()
+}
+
+// EnsurePlacement creates the placement in the working namespace if it does not exist, an existing
+// placement only gets the source of the placement recorded.
+func (s *Scope) EnsurePlacement(ctx context.Context, placement *clusterapiv1alpha1.Placement) error {
+	existing, err := s.Placements().Lister().Placements(s.WorkingNamespace).Get(placement.Name)
+	switch {
+	case errors.IsNotFound(err):
+		placement.Namespace = s.WorkingNamespace
+		_, err = s.Hub.ClusterClient.ClusterV1alpha1().Placements(s.WorkingNamespace).Create(ctx, placement, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	case err != nil:
+		return err
+	}
+
+	updated := existing.DeepCopy()
+	if !helpers.MergeSource(updated, placement) {
+		return nil
+	}
+	_, err = s.Hub.ClusterClient.ClusterV1alpha1().Placements(s.WorkingNamespace).Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+// ApplyPlacement creates the placement in the working namespace or updates its spec
+func (s *Scope) ApplyPlacement(ctx context.Context, placement *clusterapiv1alpha1.Placement) error {
+	existing, err := s.Placements().Lister().Placements(s.WorkingNamespace).Get(placement.Name)
+	switch {
+	case errors.IsNotFound(err):
+		return s.EnsurePlacement(ctx, placement)
+	case err != nil:
+		return err
+	}
+
+	updated := existing.DeepCopy()
+	sourceChanged := helpers.MergeSource(updated, placement)
+	if equality.Semantic.DeepEqual(existing.Spec, placement.Spec) && !sourceChanged {
+		return nil
+	}
+
+	updated.Spec = placement.Spec
+	_, err = s.Hub.ClusterClient.ClusterV1alpha1().Placements(s.WorkingNamespace).Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+// DeletePlacement deletes the placement in the working namespace if it exists
+func (s *Scope) DeletePlacement(ctx context.Context, name string) error {
+	_, err := s.Placements().Lister().Placements(s.WorkingNamespace).Get(name)
+	switch {
+	case errors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	err = s.Hub.ClusterClient.ClusterV1alpha1().Placements(s.WorkingNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Decisions returns the clusters decided by the placement in the working namespace
+func (s *Scope) Decisions(placementName string) ([]Decision, error) {
+	clusterDecisions, err := helpers.GetDecisionsByPlacement(s.PlacementDecisions().Lister(), placementName, s.WorkingNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := []Decision{}
+	for _, dec := range clusterDecisions {
+		decisions = append(decisions, Decision{Scope: s, ClusterName: dec.ClusterName})
+	}
+	return decisions, nil
+}
+
+// BoundClusters returns the managed clusters in the ManagedClusterSets bound to the working namespace
+func (s *Scope) BoundClusters() ([]*clusterapiv1.ManagedCluster, error) {
+	bindings, err := s.Hub.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Lister().
+		ManagedClusterSetBindings(s.WorkingNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return s.Hub.clustersOf(bindings)
+}
+
+// BoundClusterNames returns the names of the managed clusters bound to any working namespace on the hub
+func (h *Hub) BoundClusterNames() (sets.String, error) {
+	bindings, err := h.ClusterInformers.Cluster().V1alpha1().ManagedClusterSetBindings().Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := h.clustersOf(bindings)
+	if err != nil {
+		return nil, err
+	}
+	names := sets.NewString()
+	for _, cluster := range clusters {
+		names.Insert(cluster.Name)
+	}
+	return names, nil
+}
+
+// clustersOf returns the managed clusters in the ManagedClusterSets of the bindings
+func (h *Hub) clustersOf(bindings []*clusterapiv1alpha1.ManagedClusterSetBinding) ([]*clusterapiv1.ManagedCluster, error) {
+	clusterSets := sets.NewString()
+	for _, binding := range bindings {
+		clusterSets.Insert(binding.Spec.ClusterSet)
+	}
+
+	if clusterSets.Len() == 0 {
+		return nil, nil
+	}
+
+	requirement, err := labels.NewRequirement(ClusterSetLabel, selection.In, clusterSets.List())
+	if err != nil {
+		return nil, err
+	}
+
+	return h.ClusterInformers.Cluster().V1().ManagedClusters().Lister().List(labels.NewSelector().Add(*requirement))
+}
+
+// Draining returns whether the managed cluster is marked to be drained
+func (s *Scope) Draining(clusterName string) bool {
+	cluster, err := s.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(clusterName)
+	if err != nil {
+		return false
+	}
+	return cluster.Labels[DrainLabel] == "true"
+}
+
+// Drained returns whether the split workloads of the logical cluster are all moved off the managed
+// cluster, the works split from the other logical clusters sharing the cluster namespace are not waited on.
+func (s *Scope) Drained(clusterName string) (bool, error) {
+	split, err := labels.NewRequirement(SplitWorkLabel, selection.Exists, []string{})
+	if err != nil {
+		return false, err
+	}
+	source, err := labels.NewRequirement(helpers.SourceLogicalClusterLabel, selection.Equals, []string{s.WorkingNamespace})
+	if err != nil {
+		return false, err
+	}
+
+	works, err := s.ManifestWorks().Lister().ManifestWorks(clusterName).List(labels.NewSelector().Add(*split, *source))
+	if err != nil {
+		return false, err
+	}
+	return len(works) == 0, nil
+}
+
+// SplitDraining separates the decisions on the clusters marked to be drained
+func SplitDraining(decisions []Decision) ([]Decision, []Decision) {
+	active, draining := []Decision{}, []Decision{}
+	for _, decision := range decisions {
+		if decision.Scope.Draining(decision.ClusterName) {
+			draining = append(draining, decision)
+			continue
+		}
+		active = append(active, decision)
+	}
+	return active, draining
+}
+
+// DecisionsOf returns the clusters decided by the placement on all the scopes
+func DecisionsOf(scopes []*Scope, placementName string) ([]Decision, error) {
+	decisions := []Decision{}
+	for _, s := range scopes {
+		hubDecisions, err := s.Decisions(placementName)
+		if err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, hubDecisions...)
+	}
+	return decisions, nil
+}
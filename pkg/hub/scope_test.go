@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+func newWork(namespace, name string, labels map[string]string) *workapiv1.ManifestWork {
+	return &workapiv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+}
+
+func TestDrained(t *testing.T) {
+	cases := []struct {
+		name     string
+		works    []*workapiv1.ManifestWork
+		expected bool
+	}{
+		{
+			name:     "no works",
+			expected: true,
+		},
+		{
+			name: "split work of the logical cluster",
+			works: []*workapiv1.ManifestWork{
+				newWork("cluster1", "deployment-ws1.default.web", map[string]string{
+					SplitWorkLabel: "deployment-ws1.default.web", helpers.SourceLogicalClusterLabel: "ws1",
+				}),
+			},
+			expected: false,
+		},
+		{
+			name: "split work of another logical cluster",
+			works: []*workapiv1.ManifestWork{
+				newWork("cluster1", "deployment-ws2.default.web", map[string]string{
+					SplitWorkLabel: "deployment-ws2.default.web", helpers.SourceLogicalClusterLabel: "ws2",
+				}),
+			},
+			expected: true,
+		},
+		{
+			name: "split work on another cluster",
+			works: []*workapiv1.ManifestWork{
+				newWork("cluster2", "deployment-ws1.default.web", map[string]string{
+					SplitWorkLabel: "deployment-ws1.default.web", helpers.SourceLogicalClusterLabel: "ws1",
+				}),
+			},
+			expected: true,
+		},
+		{
+			name: "works that are not split",
+			works: []*workapiv1.ManifestWork{
+				newWork("cluster1", "namespace-syncer-ws1", map[string]string{helpers.SourceLogicalClusterLabel: "ws1"}),
+			},
+			expected: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scope := &Scope{
+				Hub:              &Hub{Name: "hub"},
+				WorkingNamespace: "ws1",
+				workInformers:    workinformers.NewSharedInformerFactory(nil, 0),
+			}
+			indexer := scope.ManifestWorks().Informer().GetIndexer()
+			for _, work := range c.works {
+				if err := indexer.Add(work); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			drained, err := scope.Drained("cluster1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if drained != c.expected {
+				t.Errorf("expected drained %v, got %v", c.expected, drained)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package manifests
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"path"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+//go:embed crds
+var crdFiles embed.FS
+
+//go:embed probe
+var probeFiles embed.FS
+
+// probeImagePlaceholder is replaced with the image of the API probe
+const probeImagePlaceholder = "PROBE_IMAGE"
+
+// CustomResourceDefinitionGVR is the resource of the CRDs
+var CustomResourceDefinitionGVR = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1",
+	Resource: "customresourcedefinitions",
+}
+
+const (
+	// ManagedClusterInventoryCRD is the CRD of the managed cluster inventory published into logical clusters
+	ManagedClusterInventoryCRD = "crds/kcp.open-cluster-management.io_managedclusterinventories.yaml"
+	// ClusterOverrideCRD is the CRD of the overrides of the resources delivered to the managed clusters
+	ClusterOverrideCRD = "crds/kcp.open-cluster-management.io_clusteroverrides.yaml"
+	// DeliveryPolicyCRD is the CRD of the policies the resources comply with to be delivered to the managed clusters
+	DeliveryPolicyCRD = "crds/kcp.open-cluster-management.io_deliverypolicies.yaml"
+	// EncryptedSecretCRD is the CRD of the encrypted Secrets, it is delivered to the managed clusters with them
+	EncryptedSecretCRD = "crds/kcp.open-cluster-management.io_encryptedsecrets.yaml"
+)
+
+// ApplyCRDs creates or updates the CRDs owned by kcp-ocm with the dynamic client
+func ApplyCRDs(ctx context.Context, client dynamic.Interface, files ...string) error {
+	for _, file := range files {
+		required, err := CRD(file)
+		if err != nil {
+			return err
+		}
+
+		existing, err := client.Resource(CustomResourceDefinitionGVR).Get(ctx, required.GetName(), metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			if _, err := client.Resource(CustomResourceDefinitionGVR).Create(ctx, required, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		if helpers.FieldsEqual(existing.Object["spec"], required.Object["spec"]) {
+			continue
+		}
+
+		existing.Object["spec"] = required.Object["spec"]
+		if _, err := client.Resource(CustomResourceDefinitionGVR).Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CRD returns the CRD of the file
+func CRD(file string) (*unstructured.Unstructured, error) {
+	data, err := crdFiles.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	crd := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal(data, &crd.Object); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", file, err)
+	}
+	return crd, nil
+}
+
+// APIProbeManifests returns the manifests of the probe publishing the API resources served by a
+// managed cluster as ClusterClaims, ordered by file name.
+func APIProbeManifests(image string) ([]*unstructured.Unstructured, error) {
+	entries, err := probeFiles.ReadDir("probe")
+	if err != nil {
+		return nil, err
+	}
+
+	objs := []*unstructured.Unstructured{}
+	for _, entry := range entries {
+		data, err := probeFiles.ReadFile(path.Join("probe", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		data = bytes.ReplaceAll(data, []byte(probeImagePlaceholder), []byte(image))
+
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", entry.Name(), err)
+		}
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
@@ -0,0 +1,225 @@
+package membership
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// replicaLabel is set on the leases of the replicas
+	replicaLabel = "kcp.open-cluster-management.io/replica"
+
+	leasePrefix   = "kcp-ocm-replica-"
+	leaseDuration = 30 * time.Second
+	renewInterval = 10 * time.Second
+
+	// ownershipTimeout is how long this replica owns working namespaces after the last renewal of its
+	// lease, it drops them before the lease expires and the other replicas take them over.
+	ownershipTimeout = leaseDuration - renewInterval
+)
+
+// Membership tracks the replicas of kcp-ocm with a lease per replica, and shards the working namespaces
+// across the live replicas with consistent hashing. A replica is live while its lease is renewed, and
+// drops its working namespaces when it fails to renew its own lease before the lease expires.
+type Membership struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	identity   string
+
+	lock     sync.RWMutex
+	members  sets.String
+	ring     *ring
+	handlers []func()
+	// renewed is the last time the lease of this replica was renewed
+	renewed time.Time
+}
+
+// NewMembership returns the membership of the replica with the identity, the leases are kept in the
+// namespace of the hub.
+func NewMembership(kubeClient kubernetes.Interface, namespace, identity string) *Membership {
+	return &Membership{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		identity:   identity,
+		members:    sets.NewString(),
+		ring:       newRing(nil),
+	}
+}
+
+// AddHandler registers a function called when replicas join or leave
+func (m *Membership) AddHandler(handler func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Owns returns whether the working namespace is handled by this replica. It is nil safe, a nil
+// membership owns all the working namespaces.
+func (m *Membership) Owns(namespace string) bool {
+	if m == nil {
+		return true
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.fresh(time.Now()) && m.ring.owner(namespace) == m.identity
+}
+
+// fresh returns whether the lease of this replica was renewed recently enough to own working namespaces
+func (m *Membership) fresh(now time.Time) bool {
+	return now.Sub(m.renewed) < ownershipTimeout
+}
+
+// Start joins the replicas and keeps the membership up to date until the context is done, then leaves
+// so the other replicas take over the working namespaces without waiting for the lease to expire.
+func (m *Membership) Start(ctx context.Context) error {
+	if err := m.renew(ctx); err != nil {
+		return err
+	}
+	if err := m.refresh(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			// The calls are bounded so the working namespaces are dropped in time when the hub hangs
+			ctx, cancel := context.WithTimeout(ctx, renewInterval/2)
+			defer cancel()
+
+			if err := m.renew(ctx); err != nil {
+				klog.Errorf("failed to renew the lease of replica %s: %v", m.identity, err)
+			}
+			if err := m.refresh(ctx); err != nil {
+				klog.Errorf("failed to refresh the replicas: %v", err)
+				m.dropIfStale()
+			}
+		}, renewInterval)
+
+		err := m.kubeClient.CoordinationV1().Leases(m.namespace).Delete(context.Background(), leasePrefix+m.identity, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("failed to release the lease of replica %s: %v", m.identity, err)
+		}
+	}()
+	return nil
+}
+
+// renew creates or renews the lease of this replica
+func (m *Membership) renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(time.Now())
+	leases := m.kubeClient.CoordinationV1().Leases(m.namespace)
+
+	lease, err := leases.Get(ctx, leasePrefix+m.identity, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		durationSeconds := int32(leaseDuration.Seconds())
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leasePrefix + m.identity,
+				Namespace: m.namespace,
+				Labels:    map[string]string{replicaLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+	case err == nil:
+		lease.Spec.RenewTime = &now
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.renewed = now.Time
+	m.lock.Unlock()
+	return nil
+}
+
+// refresh rebuilds the ring from the live leases and calls the handlers if the replicas changed
+func (m *Membership) refresh(ctx context.Context) error {
+	leases, err := m.kubeClient.CoordinationV1().Leases(m.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{replicaLabel: "true"}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// This replica is a member while its lease is fresh, even if the lease listed is older
+	now := time.Now()
+	members := sets.NewString()
+	for _, lease := range leases.Items {
+		if live(lease, now) {
+			members.Insert(*lease.Spec.HolderIdentity)
+		}
+	}
+	m.lock.RLock()
+	fresh := m.fresh(now)
+	m.lock.RUnlock()
+	if fresh {
+		members.Insert(m.identity)
+	} else {
+		members.Delete(m.identity)
+	}
+
+	m.update(members)
+	return nil
+}
+
+// dropIfStale removes this replica from the members once its lease is stale, so it stops handling the
+// working namespaces even when the replicas cannot be listed.
+func (m *Membership) dropIfStale() {
+	m.lock.RLock()
+	stale := !m.fresh(time.Now()) && m.members.Has(m.identity)
+	members := sets.NewString(m.members.List()...)
+	m.lock.RUnlock()
+
+	if stale {
+		members.Delete(m.identity)
+		m.update(members)
+	}
+}
+
+// update rebuilds the ring from the members and calls the handlers if the replicas changed
+func (m *Membership) update(members sets.String) {
+	m.lock.Lock()
+	if members.Equal(m.members) {
+		m.lock.Unlock()
+		return
+	}
+	klog.Infof("replicas changed from %v to %v", m.members.List(), members.List())
+	m.members = members
+	m.ring = newRing(members.List())
+	handlers := append([]func(){}, m.handlers...)
+	m.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// live returns whether the lease is held and was renewed within its duration
+func live(lease coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil {
+		return false
+	}
+
+	duration := leaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return lease.Spec.RenewTime.Add(duration).After(now)
+}
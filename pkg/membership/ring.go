@@ -0,0 +1,54 @@
+package membership
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// virtualNodes is the number of points of each member on the ring, so the keys are spread evenly and
+// only the keys of a member joining or leaving move.
+const virtualNodes = 100
+
+// ring is a consistent hash ring of the members
+type ring struct {
+	points  []uint64
+	members map[uint64]string
+}
+
+func newRing(members []string) *ring {
+	r := &ring{members: map[uint64]string{}}
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(fmt.Sprintf("%s#%d", member, i))
+			r.points = append(r.points, point)
+			r.members[point] = member
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// owner returns the member owning the key, which is the first member at or after the key on the ring
+func (r *ring) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	point := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= point
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
+
+func hash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,142 @@
+package membership
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func testKeys(n int) []string {
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("workspace-%d", i))
+	}
+	return keys
+}
+
+func TestRingOwner(t *testing.T) {
+	cases := []struct {
+		name    string
+		members []string
+		// changed are the members after a replica joins or leaves
+		changed []string
+	}{
+		{
+			name:    "no members",
+			members: []string{},
+			changed: []string{"a"},
+		},
+		{
+			name:    "single member",
+			members: []string{"a"},
+			changed: []string{"a", "b"},
+		},
+		{
+			name:    "member joining",
+			members: []string{"a", "b", "c"},
+			changed: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "member leaving",
+			members: []string{"a", "b", "c"},
+			changed: []string{"a", "c"},
+		},
+	}
+
+	keys := testKeys(1000)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before, after := newRing(c.members), newRing(c.changed)
+			members, changed := sets.NewString(c.members...), sets.NewString(c.changed...)
+
+			owned := map[string]int{}
+			for _, key := range keys {
+				owner := before.owner(key)
+				switch {
+				case len(c.members) == 0 && owner != "":
+					t.Fatalf("expected no owner of %s, got %s", key, owner)
+				case len(c.members) > 0 && !members.Has(owner):
+					t.Fatalf("%s is owned by %q which is not a member", key, owner)
+				}
+				owned[owner]++
+
+				// the order of the members does not matter
+				if reversed := newRing(reverse(c.members)); reversed.owner(key) != owner {
+					t.Errorf("%s is owned by %s or %s depending on the order of the members", key, owner, reversed.owner(key))
+				}
+
+				// only the keys of the members joining or leaving move
+				newOwner := after.owner(key)
+				if len(c.members) > 0 && newOwner != owner && changed.Has(owner) && members.Has(newOwner) {
+					t.Errorf("%s moved from %s to %s which were both members", key, owner, newOwner)
+				}
+			}
+
+			// each member owns a fair share of the keys
+			for _, member := range c.members {
+				if share := owned[member]; share < len(keys)/len(c.members)/2 {
+					t.Errorf("%s owns %d keys of %d", member, share, len(keys))
+				}
+			}
+		})
+	}
+}
+
+func reverse(members []string) []string {
+	reversed := []string{}
+	for i := len(members) - 1; i >= 0; i-- {
+		reversed = append(reversed, members[i])
+	}
+	return reversed
+}
+
+func TestOwns(t *testing.T) {
+	cases := []struct {
+		name     string
+		members  []string
+		renewed  time.Time
+		expected bool
+	}{
+		{
+			name:     "fresh single replica",
+			members:  []string{"self"},
+			renewed:  time.Now(),
+			expected: true,
+		},
+		{
+			name:     "stale lease",
+			members:  []string{"self"},
+			renewed:  time.Now().Add(-ownershipTimeout),
+			expected: false,
+		},
+		{
+			name:     "never renewed",
+			members:  []string{"self"},
+			expected: false,
+		},
+		{
+			name:     "not a member",
+			members:  []string{"other"},
+			renewed:  time.Now(),
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewMembership(nil, "ns", "self")
+			m.update(sets.NewString(c.members...))
+			m.renewed = c.renewed
+			if actual := m.Owns("workspace"); actual != c.expected {
+				t.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+
+	var m *Membership
+	if !m.Owns("workspace") {
+		t.Errorf("expected a nil membership to own all the working namespaces")
+	}
+}
@@ -0,0 +1,231 @@
+package override
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	jsonPatchType           = "JSONPatch"
+	mergePatchType          = "MergePatch"
+	strategicMergePatchType = "StrategicMergePatch"
+)
+
+// ClusterOverrideGVR is the resource of the cluster overrides in the logical cluster
+var ClusterOverrideGVR = schema.GroupVersionResource{
+	Group:    "kcp.open-cluster-management.io",
+	Version:  "v1alpha1",
+	Resource: "clusteroverrides",
+}
+
+// ClusterSelector selects the managed clusters by their names or labels
+type ClusterSelector struct {
+	ClusterNames  []string              `json:"clusterNames,omitempty"`
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+}
+
+// ResourceSelector selects the resources by their apiVersion, kind, namespace and name
+type ResourceSelector struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+type patch struct {
+	Type  string          `json:"type"`
+	Patch json.RawMessage `json:"patch"`
+}
+
+type overrideSpec struct {
+	ClusterSelector   ClusterSelector    `json:"clusterSelector,omitempty"`
+	ResourceSelectors []ResourceSelector `json:"resourceSelectors,omitempty"`
+	Patches           []patch            `json:"patches"`
+}
+
+// Overrider patches the resources delivered to a managed cluster with the ClusterOverrides in the
+// logical cluster that select the cluster and the resource, and resolves the placeholders of the
+// cluster facts in the resources.
+type Overrider struct {
+	informer informers.GenericInformer
+}
+
+func NewOverrider(informer informers.GenericInformer) *Overrider {
+	return &Overrider{informer: informer}
+}
+
+// Informer returns the informer of the ClusterOverrides, controllers requeue on its events
+func (o *Overrider) Informer() cache.SharedIndexInformer {
+	return o.informer.Informer()
+}
+
+// Apply returns the object patched by the overrides selecting the decided cluster, with the placeholders
+// resolved with the facts of the cluster. The object is returned as it is if it is neither patched nor has
+// placeholders. It is nil safe, a nil overrider only resolves the placeholders.
+func (o *Overrider) Apply(decision hub.Decision, obj runtime.Object) (runtime.Object, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	patched := false
+	if o != nil {
+		if data, patched, err = o.patch(decision, obj, data); err != nil {
+			return nil, err
+		}
+	}
+
+	hasPlaceholders := placeholderPattern.Match(data)
+	if !patched && !hasPlaceholders {
+		return obj, nil
+	}
+
+	result := &unstructured.Unstructured{}
+	if err := result.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	if hasPlaceholders {
+		substitute(result.Object, factsOf(decision))
+	}
+	return result, nil
+}
+
+// patch applies the overrides selecting the decided cluster and the object in the order of their names
+func (o *Overrider) patch(decision hub.Decision, obj runtime.Object, data []byte) ([]byte, bool, error) {
+	objs, err := o.informer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, false, err
+	}
+
+	overrides := []*unstructured.Unstructured{}
+	for _, obj := range objs {
+		if override, ok := obj.(*unstructured.Unstructured); ok {
+			overrides = append(overrides, override)
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].GetName() < overrides[j].GetName()
+	})
+
+	patched := false
+	for _, override := range overrides {
+		spec := &overrideSpec{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(specOf(override), spec); err != nil {
+			return nil, false, fmt.Errorf("invalid ClusterOverride %s: %v", override.GetName(), err)
+		}
+
+		selected, err := SelectsCluster(spec.ClusterSelector, decision)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid ClusterOverride %s: %v", override.GetName(), err)
+		}
+		if !selected || !SelectsResource(spec.ResourceSelectors, data) {
+			continue
+		}
+
+		for _, p := range spec.Patches {
+			if data, err = applyPatch(data, p, obj); err != nil {
+				return nil, false, fmt.Errorf("failed to apply ClusterOverride %s: %v", override.GetName(), err)
+			}
+			patched = true
+		}
+	}
+
+	return data, patched, nil
+}
+
+func specOf(override *unstructured.Unstructured) map[string]interface{} {
+	spec, _, _ := unstructured.NestedMap(override.Object, "spec")
+	return spec
+}
+
+// SelectsCluster returns whether the selector selects the decided cluster, an empty selector selects all the clusters
+func SelectsCluster(selector ClusterSelector, decision hub.Decision) (bool, error) {
+	if len(selector.ClusterNames) > 0 {
+		found := false
+		for _, name := range selector.ClusterNames {
+			if name == decision.ClusterName || name == decision.Key() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	if selector.LabelSelector == nil {
+		return true, nil
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector.LabelSelector)
+	if err != nil {
+		return false, err
+	}
+
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil {
+		return false, nil
+	}
+	return labelSelector.Matches(labels.Set(cluster.Labels)), nil
+}
+
+// SelectsResource returns whether any selector selects the resource, no selector selects all the resources
+func SelectsResource(selectors []ResourceSelector, data []byte) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+
+	resource := &unstructured.Unstructured{}
+	if err := resource.UnmarshalJSON(data); err != nil {
+		return false
+	}
+
+	for _, selector := range selectors {
+		if matches(selector.APIVersion, resource.GetAPIVersion()) && matches(selector.Kind, resource.GetKind()) &&
+			matches(selector.Namespace, resource.GetNamespace()) && matches(selector.Name, resource.GetName()) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(selected, value string) bool {
+	return len(selected) == 0 || strings.EqualFold(selected, value)
+}
+
+func applyPatch(data []byte, p patch, obj runtime.Object) ([]byte, error) {
+	switch p.Type {
+	case jsonPatchType:
+		operations, err := jsonpatch.DecodePatch(p.Patch)
+		if err != nil {
+			return nil, err
+		}
+		return operations.Apply(data)
+	case mergePatchType:
+		return jsonpatch.MergePatch(data, p.Patch)
+	case strategicMergePatchType:
+		// The strategic merge needs the type of the resource, which is only known for the built-in resources
+		gvk := obj.GetObjectKind().GroupVersionKind()
+		dataStruct, err := scheme.Scheme.New(gvk)
+		if err != nil {
+			return nil, fmt.Errorf("strategic merge patch is not supported on %s: %v", gvk, err)
+		}
+		return strategicpatch.StrategicMergePatch(data, p.Patch, dataStruct)
+	default:
+		return nil, fmt.Errorf("unknown patch type %q", p.Type)
+	}
+}
@@ -0,0 +1,115 @@
+package override
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+)
+
+// placeholderPattern matches the placeholders resolved with the facts of the target cluster:
+//
+//	{{cluster.name}}            the name of the managed cluster
+//	{{cluster.hub}}             the name of the hub of the managed cluster
+//	{{cluster.labels.<key>}}    the value of a label of the managed cluster
+//	{{cluster.claims.<name>}}   the value of a ClusterClaim of the managed cluster
+//
+// Placeholders of labels or claims the cluster does not have resolve to an empty string.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*cluster\.(name|hub|labels\.[^}\s]+|claims\.[^}\s]+)\s*\}\}`)
+
+// clusterFacts are the values placeholders resolve to on a managed cluster
+type clusterFacts struct {
+	name   string
+	hub    string
+	labels map[string]string
+	claims map[string]string
+}
+
+func factsOf(decision hub.Decision) clusterFacts {
+	facts := clusterFacts{
+		name:   decision.ClusterName,
+		hub:    decision.Scope.Hub.Name,
+		labels: map[string]string{},
+		claims: map[string]string{},
+	}
+
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil {
+		return facts
+	}
+	for k, v := range cluster.Labels {
+		facts.labels[k] = v
+	}
+	for _, claim := range cluster.Status.ClusterClaims {
+		facts.claims[claim.Name] = claim.Value
+	}
+	return facts
+}
+
+func (f clusterFacts) resolve(value string) string {
+	return placeholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		fact := placeholderPattern.FindStringSubmatch(placeholder)[1]
+		switch {
+		case fact == "name":
+			return f.name
+		case fact == "hub":
+			return f.hub
+		case strings.HasPrefix(fact, "labels."):
+			return f.labels[strings.TrimPrefix(fact, "labels.")]
+		default:
+			return f.claims[strings.TrimPrefix(fact, "claims.")]
+		}
+	})
+}
+
+// substitute resolves the placeholders in the labels and annotations, the env values of the containers
+// and the data of a ConfigMap.
+func substitute(obj map[string]interface{}, facts clusterFacts) {
+	if obj["kind"] == "ConfigMap" {
+		if data, ok := obj["data"].(map[string]interface{}); ok {
+			resolveValues(data, facts)
+		}
+	}
+	walk(obj, facts)
+}
+
+func walk(node interface{}, facts clusterFacts) {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		for key, value := range typed {
+			switch key {
+			case "metadata":
+				if metadata, ok := value.(map[string]interface{}); ok {
+					for _, field := range []string{"labels", "annotations"} {
+						if values, ok := metadata[field].(map[string]interface{}); ok {
+							resolveValues(values, facts)
+						}
+					}
+				}
+			case "env":
+				if envs, ok := value.([]interface{}); ok {
+					for _, env := range envs {
+						if envVar, ok := env.(map[string]interface{}); ok {
+							if v, ok := envVar["value"].(string); ok {
+								envVar["value"] = facts.resolve(v)
+							}
+						}
+					}
+				}
+			}
+			walk(value, facts)
+		}
+	case []interface{}:
+		for _, item := range typed {
+			walk(item, facts)
+		}
+	}
+}
+
+func resolveValues(values map[string]interface{}, facts clusterFacts) {
+	for k, v := range values {
+		if s, ok := v.(string); ok {
+			values[k] = facts.resolve(s)
+		}
+	}
+}
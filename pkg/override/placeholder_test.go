@@ -0,0 +1,174 @@
+package override
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	facts := clusterFacts{
+		name:   "cluster1",
+		hub:    "hub1",
+		labels: map[string]string{"region": "us-east", "cloud.example.com/tier": "gold"},
+		claims: map[string]string{"id.k8s.io": "abc"},
+	}
+
+	cases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{
+			name:     "no placeholder",
+			value:    "plain value",
+			expected: "plain value",
+		},
+		{
+			name:     "cluster name",
+			value:    "{{cluster.name}}",
+			expected: "cluster1",
+		},
+		{
+			name:     "hub name",
+			value:    "{{ cluster.hub }}",
+			expected: "hub1",
+		},
+		{
+			name:     "label",
+			value:    "https://{{cluster.labels.region}}.example.com",
+			expected: "https://us-east.example.com",
+		},
+		{
+			name:     "label key with a prefix",
+			value:    "{{cluster.labels.cloud.example.com/tier}}",
+			expected: "gold",
+		},
+		{
+			name:     "claim",
+			value:    "{{cluster.claims.id.k8s.io}}",
+			expected: "abc",
+		},
+		{
+			name:     "several placeholders",
+			value:    "{{cluster.hub}}/{{cluster.name}}",
+			expected: "hub1/cluster1",
+		},
+		{
+			name:     "missing label",
+			value:    "zone-{{cluster.labels.zone}}",
+			expected: "zone-",
+		},
+		{
+			name:     "missing claim",
+			value:    "{{cluster.claims.unknown}}",
+			expected: "",
+		},
+		{
+			name:     "unknown fact",
+			value:    "{{cluster.namespace}}",
+			expected: "{{cluster.namespace}}",
+		},
+		{
+			name:     "not a cluster fact",
+			value:    "{{ .Values.name }}",
+			expected: "{{ .Values.name }}",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := facts.resolve(c.value); actual != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	facts := clusterFacts{name: "cluster1", hub: "hub1", labels: map[string]string{}, claims: map[string]string{}}
+
+	cases := []struct {
+		name     string
+		obj      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name: "labels, annotations and env values",
+			obj: map[string]interface{}{
+				"kind": "Deployment",
+				"metadata": map[string]interface{}{
+					"name":        "{{cluster.name}}",
+					"labels":      map[string]interface{}{"cluster": "{{cluster.name}}"},
+					"annotations": map[string]interface{}{"hub": "{{cluster.hub}}"},
+				},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{
+									"image": "{{cluster.name}}",
+									"env": []interface{}{
+										map[string]interface{}{"name": "CLUSTER", "value": "{{cluster.name}}"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"kind": "Deployment",
+				"metadata": map[string]interface{}{
+					"name":        "{{cluster.name}}",
+					"labels":      map[string]interface{}{"cluster": "cluster1"},
+					"annotations": map[string]interface{}{"hub": "hub1"},
+				},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{
+									"image": "{{cluster.name}}",
+									"env": []interface{}{
+										map[string]interface{}{"name": "CLUSTER", "value": "cluster1"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "configmap data",
+			obj: map[string]interface{}{
+				"kind": "ConfigMap",
+				"data": map[string]interface{}{"cluster": "{{cluster.name}}"},
+			},
+			expected: map[string]interface{}{
+				"kind": "ConfigMap",
+				"data": map[string]interface{}{"cluster": "cluster1"},
+			},
+		},
+		{
+			name: "data of other kinds",
+			obj: map[string]interface{}{
+				"kind": "Secret",
+				"data": map[string]interface{}{"cluster": "{{cluster.name}}"},
+			},
+			expected: map[string]interface{}{
+				"kind": "Secret",
+				"data": map[string]interface{}{"cluster": "{{cluster.name}}"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			substitute(c.obj, facts)
+			if !reflect.DeepEqual(c.obj, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, c.obj)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/override"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ViolationsAnnotation is set on the kcp resources violating the delivery policies with the violations
+// on each cluster.
+const ViolationsAnnotation = "kcp.open-cluster-management.io/policy-violations"
+
+// DeliveryPolicyGVR is the resource of the delivery policies in the logical cluster
+var DeliveryPolicyGVR = schema.GroupVersionResource{
+	Group:    "kcp.open-cluster-management.io",
+	Version:  "v1alpha1",
+	Resource: "deliverypolicies",
+}
+
+type policySpec struct {
+	ClusterSelector       override.ClusterSelector    `json:"clusterSelector,omitempty"`
+	ResourceSelectors     []override.ResourceSelector `json:"resourceSelectors,omitempty"`
+	DenyPrivileged        bool                        `json:"denyPrivileged,omitempty"`
+	DenyHostPath          bool                        `json:"denyHostPath,omitempty"`
+	AllowedRegistries     []string                    `json:"allowedRegistries,omitempty"`
+	RequireResourceLimits bool                        `json:"requireResourceLimits,omitempty"`
+	Expressions           []expression                `json:"expressions,omitempty"`
+}
+
+// Validator checks the resources delivered to a managed cluster against the DeliveryPolicies in the
+// logical cluster that select the cluster and the resource, and records the violations on the kcp
+// resources.
+type Validator struct {
+	informer  informers.GenericInformer
+	kcpClient dynamic.Interface
+}
+
+func NewValidator(informer informers.GenericInformer, kcpClient dynamic.Interface) *Validator {
+	return &Validator{informer: informer, kcpClient: kcpClient}
+}
+
+// Informer returns the informer of the DeliveryPolicies, controllers requeue on its events
+func (v *Validator) Informer() cache.SharedIndexInformer {
+	return v.informer.Informer()
+}
+
+// Validate returns the violations of the object to the policies selecting the decided cluster and the
+// object. The object is the one delivered to the cluster, after the overrides. It is nil safe, a nil
+// validator allows all the objects.
+func (v *Validator) Validate(decision hub.Decision, obj runtime.Object) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	resource := &unstructured.Unstructured{}
+	if err := resource.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+
+	objs, err := v.informer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []*unstructured.Unstructured{}
+	for _, obj := range objs {
+		if policy, ok := obj.(*unstructured.Unstructured); ok {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].GetName() < policies[j].GetName()
+	})
+
+	violations := []string{}
+	for _, policy := range policies {
+		spec := &policySpec{}
+		content, _, _ := unstructured.NestedMap(policy.Object, "spec")
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content, spec); err != nil {
+			return nil, fmt.Errorf("invalid DeliveryPolicy %s: %v", policy.GetName(), err)
+		}
+
+		selected, err := override.SelectsCluster(spec.ClusterSelector, decision)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DeliveryPolicy %s: %v", policy.GetName(), err)
+		}
+		if !selected || !override.SelectsResource(spec.ResourceSelectors, data) {
+			continue
+		}
+
+		for _, check := range checks {
+			for _, violation := range check(spec, resource) {
+				violations = append(violations, fmt.Sprintf("%s: %s", policy.GetName(), violation))
+			}
+		}
+	}
+	return violations, nil
+}
+
+// Violations collects the violations of the kcp resources on the clusters during a sync
+type Violations struct {
+	resources map[string]*violatingResource
+}
+
+type violatingResource struct {
+	gvr        schema.GroupVersionResource
+	obj        metav1.Object
+	violations []string
+}
+
+func NewViolations() *Violations {
+	return &Violations{resources: map[string]*violatingResource{}}
+}
+
+// Add adds the violations of the kcp resource on the decided cluster, a resource without violations is
+// added to clear the violations recorded on it before.
+func (v *Violations) Add(gvr schema.GroupVersionResource, obj metav1.Object, decision hub.Decision, violations []string) {
+	key := fmt.Sprintf("%s/%s/%s", gvr.String(), obj.GetNamespace(), obj.GetName())
+	resource, ok := v.resources[key]
+	if !ok {
+		resource = &violatingResource{gvr: gvr, obj: obj}
+		v.resources[key] = resource
+	}
+	for _, violation := range violations {
+		resource.violations = append(resource.violations, fmt.Sprintf("%s: %s", decision.Key(), violation))
+	}
+}
+
+// Record sets the violations on the kcp resources and removes them from the resources that comply
+// with the policies now. It is nil safe.
+func (v *Validator) Record(ctx context.Context, recorder events.Recorder, violations *Violations) error {
+	if v == nil {
+		return nil
+	}
+
+	errs := []error{}
+	for _, resource := range violations.resources {
+		sort.Strings(resource.violations)
+		current, recorded := resource.obj.GetAnnotations()[ViolationsAnnotation]
+		desired := strings.Join(resource.violations, "; ")
+
+		var patch []byte
+		switch {
+		case len(desired) == 0 && !recorded:
+			continue
+		case len(desired) == 0:
+			patch = []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, ViolationsAnnotation))
+		case desired == current:
+			continue
+		default:
+			patch = []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, ViolationsAnnotation, desired))
+			recorder.Warningf("PolicyViolation", "%s %s/%s is not delivered: %s",
+				resource.gvr.Resource, resource.obj.GetNamespace(), resource.obj.GetName(), desired)
+		}
+
+		client := v.kcpClient.Resource(resource.gvr)
+		var err error
+		if len(resource.obj.GetNamespace()) > 0 {
+			_, err = client.Namespace(resource.obj.GetNamespace()).Patch(ctx, resource.obj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		} else {
+			_, err = client.Patch(ctx, resource.obj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
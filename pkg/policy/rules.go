@@ -0,0 +1,281 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+const (
+	operatorExists     = "Exists"
+	operatorNotExists  = "NotExists"
+	operatorIn         = "In"
+	operatorNotIn      = "NotIn"
+	operatorMatches    = "Matches"
+	operatorNotMatches = "NotMatches"
+
+	defaultRegistry = "docker.io"
+)
+
+type expression struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+// check returns the violations of the resource to a rule of the policy
+type check func(spec *policySpec, obj *unstructured.Unstructured) []string
+
+// checks are the rules resources are checked against, in this order
+var checks = []check{
+	checkPodSpec,
+	checkPrivileged,
+	checkHostPath,
+	checkRegistries,
+	checkResourceLimits,
+	checkExpressions,
+}
+
+// podSpecPaths are the fields of the pod spec of the workload kinds
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// podSpecOf returns the pod spec of a workload, or nil if the resource has no pods. It returns an
+// error when the pod spec cannot be read.
+func podSpecOf(obj *unstructured.Unstructured) (*corev1.PodSpec, error) {
+	path, ok := podSpecPaths[obj.GetKind()]
+	if !ok {
+		return nil, nil
+	}
+	content, found, err := unstructured.NestedMap(obj.Object, path...)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	spec := &corev1.PodSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// containersOf returns all the containers of the pod spec, including the ephemeral containers
+func containersOf(spec *corev1.PodSpec) []corev1.Container {
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(container.EphemeralContainerCommon))
+	}
+	return containers
+}
+
+// checkPodSpec reports the workloads whose pod spec cannot be read when the policy has rules on the
+// pods, so these rules never let such a workload through.
+func checkPodSpec(spec *policySpec, obj *unstructured.Unstructured) []string {
+	if !spec.DenyPrivileged && !spec.DenyHostPath && len(spec.AllowedRegistries) == 0 && !spec.RequireResourceLimits {
+		return nil
+	}
+
+	if _, err := podSpecOf(obj); err != nil {
+		return []string{fmt.Sprintf("pod spec of %s %s cannot be checked: %v", obj.GetKind(), obj.GetName(), err)}
+	}
+	return nil
+}
+
+func checkPrivileged(spec *policySpec, obj *unstructured.Unstructured) []string {
+	podSpec, err := podSpecOf(obj)
+	if !spec.DenyPrivileged || podSpec == nil || err != nil {
+		return nil
+	}
+
+	violations := []string{}
+	for _, container := range containersOf(podSpec) {
+		if container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
+			violations = append(violations, fmt.Sprintf("container %s is privileged", container.Name))
+		}
+	}
+	return violations
+}
+
+func checkHostPath(spec *policySpec, obj *unstructured.Unstructured) []string {
+	podSpec, err := podSpecOf(obj)
+	if !spec.DenyHostPath || podSpec == nil || err != nil {
+		return nil
+	}
+
+	violations := []string{}
+	for _, volume := range podSpec.Volumes {
+		if volume.HostPath != nil {
+			violations = append(violations, fmt.Sprintf("volume %s is a hostPath", volume.Name))
+		}
+	}
+	return violations
+}
+
+func checkRegistries(spec *policySpec, obj *unstructured.Unstructured) []string {
+	podSpec, err := podSpecOf(obj)
+	if len(spec.AllowedRegistries) == 0 || podSpec == nil || err != nil {
+		return nil
+	}
+
+	violations := []string{}
+	for _, container := range containersOf(podSpec) {
+		if !allowedImage(container.Image, spec.AllowedRegistries) {
+			violations = append(violations, fmt.Sprintf("image %s of container %s is not from an allowed registry", container.Image, container.Name))
+		}
+	}
+	return violations
+}
+
+// allowedImage returns whether the image is pulled from one of the registries, an image without
+// a registry is pulled from docker.io.
+func allowedImage(image string, registries []string) bool {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 || !(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		image = fmt.Sprintf("%s/%s", defaultRegistry, image)
+	}
+
+	for _, registry := range registries {
+		if strings.HasPrefix(image, strings.TrimSuffix(registry, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkResourceLimits(spec *policySpec, obj *unstructured.Unstructured) []string {
+	podSpec, err := podSpecOf(obj)
+	if !spec.RequireResourceLimits || podSpec == nil || err != nil {
+		return nil
+	}
+
+	// Ephemeral containers have no resources
+	violations := []string{}
+	for _, container := range append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		for _, resource := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if _, ok := container.Resources.Limits[resource]; !ok {
+				violations = append(violations, fmt.Sprintf("container %s has no %s limit", container.Name, resource))
+			}
+		}
+	}
+	return violations
+}
+
+func checkExpressions(spec *policySpec, obj *unstructured.Unstructured) []string {
+	violations := []string{}
+	for _, expr := range spec.Expressions {
+		satisfied, err := expr.evaluate(obj)
+		switch {
+		case err != nil:
+			violations = append(violations, fmt.Sprintf("expression %s is invalid: %v", expr.Name, err))
+		case !satisfied && len(expr.Message) > 0:
+			violations = append(violations, expr.Message)
+		case !satisfied:
+			violations = append(violations, fmt.Sprintf("expression %s is not satisfied", expr.Name))
+		}
+	}
+	return violations
+}
+
+// evaluate returns whether the values selected by the path of the expression satisfy its operator
+func (e expression) evaluate(obj *unstructured.Unstructured) (bool, error) {
+	values, err := selectValues(e.Path, obj)
+	if err != nil {
+		return false, err
+	}
+
+	switch e.Operator {
+	case operatorExists:
+		return len(values) > 0, nil
+	case operatorNotExists:
+		return len(values) == 0, nil
+	case operatorIn, operatorNotIn:
+		allowed := sets.NewString(e.Values...)
+		for _, value := range values {
+			if allowed.Has(value) != (e.Operator == operatorIn) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case operatorMatches, operatorNotMatches:
+		patterns := []*regexp.Regexp{}
+		for _, value := range e.Values {
+			pattern, err := regexp.Compile(value)
+			if err != nil {
+				return false, err
+			}
+			patterns = append(patterns, pattern)
+		}
+		for _, value := range values {
+			if matchesAny(patterns, value) != (e.Operator == operatorMatches) {
+				return false, nil
+			}
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown operator %q", e.Operator)
+	}
+}
+
+// selectValues returns the values selected by the JSONPath template, values that are not strings are
+// returned as json.
+func selectValues(path string, obj *unstructured.Unstructured) ([]string, error) {
+	parser := jsonpath.New("expression").AllowMissingKeys(true)
+	if err := parser.Parse(path); err != nil {
+		return nil, err
+	}
+
+	results, err := parser.FindResults(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for _, result := range results {
+		for _, value := range result {
+			if !value.IsValid() || !value.CanInterface() {
+				continue
+			}
+			switch typed := value.Interface().(type) {
+			case nil:
+			case string:
+				values = append(values, typed)
+			default:
+				data, err := json.Marshal(typed)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, string(bytes.TrimSpace(data)))
+			}
+		}
+	}
+	return values, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
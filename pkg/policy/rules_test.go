@@ -0,0 +1,228 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newWorkload(kind string, podSpec map[string]interface{}) *unstructured.Unstructured {
+	obj := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "default"},
+	}
+
+	path := podSpecPaths[kind]
+	if len(path) == 0 {
+		return &unstructured.Unstructured{Object: obj}
+	}
+	if err := unstructured.SetNestedField(obj, podSpec, path...); err != nil {
+		panic(err)
+	}
+	if kind == "Deployment" {
+		obj["spec"].(map[string]interface{})["replicas"] = int64(3)
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func container(name, image string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "image": image}
+}
+
+func privileged(c map[string]interface{}) map[string]interface{} {
+	c["securityContext"] = map[string]interface{}{"privileged": true}
+	return c
+}
+
+func limited(c map[string]interface{}, resources ...string) map[string]interface{} {
+	limits := map[string]interface{}{}
+	for _, resource := range resources {
+		limits[resource] = "1"
+	}
+	c["resources"] = map[string]interface{}{"limits": limits}
+	return c
+}
+
+func containers(items ...map[string]interface{}) []interface{} {
+	result := []interface{}{}
+	for _, item := range items {
+		result = append(result, item)
+	}
+	return result
+}
+
+func TestChecks(t *testing.T) {
+	cases := []struct {
+		name string
+		spec policySpec
+		obj  *unstructured.Unstructured
+		// expected are the prefixes of the violations in order
+		expected []string
+	}{
+		{
+			name: "no rules",
+			spec: policySpec{},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"containers": containers(privileged(container("app", "nginx"))),
+			}),
+			expected: []string{},
+		},
+		{
+			name: "privileged containers",
+			spec: policySpec{DenyPrivileged: true},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"initContainers": containers(privileged(container("init", "busybox"))),
+				"containers":     containers(privileged(container("app", "nginx")), container("sidecar", "envoy")),
+			}),
+			expected: []string{"container init is privileged", "container app is privileged"},
+		},
+		{
+			name: "privileged ephemeral container",
+			spec: policySpec{DenyPrivileged: true},
+			obj: newWorkload("Pod", map[string]interface{}{
+				"containers":          containers(container("app", "nginx")),
+				"ephemeralContainers": containers(privileged(container("debug", "busybox"))),
+			}),
+			expected: []string{"container debug is privileged"},
+		},
+		{
+			name: "privileged container of a cron job",
+			spec: policySpec{DenyPrivileged: true},
+			obj: newWorkload("CronJob", map[string]interface{}{
+				"containers": containers(privileged(container("job", "busybox"))),
+			}),
+			expected: []string{"container job is privileged"},
+		},
+		{
+			name: "host path volumes",
+			spec: policySpec{DenyHostPath: true},
+			obj: newWorkload("DaemonSet", map[string]interface{}{
+				"containers": containers(container("agent", "agent")),
+				"volumes": []interface{}{
+					map[string]interface{}{"name": "host", "hostPath": map[string]interface{}{"path": "/"}},
+					map[string]interface{}{"name": "tmp", "emptyDir": map[string]interface{}{}},
+				},
+			}),
+			expected: []string{"volume host is a hostPath"},
+		},
+		{
+			name: "allowed registries",
+			spec: policySpec{AllowedRegistries: []string{"quay.io", "docker.io/library/"}},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"containers": containers(
+					container("web", "nginx"),
+					container("cache", "library/redis"),
+					container("app", "quay.io/org/app:v1"),
+					container("local", "localhost/app"),
+					container("mirror", "quay.io.example.com/org/app"),
+				),
+				"ephemeralContainers": containers(container("debug", "busybox")),
+			}),
+			expected: []string{
+				"image nginx of container web is not from an allowed registry",
+				"image localhost/app of container local is not from an allowed registry",
+				"image quay.io.example.com/org/app of container mirror is not from an allowed registry",
+				"image busybox of container debug is not from an allowed registry",
+			},
+		},
+		{
+			name: "docker.io images without a registry",
+			spec: policySpec{AllowedRegistries: []string{"docker.io"}},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"containers": containers(container("web", "nginx"), container("app", "org/app")),
+			}),
+			expected: []string{},
+		},
+		{
+			name: "resource limits",
+			spec: policySpec{RequireResourceLimits: true},
+			obj: newWorkload("StatefulSet", map[string]interface{}{
+				"initContainers":      containers(container("init", "busybox")),
+				"containers":          containers(limited(container("db", "postgres"), "cpu", "memory"), limited(container("exporter", "exporter"), "cpu")),
+				"ephemeralContainers": containers(container("debug", "busybox")),
+			}),
+			expected: []string{
+				"container init has no cpu limit",
+				"container init has no memory limit",
+				"container exporter has no memory limit",
+			},
+		},
+		{
+			name: "unreadable pod spec",
+			spec: policySpec{DenyPrivileged: true},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"containers": "app",
+			}),
+			expected: []string{"pod spec of Deployment web cannot be checked: "},
+		},
+		{
+			name: "unreadable pod spec without pod rules",
+			spec: policySpec{},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"containers": "app",
+			}),
+			expected: []string{},
+		},
+		{
+			name:     "resources without pods",
+			spec:     policySpec{DenyPrivileged: true, DenyHostPath: true, AllowedRegistries: []string{"quay.io"}, RequireResourceLimits: true},
+			obj:      newWorkload("ConfigMap", nil),
+			expected: []string{},
+		},
+		{
+			name: "expressions",
+			spec: policySpec{Expressions: []expression{
+				{Name: "team", Path: "{.metadata.labels.team}", Operator: operatorExists, Message: "the team label is required"},
+				{Name: "no-owner", Path: "{.metadata.labels.owner}", Operator: operatorNotExists},
+				{Name: "replicas", Path: "{.spec.replicas}", Operator: operatorIn, Values: []string{"2", "3"}},
+				{Name: "namespace", Path: "{.metadata.namespace}", Operator: operatorNotIn, Values: []string{"default"}},
+				{Name: "registry", Path: "{.spec.template.spec.containers[*].image}", Operator: operatorMatches, Values: []string{`^quay\.io/`}},
+				{Name: "latest", Path: "{.spec.template.spec.containers[*].image}", Operator: operatorNotMatches, Values: []string{`:latest$`}},
+			}},
+			obj: newWorkload("Deployment", map[string]interface{}{
+				"containers": containers(container("app", "quay.io/org/app:v1"), container("web", "nginx:latest")),
+			}),
+			expected: []string{
+				"the team label is required",
+				"expression namespace is not satisfied",
+				"expression registry is not satisfied",
+				"expression latest is not satisfied",
+			},
+		},
+		{
+			name: "invalid expressions",
+			spec: policySpec{Expressions: []expression{
+				{Name: "operator", Path: "{.metadata.name}", Operator: "Equals"},
+				{Name: "path", Path: "{.metadata.name", Operator: operatorExists},
+				{Name: "pattern", Path: "{.metadata.name}", Operator: operatorMatches, Values: []string{"("}},
+			}},
+			obj: newWorkload("Deployment", map[string]interface{}{}),
+			expected: []string{
+				`expression operator is invalid: unknown operator "Equals"`,
+				"expression path is invalid: ",
+				"expression pattern is invalid: ",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := []string{}
+			for _, check := range checks {
+				actual = append(actual, check(&c.spec, c.obj)...)
+			}
+
+			if len(actual) != len(c.expected) {
+				t.Fatalf("expected violations %q, got %q", c.expected, actual)
+			}
+			for i := range actual {
+				if !strings.HasPrefix(actual[i], c.expected[i]) {
+					t.Errorf("expected violations %q, got %q", c.expected, actual)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// encrypt returns the spec of the EncryptedSecret of the Secret. Each value is encrypted with AES-GCM
+// under a random data key, and the data key is encrypted with RSA-OAEP under the public key of the
+// cluster. Encrypted values are the nonce followed by the ciphertext, base64 encoded.
+func encrypt(secret *corev1.Secret, publicKeyPEM string) (map[string]interface{}, error) {
+	publicKey, fingerprint, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedData := map[string]interface{}{}
+	for _, key := range dataKeys(secret) {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		// the key of the value is authenticated so values cannot be swapped
+		ciphertext := aead.Seal(nonce, nonce, secret.Data[key], []byte(key))
+		encryptedData[key] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+
+	return map[string]interface{}{
+		"type":           string(secret.Type),
+		"keyFingerprint": fingerprint,
+		"encryptedKey":   base64.StdEncoding.EncodeToString(encryptedKey),
+		"encryptedData":  encryptedData,
+	}, nil
+}
+
+// parsePublicKey returns the RSA public key of a PEM block and the sha256 fingerprint of the key, so the
+// agent knows which of its keys decrypts the data.
+func parsePublicKey(publicKeyPEM string) (*rsa.PublicKey, string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, "", fmt.Errorf("no PEM encoded public key")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", fmt.Errorf("public key is not an RSA key")
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	return publicKey, hex.EncodeToString(fingerprint[:]), nil
+}
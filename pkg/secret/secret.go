@@ -0,0 +1,294 @@
+package secret
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/qiujian16/kcp-ocm/pkg/helpers"
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	"github.com/qiujian16/kcp-ocm/pkg/manifests"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// ModeEncrypt delivers the Secrets as EncryptedSecrets, with the data encrypted with the key of the
+	// managed cluster. An agent on the managed cluster decrypts them into Secrets.
+	ModeEncrypt = "Encrypt"
+	// ModeReference delivers the Secrets as ExternalSecrets referring to the data in a secret store, which
+	// the external-secrets operator on the managed cluster resolves into Secrets.
+	ModeReference = "Reference"
+
+	// EncryptionKeyAnnotation is set on the ManagedClusters with the PEM encoded RSA public key the Secrets
+	// delivered to the cluster are encrypted with.
+	EncryptionKeyAnnotation = "kcp.open-cluster-management.io/secret-encryption-key"
+
+	// RemoteKeyAnnotation is set on the kcp Secrets with the key of their data in the secret store, it is
+	// <logical cluster>/<namespace>/<name> by default.
+	RemoteKeyAnnotation = "kcp.open-cluster-management.io/secret-remote-key"
+
+	// digestAnnotation is the keyed digest of the Secret an EncryptedSecret was sealed from, the Secret is
+	// encrypted again only when it changes.
+	digestAnnotation = "kcp.open-cluster-management.io/secret-digest"
+
+	// digestKeySecretName is the Secret on the hub holding the key of the digests, shared by the replicas
+	// and the restarts so the delivered EncryptedSecrets are not encrypted again.
+	digestKeySecretName = "kcp-ocm-secret-digest"
+	digestKeyLength     = 32
+
+	encryptedSecretAPIVersion = "kcp.open-cluster-management.io/v1alpha1"
+	encryptedSecretKind       = "EncryptedSecret"
+	externalSecretAPIVersion  = "external-secrets.io/v1beta1"
+	externalSecretKind        = "ExternalSecret"
+	secretStoreKind           = "ClusterSecretStore"
+	refreshInterval           = "1h"
+)
+
+// ValidateMode returns an error if the mode is neither empty nor a known mode
+func ValidateMode(mode string) error {
+	switch mode {
+	case "", ModeEncrypt, ModeReference:
+		return nil
+	default:
+		return fmt.Errorf("unknown secret mode %q, must be one of %s or %s", mode, ModeEncrypt, ModeReference)
+	}
+}
+
+// Sealer replaces the Secrets delivered to the managed clusters with objects that carry no secret
+// material in clear, so the hub never stores it.
+type Sealer struct {
+	mode  string
+	store string
+	// digestKey keys the digests of the sealed Secrets, so the digests reveal nothing about the data
+	digestKey []byte
+}
+
+// NewSealer returns the sealer of the mode, the store is the ClusterSecretStore referred to in the
+// reference mode. The key of the digests is read from a Secret of the namespace on the hub, which is
+// created with a random key if it does not exist.
+func NewSealer(ctx context.Context, kubeClient kubernetes.Interface, namespace, mode, store string) (*Sealer, error) {
+	if err := ValidateMode(mode); err != nil {
+		return nil, err
+	}
+	if len(mode) == 0 {
+		return nil, fmt.Errorf("secret mode is required")
+	}
+
+	digestKey, err := ensureDigestKey(ctx, kubeClient, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{mode: mode, store: store, digestKey: digestKey}, nil
+}
+
+func ensureDigestKey(ctx context.Context, kubeClient kubernetes.Interface, namespace string) ([]byte, error) {
+	existing, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, digestKeySecretName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return nil, err
+	case len(existing.Data["key"]) < digestKeyLength:
+		return nil, fmt.Errorf("secret %s/%s has no valid digest key", namespace, digestKeySecretName)
+	default:
+		return existing.Data["key"], nil
+	}
+
+	key := make([]byte, digestKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	_, err = kubeClient.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      digestKeySecretName,
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{"key": key},
+	}, metav1.CreateOptions{})
+	switch {
+	case errors.IsAlreadyExists(err):
+		// Another replica created the key first
+		return ensureDigestKey(ctx, kubeClient, namespace)
+	case err != nil:
+		return nil, err
+	}
+	return key, nil
+}
+
+// Prerequisites returns the objects delivered to the clusters before the sealed Secrets, which is the CRD
+// of the EncryptedSecrets in the encrypt mode.
+func (s *Sealer) Prerequisites() ([]runtime.Object, error) {
+	if s.mode != ModeEncrypt {
+		return nil, nil
+	}
+	crd, err := manifests.CRD(manifests.EncryptedSecretCRD)
+	if err != nil {
+		return nil, err
+	}
+	return []runtime.Object{crd}, nil
+}
+
+// Seal returns the object delivering the Secret to the decided cluster. An EncryptedSecret already
+// delivered by the works is reused while the Secret and the key of the cluster do not change. It returns
+// false when the Secret cannot be encrypted for the cluster since the cluster has no key.
+func (s *Sealer) Seal(decision hub.Decision, obj runtime.Object, deployed []*workapiv1.ManifestWork) (runtime.Object, bool, error) {
+	secret, err := toSecret(obj)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if s.mode == ModeReference {
+		return s.reference(decision, secret), true, nil
+	}
+
+	cluster, err := decision.Scope.Hub.ClusterInformers.Cluster().V1().ManagedClusters().Lister().Get(decision.ClusterName)
+	if err != nil {
+		return nil, false, err
+	}
+	publicKey, ok := cluster.Annotations[EncryptionKeyAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+
+	digest, err := s.digest(secret, publicKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	sealed := newObject(encryptedSecretAPIVersion, encryptedSecretKind, secret)
+	annotations := sealed.GetAnnotations()
+	annotations[digestAnnotation] = digest
+	sealed.SetAnnotations(annotations)
+
+	if manifest, ok := helpers.DeployedManifest(deployed, sealed); ok {
+		previous := &unstructured.Unstructured{}
+		if err := previous.UnmarshalJSON(manifest.Raw); err == nil && previous.GetAnnotations()[digestAnnotation] == digest {
+			sealed.Object["spec"] = previous.Object["spec"]
+			return sealed, true, nil
+		}
+	}
+
+	spec, err := encrypt(secret, publicKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encrypt secret %s/%s for cluster %s: %v",
+			secret.Namespace, secret.Name, decision.Key(), err)
+	}
+	sealed.Object["spec"] = spec
+	return sealed, true, nil
+}
+
+// reference returns the ExternalSecret resolving each key of the Secret from the store
+func (s *Sealer) reference(decision hub.Decision, secret *corev1.Secret) *unstructured.Unstructured {
+	remoteKey, ok := secret.Annotations[RemoteKeyAnnotation]
+	if !ok {
+		remoteKey = fmt.Sprintf("%s/%s/%s", decision.Scope.WorkingNamespace, secret.Namespace, secret.Name)
+	}
+
+	data := []interface{}{}
+	for _, key := range dataKeys(secret) {
+		data = append(data, map[string]interface{}{
+			"secretKey": key,
+			"remoteRef": map[string]interface{}{
+				"key":      remoteKey,
+				"property": key,
+			},
+		})
+	}
+
+	referenced := newObject(externalSecretAPIVersion, externalSecretKind, secret)
+	referenced.Object["spec"] = map[string]interface{}{
+		"refreshInterval": refreshInterval,
+		"secretStoreRef": map[string]interface{}{
+			"kind": secretStoreKind,
+			"name": s.store,
+		},
+		"target": map[string]interface{}{
+			"name":           secret.Name,
+			"creationPolicy": "Owner",
+			"template": map[string]interface{}{
+				"type": string(secret.Type),
+			},
+		},
+		"data": data,
+	}
+	return referenced
+}
+
+// digest returns the digest of the data of the Secret and the key it is encrypted with
+func (s *Sealer) digest(secret *corev1.Secret, publicKey string) (string, error) {
+	content, err := json.Marshal(map[string]interface{}{
+		"type": secret.Type,
+		"data": secret.Data,
+		"key":  publicKey,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, s.digestKey)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// toSecret converts the object to a Secret with the string data merged into the data
+func toSecret(obj runtime.Object) (*corev1.Secret, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{}
+	if err := json.Unmarshal(data, secret); err != nil {
+		return nil, err
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for key, value := range secret.StringData {
+		secret.Data[key] = []byte(value)
+	}
+	secret.StringData = nil
+	if len(secret.Type) == 0 {
+		secret.Type = corev1.SecretTypeOpaque
+	}
+	return secret, nil
+}
+
+// newObject returns an object of the kind with the identity, labels and annotations of the Secret
+func newObject(apiVersion, kind string, secret *corev1.Secret) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetName(secret.Name)
+	obj.SetNamespace(secret.Namespace)
+	obj.SetLabels(secret.Labels)
+
+	annotations := map[string]string{}
+	for key, value := range secret.Annotations {
+		if key == corev1.LastAppliedConfigAnnotation {
+			continue
+		}
+		annotations[key] = value
+	}
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func dataKeys(secret *corev1.Secret) []string {
+	keys := []string{}
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
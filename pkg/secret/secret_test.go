@@ -0,0 +1,271 @@
+package secret
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/qiujian16/kcp-ocm/pkg/hub"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterapiv1 "open-cluster-management.io/api/cluster/v1"
+	workapiv1 "open-cluster-management.io/api/work/v1"
+)
+
+// fakeSecretClient serves the Secrets of the hub from a map and counts the created ones
+type fakeSecretClient struct {
+	kubernetes.Interface
+	corev1client.CoreV1Interface
+	corev1client.SecretInterface
+	secrets map[string]*corev1.Secret
+	created int
+}
+
+func (c *fakeSecretClient) CoreV1() corev1client.CoreV1Interface {
+	return c
+}
+
+func (c *fakeSecretClient) Secrets(string) corev1client.SecretInterface {
+	return c
+}
+
+func (c *fakeSecretClient) Get(_ context.Context, name string, _ metav1.GetOptions) (*corev1.Secret, error) {
+	secret, ok := c.secrets[name]
+	if !ok {
+		return nil, errors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return secret, nil
+}
+
+func (c *fakeSecretClient) Create(_ context.Context, secret *corev1.Secret, _ metav1.CreateOptions) (*corev1.Secret, error) {
+	c.created++
+	c.secrets[secret.Name] = secret
+	return secret, nil
+}
+
+func newSecret(value string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", Annotations: map[string]string{"app": "web"}},
+		Data:       map[string][]byte{"password": []byte(value)},
+		StringData: map[string]string{"user": "admin"},
+	}
+}
+
+// newKeyedDecision returns the decision of cluster1, with the public key of the private key on the
+// cluster if there is one.
+func newKeyedDecision(t *testing.T, privateKey *rsa.PrivateKey) hub.Decision {
+	cluster := &clusterapiv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster1", Annotations: map[string]string{}}}
+	if privateKey != nil {
+		cluster.Annotations[EncryptionKeyAnnotation] = string(pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey),
+		}))
+	}
+
+	informers := clusterinformers.NewSharedInformerFactory(nil, 0)
+	if err := informers.Cluster().V1().ManagedClusters().Informer().GetIndexer().Add(cluster); err != nil {
+		t.Fatal(err)
+	}
+	return hub.Decision{Scope: (&hub.Hub{Name: "hub", ClusterInformers: informers}).NewScope("ws"), ClusterName: "cluster1"}
+}
+
+// decrypt returns the data of the spec of an EncryptedSecret as the agent on the cluster would
+func decrypt(t *testing.T, privateKey *rsa.PrivateKey, spec map[string]interface{}) map[string]string {
+	encryptedKey, err := base64.StdEncoding.DecodeString(spec["encryptedKey"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]string{}
+	for key, value := range spec["encryptedData"].(map[string]interface{}) {
+		ciphertext, err := base64.StdEncoding.DecodeString(value.(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[key] = string(plaintext)
+	}
+	return data
+}
+
+// deployedManifest returns the works delivering the sealed object
+func deployedManifest(t *testing.T, obj runtime.Object) []*workapiv1.ManifestWork {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*workapiv1.ManifestWork{{Spec: workapiv1.ManifestWorkSpec{Workload: workapiv1.ManifestsTemplate{
+		Manifests: []workapiv1.Manifest{{RawExtension: runtime.RawExtension{Raw: data}}},
+	}}}}
+}
+
+func TestSealEncrypt(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := &Sealer{mode: ModeEncrypt, digestKey: []byte("key")}
+
+	if _, ok, err := sealer.Seal(newKeyedDecision(t, nil), newSecret("secret"), nil); err != nil || ok {
+		t.Errorf("expected no sealed secret without the key of the cluster, got %v, %v", ok, err)
+	}
+
+	decision := newKeyedDecision(t, privateKey)
+	obj, ok, err := sealer.Seal(decision, newSecret("secret"), nil)
+	if err != nil || !ok {
+		t.Fatalf("expected a sealed secret, got %v, %v", ok, err)
+	}
+	sealed := obj.(*unstructured.Unstructured)
+	if sealed.GetKind() != encryptedSecretKind || sealed.GetName() != "db" || sealed.GetAnnotations()["app"] != "web" {
+		t.Errorf("unexpected sealed secret %v", sealed.Object)
+	}
+	spec := sealed.Object["spec"].(map[string]interface{})
+	if data := decrypt(t, privateKey, spec); !reflect.DeepEqual(data, map[string]string{"password": "secret", "user": "admin"}) {
+		t.Errorf("unexpected decrypted data %v", data)
+	}
+
+	// the delivered EncryptedSecret is kept while the Secret does not change
+	reused, _, err := sealer.Seal(decision, newSecret("secret"), deployedManifest(t, sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reused.(*unstructured.Unstructured).Object["spec"], spec) {
+		t.Errorf("expected the delivered spec to be reused")
+	}
+
+	changed, _, err := sealer.Seal(decision, newSecret("changed"), deployedManifest(t, sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changedSpec := changed.(*unstructured.Unstructured).Object["spec"].(map[string]interface{})
+	if data := decrypt(t, privateKey, changedSpec); data["password"] != "changed" {
+		t.Errorf("expected the changed secret to be encrypted again, got %v", data)
+	}
+}
+
+func TestSealReference(t *testing.T) {
+	sealer := &Sealer{mode: ModeReference, store: "vault"}
+
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expectedKey string
+	}{
+		{name: "default remote key", expectedKey: "ws/default/db"},
+		{name: "annotated remote key", annotations: map[string]string{RemoteKeyAnnotation: "prod/db"}, expectedKey: "prod/db"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			secret := newSecret("secret")
+			for key, value := range c.annotations {
+				secret.Annotations[key] = value
+			}
+
+			obj, ok, err := sealer.Seal(newKeyedDecision(t, nil), secret, nil)
+			if err != nil || !ok {
+				t.Fatalf("expected a sealed secret, got %v, %v", ok, err)
+			}
+			sealed := obj.(*unstructured.Unstructured)
+			if sealed.GetKind() != externalSecretKind {
+				t.Errorf("unexpected kind %s", sealed.GetKind())
+			}
+			store, _, _ := unstructured.NestedString(sealed.Object, "spec", "secretStoreRef", "name")
+			if store != "vault" {
+				t.Errorf("expected the store vault, got %s", store)
+			}
+			refs, _, _ := unstructured.NestedSlice(sealed.Object, "spec", "data")
+			if len(refs) != 2 {
+				t.Fatalf("expected a reference per key, got %v", refs)
+			}
+			for i, key := range []string{"password", "user"} {
+				ref := refs[i].(map[string]interface{})
+				remoteRef := ref["remoteRef"].(map[string]interface{})
+				if ref["secretKey"] != key || remoteRef["key"] != c.expectedKey || remoteRef["property"] != key {
+					t.Errorf("unexpected reference %v", ref)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureDigestKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	cases := []struct {
+		name            string
+		existing        *corev1.Secret
+		expectedCreated int
+		expectedErr     bool
+	}{
+		{
+			name:            "create the key",
+			expectedCreated: 1,
+		},
+		{
+			name:     "reuse the key",
+			existing: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: digestKeySecretName}, Data: map[string][]byte{"key": key}},
+		},
+		{
+			name:        "invalid key",
+			existing:    &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: digestKeySecretName}, Data: map[string][]byte{"key": key[:8]}},
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeSecretClient{secrets: map[string]*corev1.Secret{}}
+			if c.existing != nil {
+				client.secrets[c.existing.Name] = c.existing
+			}
+
+			actual, err := ensureDigestKey(context.Background(), client, "kcp-ocm")
+			if c.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.created != c.expectedCreated {
+				t.Errorf("expected %d created secrets, got %d", c.expectedCreated, client.created)
+			}
+			if len(actual) != digestKeyLength || !reflect.DeepEqual(actual, client.secrets[digestKeySecretName].Data["key"]) {
+				t.Errorf("unexpected key %v", actual)
+			}
+		})
+	}
+}
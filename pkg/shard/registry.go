@@ -0,0 +1,267 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultShardName is the shard built from the --kcp-kubeconfig flag
+	DefaultShardName = "default"
+
+	// ShardAnnotation is set on a working namespace to declare which kcp shard its logical cluster lives on
+	ShardAnnotation = "kcp.open-cluster-management.io/shard"
+)
+
+var (
+	shardHealthMetric = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Subsystem:      "kcp_ocm",
+		Name:           "shard_healthy",
+		Help:           "Whether the kcp shard answered the last readiness check, 1 is healthy and 0 is unhealthy",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"shard"})
+
+	shardCheckFailuresMetric = metrics.NewCounterVec(&metrics.CounterOpts{
+		Subsystem:      "kcp_ocm",
+		Name:           "shard_health_check_failures_total",
+		Help:           "Total count of failed readiness checks per kcp shard",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"shard"})
+
+	shardLogicalClustersMetric = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Subsystem:      "kcp_ocm",
+		Name:           "shard_logical_clusters",
+		Help:           "Number of logical clusters served from each kcp shard",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"shard"})
+)
+
+func init() {
+	legacyregistry.MustRegister(shardHealthMetric, shardCheckFailuresMetric, shardLogicalClustersMetric)
+}
+
+// Config is the file format of the shard registry
+type Config struct {
+	Shards []ShardConfig `json:"shards"`
+}
+
+// ShardConfig describes how to connect to one kcp shard
+type ShardConfig struct {
+	Name       string `json:"name"`
+	KubeConfig string `json:"kubeconfig"`
+}
+
+// Shard is a kcp endpoint together with its credentials and health
+type Shard struct {
+	Name       string
+	restConfig *rest.Config
+
+	lock           sync.RWMutex
+	healthy        bool
+	lastErr        error
+	logicalCluster int
+}
+
+// Healthy returns whether the last readiness check succeeded and the error of that check
+func (s *Shard) Healthy() (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.healthy, s.lastErr
+}
+
+// Registry holds all kcp shards known by the manager
+type Registry struct {
+	shards map[string]*Shard
+
+	lock     sync.RWMutex
+	handlers []func()
+}
+
+// NewRegistry builds the registry from the default kcp kubeconfig and an optional shard config file.
+func NewRegistry(defaultKubeConfig, shardConfigFile string) (*Registry, error) {
+	r := &Registry{shards: map[string]*Shard{}}
+
+	if len(defaultKubeConfig) > 0 {
+		if err := r.add(DefaultShardName, defaultKubeConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(shardConfigFile) > 0 {
+		data, err := ioutil.ReadFile(shardConfigFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config := &Config{}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse kcp shard config %s: %v", shardConfigFile, err)
+		}
+
+		for _, s := range config.Shards {
+			if _, ok := r.shards[s.Name]; ok {
+				return nil, fmt.Errorf("kcp shard %q is defined more than once", s.Name)
+			}
+			if err := r.add(s.Name, s.KubeConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(r.shards) == 0 {
+		return nil, fmt.Errorf("no kcp shard is configured")
+	}
+
+	return r, nil
+}
+
+func (r *Registry) add(name, kubeConfig string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("kcp shard with kubeconfig %s has no name", kubeConfig)
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig of kcp shard %q: %v", name, err)
+	}
+
+	r.shards[name] = &Shard{Name: name, restConfig: restConfig}
+	return nil
+}
+
+// Names returns the sorted names of all shards
+func (r *Registry) Names() []string {
+	names := []string{}
+	for name := range r.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the shard with the name, an empty name is the default shard.
+func (r *Registry) Get(name string) (*Shard, error) {
+	if len(name) == 0 {
+		name = DefaultShardName
+	}
+
+	shard, ok := r.shards[name]
+	if !ok {
+		return nil, fmt.Errorf("kcp shard %q is not registered", name)
+	}
+	return shard, nil
+}
+
+// LogicalClusterConfig returns the rest config to connect to the logical cluster on the shard
+func (s *Shard) LogicalClusterConfig(logicalCluster string) *rest.Config {
+	restConfig := rest.CopyConfig(s.restConfig)
+	restConfig.Host = fmt.Sprintf("%s/clusters/%s", restConfig.Host, logicalCluster)
+	return restConfig
+}
+
+// AddLogicalCluster records a logical cluster served from this shard
+func (s *Shard) AddLogicalCluster() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logicalCluster++
+	shardLogicalClustersMetric.WithLabelValues(s.Name).Set(float64(s.logicalCluster))
+}
+
+// RemoveLogicalCluster records a logical cluster is no longer served from this shard
+func (s *Shard) RemoveLogicalCluster() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.logicalCluster > 0 {
+		s.logicalCluster--
+	}
+	shardLogicalClustersMetric.WithLabelValues(s.Name).Set(float64(s.logicalCluster))
+}
+
+// AddHandler registers a function called when a shard turns healthy or unhealthy
+func (r *Registry) AddHandler(handler func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers = append(r.handlers, handler)
+}
+
+// Start checks the readiness of all shards once, so the logical clusters are not held back on
+// startup, and then periodically until the context is done.
+func (r *Registry) Start(ctx context.Context, interval time.Duration) {
+	for _, shard := range r.shards {
+		shard.check(ctx)
+	}
+
+	for _, shard := range r.shards {
+		shard := shard
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			if shard.check(ctx) {
+				r.notify()
+			}
+		}, interval)
+	}
+}
+
+func (r *Registry) notify() {
+	r.lock.RLock()
+	handlers := append([]func(){}, r.handlers...)
+	r.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// check probes the shard and returns whether its health changed
+func (s *Shard) check(ctx context.Context) bool {
+	err := s.probe(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err != nil {
+		changed := s.healthy
+		if s.healthy || s.lastErr == nil {
+			klog.Warningf("kcp shard %s is unhealthy: %v", s.Name, err)
+		}
+		shardCheckFailuresMetric.WithLabelValues(s.Name).Inc()
+		shardHealthMetric.WithLabelValues(s.Name).Set(0)
+		s.healthy = false
+		s.lastErr = err
+		return changed
+	}
+
+	changed := !s.healthy
+	if !s.healthy {
+		klog.Infof("kcp shard %s is healthy", s.Name)
+	}
+	shardHealthMetric.WithLabelValues(s.Name).Set(1)
+	s.healthy = true
+	s.lastErr = nil
+	return changed
+}
+
+func (s *Shard) probe(ctx context.Context) error {
+	restConfig := rest.CopyConfig(s.restConfig)
+	restConfig.Timeout = 10 * time.Second
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Discovery().RESTClient().Get().AbsPath("/readyz").DoRaw(ctx)
+	return err
+}
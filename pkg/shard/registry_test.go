@@ -0,0 +1,164 @@
+package shard
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kcp
+  cluster:
+    server: https://kcp.example.com
+contexts:
+- name: kcp
+  context:
+    cluster: kcp
+current-context: kcp
+`
+
+func TestCheck(t *testing.T) {
+	var ready int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" || atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	shard := &Shard{Name: "test", restConfig: &rest.Config{Host: server.URL}}
+
+	cases := []struct {
+		name            string
+		ready           bool
+		expectedHealthy bool
+		expectedChanged bool
+	}{
+		{name: "first ready check", ready: true, expectedHealthy: true, expectedChanged: true},
+		{name: "still ready", ready: true, expectedHealthy: true, expectedChanged: false},
+		{name: "not ready", ready: false, expectedHealthy: false, expectedChanged: true},
+		{name: "still not ready", ready: false, expectedHealthy: false, expectedChanged: false},
+		{name: "ready again", ready: true, expectedHealthy: true, expectedChanged: true},
+	}
+
+	for _, c := range cases {
+		if c.ready {
+			atomic.StoreInt32(&ready, 1)
+		} else {
+			atomic.StoreInt32(&ready, 0)
+		}
+		changed := shard.check(context.Background())
+		healthy, err := shard.Healthy()
+		if healthy != c.expectedHealthy || changed != c.expectedChanged {
+			t.Errorf("%s: expected healthy %v and changed %v, got %v and %v", c.name, c.expectedHealthy, c.expectedChanged, healthy, changed)
+		}
+		if healthy != (err == nil) {
+			t.Errorf("%s: expected an error only when unhealthy, got %v", c.name, err)
+		}
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeConfig := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeConfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name          string
+		defaultConfig string
+		shardConfig   string
+		expectedNames []string
+		expectedErr   bool
+	}{
+		{
+			name:          "default shard",
+			defaultConfig: kubeConfig,
+			expectedNames: []string{DefaultShardName},
+		},
+		{
+			name:          "shard config",
+			defaultConfig: kubeConfig,
+			shardConfig:   "shards:\n- name: east\n  kubeconfig: " + kubeConfig + "\n- name: west\n  kubeconfig: " + kubeConfig + "\n",
+			expectedNames: []string{DefaultShardName, "east", "west"},
+		},
+		{
+			name:          "shard config only",
+			shardConfig:   "shards:\n- name: east\n  kubeconfig: " + kubeConfig + "\n",
+			expectedNames: []string{"east"},
+		},
+		{
+			name:        "no shard",
+			expectedErr: true,
+		},
+		{
+			name:          "duplicated shard",
+			defaultConfig: kubeConfig,
+			shardConfig:   "shards:\n- name: east\n  kubeconfig: " + kubeConfig + "\n- name: east\n  kubeconfig: " + kubeConfig + "\n",
+			expectedErr:   true,
+		},
+		{
+			name:        "shard without a name",
+			shardConfig: "shards:\n- kubeconfig: " + kubeConfig + "\n",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			shardConfig := ""
+			if len(c.shardConfig) > 0 {
+				shardConfig = filepath.Join(dir, "shards.yaml")
+				if err := ioutil.WriteFile(shardConfig, []byte(c.shardConfig), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			registry, err := NewRegistry(c.defaultConfig, shardConfig)
+			if c.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := registry.Names(); !reflect.DeepEqual(names, c.expectedNames) {
+				t.Errorf("expected shards %v, got %v", c.expectedNames, names)
+			}
+
+			_, err = registry.Get("")
+			if hasDefault := len(c.defaultConfig) > 0; hasDefault != (err == nil) {
+				t.Errorf("expected the empty name to get the default shard only when it is configured, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLogicalClusterConfig(t *testing.T) {
+	shard := &Shard{Name: "test", restConfig: &rest.Config{Host: "https://kcp.example.com"}}
+	if host := shard.LogicalClusterConfig("admin").Host; host != "https://kcp.example.com/clusters/admin" {
+		t.Errorf("unexpected host %s", host)
+	}
+	if shard.restConfig.Host != "https://kcp.example.com" {
+		t.Errorf("expected the shard config to be left unchanged")
+	}
+}